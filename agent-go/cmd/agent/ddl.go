@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jetcamer/agent-go/internal/config"
+	"github.com/jetcamer/agent-go/internal/sinks"
+)
+
+// runGlueDDL implements `agent glue-ddl`: print the Athena/Glue table
+// for the objects this agent uploads, using s3KeyTemplate from its config.
+func runGlueDDL(cfgPath string, args []string) int {
+	fs := flag.NewFlagSet("glue-ddl", flag.ExitOnError)
+	database := fs.String("database", "", "Glue database, empty = the session default")
+	table := fs.String("table", "jetcamer_access_logs", "table name")
+	template := fs.String("template", "", "key template, overrides s3KeyTemplate from the config")
+	fs.Parse(args)
+
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	if *template == "" {
+		*template = cfg.S3KeyTemplate
+	}
+	ddl, err := sinks.TableDDL(sinks.TableOptions{
+		Database:    *database,
+		Table:       *table,
+		Bucket:      cfg.S3Bucket,
+		Prefix:      cfg.S3Prefix,
+		KeyTemplate: *template,
+		Format:      cfg.S3Format,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(ddl)
+	return 0
+}
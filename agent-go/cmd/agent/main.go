@@ -8,8 +8,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/google/uuid"
 	"github.com/jetcamer/agent-go/internal/config"
 	"github.com/jetcamer/agent-go/internal/logtail"
+	"github.com/jetcamer/agent-go/internal/realip"
 	"github.com/jetcamer/agent-go/internal/s3upload"
 	"github.com/jetcamer/agent-go/internal/security"
 	"github.com/jetcamer/agent-go/internal/server"
@@ -24,6 +27,10 @@ func main() {
 		cfgPath = env
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "glue-ddl" {
+		os.Exit(runGlueDDL(cfgPath, os.Args[2:]))
+	}
+
 	cfg, err := config.Load(cfgPath)
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
@@ -63,13 +70,98 @@ func main() {
 			SecurityMaxRpmPerPath:   cfg.SecurityMaxRPMPerPath,
 			SecurityMaxRpmPerAsn:    cfg.SecurityMaxRPMPerASN,
 			SecurityBanMinutes:      cfg.SecurityBanMinutes,
+			SecurityVerifyCrawlers:      cfg.SecurityVerifyCrawlers,
+			SecurityBanFakeCrawlers:     cfg.SecurityBanFakeCrawlers,
+			SecurityCrawlerResolver:     cfg.SecurityCrawlerResolver,
+			SecurityCrawlerCacheMinutes: cfg.SecurityCrawlerCacheMinutes,
+			SecurityTrapLinks:       cfg.SecurityTrapLinks,
+			SecurityTrapLinkPrefix:  cfg.SecurityTrapLinkPrefix,
+			SecurityTrapBanMinutes:  cfg.SecurityTrapBanMinutes,
+			SecurityAuthEnabled:       cfg.SecurityAuthEnabled,
+			SecurityAuthMaxFailures:   cfg.SecurityAuthMaxFailures,
+			SecurityAuthWindowMinutes: cfg.SecurityAuthWindowMinutes,
+			SecurityAuthBanMinutes:    cfg.SecurityAuthBanMinutes,
+			SecurityWafEnabled:        cfg.SecurityWafEnabled,
+			SecurityWafMaxHits:        cfg.SecurityWafMaxHits,
+			SecurityWafMaxScore:       cfg.SecurityWafMaxScore,
+			SecurityWafWindowMinutes:  cfg.SecurityWafWindowMinutes,
+			SecurityWafBanMinutes:     cfg.SecurityWafBanMinutes,
+			SecuritySketchWidth:       cfg.SecuritySketchWidth,
+			SecurityTopK:              cfg.SecurityTopK,
+			SecurityShards:            cfg.SecurityShards,
+			SecurityLookupCacheSize:   cfg.SecurityLookupCacheSize,
+			SecurityStateDir:          cfg.SecurityStateDir,
+			SecurityBaselineEnabled:   cfg.SecurityBaselineEnabled,
+			SecurityBaselinePath:      cfg.SecurityBaselinePath,
+			SecurityAnomalySigma:      cfg.SecurityAnomalySigma,
+			SecurityAnomalyMinCount:   cfg.SecurityAnomalyMinCount,
+			SecurityAdaptiveThresholds: cfg.SecurityAdaptiveThresholds,
+			SecurityAttackEnabled:     cfg.SecurityAttackEnabled,
+			SecurityAttackMinRpm:      cfg.SecurityAttackMinRpm,
+			SecurityAttackSurgeFactor: cfg.SecurityAttackSurgeFactor,
+			SecurityAttackIpFactor:    cfg.SecurityAttackIpFactor,
+			SecurityAttackSubnetRpm:   cfg.SecurityAttackSubnetRpm,
+			SecurityAttackAsnRpm:      cfg.SecurityAttackAsnRpm,
+			SecurityAttackCountries:   cfg.SecurityAttackCountries,
+			SecurityAttackCooldownMinutes: cfg.SecurityAttackCooldownMinutes,
+			SecurityAttackBanMinutes:  cfg.SecurityAttackBanMinutes,
+			GeoLiteCountryPath:        cfg.GeoLiteCountryPath,
+			SecurityAllowlist:         cfg.SecurityAllowlist,
+			SecurityAuditPath:         cfg.SecurityAuditPath,
+			SecurityAuditMaxMB:        cfg.SecurityAuditMaxMB,
+			SecurityAuditKeep:         cfg.SecurityAuditKeep,
 			GeoLiteAsnPath:          cfg.GeoLiteASNPath,
 			FirewallIpsetName:       cfg.FirewallIpsetName,
+			FirewallSubnetIpsetName: cfg.FirewallSubnetIpsetName,
 			FirewallNftTable:        cfg.FirewallNftTable,
 			FirewallNftChain:        cfg.FirewallNftChain,
+			FirewallDisabled:        cfg.FirewallDisabled,
 			AwsRegion:               cfg.AwsRegion,
 			AwsNetworkAclId:         cfg.AwsNetworkAclId,
 			AwsNetworkAclDenyRuleBase: cfg.AwsNetworkAclDenyRuleBase,
+			AwsNetworkAclDenyRuleMax:  cfg.AwsNetworkAclDenyRuleMax,
+			AwsNetworkAclMaxEntries:   cfg.AwsNetworkAclMaxEntries,
+			CloudEnforcers:            cfg.CloudEnforcers,
+			AwsWafScope:               cfg.AwsWafScope,
+			AwsWafIpSetName:           cfg.AwsWafIpSetName,
+			AwsWafIpSetId:             cfg.AwsWafIpSetId,
+			AwsWafIpSetV6Name:         cfg.AwsWafIpSetV6Name,
+			AwsWafIpSetV6Id:           cfg.AwsWafIpSetV6Id,
+			AwsSecurityGroupId:        cfg.AwsSecurityGroupId,
+			AwsSecurityGroupMaxRules:  cfg.AwsSecurityGroupMaxRules,
+			AwsConfigLoader: func(ctx context.Context, region string) (aws.Config, error) {
+				return s3upload.LoadAWSConfig(ctx, cfg.AWSRole(), region)
+			},
+			FirewallFeedIpsetName:   cfg.FirewallFeedIpsetName,
+			InstanceId:              cfg.InstanceId,
+			NotifySyslog:            cfg.NotifySyslog,
+			NotifySyslogAddr:        cfg.NotifySyslogAddr,
+			NotifyBatchSeconds:      cfg.NotifyBatchSeconds,
+			NotifyMaxPerMinute:      cfg.NotifyMaxPerMinute,
+			FleetBanSharing:         cfg.FleetBanSharing,
+			FleetBanMaxTTLMinutes:   cfg.FleetBanMaxTTLMinutes,
+		}
+		for _, f := range cfg.ThreatFeeds {
+			secCfg.ThreatFeeds = append(secCfg.ThreatFeeds, security.FeedConfig{
+				Name:           f.Name,
+				Source:         f.Source,
+				Format:         f.Format,
+				CsvColumn:      f.CsvColumn,
+				RefreshMinutes: f.RefreshMinutes,
+			})
+		}
+		for _, t := range cfg.SecurityTraps {
+			secCfg.SecurityTraps = append(secCfg.SecurityTraps, security.TrapConfig{
+				Site:  t.Site,
+				Paths: t.Paths,
+			})
+		}
+		for _, wh := range cfg.NotifyWebhooks {
+			secCfg.NotifyWebhooks = append(secCfg.NotifyWebhooks, security.WebhookConfig{
+				URL:    wh.URL,
+				Secret: wh.Secret,
+				Events: wh.Events,
+			})
 		}
 		var err error
 		sec, err = security.NewEngine(secCfg)
@@ -79,26 +171,115 @@ func main() {
 		}
 	}
 
-	// batch sink channel
-	batchChan := make(chan sinks.Event, 100000)
-
 	// Initialize S3 uploader for batch uploads
 	ctx := context.Background()
-	s3Uploader, err := s3upload.NewS3Uploader(ctx)
+	s3Opts := cfg.S3Options()
+	s3Uploader, err := s3upload.NewS3Uploader(ctx, s3Opts)
 	if err != nil {
 		log.Printf("WARNING: failed to initialize S3 uploader: %v (batch uploads will fail)", err)
 		s3Uploader = nil
 	}
+	uploader := s3upload.NewShared(s3Uploader, s3Opts)
+
+	// credentials stored through /internal/set-aws-config, or rewritten on
+	// disk, replace the clients in place
+	s3upload.OnCredentialsChange(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := uploader.Reload(ctx); err != nil {
+			log.Printf("WARNING: S3 uploader kept its old credentials: %v", err)
+		}
+		if sec != nil {
+			if err := sec.ReloadAWSCredentials(ctx); err != nil {
+				log.Printf("WARNING: security AWS clients kept their old credentials: %v", err)
+			}
+		}
+	})
+	go s3upload.WatchStoredCredentials(time.Minute)
+
+	// batch sinks: events are spooled to disk, then written straight to S3
+	// (or to an external collector when collectorUrl is set), or fanned out
+	// to the sinks listed in the config
+	router, err := sinks.NewRouter(cfg, uploader)
+	if err != nil {
+		log.Fatalf("failed to set up batch sinks: %v", err)
+	}
 
 	// start embedded web server exposing /live, /security, and /internal/batch
-	go server.Run(cfg, agg, sec, s3Uploader)
+	go server.Run(cfg, agg, sec, uploader, router)
 
-	// start batch sink (to internal route → S3)
-	go sinks.RunBatchSink(cfg, batchChan)
+	// start batch sinks (spool → S3 / collector / Loki / ClickHouse / webhooks)
+	router.Start()
 
 	// Initialize WebSocket manager (will auto-start when credentials are available)
 	ws.InitManager(cfg)
 	wsManager := ws.GetManager()
+
+	// forward security notifications to the control panel
+	if sec != nil && cfg.NotifyWebSocket {
+		sec.AddNotifyChannel(security.NewFuncChannel("websocket", func(batch security.NotifyBatch) error {
+			return wsManager.Publish(ws.TypeSecurityEvent, ws.SecurityEventPayload{
+				Events:  batch.Events,
+				Dropped: batch.Dropped,
+			})
+		}), nil)
+
+		// attack mode transitions also get their own message with the full state
+		sec.AddNotifyChannel(security.NewFuncChannel("attack-mode", func(batch security.NotifyBatch) error {
+			for _, ev := range batch.Events {
+				if ev.Attack == nil {
+					continue
+				}
+				if err := wsManager.Publish(ws.TypeAttackMode, ws.AttackModePayload{
+					Transition: ev.Reason,
+					Status:     ev.Attack,
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}), []string{security.NotifyAttackMode})
+	}
+
+	// share ban decisions with the rest of the customer's fleet
+	if sec != nil && cfg.FleetBanSharing {
+		sec.AddNotifyChannel(security.NewFuncChannel("fleet", func(batch security.NotifyBatch) error {
+			var bans []ws.FleetBan
+			for _, ev := range batch.Events {
+				if ev.Origin != "" {
+					continue // only publish our own decisions
+				}
+				bans = append(bans, ws.FleetBan{
+					ID:         uuid.NewString(),
+					IP:         ev.IP,
+					Reason:     ev.Reason,
+					Origin:     cfg.InstanceId,
+					SiteID:     cfg.SiteId,
+					TTLSeconds: ev.TTLSeconds,
+				})
+			}
+			if len(bans) == 0 {
+				return nil
+			}
+			return wsManager.Publish(ws.TypeBanShare, ws.FleetBanPayload{Bans: bans})
+		}), []string{security.NotifyBan})
+
+		wsManager.SetFleetBanHandler(func(p ws.FleetBanPayload) {
+			for _, b := range p.Bans {
+				if b.Action == "unban" {
+					sec.RemoveFleetBan(b.IP, b.Origin)
+					continue
+				}
+				sec.ApplyFleetBan(security.FleetBan{
+					ID:     b.ID,
+					IP:     b.IP,
+					Reason: b.Reason,
+					Origin: b.Origin,
+					TTL:    time.Duration(b.TTLSeconds) * time.Second,
+				})
+			}
+		})
+	}
 	
 	// Try to start WebSocket client immediately if credentials are available
 	if wsManager.TryStart() {
@@ -109,37 +290,73 @@ func main() {
 		wsManager.StartMonitoring(10 * time.Second)
 	}
 
+	// real client IPs behind Cloudflare / ALB / CloudFront
+	proxies := realip.New(cfg.TrustedProxies, cfg.TrustedProxyPresets, cfg.TrustedProxyRangesDir)
+
 	// tail logs, feed aggregator + security + batch
 	go func() {
 		err := logtail.TailLogs(cfg, func(evt sinks.Event) {
+			client, known := proxies.Resolve(evt.RemoteIP, evt.ForwardedFor, evt.CFConnectingIP)
+			if client != evt.RemoteIP {
+				evt.ProxyIP = evt.RemoteIP
+				evt.RemoteIP = client
+			}
 			// live analytics
 			agg.Add(evt)
-			// security analysis (rate limiting, DDoS patterns, ASN blocking)
-			if sec != nil {
+			// security analysis (rate limiting, DDoS patterns, ASN blocking);
+			// requests with no client beyond our own proxies are never banned
+			if sec != nil && known {
 				sec.Process(security.LogEvent{
-					IP:    evt.RemoteIP,
-					Path:  evt.Path,
-					Agent: evt.UserAgent,
-					Time:  evt.Timestamp,
+					IP:     evt.RemoteIP,
+					Path:   evt.Path,
+					Agent:  evt.UserAgent,
+					Time:   evt.Timestamp,
+					Source: evt.Source,
 				})
 			}
-			// send to batch pipeline (for 24h+ history)
-			select {
-			case batchChan <- evt:
-			default:
-				// drop if batch channel is full
-			}
+			// send to batch pipeline (for 24h+ history); drops are counted
+			router.Offer(evt)
 		})
 		if err != nil {
 			log.Printf("log tailer exited with error: %v", err)
 		}
 	}()
 
+	// tail sshd / mail / FTP logs for brute-force attempts
+	if sec != nil && cfg.SecurityAuthEnabled {
+		if err := logtail.TailAuthLogs(cfg, func(line string) {
+			if f, ok := security.ParseAuthLine(line); ok {
+				sec.ProcessAuth(f)
+			}
+		}); err != nil {
+			log.Printf("auth log tailer exited with error: %v", err)
+		}
+	}
+
+	// tail ModSecurity audit logs; one parser per file (serial entries span lines)
+	if sec != nil && cfg.SecurityWafEnabled {
+		if err := logtail.TailModSecLogs(cfg, func() func(line string) {
+			p := security.NewModSecParser()
+			return func(line string) {
+				if alert, ok := p.Feed(line); ok {
+					sec.ProcessWaf(alert)
+				}
+			}
+		}); err != nil {
+			log.Printf("modsecurity log tailer exited with error: %v", err)
+		}
+	}
+
 	// wait for termination signal
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	s := <-sigCh
 	log.Printf("received signal %s, shutting down...", s)
+
+	// stop tailing, then get every queued event into the spools so it is
+	// delivered after the restart
+	logtail.Stop()
+	router.Close()
 	
 	// Stop WebSocket client
 	if wsManager := ws.GetManager(); wsManager != nil {
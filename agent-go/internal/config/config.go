@@ -15,6 +15,12 @@ type Config struct {
 	LogPaths                  []string `json:"logPaths"`
 	FluentWebListen           string   `json:"webListen"` // e.g. 127.0.0.1:9811
 
+	// Real client IP behind a CDN or load balancer
+	LogExtraFields            []string `json:"logExtraFields"`        // quoted fields after the user agent, in order: "x_forwarded_for", "cf_connecting_ip" (anything else is skipped)
+	TrustedProxies            []string `json:"trustedProxies"`        // IPs/CIDRs whose forwarding headers are believed
+	TrustedProxyPresets       []string `json:"trustedProxyPresets"`   // "cloudflare", "cloudfront", "private" or <name> for <name>.txt
+	TrustedProxyRangesDir     string   `json:"trustedProxyRangesDir"` // preset range files, default /etc/jetcamer/proxy-ranges
+
 	// Batch collector (Next.js → S3)
 	CollectorUrl              string   `json:"collectorUrl"`
 	CollectorFlushIntervalSec int      `json:"collectorFlushIntervalSeconds"`
@@ -23,6 +29,47 @@ type Config struct {
 	InstanceId                string   `json:"instanceId"`
 	SiteId                    string   `json:"siteId"`
 	CollectorApiKey           string   `json:"collectorApiKey"`
+	S3Compression             string   `json:"s3Compression"` // batch objects: "gzip" (default, .ndjson.gz), "zstd" (.ndjson.zst) or "none"
+	S3KeyTemplate             string   `json:"s3KeyTemplate"` // default "{machine}/{ts}-{nanos}"; Hive: "site={site}/env={env}/dt={dt}/hour={hour}/{machine}-{nanos}"
+	S3Format                  string   `json:"s3Format"`      // "ndjson" (default) or "parquet"
+
+	// S3 destination. For MinIO, Wasabi, R2 or Ceph set s3Endpoint and
+	// usually s3PathStyle; credentials come from the usual AWS sources
+	S3Bucket                  string   `json:"s3Bucket"`             // default "cyber-agent-logs"
+	S3Prefix                  string   `json:"s3Prefix"`             // prepended to every object key, e.g. "agents/"
+	S3Region                  string   `json:"s3Region"`             // overrides the detected region; us-east-1 with s3Endpoint
+	S3Endpoint                string   `json:"s3Endpoint"`           // e.g. "https://minio.internal:9000"; empty = AWS
+	S3PathStyle               bool     `json:"s3PathStyle"`          // https://host/bucket/key instead of https://bucket.host/key
+	S3CAFile                  string   `json:"s3CaFile"`             // PEM bundle trusted in addition to the system roots
+	S3InsecureSkipVerify      bool     `json:"s3InsecureSkipVerify"` // accept any certificate, for testing only
+
+	// Bucket hardening, applied when the agent creates the bucket and
+	// reported as drift by /internal/s3-validate otherwise
+	S3Encryption              string   `json:"s3Encryption"`          // "sse-s3", "sse-kms" or "" for the bucket default; also sent on every upload
+	S3KmsKeyId                string   `json:"s3KmsKeyId"`            // sse-kms key ID, ARN or alias; empty = the aws/s3 key
+	S3BlockPublicAccess       bool     `json:"s3BlockPublicAccess"`
+	S3Lifecycle               []S3LifecycleRule `json:"s3Lifecycle"`
+	S3ObjectLock              bool     `json:"s3ObjectLock"`          // WORM bucket; turns on versioning, cannot be turned off
+	S3RetentionMode           string   `json:"s3RetentionMode"`       // "governance" or "compliance" default retention, with s3ObjectLock
+	S3RetentionDays           int      `json:"s3RetentionDays"`       // days new objects are retained
+	S3EnforceBucketPolicy     bool     `json:"s3EnforceBucketPolicy"` // also fix drift on an existing bucket at startup
+
+	// Parquet output (s3Format "parquet"): events are staged per hour under
+	// <spoolDir>/parquet and uploaded as one file per hour and flush
+	ParquetCompression        string   `json:"parquetCompression"`   // "snappy" (default), "zstd" or "none"
+	ParquetRowGroupRows       int      `json:"parquetRowGroupRows"`  // upload an hour once it has this many events, default 100000
+	ParquetMaxAgeMinutes      int      `json:"parquetMaxAgeMinutes"` // or once its oldest staged event is this old, default 15
+
+	// On-disk spool between the log tailer and the uploader
+	SpoolDir                  string   `json:"spoolDir"`                // default /var/lib/jetcamer/spool
+	SpoolSegmentMB            int      `json:"spoolSegmentMb"`          // seal a segment at this size, default 4
+	SpoolMaxMB                int      `json:"spoolMaxMb"`              // oldest segments are dropped beyond this, default 512
+	SpoolRetryMaxSeconds      int      `json:"spoolRetryMaxSeconds"`    // upload retry backoff cap, default 300
+
+	// Sink router: when set, events fan out to these named sinks instead
+	// of the single destination above, each with its own spool under
+	// <spoolDir>/sinks/<name>
+	Sinks                     []SinkConfig `json:"sinks"`
 
 	// Security config
 	SecurityEnabled           bool     `json:"securityEnabled"`
@@ -32,6 +79,68 @@ type Config struct {
 	SecurityMaxRPMPerASN      int      `json:"securityMaxRpmPerAsn"`
 	SecurityBanMinutes        int      `json:"securityBanMinutes"`
 
+	// Search-engine crawler verification (forward-confirmed reverse DNS)
+	SecurityVerifyCrawlers    bool     `json:"securityVerifyCrawlers"`
+	SecurityBanFakeCrawlers   bool     `json:"securityBanFakeCrawlers"` // ban impostors instead of only flagging them
+	SecurityCrawlerResolver   string   `json:"securityCrawlerResolver"` // optional DNS server host:port
+	SecurityCrawlerCacheMinutes int      `json:"securityCrawlerCacheMinutes"` // default 1440
+
+	// Honeypot paths that ban on first hit, per site
+	SecurityTraps             []TrapConfig `json:"securityTraps"`
+	SecurityTrapLinks         int      `json:"securityTrapLinks"`      // hidden trap links to generate for robots.txt, 0 = none
+	SecurityTrapLinkPrefix    string   `json:"securityTrapLinkPrefix"` // default "/_/"
+	SecurityTrapBanMinutes    int      `json:"securityTrapBanMinutes"` // 0 = securityBanMinutes
+
+	// Brute-force protection for sshd, Postfix/Dovecot and FTP
+	SecurityAuthEnabled       bool     `json:"securityAuthEnabled"`
+	SecurityAuthMaxFailures   int      `json:"securityAuthMaxFailures"`   // failed logins per IP within the window, default 5
+	SecurityAuthWindowMinutes int      `json:"securityAuthWindowMinutes"` // default 10
+	SecurityAuthBanMinutes    int      `json:"securityAuthBanMinutes"`    // 0 = securityBanMinutes
+	AuthLogPaths              []string `json:"authLogPaths"`              // empty = autodiscover auth.log, secure, mail.log, ...
+
+	// ModSecurity audit logs (serial or JSON) as a ban signal
+	SecurityWafEnabled        bool     `json:"securityWafEnabled"`
+	SecurityWafMaxHits        int      `json:"securityWafMaxHits"`       // alerts per IP within the window, default 5
+	SecurityWafMaxScore       int      `json:"securityWafMaxScore"`      // summed anomaly score within the window, 0 = off
+	SecurityWafWindowMinutes  int      `json:"securityWafWindowMinutes"` // default 10
+	SecurityWafBanMinutes     int      `json:"securityWafBanMinutes"`    // 0 = securityBanMinutes
+	ModSecAuditLogPaths       []string `json:"modsecAuditLogPaths"`      // empty = autodiscover modsec_audit.log
+
+	// Fixed-memory ip/path counters (count-min sketch + top-K heavy hitters)
+	SecuritySketchWidth       int      `json:"securitySketchWidth"` // cells per sketch row, default 16384 (256 KiB per counter)
+	SecurityTopK              int      `json:"securityTopK"`        // keys tracked by name per counter, default 1000
+
+	// Sharded event processing
+	SecurityShards            int      `json:"securityShards"`          // event workers, default = CPU cores
+	SecurityLookupCacheSize   int      `json:"securityLookupCacheSize"` // cached ASN/country lookups across workers, default 65536
+	SecurityStateDir          string   `json:"securityStateDir"`        // agent-owned cloud entries and keys, default /var/lib/jetcamer
+
+	// Learned per-minute baselines per site, path and ASN
+	SecurityBaselineEnabled   bool     `json:"securityBaselineEnabled"`
+	SecurityBaselinePath      string   `json:"securityBaselinePath"`       // default /etc/jetcamer/security-baseline.json
+	SecurityAnomalySigma      float64  `json:"securityAnomalySigma"`       // default 4
+	SecurityAnomalyMinCount   int      `json:"securityAnomalyMinCount"`    // requests per minute, default 30
+	SecurityAdaptiveThresholds bool    `json:"securityAdaptiveThresholds"` // learned path/asn limits replace the fixed ones
+
+	// Layer-7 DDoS "under attack" mode
+	SecurityAttackEnabled     bool     `json:"securityAttackEnabled"`
+	SecurityAttackMinRpm      int      `json:"securityAttackMinRpm"`      // total requests per minute, default 3000
+	SecurityAttackSurgeFactor float64  `json:"securityAttackSurgeFactor"` // multiple of the learned rate, default 4
+	SecurityAttackIpFactor    float64  `json:"securityAttackIpFactor"`    // per-IP limit multiplier while under attack, default 0.25
+	SecurityAttackSubnetRpm   int      `json:"securityAttackSubnetRpm"`   // requests per /24 or /64 per minute, default 600
+	SecurityAttackAsnRpm      int      `json:"securityAttackAsnRpm"`      // 0 = no ASN aggregation
+	SecurityAttackCountries   []string `json:"securityAttackCountries"`   // allowed while under attack, empty = all (needs geoLiteCountryPath)
+	SecurityAttackCooldownMinutes int  `json:"securityAttackCooldownMinutes"` // default 10
+	SecurityAttackBanMinutes  int      `json:"securityAttackBanMinutes"`  // 0 = securityBanMinutes
+
+	// Never banned automatically (IPs or CIDRs)
+	SecurityAllowlist         []string `json:"securityAllowlist"`
+
+	// Append-only JSONL audit log of every ban, unban and firewall command
+	SecurityAuditPath         string   `json:"securityAuditPath"`  // default /var/log/jetcamer/security-audit.jsonl, "off" = disabled
+	SecurityAuditMaxMB        int      `json:"securityAuditMaxMb"` // rotate after this size, default 20
+	SecurityAuditKeep         int      `json:"securityAuditKeep"`  // rotated files kept, default 5
+
 	// MaxMind ASN DB (optional)
 	GeoLiteASNPath            string   `json:"geoLiteAsnPath"`
 	// MaxMind Country/City DB (optional, for country resolution in /live/summary)
@@ -39,19 +148,123 @@ type Config struct {
 
 	// Local firewall (ipset + nftables)
 	FirewallIpsetName         string   `json:"firewallIpsetName"`
+	FirewallSubnetIpsetName   string   `json:"firewallSubnetIpsetName"` // hash:net set for attack-mode and manual subnet bans
 	FirewallNftTable          string   `json:"firewallNftTable"`
 	FirewallNftChain          string   `json:"firewallNftChain"`
+	FirewallDisabled          bool     `json:"firewallDisabled"` // bans are recorded and notified but never put in the local ipset
+
+	// Threat-intel blocklist feeds (Spamhaus DROP, FireHOL, custom lists)
+	FirewallFeedIpsetName     string   `json:"firewallFeedIpsetName"`
+	ThreatFeeds               []ThreatFeedConfig `json:"threatFeeds"`
+
+	// Security notifications (ban, unban, threshold breach, feed refresh)
+	NotifyWebSocket           bool     `json:"notifyWebSocket"` // send security_event messages to the control panel
+	NotifyWebhooks            []WebhookConfig `json:"notifyWebhooks"`
+	NotifySyslog              bool     `json:"notifySyslog"`
+	NotifySyslogAddr          string   `json:"notifySyslogAddr"`   // empty = local syslog, or udp://host:514
+	NotifyBatchSeconds        int      `json:"notifyBatchSeconds"` // default 5
+	NotifyMaxPerMinute        int      `json:"notifyMaxPerMinute"` // batches per minute per channel, default 30
+
+	// Fleet-wide ban sharing over the WebSocket connection
+	FleetBanSharing           bool     `json:"fleetBanSharing"`       // publish local bans and accept fleet_ban commands
+	FleetBanMaxTTLMinutes     int      `json:"fleetBanMaxTtlMinutes"` // cap on TTLs received from the fleet, default 1440
+
+	// Role assumed for every AWS call (S3, NACL, WAFv2, security group) on
+	// top of the stored keys or the default chain; role settings sent to
+	// /internal/set-aws-config take priority
+	AwsRoleArn                string   `json:"awsRoleArn"`
+	AwsExternalId             string   `json:"awsExternalId"`
+	AwsRoleSessionName        string   `json:"awsRoleSessionName"`      // default "jetcamer-agent"
+	AwsRoleDurationSeconds    int      `json:"awsRoleDurationSeconds"`  // 900-43200, default 3600
+	AwsWebIdentityTokenFile   string   `json:"awsWebIdentityTokenFile"` // assume awsRoleArn with this OIDC token instead
 
 	// AWS network-level blocking (NACL)
 	AwsRegion                 string   `json:"awsRegion"`
 	AwsNetworkAclId           string   `json:"awsNetworkAclId"`
 	AwsNetworkAclDenyRuleBase int      `json:"awsNetworkAclDenyRuleBase"` // starting rule number (e.g. 200)
+	AwsNetworkAclDenyRuleMax  int      `json:"awsNetworkAclDenyRuleMax"`  // last rule number the agent may use (default base+99)
+	AwsNetworkAclMaxEntries   int      `json:"awsNetworkAclMaxEntries"`   // per-NACL ingress rule quota (default 20)
+
+	// Cloud-side enforcement: "nacl", "wafv2", "security-group" (empty = nacl when awsNetworkAclId is set)
+	CloudEnforcers            []string `json:"cloudEnforcers"`
+	AwsWafScope               string   `json:"awsWafScope"`       // REGIONAL (ALB, API Gateway) or CLOUDFRONT
+	AwsWafIpSetName           string   `json:"awsWafIpSetName"`   // dedicated IPv4 IP set
+	AwsWafIpSetId             string   `json:"awsWafIpSetId"`
+	AwsWafIpSetV6Name         string   `json:"awsWafIpSetV6Name"` // optional dedicated IPv6 IP set
+	AwsWafIpSetV6Id           string   `json:"awsWafIpSetV6Id"`
+	AwsSecurityGroupId        string   `json:"awsSecurityGroupId"`       // dedicated ban-list group, never attached to instances
+	AwsSecurityGroupMaxRules  int      `json:"awsSecurityGroupMaxRules"` // inbound rule quota (default 60)
 
 	// WebSocket client (optional, for real-time communication with API)
 	WsAPIURL                  string   `json:"wsApiUrl"`   // e.g. wss://api.jetcamer.com/agent
 	WsSecret                  string   `json:"wsSecret"`   // Shared secret for HMAC signing
 }
 
+// WebhookConfig is one notification webhook. Batches are signed with
+// HMAC-SHA256 when Secret is set; Events filters notification types (empty = all).
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// SinkConfig is one destination of the sink router. Batch size, flush
+// interval, retry cap and spool size default to the collector and spool
+// settings above.
+type SinkConfig struct {
+	Name             string            `json:"name"`
+	Type             string            `json:"type"`   // "s3", "http", "webhook", "loki" or "clickhouse"
+	URL              string            `json:"url"`    // endpoint, for every type but s3
+	Format           string            `json:"format"` // s3: "ndjson" (default) or "parquet"; http/webhook: "json" (default) or "ndjson"
+	Filter           string            `json:"filter"` // e.g. "status>=500 && site=shop*"; empty = every event
+	BatchSize        int               `json:"batchSize"`
+	FlushIntervalSec int               `json:"flushIntervalSeconds"`
+	RetryMaxSeconds  int               `json:"retryMaxSeconds"`
+	SpoolMaxMB       int               `json:"spoolMaxMb"`
+	ApiKey           string            `json:"apiKey"`   // sent as a bearer token
+	Username         string            `json:"username"` // basic auth, e.g. for ClickHouse or Loki behind a proxy
+	Password         string            `json:"password"`
+	Secret           string            `json:"secret"`  // webhook: HMAC-SHA256 signing secret
+	Headers          map[string]string `json:"headers"` // extra request headers, e.g. X-Scope-OrgID for Loki
+	Labels           map[string]string `json:"labels"`  // loki: static stream labels
+	Table            string            `json:"table"`   // clickhouse: target table, default "jetcamer_events"
+}
+
+// S3LifecycleRule transitions and expires archived objects under Prefix
+// (relative to the bucket). Rules are merged into the bucket's lifecycle
+// by ID, default "jetcamer:<prefix>".
+type S3LifecycleRule struct {
+	ID          string         `json:"id"`
+	Prefix      string         `json:"prefix"`
+	Transitions []S3Transition `json:"transitions"`
+	ExpireDays  int            `json:"expireDays"` // 0 = never
+}
+
+// S3Transition moves objects to StorageClass, e.g. "STANDARD_IA",
+// "GLACIER_IR" or "DEEP_ARCHIVE", Days after upload.
+type S3Transition struct {
+	Days         int    `json:"days"`
+	StorageClass string `json:"storageClass"`
+}
+
+// TrapConfig lists trap paths for the sites whose access log file name
+// matches Site (a glob; empty = every site). Paths ending in "/" or "*"
+// match everything below them.
+type TrapConfig struct {
+	Site  string   `json:"site"`
+	Paths []string `json:"paths"`
+}
+
+// ThreatFeedConfig describes one IP reputation list.
+// Source is an http(s) URL or a local file path.
+type ThreatFeedConfig struct {
+	Name           string `json:"name"`
+	Source         string `json:"source"`
+	Format         string `json:"format"`         // "plain" (default), "cidr" or "csv"
+	CsvColumn      int    `json:"csvColumn"`      // zero-based IP/CIDR column for csv feeds
+	RefreshMinutes int    `json:"refreshMinutes"` // default 60
+}
+
 func Load(path string) (*Config, error) {
 	cfg := &Config{
 		CollectorFlushIntervalSec: 10,
@@ -59,16 +272,55 @@ func Load(path string) (*Config, error) {
 		Env:                       "prod",
 		SiteId:                    "default",
 		FluentWebListen:           "127.0.0.1:9811",
+		S3Bucket:                  "cyber-agent-logs",
+		SpoolDir:                  "/var/lib/jetcamer/spool",
+		SpoolSegmentMB:            4,
+		SpoolMaxMB:                512,
+		SpoolRetryMaxSeconds:      300,
+		ParquetRowGroupRows:       100000,
+		ParquetMaxAgeMinutes:      15,
+		TrustedProxyRangesDir:     "/etc/jetcamer/proxy-ranges",
 		SecurityEnabled:           true,
 		SecurityMaxRPSPerIP:       50,
 		SecurityMaxRPMPerIP:       2000,
 		SecurityMaxRPMPerPath:     1000,
 		SecurityMaxRPMPerASN:      5000,
 		SecurityBanMinutes:        60,
+		SecurityVerifyCrawlers:    true,
+		SecurityCrawlerCacheMinutes: 1440,
+		SecurityAuthEnabled:       true,
+		SecurityAuthMaxFailures:   5,
+		SecurityAuthWindowMinutes: 10,
+		SecurityWafEnabled:        true,
+		SecurityWafMaxHits:        5,
+		SecurityWafWindowMinutes:  10,
+		SecuritySketchWidth:       16384,
+		SecurityTopK:              1000,
+		SecurityLookupCacheSize:   65536,
+		SecurityStateDir:          "/var/lib/jetcamer",
+		SecurityBaselineEnabled:   true,
+		SecurityBaselinePath:      "/etc/jetcamer/security-baseline.json",
+		SecurityAnomalySigma:      4,
+		SecurityAnomalyMinCount:   30,
+		SecurityAttackEnabled:     false,
+		SecurityAttackMinRpm:      3000,
+		SecurityAttackSurgeFactor: 4,
+		SecurityAttackIpFactor:    0.25,
+		SecurityAttackSubnetRpm:   600,
+		SecurityAttackCooldownMinutes: 10,
+		SecurityAuditPath:         "/var/log/jetcamer/security-audit.jsonl",
+		SecurityAuditMaxMB:        20,
+		SecurityAuditKeep:         5,
 		FirewallIpsetName:         "jetcamer_blacklist",
+		FirewallSubnetIpsetName:   "jetcamer_blacklist_net",
 		FirewallNftTable:          "inet",
 		FirewallNftChain:          "jetcamer_drop",
+		FirewallFeedIpsetName:     "jetcamer_feeds",
+		NotifyWebSocket:           true,
+		FleetBanMaxTTLMinutes:     1440,
 		AwsNetworkAclDenyRuleBase: 200,
+		AwsNetworkAclDenyRuleMax:  299,
+		AwsNetworkAclMaxEntries:   20,
 	}
 	f, err := os.Open(path)
 	if err != nil {
@@ -85,6 +337,27 @@ func Load(path string) (*Config, error) {
 	if cfg.CollectorMaxBatchSize <= 0 {
 		cfg.CollectorMaxBatchSize = 500
 	}
+	if cfg.S3Bucket == "" {
+		cfg.S3Bucket = "cyber-agent-logs"
+	}
+	if cfg.SpoolDir == "" {
+		cfg.SpoolDir = "/var/lib/jetcamer/spool"
+	}
+	if cfg.SpoolSegmentMB <= 0 {
+		cfg.SpoolSegmentMB = 4
+	}
+	if cfg.SpoolMaxMB <= 0 {
+		cfg.SpoolMaxMB = 512
+	}
+	if cfg.SpoolRetryMaxSeconds <= 0 {
+		cfg.SpoolRetryMaxSeconds = 300
+	}
+	if cfg.ParquetRowGroupRows <= 0 {
+		cfg.ParquetRowGroupRows = 100000
+	}
+	if cfg.ParquetMaxAgeMinutes <= 0 {
+		cfg.ParquetMaxAgeMinutes = 15
+	}
 	if cfg.InstanceId == "" {
 		cfg.InstanceId = detectInstanceId()
 	}
@@ -94,9 +367,63 @@ func Load(path string) (*Config, error) {
 	if cfg.SecurityBanMinutes <= 0 {
 		cfg.SecurityBanMinutes = 60
 	}
+	if cfg.SecurityCrawlerCacheMinutes <= 0 {
+		cfg.SecurityCrawlerCacheMinutes = 1440
+	}
+	if cfg.SecurityAuthMaxFailures <= 0 {
+		cfg.SecurityAuthMaxFailures = 5
+	}
+	if cfg.SecurityAuthWindowMinutes <= 0 {
+		cfg.SecurityAuthWindowMinutes = 10
+	}
+	if cfg.SecurityWafMaxHits <= 0 {
+		cfg.SecurityWafMaxHits = 5
+	}
+	if cfg.SecurityWafWindowMinutes <= 0 {
+		cfg.SecurityWafWindowMinutes = 10
+	}
+	if cfg.SecurityAnomalySigma <= 0 {
+		cfg.SecurityAnomalySigma = 4
+	}
+	if cfg.SecurityAnomalyMinCount <= 0 {
+		cfg.SecurityAnomalyMinCount = 30
+	}
+	if cfg.SecurityAttackSurgeFactor <= 0 {
+		cfg.SecurityAttackSurgeFactor = 4
+	}
+	if cfg.SecurityAttackCooldownMinutes <= 0 {
+		cfg.SecurityAttackCooldownMinutes = 10
+	}
+	if cfg.SecurityAuditPath == "off" {
+		cfg.SecurityAuditPath = ""
+	}
+	if cfg.SecurityAuditMaxMB <= 0 {
+		cfg.SecurityAuditMaxMB = 20
+	}
+	if cfg.SecurityAuditKeep <= 0 {
+		cfg.SecurityAuditKeep = 5
+	}
 	if cfg.AwsNetworkAclDenyRuleBase <= 0 {
 		cfg.AwsNetworkAclDenyRuleBase = 200
 	}
+	if cfg.AwsNetworkAclDenyRuleMax < cfg.AwsNetworkAclDenyRuleBase {
+		cfg.AwsNetworkAclDenyRuleMax = cfg.AwsNetworkAclDenyRuleBase + 99
+	}
+	if cfg.AwsNetworkAclMaxEntries <= 0 {
+		cfg.AwsNetworkAclMaxEntries = 20
+	}
+	if cfg.AwsWafScope == "" {
+		cfg.AwsWafScope = "REGIONAL"
+	}
+	if cfg.AwsSecurityGroupMaxRules <= 0 {
+		cfg.AwsSecurityGroupMaxRules = 60
+	}
+	if cfg.FirewallSubnetIpsetName == "" {
+		cfg.FirewallSubnetIpsetName = "jetcamer_blacklist_net"
+	}
+	if cfg.FirewallFeedIpsetName == "" {
+		cfg.FirewallFeedIpsetName = "jetcamer_feeds"
+	}
 
 	// Auto-configure WebSocket if not explicitly set
 	if cfg.WsAPIURL == "" {
@@ -106,8 +433,8 @@ func Load(path string) (*Config, error) {
 		}
 	}
 	if cfg.WsSecret == "" {
-		// Try to get AWS secret key
-		cfg.WsSecret = getAWSSecretKey()
+		// Derive it from the AWS secret key
+		cfg.WsSecret = s3upload.WsSecret()
 	}
 
 	return cfg, nil
@@ -117,6 +444,54 @@ func (c *Config) FlushInterval() time.Duration {
 	return time.Duration(c.CollectorFlushIntervalSec) * time.Second
 }
 
+// AWSRole is the role from the config, if any.
+func (c *Config) AWSRole() s3upload.Role {
+	return s3upload.Role{
+		ARN:                  c.AwsRoleArn,
+		ExternalID:           c.AwsExternalId,
+		SessionName:          c.AwsRoleSessionName,
+		Duration:             time.Duration(c.AwsRoleDurationSeconds) * time.Second,
+		WebIdentityTokenFile: c.AwsWebIdentityTokenFile,
+	}
+}
+
+// S3Options are the uploader settings from the config.
+func (c *Config) S3Options() s3upload.Options {
+	var lifecycle []s3upload.LifecycleRule
+	for _, r := range c.S3Lifecycle {
+		rule := s3upload.LifecycleRule{ID: r.ID, Prefix: r.Prefix, ExpireDays: r.ExpireDays}
+		for _, t := range r.Transitions {
+			rule.Transitions = append(rule.Transitions, s3upload.Transition{Days: t.Days, StorageClass: t.StorageClass})
+		}
+		lifecycle = append(lifecycle, rule)
+	}
+	return s3upload.Options{
+		Compression:        c.S3Compression,
+		KeyTemplate:        c.S3KeyTemplate,
+		Site:               c.SiteId,
+		Env:                c.Env,
+		InstanceID:         c.InstanceId,
+		Bucket:             c.S3Bucket,
+		Prefix:             c.S3Prefix,
+		Region:             c.S3Region,
+		Endpoint:           c.S3Endpoint,
+		PathStyle:          c.S3PathStyle,
+		CAFile:             c.S3CAFile,
+		InsecureSkipVerify: c.S3InsecureSkipVerify,
+		Role:               c.AWSRole(),
+		Policy: s3upload.BucketPolicy{
+			Encryption:        strings.ToLower(strings.TrimSpace(c.S3Encryption)),
+			KMSKeyID:          c.S3KmsKeyId,
+			BlockPublicAccess: c.S3BlockPublicAccess,
+			Lifecycle:         lifecycle,
+			ObjectLock:        c.S3ObjectLock,
+			RetentionMode:     strings.ToLower(strings.TrimSpace(c.S3RetentionMode)),
+			RetentionDays:     c.S3RetentionDays,
+			Enforce:           c.S3EnforceBucketPolicy,
+		},
+	}
+}
+
 func detectInstanceId() string {
 	h, err := os.Hostname()
 	if err != nil {
@@ -215,21 +590,3 @@ func getPublicIPV1(ctx context.Context, client *http.Client) string {
 	return ip
 }
 
-// getAWSSecretKey attempts to get AWS secret access key from various sources
-func getAWSSecretKey() string {
-	// 1. Try stored credentials (set via /internal/set-aws-config)
-	if storedCreds := s3upload.GetStoredCredentials(); storedCreds != nil && storedCreds.SecretAccessKey != "" {
-		return storedCreds.SecretAccessKey
-	}
-
-	// 2. Try environment variable
-	if secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY"); secretKey != "" {
-		return secretKey
-	}
-
-	// 3. Try AWS credentials file (~/.aws/credentials)
-	// Note: We don't parse the credentials file here to avoid adding dependencies
-	// The server should have access to this via the AWS SDK credential chain
-
-	return ""
-}
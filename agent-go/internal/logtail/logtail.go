@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/jetcamer/agent-go/internal/config"
@@ -12,6 +13,38 @@ import (
 	"github.com/jetcamer/agent-go/internal/sinks"
 )
 
+var (
+	stopOnce sync.Once
+	stopCh   = make(chan struct{})
+	tails    sync.WaitGroup
+)
+
+// Stop ends every tail started by this package and waits until no
+// callback is running, so nothing is handed on after it returns.
+func Stop() {
+	stopOnce.Do(func() { close(stopCh) })
+	tails.Wait()
+}
+
+// start runs fn as a tail goroutine that Stop waits for.
+func start(fn func()) {
+	tails.Add(1)
+	go func() {
+		defer tails.Done()
+		fn()
+	}()
+}
+
+// sleep waits for d and reports false if Stop was called first.
+func sleep(d time.Duration) bool {
+	select {
+	case <-stopCh:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 // TailLogs autodiscovers Apache and Nginx access logs if cfg.LogPaths is empty.
 // Otherwise, it tails the explicit paths.
 func TailLogs(cfg *config.Config, cb func(sinks.Event)) error {
@@ -27,7 +60,7 @@ func TailLogs(cfg *config.Config, cb func(sinks.Event)) error {
 	for _, p := range paths {
 		p := p
 		log.Printf("logtail: starting tail on %s", p)
-		go tailFile(p, cb)
+		start(func() { tailFile(p, cfg.LogExtraFields, cb) })
 	}
 	return nil
 }
@@ -73,17 +106,124 @@ func globDir(dir, pattern string) []string {
 	return out
 }
 
-func tailFile(path string, cb func(sinks.Event)) {
+// tailFile parses combined log lines. extra names the quoted fields the
+// log format appends after the user agent, in order.
+func tailFile(path string, extra []string, cb func(sinks.Event)) {
+	tailLines(path, func(line string) {
+		parsed, _ := parser.ParseCombined(line)
+		if parsed != nil {
+			rawStr := parsed.Raw
+			evt := sinks.Event{
+				RemoteIP:  parsed.RemoteIP,
+				Path:      parsed.Path,
+				Method:    parsed.Method,
+				Status:    parsed.Status,
+				Bytes:     parsed.Bytes,
+				UserAgent: parsed.UserAgent,
+				Referer:   parsed.Referer,
+				Timestamp: parsed.Timestamp,
+				Raw:       &rawStr,
+				Source:    filepath.Base(path),
+			}
+			for i, name := range extra {
+				if i >= len(parsed.Extra) || parsed.Extra[i] == "-" {
+					continue
+				}
+				switch name {
+				case "x_forwarded_for":
+					evt.ForwardedFor = parsed.Extra[i]
+				case "cf_connecting_ip":
+					evt.CFConnectingIP = parsed.Extra[i]
+				}
+			}
+			cb(evt)
+		}
+	})
+}
+
+// TailAuthLogs follows sshd, mail and FTP logs and hands every new line to
+// cb. It autodiscovers the usual syslog destinations if cfg.AuthLogPaths
+// is empty.
+func TailAuthLogs(cfg *config.Config, cb func(line string)) error {
+	var paths []string
+	if len(cfg.AuthLogPaths) > 0 {
+		paths = append(paths, cfg.AuthLogPaths...)
+	} else {
+		paths = discoverAuthLogs()
+	}
+	if len(paths) == 0 {
+		log.Printf("logtail: no auth log files discovered")
+	}
+	for _, p := range paths {
+		p := p
+		log.Printf("logtail: starting auth tail on %s", p)
+		start(func() { tailLines(p, cb) })
+	}
+	return nil
+}
+
+func discoverAuthLogs() []string {
+	return existingFiles(
+		"/var/log/auth.log", // Debian/Ubuntu sshd
+		"/var/log/secure",   // RHEL/CentOS sshd
+		"/var/log/mail.log", // Debian/Ubuntu Postfix + Dovecot
+		"/var/log/maillog",  // RHEL/CentOS Postfix + Dovecot
+		"/var/log/pureftpd.log",
+		"/var/log/proftpd/proftpd.log",
+		"/var/log/vsftpd.log",
+	)
+}
+
+// TailModSecLogs follows ModSecurity audit logs. newHandler is called once
+// per file so each gets its own parser state. It autodiscovers the usual
+// locations if cfg.ModSecAuditLogPaths is empty.
+func TailModSecLogs(cfg *config.Config, newHandler func() func(line string)) error {
+	var paths []string
+	if len(cfg.ModSecAuditLogPaths) > 0 {
+		paths = append(paths, cfg.ModSecAuditLogPaths...)
+	} else {
+		paths = existingFiles(
+			"/var/log/apache2/modsec_audit.log",
+			"/var/log/httpd/modsec_audit.log",
+			"/var/log/nginx/modsec_audit.log",
+			"/var/log/modsec_audit.log",
+		)
+	}
+	if len(paths) == 0 {
+		log.Printf("logtail: no modsecurity audit logs discovered")
+	}
+	for _, p := range paths {
+		p := p
+		log.Printf("logtail: starting modsecurity tail on %s", p)
+		handler := newHandler()
+		start(func() { tailLines(p, handler) })
+	}
+	return nil
+}
+
+func existingFiles(candidates ...string) []string {
+	out := []string{}
+	for _, p := range candidates {
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func tailLines(path string, cb func(line string)) {
 	for {
 		err := tailOnce(path, cb)
 		if err != nil {
 			log.Printf("logtail: error on %s: %v", path, err)
 		}
-		time.Sleep(2 * time.Second)
+		if !sleep(2 * time.Second) {
+			return
+		}
 	}
 }
 
-func tailOnce(path string, cb func(sinks.Event)) error {
+func tailOnce(path string, cb func(line string)) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -99,25 +239,18 @@ func tailOnce(path string, cb func(sinks.Event)) error {
 	for {
 		line, err := reader.ReadString('\n')
 		if len(line) > 0 {
-			parsed, _ := parser.ParseCombined(line)
-			if parsed != nil {
-				rawStr := parsed.Raw
-				cb(sinks.Event{
-					RemoteIP:  parsed.RemoteIP,
-					Path:      parsed.Path,
-					Method:    parsed.Method,
-					Status:    parsed.Status,
-					Bytes:     parsed.Bytes,
-					UserAgent: parsed.UserAgent,
-					Referer:   parsed.Referer,
-					Timestamp: parsed.Timestamp,
-					Raw:       &rawStr,
-					Source:    filepath.Base(path),
-				})
+			cb(line)
+		}
+		if err == nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
 			}
+			continue
 		}
-		if err != nil {
-			time.Sleep(500 * time.Millisecond)
+		if !sleep(500 * time.Millisecond) {
+			return nil
 		}
 	}
 }
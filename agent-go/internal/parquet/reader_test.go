@@ -0,0 +1,327 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A minimal reader for what Writer produces, so tests can check files
+// without an external Parquet library.
+
+// thriftReader decodes the Thrift compact protocol into generic values:
+// structs as map[int16]any, lists as []any, integers as int64, binary as
+// []byte.
+type thriftReader struct {
+	b   []byte
+	err error
+}
+
+func (r *thriftReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.b = nil
+}
+
+func (r *thriftReader) byte() byte {
+	if len(r.b) == 0 {
+		r.fail("thrift: unexpected end")
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail("thrift: bad varint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	u := r.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case ctTrue:
+		return true
+	case ctFalse:
+		return false
+	case 3: // byte
+		return int64(int8(r.byte()))
+	case 4, ctI32, ctI64:
+		return r.zigzag()
+	case 7: // double
+		if len(r.b) < 8 {
+			r.fail("thrift: short double")
+			return 0.0
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+		r.b = r.b[8:]
+		return v
+	case ctBinary:
+		n := int(r.uvarint())
+		if n > len(r.b) {
+			r.fail("thrift: binary of %d bytes past the end", n)
+			return []byte(nil)
+		}
+		v := r.b[:n]
+		r.b = r.b[n:]
+		return v
+	case ctList, 10:
+		h := r.byte()
+		n, elem := int(h>>4), h&0x0f
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]any, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			if elem == ctTrue || elem == ctFalse {
+				list = append(list, r.byte() == ctTrue)
+				continue
+			}
+			list = append(list, r.value(elem))
+		}
+		return list
+	case ctStruct:
+		return r.structValue()
+	}
+	r.fail("thrift: unsupported type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structValue() map[int16]any {
+	m := make(map[int16]any)
+	var last int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			break
+		}
+		typ, delta := h&0x0f, int16(h>>4)
+		id := last + delta
+		if delta == 0 {
+			id = int16(r.zigzag())
+		}
+		m[id] = r.value(typ)
+		last = id
+	}
+	return m
+}
+
+// i64 returns an integer field, or -1 when it is missing.
+func (r *thriftReader) i64(m map[int16]any, id int16) int64 {
+	if v, ok := m[id].(int64); ok {
+		return v
+	}
+	return -1
+}
+
+// decodeHybrid reads n values of the RLE/bit-packing hybrid encoding.
+func decodeHybrid(t *testing.T, b []byte, bw, n int) []uint32 {
+	t.Helper()
+	var out []uint32
+	for len(out) < n {
+		h, k := binary.Uvarint(b)
+		if k <= 0 {
+			t.Fatalf("hybrid: bad run header after %d of %d values", len(out), n)
+		}
+		b = b[k:]
+		if h&1 == 1 {
+			groups := int(h >> 1)
+			packed := b[:groups*bw]
+			b = b[groups*bw:]
+			for i := 0; i < groups*8; i++ {
+				var v uint32
+				for j := 0; j < bw; j++ {
+					bit := i*bw + j
+					v |= uint32(packed[bit/8]>>(bit%8)&1) << j
+				}
+				out = append(out, v)
+			}
+			continue
+		}
+		var v uint32
+		for j := 0; j < (bw+7)/8; j++ {
+			v |= uint32(b[j]) << (8 * j)
+		}
+		b = b[(bw+7)/8:]
+		for i := 0; i < int(h>>1); i++ {
+			out = append(out, v)
+		}
+	}
+	return out[:n]
+}
+
+// chunkRead is one column chunk read back from a file.
+type chunkRead struct {
+	meta   map[int16]any // ColumnMetaData
+	values ColumnValues
+	pages  int // data pages
+	dict   bool
+}
+
+// readFooter checks the magic bytes and decodes the FileMetaData.
+func readFooter(t *testing.T, data []byte) map[int16]any {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != magic || string(data[len(data)-4:]) != magic {
+		t.Fatal("missing PAR1 magic")
+	}
+	n := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	r := thriftReader{b: data[len(data)-8-n : len(data)-8]}
+	meta := r.structValue()
+	if r.err != nil || len(r.b) != 0 {
+		t.Fatalf("footer: %v (%d bytes left)", r.err, len(r.b))
+	}
+	return meta
+}
+
+// readChunk decodes every page of the chunk described by cc.
+func readChunk(t *testing.T, data []byte, col Column, cc map[int16]any) chunkRead {
+	t.Helper()
+	var r thriftReader
+	md := cc[3].(map[int16]any)
+	out := chunkRead{meta: md}
+	codec := Codec(r.i64(md, 4))
+	rows := int(r.i64(md, 5))
+	off := r.i64(md, 9)
+	if dict := r.i64(md, 11); dict >= 0 {
+		off = dict
+	}
+	if first := r.i64(cc, 2); first != off {
+		t.Fatalf("file_offset %d, first page at %d", first, off)
+	}
+	end := off + r.i64(md, 7)
+
+	var dictStrs []string
+	var dictInts []int64
+	for pos := off; pos < end; {
+		pr := thriftReader{b: data[pos:end]}
+		h := pr.structValue()
+		if pr.err != nil {
+			t.Fatalf("page header at %d: %v", pos, pr.err)
+		}
+		start := end - int64(len(pr.b))
+		size := pr.i64(h, 3)
+		page := decompress(t, codec, data[start:start+size], int(pr.i64(h, 2)))
+		pos = start + size
+
+		switch pr.i64(h, 1) {
+		case pageDictionary:
+			dh := h[7].(map[int16]any)
+			out.dict = true
+			dictStrs, dictInts = readPlain(t, col.Kind, page, int(pr.i64(dh, 1)))
+		case pageData:
+			out.pages++
+			dh := h[5].(map[int16]any)
+			n := int(pr.i64(dh, 1))
+			levels := make([]uint32, n)
+			for i := range levels {
+				levels[i] = 1
+			}
+			if col.Optional {
+				l := int(binary.LittleEndian.Uint32(page))
+				levels = decodeHybrid(t, page[4:4+l], 1, n)
+				page = page[4+l:]
+			}
+			present := 0
+			for _, l := range levels {
+				present += int(l)
+			}
+			var strs []string
+			var ints []int64
+			if pr.i64(dh, 2) == encPlainDictionary {
+				for _, i := range decodeHybrid(t, page[1:], int(page[0]), present) {
+					if col.Kind == String {
+						strs = append(strs, dictStrs[i])
+					} else {
+						ints = append(ints, dictInts[i])
+					}
+				}
+			} else {
+				strs, ints = readPlain(t, col.Kind, page, present)
+			}
+			for _, l := range levels {
+				null := l == 0
+				if col.Optional {
+					out.values.Null = append(out.values.Null, null)
+				}
+				switch {
+				case col.Kind == String && null:
+					out.values.Strings = append(out.values.Strings, "")
+				case col.Kind == String:
+					out.values.Strings, strs = append(out.values.Strings, strs[0]), strs[1:]
+				case null:
+					out.values.Ints = append(out.values.Ints, 0)
+				default:
+					out.values.Ints, ints = append(out.values.Ints, ints[0]), ints[1:]
+				}
+			}
+		default:
+			t.Fatalf("unexpected page type %d", pr.i64(h, 1))
+		}
+	}
+	if got := max(len(out.values.Strings), len(out.values.Ints)); got != rows {
+		t.Fatalf("column %s: read %d values, metadata says %d", col.Name, got, rows)
+	}
+	return out
+}
+
+func decompress(t *testing.T, codec Codec, p []byte, size int) []byte {
+	t.Helper()
+	var out []byte
+	var err error
+	switch codec {
+	case Snappy:
+		out, err = snappy.Decode(nil, p)
+	case Zstd:
+		var dec *zstd.Decoder
+		if dec, err = zstd.NewReader(nil); err == nil {
+			out, err = dec.DecodeAll(p, nil)
+			dec.Close()
+		}
+	default:
+		out = p
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != size {
+		t.Fatalf("page is %d bytes uncompressed, header says %d", len(out), size)
+	}
+	return out
+}
+
+func readPlain(t *testing.T, k Kind, b []byte, n int) (strs []string, ints []int64) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		switch k {
+		case String:
+			l := int(binary.LittleEndian.Uint32(b))
+			strs = append(strs, string(b[4:4+l]))
+			b = b[4+l:]
+		case Int32:
+			ints = append(ints, int64(int32(binary.LittleEndian.Uint32(b))))
+			b = b[4:]
+		default:
+			ints = append(ints, int64(binary.LittleEndian.Uint64(b)))
+			b = b[8:]
+		}
+	}
+	if len(b) != 0 {
+		t.Fatalf("%d bytes left after %d plain values", len(b), n)
+	}
+	return strs, ints
+}
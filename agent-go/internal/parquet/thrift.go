@@ -0,0 +1,109 @@
+package parquet
+
+import (
+	"encoding/binary"
+)
+
+// Thrift compact protocol, write side only, just enough for the Parquet
+// page headers and file footer.
+
+const (
+	ctTrue   = 1
+	ctFalse  = 2
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // last field id per open struct
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf = binary.AppendUvarint(t.buf, v)
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) beginStruct() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf = append(t.buf, 0) // stop
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.buf = append(t.buf, byte(d)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, ctI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, ctI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) bool(id int16, v bool) {
+	if v {
+		t.field(id, ctTrue)
+	} else {
+		t.field(id, ctFalse)
+	}
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, ctBinary)
+	t.rawString(v)
+}
+
+func (t *thriftWriter) rawString(v string) {
+	t.varint(uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
+
+func (t *thriftWriter) listHeader(id int16, elem byte, n int) {
+	t.field(id, ctList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elem)
+	} else {
+		t.buf = append(t.buf, 0xf0|elem)
+		t.varint(uint64(n))
+	}
+}
+
+func (t *thriftWriter) i32List(id int16, vs []int32) {
+	t.listHeader(id, ctI32, len(vs))
+	for _, v := range vs {
+		t.zigzag(int64(v))
+	}
+}
+
+func (t *thriftWriter) stringList(id int16, vs []string) {
+	t.listHeader(id, ctBinary, len(vs))
+	for _, v := range vs {
+		t.rawString(v)
+	}
+}
+
+// structField opens a nested struct field; close it with endStruct.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, ctStruct)
+	t.beginStruct()
+}
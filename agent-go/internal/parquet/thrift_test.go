@@ -0,0 +1,83 @@
+package parquet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestThriftCompactGolden(t *testing.T) {
+	var w thriftWriter
+	w.beginStruct()
+	w.i32(1, 1)
+	w.binary(4, "ab")
+	w.i64(20, -1) // field delta above 15: long form
+	w.i32List(21, []int32{1, 2})
+	w.structField(22)
+	w.bool(1, true)
+	w.endStruct()
+	w.endStruct()
+
+	want := []byte{
+		0x15, 0x02, // i32 field 1 = 1
+		0x38, 0x02, 'a', 'b', // binary field 4 = "ab"
+		0x06, 0x28, 0x01, // i64 field 20 = -1
+		0x19, 0x25, 0x02, 0x04, // list<i32> field 21 = [1, 2]
+		0x1c, 0x11, 0x00, // struct field 22 { bool field 1 = true }
+		0x00,
+	}
+	if !bytes.Equal(w.buf, want) {
+		t.Fatalf("got  % x\nwant % x", w.buf, want)
+	}
+
+	// and it reads back
+	r := thriftReader{b: w.buf}
+	got := r.structValue()
+	if r.err != nil || r.i64(got, 1) != 1 || string(got[4].([]byte)) != "ab" || r.i64(got, 20) != -1 {
+		t.Fatalf("read back %v (err %v)", got, r.err)
+	}
+	if nested := got[22].(map[int16]any); nested[1] != true {
+		t.Fatalf("nested struct = %v", nested)
+	}
+
+	// lists of 15 or more carry their size in a varint
+	var l thriftWriter
+	l.beginStruct()
+	l.listHeader(1, ctI32, 20)
+	if want := []byte{0x19, 0xf5, 0x14}; !bytes.Equal(l.buf, want) {
+		t.Fatalf("long list header = % x, want % x", l.buf, want)
+	}
+}
+
+func TestHybridGolden(t *testing.T) {
+	cases := []struct {
+		vals []uint32
+		bw   int
+		want []byte
+	}{
+		{[]uint32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 1, []byte{0x14, 0x00}},                 // RLE run of 10
+		{[]uint32{1, 0, 1}, 1, []byte{0x03, 0x05}},                                      // one bit-packed group
+		{[]uint32{3, 3, 3, 3, 3, 3, 3, 3, 1}, 2, []byte{0x10, 0x03, 0x03, 0x01, 0x00}},  // run, then a group
+		{[]uint32{300, 300, 300, 300, 300, 300, 300, 300}, 9, []byte{0x10, 0x2c, 0x01}}, // 2-byte RLE value
+	}
+	for _, c := range cases {
+		got := appendHybrid(nil, c.vals, c.bw)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("appendHybrid(%v, %d) = % x, want % x", c.vals, c.bw, got, c.want)
+		}
+		if back := decodeHybrid(t, got, c.bw, len(c.vals)); !equalUint32(back, c.vals) {
+			t.Errorf("decoded %v, want %v", back, c.vals)
+		}
+	}
+}
+
+func equalUint32(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,541 @@
+// Package parquet writes flat Parquet files: top-level string and
+// integer columns, optional values, dictionary encoding and snappy or
+// zstd pages. It covers what the agent archives and nothing more; the
+// output is readable by Athena, Spark, DuckDB and pyarrow.
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Kind is the type of a column.
+type Kind int
+
+const (
+	String          Kind = iota // BYTE_ARRAY, UTF8
+	Int32                       // INT32
+	Int64                       // INT64
+	TimestampMillis             // INT64, TIMESTAMP_MILLIS, UTC
+)
+
+// Column describes one top-level column. Optional columns store null for
+// values marked in ColumnValues.Null. Dictionary columns are dictionary
+// encoded unless the dictionary grows past maxDictBytes, in which case
+// the row group falls back to plain encoding for that column.
+type Column struct {
+	Name       string
+	Kind       Kind
+	Optional   bool
+	Dictionary bool
+}
+
+// ColumnValues is one column of a row group: Strings for String columns,
+// Ints for the others. Null[i], when Null is set, marks row i as missing.
+type ColumnValues struct {
+	Strings []string
+	Ints    []int64
+	Null    []bool
+}
+
+// Codec is the page compression.
+type Codec int32
+
+const (
+	Uncompressed Codec = 0
+	Snappy       Codec = 1
+	Zstd         Codec = 6
+)
+
+// ParseCodec maps "snappy" (default), "zstd" and "none".
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "snappy":
+		return Snappy, nil
+	case "zstd":
+		return Zstd, nil
+	case "none", "off", "uncompressed":
+		return Uncompressed, nil
+	}
+	return 0, fmt.Errorf("unknown parquet compression %q (snappy, zstd or none)", s)
+}
+
+func (c Codec) String() string {
+	switch c {
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	}
+	return "none"
+}
+
+// Parquet enums used below.
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeByteArray = 6
+
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+
+	repRequired = 0
+	repOptional = 1
+
+	encPlain           = 0
+	encPlainDictionary = 2
+	encRLE             = 3
+
+	pageData       = 0
+	pageDictionary = 2
+)
+
+const (
+	magic        = "PAR1"
+	pageRows     = 20000   // rows per data page
+	maxDictBytes = 1 << 20 // plain-encoded dictionary size limit per column chunk
+)
+
+// Writer writes one Parquet file. Call WriteRowGroup for each row group
+// and Close to write the footer; the underlying writer is not closed.
+type Writer struct {
+	w         io.Writer
+	off       int64
+	schema    []Column
+	codec     Codec
+	zstd      *zstd.Encoder
+	rowGroups []rowGroupMeta
+	rows      int64
+	err       error
+
+	// CreatedBy is recorded in the footer.
+	CreatedBy string
+}
+
+type rowGroupMeta struct {
+	rows    int64
+	bytes   int64
+	columns []chunkMeta
+}
+
+type chunkMeta struct {
+	encodings    []int32
+	values       int64
+	uncompressed int64
+	compressed   int64
+	dataOffset   int64
+	dictOffset   int64 // -1 when plain
+	hasStats     bool
+	min, max     int64
+	nulls        int64
+}
+
+// NewWriter starts a file on w.
+func NewWriter(w io.Writer, schema []Column, codec Codec) (*Writer, error) {
+	pw := &Writer{w: w, schema: schema, codec: codec, CreatedBy: "jetcamer-agent"}
+	if codec == Zstd {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		pw.zstd = enc
+	}
+	pw.write([]byte(magic))
+	return pw, pw.err
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(p)
+	w.off += int64(n)
+	w.err = err
+}
+
+// WriteRowGroup writes rows rows; cols must follow the schema order.
+func (w *Writer) WriteRowGroup(rows int, cols []ColumnValues) error {
+	if len(cols) != len(w.schema) {
+		return fmt.Errorf("parquet: %d columns for a schema of %d", len(cols), len(w.schema))
+	}
+	if rows == 0 {
+		return nil
+	}
+	rg := rowGroupMeta{rows: int64(rows)}
+	for i, c := range w.schema {
+		cm, err := w.writeChunk(c, cols[i], rows)
+		if err != nil {
+			return fmt.Errorf("parquet: column %s: %w", c.Name, err)
+		}
+		rg.bytes += cm.uncompressed
+		rg.columns = append(rg.columns, cm)
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+	w.rows += int64(rows)
+	return w.err
+}
+
+func (w *Writer) writeChunk(c Column, v ColumnValues, rows int) (chunkMeta, error) {
+	isNull := func(i int) bool { return c.Optional && v.Null != nil && v.Null[i] }
+	if c.Kind == String && len(v.Strings) < rows || c.Kind != String && len(v.Ints) < rows {
+		return chunkMeta{}, fmt.Errorf("%d values for %d rows", max(len(v.Strings), len(v.Ints)), rows)
+	}
+	cm := chunkMeta{values: int64(rows), dictOffset: -1}
+
+	if c.Kind != String {
+		for i := 0; i < rows; i++ {
+			if isNull(i) {
+				cm.nulls++
+				continue
+			}
+			x := v.Ints[i]
+			if !cm.hasStats || x < cm.min {
+				cm.min = x
+			}
+			if !cm.hasStats || x > cm.max {
+				cm.max = x
+			}
+			cm.hasStats = true
+		}
+	} else {
+		for i := 0; i < rows; i++ {
+			if isNull(i) {
+				cm.nulls++
+			}
+		}
+	}
+
+	// dictionary: index per row, plain-encoded distinct values
+	var (
+		indices []uint32
+		dict    []byte
+		ndict   int
+	)
+	if c.Dictionary {
+		indices = make([]uint32, rows)
+		if c.Kind == String {
+			seen := make(map[string]uint32)
+			for i := 0; i < rows && len(dict) <= maxDictBytes; i++ {
+				if isNull(i) {
+					continue
+				}
+				s := v.Strings[i]
+				idx, ok := seen[s]
+				if !ok {
+					idx = uint32(len(seen))
+					seen[s] = idx
+					dict = appendPlain(dict, c.Kind, s, 0)
+				}
+				indices[i] = idx
+			}
+			ndict = len(seen)
+		} else {
+			seen := make(map[int64]uint32)
+			for i := 0; i < rows && len(dict) <= maxDictBytes; i++ {
+				if isNull(i) {
+					continue
+				}
+				x := v.Ints[i]
+				idx, ok := seen[x]
+				if !ok {
+					idx = uint32(len(seen))
+					seen[x] = idx
+					dict = appendPlain(dict, c.Kind, "", x)
+				}
+				indices[i] = idx
+			}
+			ndict = len(seen)
+		}
+		if len(dict) > maxDictBytes || ndict == 0 {
+			indices, dict = nil, nil
+		}
+	}
+
+	if indices != nil {
+		cm.dictOffset = w.off
+		var h thriftWriter
+		h.beginStruct()
+		h.i32(1, pageDictionary)
+		h.i32(2, int32(len(dict)))
+		payload, err := w.compress(dict)
+		if err != nil {
+			return cm, err
+		}
+		h.i32(3, int32(len(payload)))
+		h.structField(7)
+		h.i32(1, int32(ndict))
+		h.i32(2, encPlainDictionary)
+		h.endStruct()
+		h.endStruct()
+		w.write(h.buf)
+		w.write(payload)
+		cm.uncompressed += int64(len(h.buf) + len(dict))
+		cm.compressed += int64(len(h.buf) + len(payload))
+		cm.encodings = []int32{encPlainDictionary, encRLE}
+	} else {
+		cm.encodings = []int32{encPlain, encRLE}
+	}
+
+	bw := bits.Len32(uint32(ndict - 1))
+	if bw == 0 {
+		bw = 1
+	}
+	cm.dataOffset = w.off
+	for start := 0; start < rows; start += pageRows {
+		end := min(start+pageRows, rows)
+		var page []byte
+		if c.Optional {
+			levels := make([]uint32, 0, end-start)
+			for i := start; i < end; i++ {
+				if isNull(i) {
+					levels = append(levels, 0)
+				} else {
+					levels = append(levels, 1)
+				}
+			}
+			enc := appendHybrid(nil, levels, 1)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(enc)))
+			page = append(page, enc...)
+		}
+		encoding := int32(encPlain)
+		if indices != nil {
+			encoding = encPlainDictionary
+			idx := make([]uint32, 0, end-start)
+			for i := start; i < end; i++ {
+				if !isNull(i) {
+					idx = append(idx, indices[i])
+				}
+			}
+			page = append(page, byte(bw))
+			page = appendHybrid(page, idx, bw)
+		} else {
+			for i := start; i < end; i++ {
+				if isNull(i) {
+					continue
+				}
+				if c.Kind == String {
+					page = appendPlain(page, c.Kind, v.Strings[i], 0)
+				} else {
+					page = appendPlain(page, c.Kind, "", v.Ints[i])
+				}
+			}
+		}
+
+		payload, err := w.compress(page)
+		if err != nil {
+			return cm, err
+		}
+		var h thriftWriter
+		h.beginStruct()
+		h.i32(1, pageData)
+		h.i32(2, int32(len(page)))
+		h.i32(3, int32(len(payload)))
+		h.structField(5)
+		h.i32(1, int32(end-start))
+		h.i32(2, encoding)
+		h.i32(3, encRLE)
+		h.i32(4, encRLE)
+		h.endStruct()
+		h.endStruct()
+		w.write(h.buf)
+		w.write(payload)
+		cm.uncompressed += int64(len(h.buf) + len(page))
+		cm.compressed += int64(len(h.buf) + len(payload))
+	}
+	return cm, w.err
+}
+
+func (w *Writer) compress(p []byte) ([]byte, error) {
+	switch w.codec {
+	case Snappy:
+		return snappy.Encode(nil, p), nil
+	case Zstd:
+		return w.zstd.EncodeAll(p, nil), nil
+	}
+	return p, nil
+}
+
+// Close writes the footer with meta as key/value metadata.
+func (w *Writer) Close(meta map[string]string) error {
+	if w.zstd != nil {
+		defer w.zstd.Close()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	var t thriftWriter
+	t.beginStruct()
+	t.i32(1, 1) // version
+
+	// schema: root, then one element per column
+	t.listHeader(2, ctStruct, len(w.schema)+1)
+	t.beginStruct()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(w.schema)))
+	t.endStruct()
+	for _, c := range w.schema {
+		t.beginStruct()
+		t.i32(1, physicalType(c.Kind))
+		rep := int32(repRequired)
+		if c.Optional {
+			rep = repOptional
+		}
+		t.i32(3, rep)
+		t.binary(4, c.Name)
+		switch c.Kind {
+		case String:
+			t.i32(6, convertedUTF8)
+		case TimestampMillis:
+			t.i32(6, convertedTimestampMillis)
+		}
+		t.endStruct()
+	}
+	t.i64(3, w.rows)
+
+	t.listHeader(4, ctStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		t.beginStruct()
+		t.listHeader(1, ctStruct, len(rg.columns))
+		for i, cm := range rg.columns {
+			c := w.schema[i]
+			first := cm.dataOffset
+			if cm.dictOffset >= 0 {
+				first = cm.dictOffset
+			}
+			t.beginStruct()
+			t.i64(2, first)
+			t.structField(3)
+			t.i32(1, physicalType(c.Kind))
+			t.i32List(2, cm.encodings)
+			t.stringList(3, []string{c.Name})
+			t.i32(4, int32(w.codec))
+			t.i64(5, cm.values)
+			t.i64(6, cm.uncompressed)
+			t.i64(7, cm.compressed)
+			t.i64(9, cm.dataOffset)
+			if cm.dictOffset >= 0 {
+				t.i64(11, cm.dictOffset)
+			}
+			t.structField(12)
+			t.i64(3, cm.nulls)
+			if cm.hasStats {
+				t.binary(5, string(appendPlain(nil, c.Kind, "", cm.max)))
+				t.binary(6, string(appendPlain(nil, c.Kind, "", cm.min)))
+			}
+			t.endStruct() // statistics
+			t.endStruct() // meta_data
+			t.endStruct() // column chunk
+		}
+		t.i64(2, rg.bytes)
+		t.i64(3, rg.rows)
+		t.endStruct()
+	}
+
+	if len(meta) > 0 {
+		keys := make([]string, 0, len(meta))
+		for k := range meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		t.listHeader(5, ctStruct, len(keys))
+		for _, k := range keys {
+			t.beginStruct()
+			t.binary(1, k)
+			t.binary(2, meta[k])
+			t.endStruct()
+		}
+	}
+	t.binary(6, w.CreatedBy)
+	// column_orders: TYPE_ORDER for every column, so readers trust min/max
+	t.listHeader(7, ctStruct, len(w.schema))
+	for range w.schema {
+		t.beginStruct()
+		t.structField(1)
+		t.endStruct()
+		t.endStruct()
+	}
+	t.endStruct()
+
+	w.write(t.buf)
+	w.write(binary.LittleEndian.AppendUint32(nil, uint32(len(t.buf))))
+	w.write([]byte(magic))
+	return w.err
+}
+
+func physicalType(k Kind) int32 {
+	switch k {
+	case Int32:
+		return typeInt32
+	case Int64, TimestampMillis:
+		return typeInt64
+	}
+	return typeByteArray
+}
+
+func appendPlain(dst []byte, k Kind, s string, x int64) []byte {
+	switch k {
+	case String:
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(s)))
+		return append(dst, s...)
+	case Int32:
+		return binary.LittleEndian.AppendUint32(dst, uint32(int32(x)))
+	}
+	return binary.LittleEndian.AppendUint64(dst, uint64(x))
+}
+
+// appendHybrid writes vals with the RLE/bit-packing hybrid encoding:
+// runs of 8 or more equal values as RLE runs, everything else in
+// bit-packed groups of 8.
+func appendHybrid(dst []byte, vals []uint32, bw int) []byte {
+	byteWidth := (bw + 7) / 8
+	var pending []uint32 // a multiple of 8 long except at the very end
+	flushPacked := func() {
+		if len(pending) == 0 {
+			return
+		}
+		groups := (len(pending) + 7) / 8
+		dst = binary.AppendUvarint(dst, uint64(groups)<<1|1)
+		var acc uint64
+		nbits := 0
+		for i := 0; i < groups*8; i++ {
+			var v uint32
+			if i < len(pending) {
+				v = pending[i]
+			}
+			acc |= uint64(v) << nbits
+			nbits += bw
+			for nbits >= 8 {
+				dst = append(dst, byte(acc))
+				acc >>= 8
+				nbits -= 8
+			}
+		}
+		pending = pending[:0]
+	}
+	for i := 0; i < len(vals); {
+		j := i + 1
+		for j < len(vals) && vals[j] == vals[i] {
+			j++
+		}
+		if j-i >= 8 && len(pending)%8 == 0 {
+			flushPacked()
+			dst = binary.AppendUvarint(dst, uint64(j-i)<<1)
+			for b := 0; b < byteWidth; b++ {
+				dst = append(dst, byte(vals[i]>>(8*b)))
+			}
+			i = j
+			continue
+		}
+		pending = append(pending, vals[i])
+		i++
+	}
+	flushPacked()
+	return dst
+}
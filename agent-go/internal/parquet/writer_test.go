@@ -0,0 +1,200 @@
+package parquet
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+var testSchema = []Column{
+	{Name: "method", Kind: String, Dictionary: true},
+	{Name: "referer", Kind: String, Optional: true, Dictionary: true},
+	{Name: "raw", Kind: String, Dictionary: true}, // unique values: falls back to plain in a big row group
+	{Name: "status", Kind: Int32, Dictionary: true},
+	{Name: "bytes", Kind: Int64, Optional: true},
+	{Name: "ts", Kind: TimestampMillis},
+}
+
+// testRowGroup builds rows rows of testSchema, starting at row seq.
+func testRowGroup(seq, rows int) []ColumnValues {
+	cols := make([]ColumnValues, len(testSchema))
+	for i := seq; i < seq+rows; i++ {
+		cols[0].Strings = append(cols[0].Strings, []string{"GET", "GET", "GET", "POST", "HEAD"}[i%5])
+		ref := ""
+		if i%3 != 0 {
+			ref = fmt.Sprintf("https://example.com/%d", i%7)
+		}
+		cols[1].Strings = append(cols[1].Strings, ref)
+		cols[1].Null = append(cols[1].Null, ref == "")
+		cols[2].Strings = append(cols[2].Strings, fmt.Sprintf("203.0.113.%d - - GET /page/%08d", i%256, i))
+		cols[3].Ints = append(cols[3].Ints, []int64{200, 200, 404, 301, 500}[i%5])
+		cols[4].Ints = append(cols[4].Ints, int64(i*13%9000-1000))
+		cols[4].Null = append(cols[4].Null, i%4 == 0)
+		cols[5].Ints = append(cols[5].Ints, 1760000000000+int64(i))
+	}
+	return cols
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	// 45000 rows: three data pages per chunk, and a raw column whose
+	// dictionary passes maxDictBytes; then a small second row group
+	groups := [][2]int{{0, 45000}, {45000, 10}}
+
+	for _, codec := range []Codec{Uncompressed, Snappy, Zstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, testSchema, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.CreatedBy = "test"
+			var want [][]ColumnValues
+			for _, g := range groups {
+				cols := testRowGroup(g[0], g[1])
+				want = append(want, cols)
+				if err := w.WriteRowGroup(g[1], cols); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(map[string]string{"k": "v"}); err != nil {
+				t.Fatal(err)
+			}
+
+			data := buf.Bytes()
+			var r thriftReader
+			meta := readFooter(t, data)
+			if n := r.i64(meta, 3); n != 45010 {
+				t.Fatalf("num_rows = %d", n)
+			}
+			if got := string(meta[6].([]byte)); got != "test" {
+				t.Fatalf("created_by = %q", got)
+			}
+			kv := meta[5].([]any)[0].(map[int16]any)
+			if string(kv[1].([]byte)) != "k" || string(kv[2].([]byte)) != "v" {
+				t.Fatalf("key/value metadata = %v", kv)
+			}
+			schema := meta[2].([]any)
+			if len(schema) != len(testSchema)+1 {
+				t.Fatalf("%d schema elements", len(schema))
+			}
+			for i, c := range testSchema {
+				el := schema[i+1].(map[int16]any)
+				optional := r.i64(el, 3) == repOptional
+				if string(el[4].([]byte)) != c.Name || r.i64(el, 1) != int64(physicalType(c.Kind)) || optional != c.Optional {
+					t.Fatalf("schema element %d = %v", i+1, el)
+				}
+			}
+
+			rowGroups := meta[4].([]any)
+			if len(rowGroups) != len(groups) {
+				t.Fatalf("%d row groups, want %d", len(rowGroups), len(groups))
+			}
+			for g, rgv := range rowGroups {
+				rg := rgv.(map[int16]any)
+				if n := r.i64(rg, 3); n != int64(groups[g][1]) {
+					t.Fatalf("row group %d: %d rows", g, n)
+				}
+				for i, ccv := range rg[1].([]any) {
+					col := testSchema[i]
+					got := readChunk(t, data, col, ccv.(map[int16]any))
+					checkColumn(t, fmt.Sprintf("rg %d %s", g, col.Name), got.values, want[g][i], groups[g][1])
+					if r.i64(got.meta, 4) != int64(codec) {
+						t.Fatalf("%s: codec %d", col.Name, r.i64(got.meta, 4))
+					}
+
+					wantDict := col.Dictionary && !(col.Name == "raw" && g == 0)
+					if got.dict != wantDict {
+						t.Errorf("rg %d %s: dictionary page = %v, want %v", g, col.Name, got.dict, wantDict)
+					}
+					if wantPages := (groups[g][1] + pageRows - 1) / pageRows; got.pages != wantPages {
+						t.Errorf("rg %d %s: %d data pages, want %d", g, col.Name, got.pages, wantPages)
+					}
+					checkStats(t, col, got.meta, want[g][i], groups[g][1])
+				}
+			}
+		})
+	}
+}
+
+func checkColumn(t *testing.T, name string, got, want ColumnValues, rows int) {
+	t.Helper()
+	for i := 0; i < rows; i++ {
+		null := want.Null != nil && want.Null[i]
+		if got.Null != nil && got.Null[i] != null {
+			t.Fatalf("%s row %d: null = %v, want %v", name, i, got.Null[i], null)
+		}
+		if null {
+			continue
+		}
+		if want.Strings != nil && got.Strings[i] != want.Strings[i] {
+			t.Fatalf("%s row %d: %q, want %q", name, i, got.Strings[i], want.Strings[i])
+		}
+		if want.Ints != nil && got.Ints[i] != want.Ints[i] {
+			t.Fatalf("%s row %d: %d, want %d", name, i, got.Ints[i], want.Ints[i])
+		}
+	}
+}
+
+// checkStats compares null_count and, for integer columns, min and max.
+func checkStats(t *testing.T, col Column, md map[int16]any, want ColumnValues, rows int) {
+	t.Helper()
+	var r thriftReader
+	stats := md[12].(map[int16]any)
+	var nulls, lo, hi int64
+	seen := false
+	for i := 0; i < rows; i++ {
+		if want.Null != nil && want.Null[i] {
+			nulls++
+			continue
+		}
+		if col.Kind == String {
+			continue
+		}
+		x := want.Ints[i]
+		if !seen || x < lo {
+			lo = x
+		}
+		if !seen || x > hi {
+			hi = x
+		}
+		seen = true
+	}
+	if got := r.i64(stats, 3); got != nulls {
+		t.Errorf("%s: null_count %d, want %d", col.Name, got, nulls)
+	}
+	if col.Kind == String {
+		if _, ok := stats[5]; ok {
+			t.Errorf("%s: min/max written for a string column", col.Name)
+		}
+		return
+	}
+	_, maxv := readPlain(t, col.Kind, stats[5].([]byte), 1)
+	_, minv := readPlain(t, col.Kind, stats[6].([]byte), 1)
+	if minv[0] != lo || maxv[0] != hi {
+		t.Errorf("%s: min/max %d/%d, want %d/%d", col.Name, minv[0], maxv[0], lo, hi)
+	}
+}
+
+func TestWriterRejectsShortColumns(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{}, testSchema[:1], Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRowGroup(3, []ColumnValues{{Strings: []string{"GET"}}}); err == nil {
+		t.Fatal("short column accepted")
+	}
+	if err := w.WriteRowGroup(1, nil); err == nil {
+		t.Fatal("missing columns accepted")
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for in, want := range map[string]Codec{"": Snappy, "snappy": Snappy, " ZSTD ": Zstd, "none": Uncompressed} {
+		if got, err := ParseCodec(in); err != nil || got != want {
+			t.Errorf("ParseCodec(%q) = %v, %v", in, got, err)
+		}
+	}
+	if _, err := ParseCodec("gzip"); err == nil {
+		t.Error("gzip accepted")
+	}
+}
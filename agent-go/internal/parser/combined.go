@@ -10,7 +10,12 @@ import (
 // This regex handles standard "combined" access logs used by Apache and Nginx.
 // Example:
 // 73.252.173.115 - - [16/Nov/2025:22:32:31 +0000] "GET / HTTP/1.1" 200 3460 "-" "Mozilla/5.0 ..."
-var combinedRegex = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) (\S+) "([^"]*)" "([^"]*)"`)
+//
+// Quoted fields appended after the user agent, such as
+// "$http_x_forwarded_for" in an nginx log_format, are returned in Extra.
+var combinedRegex = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) (\S+) "([^"]*)" "([^"]*)"(.*)`)
+
+var extraFieldRegex = regexp.MustCompile(`"([^"]*)"`)
 
 type Parsed struct {
 	RemoteIP  string
@@ -22,6 +27,7 @@ type Parsed struct {
 	Bytes     int64
 	Referer   string
 	UserAgent string
+	Extra     []string // trailing quoted fields, "-" left as is
 	Raw       string
 }
 
@@ -36,6 +42,9 @@ func ParseCombined(line string) (*Parsed, error) {
 		UserAgent: m[7],
 		Raw:       strings.TrimSpace(line),
 	}
+	for _, f := range extraFieldRegex.FindAllStringSubmatch(m[8], -1) {
+		p.Extra = append(p.Extra, f[1])
+	}
 
 	// date like 16/Nov/2006:22:32:31 +0000
 	ts, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[2])
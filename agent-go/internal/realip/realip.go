@@ -0,0 +1,229 @@
+package realip
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Resolver derives the real client address of a request that reached the
+// web server through a CDN or load balancer. Forwarding headers are only
+// believed when the connecting peer is a trusted proxy; anyone else could
+// have written them.
+type Resolver struct {
+	trusted    []*net.IPNet
+	cloudflare []*net.IPNet // subset of trusted allowed to set CF-Connecting-IP
+}
+
+// DefaultRangesDir holds the preset range files.
+const DefaultRangesDir = "/etc/jetcamer/proxy-ranges"
+
+// privateRanges is the "private" preset: an ALB or reverse proxy inside
+// the VPC connects from these.
+var privateRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"fc00::/7",
+	"::1/128",
+}
+
+// New builds a resolver from explicit IPs/CIDRs and named presets read
+// from dir:
+//
+//	cloudflare  cloudflare.txt, https://www.cloudflare.com/ips-v4 and ips-v6 concatenated
+//	cloudfront  aws-ip-ranges.json, https://ip-ranges.amazonaws.com/ip-ranges.json (service CLOUDFRONT)
+//	private     built in: RFC 1918, loopback and IPv6 ULA
+//	<name>      <name>.txt, one IP or CIDR per line
+//
+// Unreadable presets and invalid entries are logged and skipped. It
+// returns nil when nothing is trusted, which leaves every address as is.
+func New(proxies, presets []string, dir string) *Resolver {
+	if dir == "" {
+		dir = DefaultRangesDir
+	}
+	r := &Resolver{}
+	r.trusted = appendNets(r.trusted, "trustedProxies", proxies)
+	for _, p := range presets {
+		p = strings.ToLower(strings.TrimSpace(p))
+		var (
+			entries []string
+			err     error
+		)
+		switch p {
+		case "":
+			continue
+		case "private":
+			entries = privateRanges
+		case "cloudfront":
+			entries, err = readAWSRanges(filepath.Join(dir, "aws-ip-ranges.json"), "CLOUDFRONT")
+		default:
+			entries, err = readList(filepath.Join(dir, p+".txt"))
+		}
+		if err != nil {
+			log.Printf("realip: preset %s unavailable: %v", p, err)
+			continue
+		}
+		nets := appendNets(nil, p, entries)
+		if p == "cloudflare" {
+			r.cloudflare = append(r.cloudflare, nets...)
+		}
+		r.trusted = append(r.trusted, nets...)
+		log.Printf("realip: preset %s: %d ranges", p, len(nets))
+	}
+	if len(r.trusted) == 0 {
+		return nil
+	}
+	return r
+}
+
+// Resolve returns the client address for a request from peer carrying the
+// given X-Forwarded-For and CF-Connecting-IP values (empty if not logged).
+// X-Forwarded-For is walked right to left, skipping trusted proxies; the
+// first other address is the client. CF-Connecting-IP is used only when
+// the chain came through Cloudflare and X-Forwarded-For gave no answer.
+// ok is false when the result is itself a trusted proxy, e.g. a load
+// balancer health check. A nil Resolver returns peer unchanged.
+func (r *Resolver) Resolve(peer, xff, cfIP string) (client string, ok bool) {
+	if r == nil {
+		return peer, true
+	}
+	ip := parseHop(peer)
+	if ip == nil {
+		return peer, true
+	}
+	if !contains(r.trusted, ip) {
+		return peer, true
+	}
+
+	viaCF := contains(r.cloudflare, ip)
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := strings.TrimSpace(hops[i])
+		if h == "" || h == "-" {
+			continue
+		}
+		hip := parseHop(h)
+		if hip == nil {
+			// garbage from the client side: the last proxy is all we know
+			break
+		}
+		if !contains(r.trusted, hip) {
+			return hip.String(), true
+		}
+		ip = hip
+		viaCF = viaCF || contains(r.cloudflare, hip)
+	}
+	if viaCF {
+		if cip := parseHop(strings.TrimSpace(cfIP)); cip != nil && !contains(r.trusted, cip) {
+			return cip.String(), true
+		}
+	}
+	return ip.String(), false
+}
+
+// parseHop accepts "ip", "ip:port" and "[ipv6]:port".
+func parseHop(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendNets(dst []*net.IPNet, source string, entries []string) []*net.IPNet {
+	for _, s := range entries {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				dst = append(dst, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("realip: %s: ignoring invalid entry %q", source, s)
+			continue
+		}
+		dst = append(dst, n)
+	}
+	return dst
+}
+
+// readList reads one entry per line; "#" starts a comment.
+func readList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, sc.Err()
+}
+
+// readAWSRanges extracts the IPv4 and IPv6 prefixes of one service from
+// the published ip-ranges.json.
+func readAWSRanges(path, service string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Prefixes []struct {
+			Prefix  string `json:"ip_prefix"`
+			Service string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			Prefix  string `json:"ipv6_prefix"`
+			Service string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, p := range doc.Prefixes {
+		if p.Service == service {
+			out = append(out, p.Prefix)
+		}
+	}
+	for _, p := range doc.IPv6Prefixes {
+		if p.Service == service {
+			out = append(out, p.Prefix)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package realip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestResolver(t *testing.T) *Resolver {
+	t.Helper()
+	dir := t.TempDir()
+	cf := "# https://www.cloudflare.com/ips\n173.245.48.0/20\n2400:cb00::/32\n"
+	if err := os.WriteFile(filepath.Join(dir, "cloudflare.txt"), []byte(cf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := New([]string{"10.0.0.0/8", "192.0.2.10", "not-a-range"}, []string{"cloudflare", "missing"}, dir)
+	if r == nil {
+		t.Fatal("New returned nil with trusted ranges")
+	}
+	return r
+}
+
+func TestResolve(t *testing.T) {
+	r := newTestResolver(t)
+	tests := []struct {
+		name, peer, xff, cf string
+		want                string
+		ok                  bool
+	}{
+		{"untrusted peer keeps its address", "203.0.113.50", "198.51.100.1", "198.51.100.2", "203.0.113.50", true},
+		{"no forwarding headers", "10.0.0.5", "", "", "10.0.0.5", false},
+		{"single hop", "10.0.0.5", "203.0.113.9", "", "203.0.113.9", true},
+		{"spoofed leftmost entry", "10.0.0.5", "1.2.3.4, 203.0.113.9", "", "203.0.113.9", true},
+		{"spoofed trusted leftmost entry", "10.0.0.5", "10.9.9.9, 203.0.113.9, 10.0.0.7", "", "203.0.113.9", true},
+		{"all hops trusted", "10.0.0.5", "10.0.0.7, 192.0.2.10", "", "10.0.0.7", false},
+		{"cf header from a non-cloudflare proxy", "10.0.0.5", "", "198.51.100.1", "10.0.0.5", false},
+		{"cf header from an untrusted peer", "203.0.113.50", "", "198.51.100.1", "203.0.113.50", true},
+		{"cf header from cloudflare", "173.245.48.1", "", "198.51.100.1", "198.51.100.1", true},
+		{"cf header through a proxy chain", "10.0.0.5", "173.245.48.9", "198.51.100.1", "198.51.100.1", true},
+		{"xff answer beats cf header", "173.245.48.1", "203.0.113.9", "198.51.100.1", "203.0.113.9", true},
+		{"cf header naming a proxy", "173.245.48.1", "", "10.1.1.1", "173.245.48.1", false},
+		{"malformed cf header", "173.245.48.1", "", "garbage", "173.245.48.1", false},
+		{"cloudflare over ipv6", "2400:cb00::1", "", "2001:db8::7", "2001:db8::7", true},
+		{"ported peer", "10.0.0.5:8080", "203.0.113.9", "", "203.0.113.9", true},
+		{"ported ipv4 hop", "10.0.0.5", "203.0.113.9:51234", "", "203.0.113.9", true},
+		{"ported ipv6 hop", "10.0.0.5", "[2001:db8::1]:443", "", "2001:db8::1", true},
+		{"bare ipv6 hop", "10.0.0.5", "2001:db8::1", "", "2001:db8::1", true},
+		{"malformed hop stops the walk", "10.0.0.5", "unknown, 10.0.0.7", "", "10.0.0.7", false},
+		{"malformed hop left of the client", "10.0.0.5", "garbage, 203.0.113.9", "", "203.0.113.9", true},
+		{"empty and dash hops skipped", "10.0.0.5", "203.0.113.9, -, ,", "", "203.0.113.9", true},
+		{"malformed peer", "not-an-ip", "203.0.113.9", "", "not-an-ip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := r.Resolve(tt.peer, tt.xff, tt.cf)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("Resolve(%q, %q, %q) = %q, %v; want %q, %v", tt.peer, tt.xff, tt.cf, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNilResolver(t *testing.T) {
+	r := New(nil, []string{"missing"}, t.TempDir())
+	if r != nil {
+		t.Fatal("New trusted nothing but returned a resolver")
+	}
+	if got, ok := r.Resolve("10.0.0.5", "203.0.113.9", "198.51.100.1"); got != "10.0.0.5" || !ok {
+		t.Fatalf("nil Resolve = %q, %v; want the peer", got, ok)
+	}
+}
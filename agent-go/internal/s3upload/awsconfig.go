@@ -0,0 +1,141 @@
+package s3upload
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Role is an IAM role assumed on top of the base credentials (stored
+// keys or the default chain), or with a web identity token instead of
+// them (EKS IRSA, GitHub Actions, any OIDC provider trusted by the role).
+type Role struct {
+	ARN                  string
+	ExternalID           string        // required by the role's trust policy, if any
+	SessionName          string        // default "jetcamer-agent"
+	Duration             time.Duration // 15m to 12h, default 1h
+	WebIdentityTokenFile string        // OIDC token file, re-read on every refresh
+}
+
+func (r Role) check() error {
+	if r.ARN == "" {
+		if r.WebIdentityTokenFile != "" || r.ExternalID != "" {
+			return fmt.Errorf("a role ARN is required with an external ID or web identity token")
+		}
+		return nil
+	}
+	if r.Duration != 0 && (r.Duration < 15*time.Minute || r.Duration > 12*time.Hour) {
+		return fmt.Errorf("role session duration %s out of range (15m to 12h)", r.Duration)
+	}
+	return nil
+}
+
+// kind describes the credentials for logs and validation results.
+func (r Role) kind() string {
+	switch {
+	case r.WebIdentityTokenFile != "":
+		return "web-identity"
+	case r.ARN != "":
+		return "assume-role"
+	}
+	return ""
+}
+
+// credentialSource describes where credentials come from, for logs.
+func credentialSource(role Role) string {
+	src := "the default credential chain"
+	if stored := GetStoredCredentials(); stored != nil {
+		role = stored.role(role)
+		if stored.AccessKeyID != "" {
+			src = "stored AWS credentials"
+		}
+	}
+	switch role.kind() {
+	case "web-identity":
+		return "web identity token " + role.WebIdentityTokenFile + " for role " + role.ARN
+	case "assume-role":
+		return "role " + role.ARN + " assumed with " + src
+	}
+	return src
+}
+
+// refreshWindow is how long before expiry temporary credentials are
+// renewed, so requests never go out with credentials about to lapse.
+const refreshWindow = 5 * time.Minute
+
+// LoadAWSConfig returns the SDK config every AWS client of the agent uses.
+// Base credentials are the keys stored through /internal/set-aws-config,
+// or the default chain; role is assumed on top of them, with the role
+// settings stored alongside the keys taking priority. Temporary
+// credentials are cached and refreshed before they expire. An empty
+// region falls back to the stored one, then to the default chain's.
+func LoadAWSConfig(ctx context.Context, role Role, region string) (aws.Config, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if stored := GetStoredCredentials(); stored != nil {
+		role = stored.role(role)
+		if region == "" {
+			region = stored.Region
+		}
+		if stored.AccessKeyID != "" {
+			loadOpts = append(loadOpts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+				stored.AccessKeyID,
+				stored.SecretAccessKey,
+				"",
+			)))
+		}
+	}
+	if region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return cfg, err
+	}
+	if err := role.check(); err != nil {
+		return cfg, err
+	}
+	if role.ARN == "" {
+		return cfg, nil
+	}
+
+	// STS is global; it still needs a region to sign requests
+	stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if o.Region == "" {
+			o.Region = "us-east-1"
+		}
+	})
+	session := role.SessionName
+	if session == "" {
+		session = "jetcamer-agent"
+	}
+	var provider aws.CredentialsProvider
+	if role.WebIdentityTokenFile != "" {
+		provider = stscreds.NewWebIdentityRoleProvider(stsClient, role.ARN,
+			stscreds.IdentityTokenFile(role.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = session
+				o.Duration = role.Duration
+			})
+	} else {
+		provider = stscreds.NewAssumeRoleProvider(stsClient, role.ARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = session
+			if role.ExternalID != "" {
+				o.ExternalID = aws.String(role.ExternalID)
+			}
+			if role.Duration > 0 {
+				o.Duration = role.Duration
+			}
+		})
+	}
+	cfg.Credentials = aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = refreshWindow
+		o.ExpiryWindowJitterFrac = 0.5
+	})
+	return cfg, nil
+}
@@ -0,0 +1,152 @@
+package s3upload
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jetcamer/agent-go/internal/version"
+)
+
+// Compression of uploaded batch objects. Gzip is readable by Athena,
+// Glue and most log tools; zstd is smaller and faster but needs a newer
+// reader (Athena engine v3 handles it).
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// codec describes how one compression setting is written to S3.
+type codec struct {
+	suffix   string // appended to .ndjson
+	encoding string // Content-Encoding, empty for none
+}
+
+var codecs = map[string]codec{
+	CompressionNone: {suffix: "", encoding: ""},
+	CompressionGzip: {suffix: ".gz", encoding: "gzip"},
+	CompressionZstd: {suffix: ".zst", encoding: "zstd"},
+}
+
+// parseCompression maps a config value to a known compression; empty
+// means gzip.
+func parseCompression(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "":
+		return CompressionGzip, nil
+	case "off", "false":
+		return CompressionNone, nil
+	}
+	if _, ok := codecs[s]; !ok {
+		return "", fmt.Errorf("unknown compression %q (none, gzip or zstd)", s)
+	}
+	return s, nil
+}
+
+var (
+	gzipPool = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	zstdPool = sync.Pool{New: func() interface{} {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// encodeLines returns the object body for lines under compression. The
+// uncompressed body streams the lines as they are; compressed bodies are
+// built in memory because S3 needs the length up front.
+func encodeLines(compression string, lines [][]byte) (io.ReadSeeker, int64, error) {
+	src := newNDJSONReader(lines)
+	var buf bytes.Buffer
+	switch compression {
+	case CompressionGzip:
+		w := gzipPool.Get().(*gzip.Writer)
+		defer gzipPool.Put(w)
+		w.Reset(&buf)
+		if _, err := io.Copy(w, src); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+	case CompressionZstd:
+		w := zstdPool.Get().(*zstd.Encoder)
+		defer zstdPool.Put(w)
+		w.Reset(&buf)
+		if _, err := io.Copy(w, src); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+	default:
+		return src, src.size, nil
+	}
+	return bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil
+}
+
+// batchMetadata is stored as x-amz-meta-* on every object so consumers
+// can skip objects by time range without downloading them.
+func batchMetadata(lines [][]byte) map[string]string {
+	var first, last time.Time
+	for _, l := range lines {
+		ts, ok := EventTime(l)
+		if !ok {
+			continue
+		}
+		if first.IsZero() || ts.Before(first) {
+			first = ts
+		}
+		if ts.After(last) {
+			last = ts
+		}
+	}
+	return ObjectMetadata(len(lines), first, last)
+}
+
+// ObjectMetadata is the metadata of an object holding events events from
+// first to last (zero when unknown).
+func ObjectMetadata(events int, first, last time.Time) map[string]string {
+	meta := map[string]string{
+		"event-count":   strconv.Itoa(events),
+		"agent-version": version.Get(),
+	}
+	if !first.IsZero() {
+		meta["first-ts"] = first.UTC().Format(time.RFC3339Nano)
+		meta["last-ts"] = last.UTC().Format(time.RFC3339Nano)
+	}
+	return meta
+}
+
+var tsKey = []byte(`"ts":"`)
+
+// EventTime finds the "ts" field of one encoded event without decoding
+// the rest. Quotes inside JSON strings are escaped, so the first raw
+// `"ts":"` is the key itself.
+func EventTime(line []byte) (time.Time, bool) {
+	i := bytes.Index(line, tsKey)
+	if i < 0 {
+		return time.Time{}, false
+	}
+	v := line[i+len(tsKey):]
+	j := bytes.IndexByte(v, '"')
+	if j < 0 {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, string(v[:j]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
@@ -1,26 +1,57 @@
 package s3upload
 
 import (
-	"encoding/json"
+	"log"
 	"os"
-	"path/filepath"
 	"sync"
+	"time"
 )
 
-// StoredCredentials holds AWS credentials stored via API
+// StoredCredentials holds AWS credentials stored via API. Keys are
+// optional when a role is given: it is then assumed with the default
+// chain, or with a web identity token.
 type StoredCredentials struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Region          string
+
+	RoleARN              string
+	ExternalID           string
+	RoleSessionName      string
+	RoleDurationSeconds  int
+	WebIdentityTokenFile string
 }
 
-const (
-	credentialsFile = "/etc/jetcamer/aws-credentials.json"
-)
+func (c *StoredCredentials) usable() bool {
+	return (c.AccessKeyID != "" && c.SecretAccessKey != "") || c.RoleARN != ""
+}
+
+// role returns the stored role settings, or base when none are stored.
+func (c *StoredCredentials) role(base Role) Role {
+	if c.RoleARN == "" {
+		return base
+	}
+	return Role{
+		ARN:                  c.RoleARN,
+		ExternalID:           c.ExternalID,
+		SessionName:          c.RoleSessionName,
+		Duration:             time.Duration(c.RoleDurationSeconds) * time.Second,
+		WebIdentityTokenFile: c.WebIdentityTokenFile,
+	}
+}
+
+// credentialsFile is a variable so tests can point it elsewhere
+var credentialsFile = "/etc/jetcamer/aws-credentials.json"
 
 var (
 	storedCreds     *StoredCredentials
 	storedCredsLock sync.RWMutex
+	credsFileStamp  time.Time // mtime of credentialsFile when last read or written
+
+	credsListenersLock sync.Mutex
+	credsListeners     []func()
+	credsWorkerOnce    sync.Once
+	credsChanged       = make(chan struct{}, 1) // pending change, coalesced
 )
 
 // init loads stored credentials from disk on startup
@@ -29,17 +60,12 @@ func init() {
 }
 
 // SetStoredCredentials sets AWS credentials to be used as first priority
-// Credentials are persisted to disk for persistence across restarts
-func SetStoredCredentials(accessKeyID, secretAccessKey, region string) {
+// Credentials are persisted to disk for persistence across restarts, and
+// clients built from them are rebuilt through OnCredentialsChange
+func SetStoredCredentials(creds StoredCredentials) {
 	storedCredsLock.Lock()
-	defer storedCredsLock.Unlock()
-	
-	if accessKeyID != "" && secretAccessKey != "" {
-		storedCreds = &StoredCredentials{
-			AccessKeyID:     accessKeyID,
-			SecretAccessKey: secretAccessKey,
-			Region:          region,
-		}
+	if creds.usable() {
+		storedCreds = &creds
 		// Persist to disk
 		saveStoredCredentialsToDisk(storedCreds)
 	} else {
@@ -48,6 +74,60 @@ func SetStoredCredentials(accessKeyID, secretAccessKey, region string) {
 		// Remove from disk
 		removeStoredCredentialsFromDisk()
 	}
+	storedCredsLock.Unlock()
+	notifyCredentialsChange()
+}
+
+// OnCredentialsChange registers fn to run after the stored credentials
+// change, through SetStoredCredentials or because the credentials file
+// was rewritten on disk. Listeners run one after another on a single
+// worker goroutine. Changes that arrive while they run are coalesced into
+// one more run, so the last run always sees the latest credentials.
+func OnCredentialsChange(fn func()) {
+	credsListenersLock.Lock()
+	credsListeners = append(credsListeners, fn)
+	credsListenersLock.Unlock()
+	credsWorkerOnce.Do(func() { go credentialsWorker() })
+}
+
+func notifyCredentialsChange() {
+	select {
+	case credsChanged <- struct{}{}:
+	default: // a run is already pending and will read the new state
+	}
+}
+
+func credentialsWorker() {
+	for range credsChanged {
+		credsListenersLock.Lock()
+		fns := append([]func(){}, credsListeners...)
+		credsListenersLock.Unlock()
+		for _, fn := range fns {
+			fn()
+		}
+	}
+}
+
+// WatchStoredCredentials reloads the credentials file when another
+// process (a provisioning tool rotating keys) rewrites or removes it.
+func WatchStoredCredentials(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var mtime time.Time
+		if info, err := os.Stat(credentialsFile); err == nil {
+			mtime = info.ModTime()
+		}
+		storedCredsLock.RLock()
+		changed := !mtime.Equal(credsFileStamp)
+		storedCredsLock.RUnlock()
+		if !changed {
+			continue
+		}
+		log.Printf("credentials file %s changed, reloading", credentialsFile)
+		loadStoredCredentialsFromDisk()
+		notifyCredentialsChange()
+	}
 }
 
 // GetStoredCredentials returns the stored credentials (if any)
@@ -60,11 +140,8 @@ func GetStoredCredentials() *StoredCredentials {
 	}
 	
 	// Return a copy to avoid external modification
-	return &StoredCredentials{
-		AccessKeyID:     storedCreds.AccessKeyID,
-		SecretAccessKey: storedCreds.SecretAccessKey,
-		Region:          storedCreds.Region,
-	}
+	c := *storedCreds
+	return &c
 }
 
 // HasStoredCredentials returns true if credentials are stored
@@ -74,51 +151,70 @@ func HasStoredCredentials() bool {
 	return storedCreds != nil
 }
 
-// loadStoredCredentialsFromDisk loads credentials from disk file
+// loadStoredCredentialsFromDisk loads credentials from disk file,
+// replacing the stored ones. A plaintext file left by an older agent (or
+// a provisioning tool) is encrypted in place.
 func loadStoredCredentialsFromDisk() {
+	var mtime time.Time
+	if info, err := os.Stat(credentialsFile); err == nil {
+		mtime = info.ModTime()
+	}
+	loaded, legacy := readStoredCredentials()
+	storedCredsLock.Lock()
+	storedCreds = loaded
+	credsFileStamp = mtime
+	if loaded != nil && legacy {
+		if saveStoredCredentialsToDisk(loaded) {
+			log.Printf("encrypted plaintext credentials file %s", credentialsFile)
+		}
+	}
+	storedCredsLock.Unlock()
+}
+
+func readStoredCredentials() (creds *StoredCredentials, legacy bool) {
 	data, err := os.ReadFile(credentialsFile)
 	if err != nil {
 		// File doesn't exist or can't be read - that's okay
-		return
+		return nil, false
 	}
 
-	var creds StoredCredentials
-	if err := json.Unmarshal(data, &creds); err != nil {
-		// Invalid JSON - ignore
-		return
+	creds, legacy, err = decodeCredentialsFile(data)
+	if err != nil {
+		log.Printf("WARNING: ignoring stored credentials in %s: %v", credentialsFile, err)
+		return nil, false
 	}
 
-	// Only load if both required fields are present
-	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
-		storedCredsLock.Lock()
-		storedCreds = &creds
-		storedCredsLock.Unlock()
+	// Only load if keys or a role are present
+	if !creds.usable() {
+		return nil, false
 	}
+	return creds, legacy
 }
 
-// saveStoredCredentialsToDisk saves credentials to disk file
-func saveStoredCredentialsToDisk(creds *StoredCredentials) {
-	// Ensure directory exists
-	dir := filepath.Dir(credentialsFile)
-	if err := os.MkdirAll(dir, 0750); err != nil {
-		// Log error but don't fail - credentials still work in memory
-		return
+// saveStoredCredentialsToDisk encrypts credentials to disk file and
+// reports whether they were written
+func saveStoredCredentialsToDisk(creds *StoredCredentials) bool {
+	key, keyID, err := credentialsKey(secretKeyFile, true)
+	if err == nil {
+		var data []byte
+		if data, err = sealCredentials(creds, key, keyID); err == nil {
+			err = writeFileAtomic(credentialsFile, data)
+		}
 	}
-
-	data, err := json.Marshal(creds)
 	if err != nil {
-		return
-	}
-
-	// Write with restricted permissions (owner read/write only)
-	if err := os.WriteFile(credentialsFile, data, 0600); err != nil {
 		// Log error but don't fail - credentials still work in memory
-		return
+		log.Printf("WARNING: stored credentials kept in memory only: %v", err)
+		return false
+	}
+	if info, err := os.Stat(credentialsFile); err == nil {
+		credsFileStamp = info.ModTime()
 	}
+	return true
 }
 
 // removeStoredCredentialsFromDisk removes the credentials file from disk
 func removeStoredCredentialsFromDisk() {
 	os.Remove(credentialsFile)
+	credsFileStamp = time.Time{}
 }
 
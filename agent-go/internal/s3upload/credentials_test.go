@@ -0,0 +1,36 @@
+package s3upload
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCredentialsChangeCoalesces(t *testing.T) {
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	OnCredentialsChange(func() {
+		if runs.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+	})
+
+	notifyCredentialsChange()
+	<-started
+	// changes during a run collapse into a single follow-up run
+	for i := 0; i < 5; i++ {
+		notifyCredentialsChange()
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runs.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := runs.Load(); n != 2 {
+		t.Fatalf("listener ran %d times, want 2", n)
+	}
+}
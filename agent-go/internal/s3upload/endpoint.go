@@ -0,0 +1,121 @@
+package s3upload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3-compatible services (MinIO, Wasabi, Cloudflare R2, Ceph RGW) are
+// reached through Options.Endpoint. Most of them want path-style
+// addressing unless wildcard DNS is set up for the bucket host names, and
+// on-prem ones often use a private CA.
+
+func (o Options) bucket() string {
+	if b := strings.TrimSpace(o.Bucket); b != "" {
+		return b
+	}
+	return DefaultBucket
+}
+
+// prefix is Prefix as a key prefix: no leading slash, one trailing slash.
+func (o Options) prefix() string {
+	p := strings.Trim(strings.TrimSpace(o.Prefix), "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// endpointName is the endpoint for logs and validation results.
+func (o Options) endpointName() string {
+	if o.Endpoint == "" {
+		return "aws"
+	}
+	return o.Endpoint
+}
+
+// defaultRegion is the region when neither the options, the stored
+// credentials nor the environment name one. Outside AWS there is no
+// instance metadata to ask, and S3-compatible services accept us-east-1.
+func (o Options) defaultRegion(ctx context.Context) string {
+	if o.Endpoint != "" {
+		return "us-east-1"
+	}
+	return getRegionFromEC2Metadata(ctx)
+}
+
+// newS3Client builds the S3 client for cfg with the endpoint, addressing
+// and TLS settings of o.
+func newS3Client(cfg aws.Config, o Options) (*s3.Client, error) {
+	if o.Endpoint != "" {
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q: want http(s)://host[:port]", o.Endpoint)
+		}
+	}
+	tlsCfg, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(so *s3.Options) {
+		if o.Endpoint != "" {
+			so.BaseEndpoint = aws.String(strings.TrimRight(o.Endpoint, "/"))
+		}
+		so.UsePathStyle = o.PathStyle
+		if tlsCfg != nil {
+			so.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+				tr.TLSClientConfig = tlsCfg
+			})
+		}
+	}), nil
+}
+
+// tlsConfig returns nil when the SDK defaults apply.
+func (o Options) tlsConfig() (*tls.Config, error) {
+	if o.CAFile == "" && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read S3 CA file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("S3 CA file %s has no PEM certificates", o.CAFile)
+		}
+		cfg.RootCAs = roots
+	}
+	return cfg, nil
+}
+
+// createBucketInput creates bucket in region. us-east-1 is the default
+// and must not be sent as a location constraint.
+func createBucketInput(bucket, region string) (*s3.CreateBucketInput, error) {
+	in := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	if region == "us-east-1" {
+		return in, nil
+	}
+	if len(region) == 0 || len(region) >= 20 {
+		return nil, fmt.Errorf("invalid AWS region: %s", region)
+	}
+	in.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+		LocationConstraint: types.BucketLocationConstraint(region),
+	}
+	return in, nil
+}
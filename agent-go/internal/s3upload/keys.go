@@ -0,0 +1,188 @@
+package s3upload
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultKeyTemplate is the original flat layout, one prefix per machine.
+const DefaultKeyTemplate = "{machine}/{ts}-{nanos}"
+
+// HiveKeyTemplate partitions objects for Athena/Glue so date-bounded
+// queries only read the hours they ask for.
+const HiveKeyTemplate = "site={site}/env={env}/dt={dt}/hour={hour}/{machine}-{nanos}"
+
+// Key template placeholders. {dt} and {hour} are the UTC hour of the
+// events in the object (batches that straddle hours are split); {ts} and
+// {nanos} are the upload time. The extension (.ndjson, .ndjson.gz, ...)
+// is appended to the rendered key.
+var keyVars = map[string]bool{
+	"site":     true,
+	"env":      true,
+	"instance": true,
+	"machine":  true,
+	"dt":       true,
+	"hour":     true,
+	"ts":       true,
+	"nanos":    true,
+}
+
+// keyTemplate is a parsed S3 key template.
+type keyTemplate struct {
+	text        string
+	parts       []string // literal, placeholder, literal, ... (even = literal)
+	partitioned bool     // uses {dt} or {hour}
+}
+
+func parseKeyTemplate(s string) (*keyTemplate, error) {
+	s = strings.Trim(strings.TrimSpace(s), "/")
+	if s == "" {
+		s = DefaultKeyTemplate
+	}
+	t := &keyTemplate{text: s}
+	rest := s
+	for {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			t.parts = append(t.parts, rest)
+			break
+		}
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("key template %q: unclosed {", s)
+		}
+		name := rest[i+1 : i+j]
+		if !keyVars[name] {
+			return nil, fmt.Errorf("key template %q: unknown placeholder {%s}", s, name)
+		}
+		if name == "dt" || name == "hour" {
+			t.partitioned = true
+		}
+		t.parts = append(t.parts, rest[:i], name)
+		rest = rest[i+j+1:]
+	}
+	if !strings.Contains(s, "{nanos}") {
+		return nil, fmt.Errorf("key template %q: must contain {nanos} so objects do not overwrite each other", s)
+	}
+	return t, nil
+}
+
+// keyValues are the placeholder values for one object.
+type keyValues struct {
+	site, env, instance, machine string
+	hour                         time.Time // event hour, UTC
+	uploaded                     time.Time
+}
+
+func (t *keyTemplate) render(v keyValues) string {
+	var b strings.Builder
+	for i, p := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(p)
+			continue
+		}
+		switch p {
+		case "site":
+			b.WriteString(keySafe(v.site))
+		case "env":
+			b.WriteString(keySafe(v.env))
+		case "instance":
+			b.WriteString(keySafe(v.instance))
+		case "machine":
+			b.WriteString(v.machine)
+		case "dt":
+			b.WriteString(v.hour.Format("2006-01-02"))
+		case "hour":
+			b.WriteString(v.hour.Format("15"))
+		case "ts":
+			b.WriteString(v.uploaded.Format("2006-01-02T15-04-05"))
+		case "nanos":
+			b.WriteString(strconv.FormatInt(v.uploaded.UnixNano(), 10))
+		}
+	}
+	return b.String()
+}
+
+// keySafe keeps a value inside one path segment and out of the k=v
+// syntax Hive uses for partitions.
+func keySafe(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '=', '\\', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Partition is one Hive partition directory of a key template.
+type Partition struct {
+	Column string // e.g. "dt"
+	Var    string // placeholder it is filled from, e.g. "dt"
+}
+
+// KeyPartitions returns the k={var} directories of template in order and
+// the key prefix before the first of them. ok is false when a directory
+// between the partitions is neither a partition nor a fixed literal, so
+// the layout cannot be described by partition projection.
+func KeyPartitions(template string) (prefix string, parts []Partition, ok bool, err error) {
+	t, err := parseKeyTemplate(template)
+	if err != nil {
+		return "", nil, false, err
+	}
+	dirs := strings.Split(t.text, "/")
+	dirs = dirs[:len(dirs)-1] // file name
+	ok = true
+	var lit []string
+	for _, d := range dirs {
+		k, v, isKV := strings.Cut(d, "=")
+		if isKV && strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}") && keyVars[v[1:len(v)-1]] && !strings.ContainsAny(k, "{}") {
+			parts = append(parts, Partition{Column: k, Var: v[1 : len(v)-1]})
+			continue
+		}
+		if len(parts) > 0 || strings.ContainsAny(d, "{}") {
+			ok = false
+			continue
+		}
+		lit = append(lit, d)
+	}
+	if len(lit) > 0 {
+		prefix = strings.Join(lit, "/") + "/"
+	}
+	return prefix, parts, ok && len(parts) > 0, nil
+}
+
+// hourGroup is the events of one UTC hour.
+type hourGroup struct {
+	hour  time.Time
+	lines [][]byte
+}
+
+// splitByHour groups lines by the hour of their "ts"; lines without one
+// go to the current hour.
+func splitByHour(lines [][]byte, now time.Time) []hourGroup {
+	idx := make(map[int64]int)
+	var groups []hourGroup
+	cur := now.UTC().Truncate(time.Hour)
+	for _, l := range lines {
+		h := cur
+		if ts, ok := EventTime(l); ok {
+			h = ts.UTC().Truncate(time.Hour)
+		}
+		i, seen := idx[h.Unix()]
+		if !seen {
+			i = len(groups)
+			idx[h.Unix()] = i
+			groups = append(groups, hourGroup{hour: h})
+		}
+		groups[i].lines = append(groups[i].lines, l)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].hour.Before(groups[j].hour) })
+	return groups
+}
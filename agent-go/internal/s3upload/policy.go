@@ -0,0 +1,451 @@
+package s3upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Bucket encryption settings.
+const (
+	EncryptionSSES3  = "sse-s3"
+	EncryptionSSEKMS = "sse-kms"
+)
+
+// Object lock default retention modes.
+const (
+	RetentionGovernance = "governance"
+	RetentionCompliance = "compliance"
+)
+
+// BucketPolicy is the configuration the archive bucket should have. It is
+// applied when the agent creates the bucket, and to an existing bucket
+// when Enforce is set; otherwise differences are only reported.
+type BucketPolicy struct {
+	Encryption        string // "", EncryptionSSES3 or EncryptionSSEKMS
+	KMSKeyID          string // SSE-KMS key ID, ARN or alias; empty = the aws/s3 key
+	BlockPublicAccess bool
+	Lifecycle         []LifecycleRule
+	ObjectLock        bool   // object lock on the bucket; versioning is turned on with it
+	RetentionMode     string // "", RetentionGovernance or RetentionCompliance
+	RetentionDays     int    // default retention for new objects, with RetentionMode
+	Enforce           bool
+}
+
+// LifecycleRule transitions and expires objects under Prefix. Rules are
+// merged into the bucket's lifecycle by ID, so rules added by others are
+// kept.
+type LifecycleRule struct {
+	ID          string
+	Prefix      string // relative to the bucket, e.g. "agents/"
+	Transitions []Transition
+	ExpireDays  int // 0 = never
+}
+
+// Transition moves objects to StorageClass (e.g. "STANDARD_IA",
+// "GLACIER_IR", "DEEP_ARCHIVE") Days after they were written.
+type Transition struct {
+	Days         int
+	StorageClass string
+}
+
+func (p BucketPolicy) empty() bool {
+	return p.Encryption == "" && !p.BlockPublicAccess && len(p.Lifecycle) == 0 && !p.ObjectLock
+}
+
+// check rejects settings S3 would reject later, at startup.
+func (p BucketPolicy) check() error {
+	switch p.Encryption {
+	case "", EncryptionSSES3:
+		if p.KMSKeyID != "" {
+			return fmt.Errorf("a KMS key is only used with %s encryption", EncryptionSSEKMS)
+		}
+	case EncryptionSSEKMS:
+	default:
+		return fmt.Errorf("unknown S3 encryption %q (%s or %s)", p.Encryption, EncryptionSSES3, EncryptionSSEKMS)
+	}
+	switch p.RetentionMode {
+	case "":
+		if p.RetentionDays != 0 {
+			return fmt.Errorf("retention days need a retention mode (%s or %s)", RetentionGovernance, RetentionCompliance)
+		}
+	case RetentionGovernance, RetentionCompliance:
+		if !p.ObjectLock {
+			return fmt.Errorf("retention needs object lock")
+		}
+		if p.RetentionDays <= 0 {
+			return fmt.Errorf("%s retention needs a number of days", p.RetentionMode)
+		}
+	default:
+		return fmt.Errorf("unknown retention mode %q (%s or %s)", p.RetentionMode, RetentionGovernance, RetentionCompliance)
+	}
+	seen := make(map[string]bool)
+	for _, r := range p.Lifecycle {
+		id := r.id()
+		if seen[id] {
+			return fmt.Errorf("duplicate lifecycle rule %q", id)
+		}
+		seen[id] = true
+		if len(r.Transitions) == 0 && r.ExpireDays <= 0 {
+			return fmt.Errorf("lifecycle rule %q has neither transitions nor expiry", id)
+		}
+		for _, t := range r.Transitions {
+			if t.Days < 0 || t.StorageClass == "" {
+				return fmt.Errorf("lifecycle rule %q: transitions need days and a storage class", id)
+			}
+		}
+	}
+	return nil
+}
+
+func (r LifecycleRule) id() string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return "jetcamer:" + r.Prefix
+}
+
+// sseAlgorithm is the x-amz-server-side-encryption value for Encryption.
+func (p BucketPolicy) sseAlgorithm() types.ServerSideEncryption {
+	switch p.Encryption {
+	case EncryptionSSES3:
+		return types.ServerSideEncryptionAes256
+	case EncryptionSSEKMS:
+		return types.ServerSideEncryptionAwsKms
+	}
+	return ""
+}
+
+// applyObjectEncryption asks for Encryption on each upload, so objects are
+// encrypted as configured even if the bucket default drifts.
+func (p BucketPolicy) applyObjectEncryption(in *s3.PutObjectInput) {
+	alg := p.sseAlgorithm()
+	if alg == "" {
+		return
+	}
+	in.ServerSideEncryption = alg
+	if alg == types.ServerSideEncryptionAwsKms {
+		if p.KMSKeyID != "" {
+			in.SSEKMSKeyId = aws.String(p.KMSKeyID)
+		}
+		in.BucketKeyEnabled = aws.Bool(true)
+	}
+}
+
+// applyCreate enables object lock at creation, which also turns on
+// versioning.
+func (p BucketPolicy) applyCreate(in *s3.CreateBucketInput) {
+	if p.ObjectLock {
+		in.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+}
+
+// applyObjectLock sends a checksum with each upload: S3 rejects puts to a
+// locked bucket without one.
+func (p BucketPolicy) applyObjectLock(in *s3.PutObjectInput) {
+	if p.ObjectLock {
+		in.ChecksumAlgorithm = types.ChecksumAlgorithmCrc32
+	}
+}
+
+// objectLockConfig is the object lock configuration p asks for.
+func (p BucketPolicy) objectLockConfig() *types.ObjectLockConfiguration {
+	c := &types.ObjectLockConfiguration{ObjectLockEnabled: types.ObjectLockEnabledEnabled}
+	if p.RetentionMode != "" {
+		c.Rule = &types.ObjectLockRule{DefaultRetention: &types.DefaultRetention{
+			Mode: types.ObjectLockRetentionMode(strings.ToUpper(p.RetentionMode)),
+			Days: aws.Int32(int32(p.RetentionDays)),
+		}}
+	}
+	return c
+}
+
+// objectLockDrift lists how have, nil when object lock is off, differs
+// from p. Without a configured mode, any default retention is kept.
+func (p BucketPolicy) objectLockDrift(have *types.ObjectLockConfiguration) []string {
+	if have == nil || have.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		return []string{"object lock is not enabled"}
+	}
+	if p.RetentionMode == "" {
+		return nil
+	}
+	var mode types.ObjectLockRetentionMode
+	var days, years int32
+	if have.Rule != nil && have.Rule.DefaultRetention != nil {
+		mode = have.Rule.DefaultRetention.Mode
+		days = aws.ToInt32(have.Rule.DefaultRetention.Days)
+		years = aws.ToInt32(have.Rule.DefaultRetention.Years)
+	}
+	want := types.ObjectLockRetentionMode(strings.ToUpper(p.RetentionMode))
+	switch {
+	case mode != want:
+		return []string{fmt.Sprintf("default retention mode: %q, want %q", mode, want)}
+	case years != 0 || days != int32(p.RetentionDays):
+		return []string{fmt.Sprintf("default retention: %d days %d years, want %d days", days, years, p.RetentionDays)}
+	}
+	return nil
+}
+
+// bucketDrift lists how bucket differs from p. An error means the
+// configuration could not be read at all.
+func bucketDrift(ctx context.Context, client *s3.Client, bucket string, p BucketPolicy) ([]string, error) {
+	var drift []string
+
+	if want := p.sseAlgorithm(); want != "" {
+		out, err := client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: aws.String(bucket)})
+		var def *types.ServerSideEncryptionByDefault
+		if err == nil && out.ServerSideEncryptionConfiguration != nil && len(out.ServerSideEncryptionConfiguration.Rules) > 0 {
+			def = out.ServerSideEncryptionConfiguration.Rules[0].ApplyServerSideEncryptionByDefault
+		} else if err != nil && !isAPIError(err, "ServerSideEncryptionConfigurationNotFoundError") {
+			return nil, fmt.Errorf("failed to read bucket encryption: %w", err)
+		}
+		switch {
+		case def == nil:
+			drift = append(drift, fmt.Sprintf("default encryption: none, want %s", p.Encryption))
+		case def.SSEAlgorithm != want:
+			drift = append(drift, fmt.Sprintf("default encryption: %s, want %s", def.SSEAlgorithm, want))
+		case p.KMSKeyID != "" && !sameKMSKey(aws.ToString(def.KMSMasterKeyID), p.KMSKeyID):
+			drift = append(drift, fmt.Sprintf("default KMS key: %q, want %q", aws.ToString(def.KMSMasterKeyID), p.KMSKeyID))
+		}
+	}
+
+	if p.BlockPublicAccess {
+		out, err := client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: aws.String(bucket)})
+		if err != nil && !isAPIError(err, "NoSuchPublicAccessBlockConfiguration") {
+			return nil, fmt.Errorf("failed to read public access block: %w", err)
+		}
+		if err != nil || !allBlocked(out.PublicAccessBlockConfiguration) {
+			drift = append(drift, "public access is not fully blocked")
+		}
+	}
+
+	if p.ObjectLock {
+		have, err := objectLockConfiguration(ctx, client, bucket)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, p.objectLockDrift(have)...)
+	}
+
+	if len(p.Lifecycle) > 0 {
+		have, err := lifecycleRules(ctx, client, bucket)
+		if err != nil {
+			return nil, err
+		}
+		byID := make(map[string]types.LifecycleRule)
+		for _, r := range have {
+			byID[aws.ToString(r.ID)] = r
+		}
+		for _, want := range p.Lifecycle {
+			got, ok := byID[want.id()]
+			if !ok {
+				drift = append(drift, fmt.Sprintf("lifecycle rule %q is missing", want.id()))
+			} else if !sameLifecycleRule(got, want.sdkRule()) {
+				drift = append(drift, fmt.Sprintf("lifecycle rule %q differs from the configured one", want.id()))
+			}
+		}
+	}
+	return drift, nil
+}
+
+// applyBucketPolicy puts every part of p on bucket.
+func applyBucketPolicy(ctx context.Context, client *s3.Client, bucket string, p BucketPolicy) error {
+	if alg := p.sseAlgorithm(); alg != "" {
+		def := &types.ServerSideEncryptionByDefault{SSEAlgorithm: alg}
+		rule := types.ServerSideEncryptionRule{ApplyServerSideEncryptionByDefault: def}
+		if alg == types.ServerSideEncryptionAwsKms {
+			if p.KMSKeyID != "" {
+				def.KMSMasterKeyID = aws.String(p.KMSKeyID)
+			}
+			rule.BucketKeyEnabled = aws.Bool(true)
+		}
+		_, err := client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: aws.String(bucket),
+			ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{
+				Rules: []types.ServerSideEncryptionRule{rule},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set default encryption: %w", err)
+		}
+	}
+
+	if p.BlockPublicAccess {
+		_, err := client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+			Bucket: aws.String(bucket),
+			PublicAccessBlockConfiguration: &types.PublicAccessBlockConfiguration{
+				BlockPublicAcls:       aws.Bool(true),
+				BlockPublicPolicy:     aws.Bool(true),
+				IgnorePublicAcls:      aws.Bool(true),
+				RestrictPublicBuckets: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to block public access: %w", err)
+		}
+	}
+
+	if len(p.Lifecycle) > 0 {
+		have, err := lifecycleRules(ctx, client, bucket)
+		if err != nil {
+			return err
+		}
+		ours := make(map[string]bool)
+		var rules []types.LifecycleRule
+		for _, r := range p.Lifecycle {
+			ours[r.id()] = true
+			rules = append(rules, r.sdkRule())
+		}
+		for _, r := range have {
+			if !ours[aws.ToString(r.ID)] {
+				rules = append(rules, r)
+			}
+		}
+		_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 aws.String(bucket),
+			LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set lifecycle rules: %w", err)
+		}
+	}
+
+	if p.ObjectLock {
+		have, err := objectLockConfiguration(ctx, client, bucket)
+		if err != nil {
+			return err
+		}
+		if p.objectLockDrift(have) == nil {
+			return nil
+		}
+		// an existing bucket can only be locked once versioning is on
+		_, err = client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  aws.String(bucket),
+			VersioningConfiguration: &types.VersioningConfiguration{Status: types.BucketVersioningStatusEnabled},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning: %w", err)
+		}
+		_, err = client.PutObjectLockConfiguration(ctx, &s3.PutObjectLockConfigurationInput{
+			Bucket:                  aws.String(bucket),
+			ObjectLockConfiguration: p.objectLockConfig(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set object lock: %w", err)
+		}
+	}
+	return nil
+}
+
+// enforceBucketPolicy is run by ensureBucket on a bucket that already
+// existed: drift is logged, and fixed when p.Enforce is set.
+func enforceBucketPolicy(ctx context.Context, client *s3.Client, bucket string, p BucketPolicy) error {
+	drift, err := bucketDrift(ctx, client, bucket, p)
+	if err != nil {
+		log.Printf("bucket %s: cannot check configuration: %v", bucket, err)
+		return nil
+	}
+	if len(drift) == 0 {
+		return nil
+	}
+	if !p.Enforce {
+		for _, d := range drift {
+			log.Printf("WARNING: bucket %s drift: %s", bucket, d)
+		}
+		return nil
+	}
+	log.Printf("bucket %s: fixing drift (%s)", bucket, strings.Join(drift, "; "))
+	return applyBucketPolicy(ctx, client, bucket, p)
+}
+
+// objectLockConfiguration reads the bucket's object lock configuration,
+// nil when it has none.
+func objectLockConfiguration(ctx context.Context, client *s3.Client, bucket string) (*types.ObjectLockConfiguration, error) {
+	out, err := client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		if isAPIError(err, "ObjectLockConfigurationNotFoundError") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read object lock configuration: %w", err)
+	}
+	return out.ObjectLockConfiguration, nil
+}
+
+func lifecycleRules(ctx context.Context, client *s3.Client, bucket string) ([]types.LifecycleRule, error) {
+	out, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		if isAPIError(err, "NoSuchLifecycleConfiguration") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read lifecycle rules: %w", err)
+	}
+	return out.Rules, nil
+}
+
+func (r LifecycleRule) sdkRule() types.LifecycleRule {
+	rule := types.LifecycleRule{
+		ID:     aws.String(r.id()),
+		Status: types.ExpirationStatusEnabled,
+		Filter: &types.LifecycleRuleFilter{Prefix: aws.String(r.Prefix)},
+	}
+	for _, t := range r.Transitions {
+		rule.Transitions = append(rule.Transitions, types.Transition{
+			Days:         aws.Int32(int32(t.Days)),
+			StorageClass: types.TransitionStorageClass(strings.ToUpper(t.StorageClass)),
+		})
+	}
+	if r.ExpireDays > 0 {
+		rule.Expiration = &types.LifecycleExpiration{Days: aws.Int32(int32(r.ExpireDays))}
+	}
+	return rule
+}
+
+func sameLifecycleRule(a, b types.LifecycleRule) bool {
+	if a.Status != b.Status || rulePrefix(a) != rulePrefix(b) || len(a.Transitions) != len(b.Transitions) {
+		return false
+	}
+	for i := range a.Transitions {
+		if aws.ToInt32(a.Transitions[i].Days) != aws.ToInt32(b.Transitions[i].Days) ||
+			a.Transitions[i].StorageClass != b.Transitions[i].StorageClass {
+			return false
+		}
+	}
+	var ae, be int32
+	if a.Expiration != nil {
+		ae = aws.ToInt32(a.Expiration.Days)
+	}
+	if b.Expiration != nil {
+		be = aws.ToInt32(b.Expiration.Days)
+	}
+	return ae == be
+}
+
+func rulePrefix(r types.LifecycleRule) string {
+	if r.Filter != nil && r.Filter.Prefix != nil {
+		return *r.Filter.Prefix
+	}
+	return aws.ToString(r.Prefix)
+}
+
+func allBlocked(c *types.PublicAccessBlockConfiguration) bool {
+	return c != nil && aws.ToBool(c.BlockPublicAcls) && aws.ToBool(c.BlockPublicPolicy) &&
+		aws.ToBool(c.IgnorePublicAcls) && aws.ToBool(c.RestrictPublicBuckets)
+}
+
+// sameKMSKey compares a bucket's key, usually an ARN, with the configured
+// ID, ARN or alias.
+func sameKMSKey(have, want string) bool {
+	return have == want || strings.HasSuffix(have, "/"+want) || strings.HasSuffix(have, ":"+want)
+}
+
+func isAPIError(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
@@ -0,0 +1,103 @@
+package s3upload
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestBucketPolicyCheckRetention(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy BucketPolicy
+		err    string
+	}{
+		{"lock only", BucketPolicy{ObjectLock: true}, ""},
+		{"governance", BucketPolicy{ObjectLock: true, RetentionMode: RetentionGovernance, RetentionDays: 30}, ""},
+		{"compliance", BucketPolicy{ObjectLock: true, RetentionMode: RetentionCompliance, RetentionDays: 365}, ""},
+		{"mode without lock", BucketPolicy{RetentionMode: RetentionGovernance, RetentionDays: 30}, "needs object lock"},
+		{"mode without days", BucketPolicy{ObjectLock: true, RetentionMode: RetentionCompliance}, "number of days"},
+		{"days without mode", BucketPolicy{ObjectLock: true, RetentionDays: 30}, "need a retention mode"},
+		{"unknown mode", BucketPolicy{ObjectLock: true, RetentionMode: "legal-hold", RetentionDays: 30}, "unknown retention mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("check() = %v, want nil", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("check() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	if (BucketPolicy{ObjectLock: true}).empty() {
+		t.Fatal("a policy with object lock is empty")
+	}
+}
+
+func TestObjectLockDrift(t *testing.T) {
+	p := BucketPolicy{ObjectLock: true, RetentionMode: RetentionCompliance, RetentionDays: 90}
+	retained := func(mode types.ObjectLockRetentionMode, days, years int32) *types.ObjectLockConfiguration {
+		r := &types.DefaultRetention{Mode: mode}
+		if days > 0 {
+			r.Days = aws.Int32(days)
+		}
+		if years > 0 {
+			r.Years = aws.Int32(years)
+		}
+		return &types.ObjectLockConfiguration{
+			ObjectLockEnabled: types.ObjectLockEnabledEnabled,
+			Rule:              &types.ObjectLockRule{DefaultRetention: r},
+		}
+	}
+	tests := []struct {
+		name  string
+		have  *types.ObjectLockConfiguration
+		drift string
+	}{
+		{"matches", p.objectLockConfig(), ""},
+		{"not locked", nil, "object lock is not enabled"},
+		{"no default retention", &types.ObjectLockConfiguration{ObjectLockEnabled: types.ObjectLockEnabledEnabled}, "retention mode"},
+		{"other mode", retained(types.ObjectLockRetentionModeGovernance, 90, 0), "retention mode"},
+		{"other days", retained(types.ObjectLockRetentionModeCompliance, 30, 0), "want 90 days"},
+		{"years", retained(types.ObjectLockRetentionModeCompliance, 0, 1), "want 90 days"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drift := strings.Join(p.objectLockDrift(tt.have), "; ")
+			if tt.drift == "" && drift != "" || !strings.Contains(drift, tt.drift) {
+				t.Fatalf("drift = %q, want %q", drift, tt.drift)
+			}
+		})
+	}
+
+	// lock without a mode keeps an operator's default retention
+	lockOnly := BucketPolicy{ObjectLock: true}
+	if d := lockOnly.objectLockDrift(retained(types.ObjectLockRetentionModeGovernance, 7, 0)); d != nil {
+		t.Fatalf("drift = %v, want none", d)
+	}
+}
+
+func TestObjectLockRequestSettings(t *testing.T) {
+	p := BucketPolicy{ObjectLock: true}
+	create := &s3.CreateBucketInput{}
+	p.applyCreate(create)
+	if !aws.ToBool(create.ObjectLockEnabledForBucket) {
+		t.Fatal("bucket not created with object lock")
+	}
+	put := &s3.PutObjectInput{}
+	p.applyObjectLock(put)
+	if put.ChecksumAlgorithm == "" {
+		t.Fatal("upload to a locked bucket has no checksum")
+	}
+
+	put = &s3.PutObjectInput{}
+	BucketPolicy{}.applyObjectLock(put)
+	if put.ChecksumAlgorithm != "" {
+		t.Fatal("checksum forced without object lock")
+	}
+}
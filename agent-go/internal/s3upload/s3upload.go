@@ -11,95 +11,77 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-const (
-	bucketName = "cyber-agent-logs"
-	machineIDPath = "/etc/machine-id"
-)
+const DefaultBucket = "cyber-agent-logs"
+
+// machineIDPath is a variable so tests can point it elsewhere
+var machineIDPath = "/etc/machine-id"
 
 type S3Uploader struct {
+	opts      Options
+	mu        sync.RWMutex // guards client, replaced by Reload
 	client    *s3.Client
 	machineID string
 	bucketName string
+	prefix    string
 	region    string
+	compression string
+	keys      *keyTemplate
+	policy    BucketPolicy
+	site      string
+	env       string
+	instance  string
 }
 
-// NewS3Uploader creates a new S3 uploader instance
-func NewS3Uploader(ctx context.Context) (*S3Uploader, error) {
-	var cfg aws.Config
-	var err error
-	var region string
-
-	// Check if stored credentials are available (first priority)
-	storedCreds := GetStoredCredentials()
-	if storedCreds != nil {
-		// Use stored credentials
-		region = storedCreds.Region
-		if region == "" {
-			// Try to get region from EC2 if not provided
-			region = getRegionFromEC2Metadata(ctx)
-		}
-		if region == "" {
-			return nil, fmt.Errorf("AWS region is required when using stored credentials")
-		}
-		
-		// Create config with static credentials
-		cfg, err = config.LoadDefaultConfig(ctx,
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				storedCreds.AccessKeyID,
-				storedCreds.SecretAccessKey,
-				"",
-			)),
-			config.WithRegion(region),
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load AWS config with stored credentials: %w", err)
-		}
-		log.Printf("S3 uploader using stored AWS credentials with region: %s", region)
-	} else {
-		// Use default credential chain
-		cfg, err = config.LoadDefaultConfig(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load AWS config: %w", err)
-		}
+// Options are the agent settings that shape uploaded objects.
+type Options struct {
+	Compression string // "gzip" (default), "zstd" or "none"
+	KeyTemplate string // see keys.go; empty = DefaultKeyTemplate
+	Site        string // {site}
+	Env         string // {env}
+	InstanceID  string // {instance}
+
+	// Destination; see endpoint.go
+	Bucket             string // default DefaultBucket
+	Prefix             string // prepended to every key
+	Region             string // overrides the detected region
+	Endpoint           string // S3-compatible service (MinIO, Wasabi, R2, Ceph); empty = AWS
+	PathStyle          bool   // address the bucket in the path, not the host name
+	CAFile             string // PEM bundle trusted in addition to the system roots
+	InsecureSkipVerify bool   // accept any certificate (testing only)
+
+	Policy BucketPolicy // encryption, public access, lifecycle and object lock; see policy.go
+	Role   Role         // assumed for every request; see awsconfig.go
+}
 
-		// Get region from config
-		region = cfg.Region
-		if region == "" {
-			// Try to get from environment
-			if envRegion := os.Getenv("AWS_REGION"); envRegion != "" {
-				region = envRegion
-			} else if envRegion := os.Getenv("AWS_DEFAULT_REGION"); envRegion != "" {
-				region = envRegion
-			} else {
-				// Try to get region from EC2 instance metadata
-				region = getRegionFromEC2Metadata(ctx)
-			}
-		}
-		
-		// If region is still empty, set it in config
-		if region != "" && cfg.Region == "" {
-			cfg.Region = region
-		}
+// NewS3Uploader creates a new S3 uploader instance
+func NewS3Uploader(ctx context.Context, opts Options) (*S3Uploader, error) {
+	compression, err := parseCompression(opts.Compression)
+	if err != nil {
+		return nil, err
 	}
-	
-	// Validate region format (basic check)
-	if region == "" {
-		return nil, fmt.Errorf("AWS region is not configured. Set AWS_REGION environment variable or configure AWS credentials file")
+	keys, err := parseKeyTemplate(opts.KeyTemplate)
+	if err != nil {
+		return nil, err
 	}
-	if len(region) > 20 {
-		return nil, fmt.Errorf("invalid AWS region format: %q (must be 1-20 characters)", region)
+	if err := opts.Policy.check(); err != nil {
+		return nil, err
+	}
+	if err := opts.Role.check(); err != nil {
+		return nil, err
+	}
+
+	client, region, err := connect(ctx, opts)
+	if err != nil {
+		return nil, err
 	}
-	
-	log.Printf("S3 uploader using AWS region: %s", region)
 
 	// Read machine-id
 	machineID, err := readMachineID()
@@ -108,10 +90,18 @@ func NewS3Uploader(ctx context.Context) (*S3Uploader, error) {
 	}
 
 	uploader := &S3Uploader{
-		client:    s3.NewFromConfig(cfg),
+		opts:      opts,
+		client:    client,
 		machineID: machineID,
-		bucketName: bucketName,
+		bucketName: opts.bucket(),
+		prefix:    opts.prefix(),
 		region:    region,
+		compression: compression,
+		keys:      keys,
+		policy:    opts.Policy,
+		site:      opts.Site,
+		env:       opts.Env,
+		instance:  opts.InstanceID,
 	}
 
 	// Ensure bucket exists
@@ -119,10 +109,63 @@ func NewS3Uploader(ctx context.Context) (*S3Uploader, error) {
 		return nil, fmt.Errorf("failed to ensure bucket exists: %w", err)
 	}
 
-	log.Printf("S3 uploader initialized: bucket=%s machine-id=%s", bucketName, machineID)
+	log.Printf("S3 uploader initialized: bucket=%s prefix=%q endpoint=%s machine-id=%s compression=%s keys=%s",
+		uploader.bucketName, uploader.prefix, opts.endpointName(), machineID, compression, keys.text)
 	return uploader, nil
 }
 
+// connect resolves credentials and region for opts and builds the S3
+// client.
+func connect(ctx context.Context, opts Options) (*s3.Client, string, error) {
+	cfg, err := LoadAWSConfig(ctx, opts.Role, opts.Region)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	region := cfg.Region
+	if region == "" {
+		// Try to get region from EC2 instance metadata
+		region = opts.defaultRegion(ctx)
+		cfg.Region = region
+	}
+
+	// Validate region format (basic check)
+	if region == "" {
+		return nil, "", fmt.Errorf("AWS region is not configured. Set AWS_REGION environment variable or configure AWS credentials file")
+	}
+	if len(region) > 20 {
+		return nil, "", fmt.Errorf("invalid AWS region format: %q (must be 1-20 characters)", region)
+	}
+	log.Printf("S3 uploader using %s with region: %s", credentialSource(opts.Role), region)
+
+	client, err := newS3Client(cfg, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, region, nil
+}
+
+// Reload rebuilds the S3 client from the current credentials, e.g. after
+// /internal/set-aws-config stored new ones. Uploads in flight finish with
+// the old client.
+func (u *S3Uploader) Reload(ctx context.Context) error {
+	client, region, err := connect(ctx, u.opts)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.client = client
+	u.region = region
+	u.mu.Unlock()
+	log.Printf("S3 uploader reloaded credentials (region %s)", region)
+	return nil
+}
+
+func (u *S3Uploader) s3Client() *s3.Client {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.client
+}
+
 // readMachineID reads the machine-id from /etc/machine-id
 func readMachineID() (string, error) {
 	data, err := os.ReadFile(machineIDPath)
@@ -143,53 +186,49 @@ func GetMachineID() (string, error) {
 
 // ensureBucket creates the bucket if it doesn't exist
 func (u *S3Uploader) ensureBucket(ctx context.Context) error {
+	client := u.s3Client()
 	// Check if bucket exists
-	_, err := u.client.HeadBucket(ctx, &s3.HeadBucketInput{
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(u.bucketName),
 	})
 	if err == nil {
 		// Bucket exists
-		return nil
+		return enforceBucketPolicy(ctx, client, u.bucketName, u.policy)
 	}
 
 	// Try to create the bucket
 	log.Printf("bucket %s does not exist, creating in region %s...", u.bucketName, u.region)
 
-	createInput := &s3.CreateBucketInput{
-		Bucket: aws.String(u.bucketName),
-	}
-
-	// Set location constraint for regions other than us-east-1
-	// us-east-1 is the default region and doesn't need a location constraint
-	if u.region != "us-east-1" {
-		// Validate region is a valid AWS region format
-		if len(u.region) > 0 && len(u.region) < 20 {
-			createInput.CreateBucketConfiguration = &types.CreateBucketConfiguration{
-				LocationConstraint: types.BucketLocationConstraint(u.region),
-			}
-		} else {
-			return fmt.Errorf("invalid AWS region: %s", u.region)
-		}
+	createInput, err := createBucketInput(u.bucketName, u.region)
+	if err != nil {
+		return err
 	}
+	u.policy.applyCreate(createInput)
 
-	_, err = u.client.CreateBucket(ctx, createInput)
+	_, err = client.CreateBucket(ctx, createInput)
 	if err != nil {
 		// Check if bucket was created by another process (race condition)
 		var bucketAlreadyOwnedByYou *types.BucketAlreadyOwnedByYou
 		if errors.As(err, &bucketAlreadyOwnedByYou) {
 			log.Printf("bucket %s already exists (created by another process)", u.bucketName)
-			return nil
+			return enforceBucketPolicy(ctx, client, u.bucketName, u.policy)
 		}
 		// Check for other "already exists" errors
 		if strings.Contains(err.Error(), "BucketAlreadyOwnedByYou") || 
 		   strings.Contains(err.Error(), "BucketAlreadyExists") {
 			log.Printf("bucket %s already exists", u.bucketName)
-			return nil
+			return enforceBucketPolicy(ctx, client, u.bucketName, u.policy)
 		}
 		return fmt.Errorf("failed to create bucket: %w", err)
 	}
 
 	log.Printf("bucket %s created successfully", u.bucketName)
+	if !u.policy.empty() {
+		if err := applyBucketPolicy(ctx, client, u.bucketName, u.policy); err != nil {
+			return err
+		}
+		log.Printf("bucket %s: encryption, public access block, lifecycle rules and object lock applied", u.bucketName)
+	}
 	return nil
 }
 
@@ -199,62 +238,202 @@ func (u *S3Uploader) UploadBatch(ctx context.Context, events []interface{}) erro
 		return nil
 	}
 
-	// Convert events to NDJSON format
-	var ndjsonBuilder strings.Builder
+	// Convert events to NDJSON lines
+	lines := make([][]byte, 0, len(events))
 	for _, event := range events {
 		jsonBytes, err := json.Marshal(event)
 		if err != nil {
 			log.Printf("failed to marshal event: %v", err)
 			continue
 		}
-		ndjsonBuilder.Write(jsonBytes)
-		ndjsonBuilder.WriteString("\n")
+		lines = append(lines, jsonBytes)
 	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return u.putLines(ctx, lines)
+}
 
-	ndjsonData := ndjsonBuilder.String()
-	if ndjsonData == "" {
+// UploadNDJSON uploads raw NDJSON data to S3
+func (u *S3Uploader) UploadNDJSON(ctx context.Context, data io.Reader, size int64) error {
+	var buf bytes.Buffer
+	if size > 0 {
+		buf.Grow(int(size))
+	}
+	if _, err := buf.ReadFrom(data); err != nil {
+		return fmt.Errorf("failed to read NDJSON: %w", err)
+	}
+	var lines [][]byte
+	for _, l := range bytes.Split(buf.Bytes(), []byte{'\n'}) {
+		if len(bytes.TrimSpace(l)) > 0 {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
 		return nil
 	}
+	return u.putLines(ctx, lines)
+}
 
-	// Generate S3 key: cyber-agent-logs/machine-id/timestamp-{random}.ndjson
-	timestamp := time.Now().Format("2006-01-02T15-04-05")
-	key := fmt.Sprintf("%s/%s-%d.ndjson", u.machineID, timestamp, time.Now().UnixNano())
+// Name identifies the uploader as a batch sink.
+func (u *S3Uploader) Name() string {
+	return "s3"
+}
 
-	// Upload to S3
-	_, err := u.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(u.bucketName),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader([]byte(ndjsonData)),
-		ContentType: aws.String("application/x-ndjson"),
-	})
+// WriteBatch uploads already-encoded events, one JSON object each, as one
+// NDJSON object. Uncompressed, the lines are streamed into the request
+// body as they are, without decoding or copying them.
+func (u *S3Uploader) WriteBatch(ctx context.Context, events [][]byte) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return u.putLines(ctx, events)
+}
 
+// putLines uploads lines as one object, or one per UTC hour when the key
+// template is partitioned by {dt}/{hour}.
+func (u *S3Uploader) putLines(ctx context.Context, lines [][]byte) error {
+	now := time.Now()
+	if !u.keys.partitioned {
+		return u.putObject(ctx, lines, now.UTC().Truncate(time.Hour))
+	}
+	for _, g := range splitByHour(lines, now) {
+		if err := u.putObject(ctx, g.lines, g.hour); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putObject uploads lines as .ndjson[.gz|.zst], with Content-Encoding set
+// for compressed bodies and the event count, time range and agent version
+// as metadata.
+func (u *S3Uploader) putObject(ctx context.Context, lines [][]byte, hour time.Time) error {
+	c := codecs[u.compression]
+	body, size, err := encodeLines(u.compression, lines)
 	if err != nil {
+		return fmt.Errorf("failed to compress batch: %w", err)
+	}
+	return u.UploadObject(ctx, Object{
+		Hour:            hour,
+		Ext:             ".ndjson" + c.suffix,
+		ContentType:     "application/x-ndjson",
+		ContentEncoding: c.encoding,
+		Body:            body,
+		Size:            size,
+		Events:          len(lines),
+		Metadata:        batchMetadata(lines),
+	})
+}
+
+// Object is a finished file to store under the key template.
+type Object struct {
+	Hour            time.Time // {dt}/{hour}
+	Ext             string    // appended to the rendered key, e.g. ".parquet"
+	ContentType     string
+	ContentEncoding string
+	Body            io.ReadSeeker
+	Size            int64
+	Events          int
+	Metadata        map[string]string // x-amz-meta-*
+}
+
+// UploadObject stores obj under the rendered key template.
+func (u *S3Uploader) UploadObject(ctx context.Context, obj Object) error {
+	key := u.keys.render(keyValues{
+		site:     u.site,
+		env:      u.env,
+		instance: u.instance,
+		machine:  u.machineID,
+		hour:     obj.Hour,
+		uploaded: time.Now(),
+	})
+	key = u.prefix + key + obj.Ext
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(u.bucketName),
+		Key:           aws.String(key),
+		Body:          obj.Body,
+		ContentLength: aws.Int64(obj.Size),
+		ContentType:   aws.String(obj.ContentType),
+		Metadata:      obj.Metadata,
+	}
+	if obj.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(obj.ContentEncoding)
+	}
+	u.policy.applyObjectEncryption(input)
+	u.policy.applyObjectLock(input)
+	if _, err := u.s3Client().PutObject(ctx, input); err != nil {
 		return fmt.Errorf("failed to upload to S3: %w", err)
 	}
 
-	log.Printf("✓ uploaded batch to S3: s3://%s/%s (%d events, %d bytes)", 
-		u.bucketName, key, len(events), len(ndjsonData))
+	log.Printf("✓ uploaded batch to S3: s3://%s/%s (%d events, %d bytes)",
+		u.bucketName, key, obj.Events, obj.Size)
 	return nil
 }
 
-// UploadNDJSON uploads raw NDJSON data to S3
-func (u *S3Uploader) UploadNDJSON(ctx context.Context, data io.Reader, size int64) error {
-	timestamp := time.Now().Format("2006-01-02T15-04-05")
-	key := fmt.Sprintf("%s/%s-%d.ndjson", u.machineID, timestamp, time.Now().UnixNano())
-
-	_, err := u.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(u.bucketName),
-		Key:         aws.String(key),
-		Body:        data,
-		ContentType: aws.String("application/x-ndjson"),
-	})
+// ndjsonReader presents lines as one newline-terminated stream. It is
+// seekable so the SDK can hash and retry the body.
+type ndjsonReader struct {
+	lines [][]byte
+	size  int64
+	off   int64
+	line  int   // index of the line containing off
+	start int64 // offset of lines[line]
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to upload NDJSON to S3: %w", err)
+func newNDJSONReader(lines [][]byte) *ndjsonReader {
+	r := &ndjsonReader{lines: lines}
+	for _, l := range lines {
+		r.size += int64(len(l)) + 1
 	}
+	return r
+}
 
-	log.Printf("uploaded NDJSON to S3: s3://%s/%s", u.bucketName, key)
-	return nil
+func (r *ndjsonReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && r.line < len(r.lines) {
+		l := r.lines[r.line]
+		pos := r.off - r.start
+		if pos < int64(len(l)) {
+			c := copy(p[n:], l[pos:])
+			n += c
+			r.off += int64(c)
+			continue
+		}
+		p[n] = '\n'
+		n++
+		r.off++
+		r.start = r.off
+		r.line++
+	}
+	if n == 0 && r.line >= len(r.lines) {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (r *ndjsonReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 || offset > r.size {
+		return r.off, fmt.Errorf("ndjson reader: seek to %d out of range", offset)
+	}
+	r.off, r.line, r.start = 0, 0, 0
+	for r.line < len(r.lines) {
+		next := r.start + int64(len(r.lines[r.line])) + 1
+		if offset < next {
+			break
+		}
+		r.start = next
+		r.line++
+	}
+	r.off = offset
+	return offset, nil
 }
 
 // getRegionFromEC2Metadata queries EC2 instance metadata service for the region
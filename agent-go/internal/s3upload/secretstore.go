@@ -0,0 +1,294 @@
+package s3upload
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The credentials file is sealed with AES-256-GCM. The key is derived from
+// a random secret in secretKeyFile (0600, created on first save) and the
+// machine-id, so the file alone is useless and so is a copy of both files
+// on a host with another machine-id (a cloned image, a stolen backup).
+// Rotating replaces the secret; wiping removes it with the credentials.
+
+// secretKeyFile is a variable so tests can point it elsewhere
+var secretKeyFile = "/etc/jetcamer/secret.key"
+
+const (
+	// secretKeyFile+pendingKeySuffix holds a rotated secret until the
+	// credentials sealed with it are on disk
+	pendingKeySuffix = ".new"
+
+	sealedVersion = 1
+	sealedAAD     = "jetcamer-agent aws-credentials v1"
+
+	// wsSecretLabel separates the WebSocket signing key from the AWS
+	// secret it is derived from
+	wsSecretLabel = "jetcamer-agent ws-hmac v1"
+)
+
+// sealedCredentials is the on-disk form of StoredCredentials.
+type sealedCredentials struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"keyId"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// SecretStoreStatus describes the secret store without exposing secrets.
+type SecretStoreStatus struct {
+	Encrypted      bool      `json:"encrypted"` // the credentials file is sealed
+	HasCredentials bool      `json:"hasCredentials"`
+	KeyFile        string    `json:"keyFile"`
+	KeyID          string    `json:"keyId,omitempty"` // fingerprint of the derived key
+	KeyCreated     time.Time `json:"keyCreated"`      // when the secret was generated or last rotated
+}
+
+// credentialsKey derives the file key from the secret in path and the
+// machine-id. The secret is generated when missing and create is set.
+func credentialsKey(path string, create bool) (key []byte, id string, err error) {
+	secret, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && create {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, "", err
+		}
+		err = writeFileAtomic(path, secret)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(secret) < 32 {
+		return nil, "", fmt.Errorf("secret key file %s is truncated", path)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("WARNING: %s was readable by other users, resetting it to 0600", path)
+		os.Chmod(path, 0600)
+	}
+	machineID, err := readMachineID()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read machine-id: %w", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sealedAAD + "\x00" + machineID))
+	key = mac.Sum(nil)
+	sum := sha256.Sum256(key)
+	return key, hex.EncodeToString(sum[:8]), nil
+}
+
+func sealCredentials(creds *StoredCredentials, key []byte, keyID string) ([]byte, error) {
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedCredentials{
+		Version:    sealedVersion,
+		KeyID:      keyID,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plain, []byte(sealedAAD)),
+	})
+}
+
+func openCredentials(sealed *sealedCredentials, key []byte) (*StoredCredentials, error) {
+	if sealed.Version != sealedVersion {
+		return nil, fmt.Errorf("unsupported credentials file version %d", sealed.Version)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("credentials file has a bad nonce")
+	}
+	plain, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(sealedAAD))
+	if err != nil {
+		return nil, fmt.Errorf("credentials file cannot be decrypted (secret key or machine-id changed)")
+	}
+	var creds StoredCredentials
+	if err := json.Unmarshal(plain, &creds); err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decodeCredentialsFile parses the credentials file. Files written before
+// encryption hold the plain JSON; legacy reports those so they can be
+// sealed in place.
+func decodeCredentialsFile(data []byte) (creds *StoredCredentials, legacy bool, err error) {
+	var sealed sealedCredentials
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, false, err
+	}
+	if sealed.Ciphertext == nil {
+		var plain StoredCredentials
+		if err := json.Unmarshal(data, &plain); err != nil {
+			return nil, false, err
+		}
+		return &plain, true, nil
+	}
+
+	key, _, err := credentialsKey(secretKeyFile, false)
+	if err == nil {
+		if creds, err = openCredentials(&sealed, key); err == nil {
+			// a rotation that stopped before promoting its key
+			os.Remove(secretKeyFile + pendingKeySuffix)
+			return creds, false, nil
+		}
+	}
+	// a rotation that stopped after sealing with the new key
+	pending := secretKeyFile + pendingKeySuffix
+	if pkey, _, perr := credentialsKey(pending, false); perr == nil {
+		if creds, perr := openCredentials(&sealed, pkey); perr == nil {
+			if os.Rename(pending, secretKeyFile) == nil {
+				log.Printf("secret store: completed interrupted key rotation")
+			}
+			return creds, false, nil
+		}
+	}
+	return nil, false, err
+}
+
+// DeriveWsSecret derives the WebSocket HMAC secret from an AWS secret
+// access key: hex(HMAC-SHA256(awsSecret, wsSecretLabel)). The control
+// plane, which issued the key, derives the same; a leaked signing key
+// does not give AWS access, and the AWS key is never used to sign.
+func DeriveWsSecret(awsSecret string) string {
+	if awsSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(awsSecret))
+	mac.Write([]byte(wsSecretLabel))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WsSecret is the WebSocket HMAC secret derived from the stored
+// credentials, or from AWS_SECRET_ACCESS_KEY when none are stored.
+func WsSecret() string {
+	if creds := GetStoredCredentials(); creds != nil && creds.SecretAccessKey != "" {
+		return DeriveWsSecret(creds.SecretAccessKey)
+	}
+	return DeriveWsSecret(os.Getenv("AWS_SECRET_ACCESS_KEY"))
+}
+
+// writeFileAtomic replaces path with data, readable by the owner only.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// RotateSecretKey generates a new secret and re-seals the stored
+// credentials with it. The new secret is promoted only once the
+// credentials are on disk; an interruption is finished on the next load.
+func RotateSecretKey() (SecretStoreStatus, error) {
+	storedCredsLock.Lock()
+	defer storedCredsLock.Unlock()
+
+	pending := secretKeyFile + pendingKeySuffix
+	os.Remove(pending)
+	key, keyID, err := credentialsKey(pending, true)
+	if err != nil {
+		os.Remove(pending)
+		return SecretStoreStatus{}, fmt.Errorf("failed to generate secret key: %w", err)
+	}
+	if storedCreds != nil {
+		data, err := sealCredentials(storedCreds, key, keyID)
+		if err == nil {
+			err = writeFileAtomic(credentialsFile, data)
+		}
+		if err != nil {
+			os.Remove(pending)
+			return SecretStoreStatus{}, fmt.Errorf("failed to re-encrypt credentials: %w", err)
+		}
+		if info, err := os.Stat(credentialsFile); err == nil {
+			credsFileStamp = info.ModTime()
+		}
+	}
+	if err := os.Rename(pending, secretKeyFile); err != nil {
+		return SecretStoreStatus{}, fmt.Errorf("failed to install secret key: %w", err)
+	}
+	log.Printf("secret store: secret key rotated (key %s)", keyID)
+	return secretStoreStatus(), nil
+}
+
+// WipeSecretStore forgets the stored credentials and removes both the
+// credentials file and the secret key, so copies of the file left in
+// backups can no longer be decrypted. Clients fall back to the default
+// credential chain.
+func WipeSecretStore() error {
+	storedCredsLock.Lock()
+	storedCreds = nil
+	removeStoredCredentialsFromDisk()
+	var errs []error
+	for _, path := range []string{secretKeyFile, secretKeyFile + pendingKeySuffix} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	storedCredsLock.Unlock()
+	notifyCredentialsChange()
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to remove secret key: %w", err)
+	}
+	log.Printf("secret store: credentials and secret key wiped")
+	return nil
+}
+
+// GetSecretStoreStatus reports whether the credentials file is sealed and
+// which key seals it.
+func GetSecretStoreStatus() SecretStoreStatus {
+	storedCredsLock.RLock()
+	defer storedCredsLock.RUnlock()
+	return secretStoreStatus()
+}
+
+func secretStoreStatus() SecretStoreStatus {
+	st := SecretStoreStatus{HasCredentials: storedCreds != nil, KeyFile: secretKeyFile}
+	if data, err := os.ReadFile(credentialsFile); err == nil {
+		var sealed sealedCredentials
+		if json.Unmarshal(data, &sealed) == nil && sealed.Ciphertext != nil {
+			st.Encrypted = true
+			st.KeyID = sealed.KeyID
+		}
+	}
+	if info, err := os.Stat(secretKeyFile); err == nil {
+		st.KeyCreated = info.ModTime().UTC()
+	}
+	return st
+}
@@ -0,0 +1,80 @@
+package s3upload
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Shared holds the process-wide uploader for the batch sink and the
+// /internal/batch route. When the agent starts without usable
+// credentials it is created on first use after /internal/set-aws-config
+// has stored some.
+type Shared struct {
+	opts Options
+	mu   sync.Mutex
+	u    *S3Uploader
+}
+
+// NewShared wraps u, which may be nil; opts are used to create it later.
+func NewShared(u *S3Uploader, opts Options) *Shared {
+	return &Shared{opts: opts, u: u}
+}
+
+// Get returns the uploader, initializing it from stored credentials if
+// it does not exist yet.
+func (s *Shared) Get(ctx context.Context) (*S3Uploader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.u != nil {
+		return s.u, nil
+	}
+	if !HasStoredCredentials() {
+		return nil, fmt.Errorf("S3 uploader not initialized. Configure AWS credentials via /internal/set-aws-config or ensure AWS credentials are available.")
+	}
+	log.Printf("S3 uploader not initialized, attempting lazy initialization with stored credentials...")
+	u, err := NewS3Uploader(ctx, s.opts)
+	if err != nil {
+		return nil, fmt.Errorf("S3 uploader not initialized: %w. Use /internal/set-aws-config to configure credentials.", err)
+	}
+	log.Printf("S3 uploader initialized successfully with stored credentials")
+	s.u = u
+	return u, nil
+}
+
+// Name identifies the uploader as a batch sink.
+func (s *Shared) Name() string {
+	return "s3"
+}
+
+// WriteBatch uploads events with the current uploader.
+func (s *Shared) WriteBatch(ctx context.Context, events [][]byte) error {
+	u, err := s.Get(ctx)
+	if err != nil {
+		return err
+	}
+	return u.WriteBatch(ctx, events)
+}
+
+// UploadObject stores a finished file with the current uploader.
+func (s *Shared) UploadObject(ctx context.Context, obj Object) error {
+	u, err := s.Get(ctx)
+	if err != nil {
+		return err
+	}
+	return u.UploadObject(ctx, obj)
+}
+
+// Reload rebuilds the uploader's client from the current credentials, or
+// creates the uploader if it could not be created before.
+func (s *Shared) Reload(ctx context.Context) error {
+	s.mu.Lock()
+	u := s.u
+	s.mu.Unlock()
+	if u == nil {
+		_, err := s.Get(ctx)
+		return err
+	}
+	return u.Reload(ctx)
+}
@@ -9,8 +9,6 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
@@ -21,17 +19,31 @@ type ValidationResult struct {
 	Errors          []string `json:"errors,omitempty"`
 	Warnings        []string `json:"warnings,omitempty"`
 	Region          string   `json:"region,omitempty"`
+	Bucket          string   `json:"bucket,omitempty"`
+	Prefix          string   `json:"prefix,omitempty"`
+	Endpoint        string   `json:"endpoint,omitempty"` // "aws" or the S3-compatible endpoint
 	BucketExists    bool     `json:"bucketExists,omitempty"`
+	Drift           []string `json:"drift,omitempty"` // differences from the configured encryption, public access block and lifecycle
 	MachineID       string   `json:"machineId,omitempty"`
 	CredentialsType string   `json:"credentialsType,omitempty"`
+	Role            string   `json:"role,omitempty"` // ARN of the assumed role
 }
 
 // ValidateS3Config validates the S3 configuration without exposing sensitive data
-func ValidateS3Config(ctx context.Context) ValidationResult {
+func ValidateS3Config(ctx context.Context, opts Options) ValidationResult {
+	bucketName := opts.bucket()
 	result := ValidationResult{
 		Valid:    true,
 		Errors:   []string{},
 		Warnings: []string{},
+		Bucket:   bucketName,
+		Prefix:   opts.prefix(),
+		Endpoint: opts.endpointName(),
+	}
+
+	if err := opts.Policy.check(); err != nil {
+		result.Valid = false
+		result.Errors = append(result.Errors, err.Error())
 	}
 
 	// 1. Check machine-id
@@ -44,46 +56,16 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 	}
 
 	// 2. Check AWS credentials and region
-	var cfg aws.Config
-	
-	// Check if stored credentials are available (first priority)
-	storedCreds := GetStoredCredentials()
-	if storedCreds != nil {
-		// Use stored credentials for validation
-		region := storedCreds.Region
-		if region == "" {
-			region = getRegionFromEC2Metadata(ctx)
-		}
-		if region == "" {
-			result.Valid = false
-			result.Errors = append(result.Errors, "AWS region is required when using stored credentials")
-			result.CredentialsType = "stored-credentials"
-			return result
-		}
-		
-		cfg, err = config.LoadDefaultConfig(ctx,
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				storedCreds.AccessKeyID,
-				storedCreds.SecretAccessKey,
-				"",
-			)),
-			config.WithRegion(region),
-		)
-		if err != nil {
-			result.Valid = false
-			result.Errors = append(result.Errors, fmt.Sprintf("Failed to load AWS configuration with stored credentials: %v", err))
-			result.CredentialsType = "stored-credentials"
-			return result
-		}
+	// Stored credentials come first, then the default credential chain;
+	// a configured role is assumed on top of either
+	cfg, err := LoadAWSConfig(ctx, opts.Role, opts.Region)
+	if HasStoredCredentials() {
 		result.CredentialsType = "stored-credentials"
-	} else {
-		// Use default credential chain
-		cfg, err = config.LoadDefaultConfig(ctx)
-		if err != nil {
-			result.Valid = false
-			result.Errors = append(result.Errors, fmt.Sprintf("Failed to load AWS configuration: %v", err))
-			return result
-		}
+	}
+	if err != nil {
+		result.Valid = false
+		result.Errors = append(result.Errors, fmt.Sprintf("Failed to load AWS configuration: %v", err))
+		return result
 	}
 
 	// Determine credentials type (without exposing actual credentials)
@@ -122,8 +104,26 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 		result.CredentialsType = credsType
 	}
 
+	// A role replaces the base credentials; check that it can be assumed
+	role := opts.Role
+	if stored := GetStoredCredentials(); stored != nil {
+		role = stored.role(role)
+	}
+	if kind := role.kind(); kind != "" {
+		result.CredentialsType = kind
+		result.Role = role.ARN
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			result.Valid = false
+			result.Errors = append(result.Errors, fmt.Sprintf("Cannot assume role %s: %v", role.ARN, err))
+			return result
+		}
+	}
+
 	// Check region
-	region := cfg.Region
+	region := opts.Region
+	if region == "" {
+		region = cfg.Region
+	}
 	if region == "" {
 		// Try environment variables first
 		if envRegion := os.Getenv("AWS_REGION"); envRegion != "" {
@@ -132,7 +132,7 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 			region = envRegion
 		} else {
 			// Try to get region from EC2 instance metadata
-			region = getRegionFromEC2Metadata(ctx)
+			region = opts.defaultRegion(ctx)
 		}
 	}
 
@@ -151,23 +151,18 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 
 	// 3. Test S3 client creation and bucket access
 	if result.Region != "" {
-		// Reload config with the detected region to ensure S3 client uses it
-		var s3Cfg aws.Config
-		if cfg.Region == "" {
-			// Create new config with the detected region
-			var err error
-			s3Cfg, err = config.LoadDefaultConfig(ctx, config.WithRegion(result.Region))
-			if err != nil {
-				result.Warnings = append(result.Warnings, fmt.Sprintf("Failed to create AWS config with region %s: %v", result.Region, err))
-				return result
-			}
-		} else {
-			s3Cfg = cfg
+		// Use the detected region for the S3 client
+		s3Cfg := cfg
+		s3Cfg.Region = result.Region
+		client, err := newS3Client(s3Cfg, opts)
+		if err != nil {
+			result.Valid = false
+			result.Errors = append(result.Errors, err.Error())
+			return result
 		}
-		client := s3.NewFromConfig(s3Cfg)
 
 		// Try to check if bucket exists
-		_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+		_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{
 			Bucket: aws.String(bucketName),
 		})
 		if err != nil {
@@ -179,20 +174,11 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 			} else if strings.Contains(errStr, "NoSuchBucket") || strings.Contains(errStr, "NotFound") || strings.Contains(errStr, "404") {
 				// Bucket doesn't exist - try to create it
 				log.Printf("Bucket %s does not exist, creating...", bucketName)
-				createInput := &s3.CreateBucketInput{
-					Bucket: aws.String(bucketName),
-				}
-				
-				// Set location constraint for regions other than us-east-1
-				if result.Region != "" && result.Region != "us-east-1" {
-					if len(result.Region) > 0 && len(result.Region) < 20 {
-						createInput.CreateBucketConfiguration = &types.CreateBucketConfiguration{
-							LocationConstraint: types.BucketLocationConstraint(result.Region),
-						}
-					}
+				createInput, createErr := createBucketInput(bucketName, result.Region)
+				if createErr == nil {
+					opts.Policy.applyCreate(createInput)
+					_, createErr = client.CreateBucket(ctx, createInput)
 				}
-				
-				_, createErr := client.CreateBucket(ctx, createInput)
 				if createErr != nil {
 					// Check if bucket was created by another process (race condition)
 					var bucketAlreadyOwnedByYou *types.BucketAlreadyOwnedByYou
@@ -212,6 +198,11 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 				} else {
 					log.Printf("Bucket %s created successfully", bucketName)
 					result.BucketExists = true
+					if !opts.Policy.empty() {
+						if err := applyBucketPolicy(ctx, client, bucketName, opts.Policy); err != nil {
+							result.Warnings = append(result.Warnings, err.Error())
+						}
+					}
 				}
 			} else if strings.Contains(errStr, "AccessDenied") || strings.Contains(errStr, "Forbidden") || strings.Contains(errStr, "403") {
 				result.Valid = false
@@ -220,6 +211,9 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 				// Only flag as invalid region if the error specifically mentions region
 				result.Valid = false
 				result.Errors = append(result.Errors, fmt.Sprintf("AWS SDK error with region %s: %v. Check that the region is correctly configured.", result.Region, err))
+			} else if strings.Contains(errStr, "x509:") || strings.Contains(errStr, "tls:") {
+				result.Valid = false
+				result.Errors = append(result.Errors, fmt.Sprintf("TLS error talking to %s: %v. Set s3CaFile to the CA that signed the endpoint certificate.", result.Endpoint, err))
 			} else {
 				// For other errors, show as warning (might be temporary network issues, etc.)
 				result.Warnings = append(result.Warnings, fmt.Sprintf("Cannot access bucket %s: %v", bucketName, err))
@@ -227,6 +221,17 @@ func ValidateS3Config(ctx context.Context) ValidationResult {
 		} else {
 			result.BucketExists = true
 		}
+
+		// 4. Compare the bucket with the configured policy
+		if result.BucketExists && !opts.Policy.empty() {
+			drift, err := bucketDrift(ctx, client, bucketName, opts.Policy)
+			if err != nil {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Cannot check bucket configuration: %v", err))
+			} else if len(drift) > 0 {
+				result.Drift = drift
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Bucket %s differs from the configured policy; set s3EnforceBucketPolicy to fix it at startup", bucketName))
+			}
+		}
 	}
 
 	return result
@@ -0,0 +1,241 @@
+package security
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Layer-7 DDoS "under attack" mode
+//────────────────────────────────────────────────────────────
+
+// A distributed flood keeps every IP under the per-IP limit, so attack
+// mode watches the total request rate instead. When it surges past
+// SecurityAttackSurgeFactor times the rate learned from calm minutes, the
+// engine tightens the per-IP limit, bans whole /24 (IPv4) or /64 (IPv6)
+// subnets and subnets of flooding ASNs, and optionally bans clients from
+// outside SecurityAttackCountries. It de-escalates once the rate stays at
+// or below the surge over the pre-attack rate for
+// SecurityAttackCooldownMinutes.
+//
+// Nothing escalates until attackWarmup calm minutes were learned: a busy
+// site would otherwise cross SecurityAttackMinRpm right after a restart.
+//
+// Path and ASN limits are deliberately not tightened: during a flood they
+// are exceeded by every visitor of the targeted page.
+
+const (
+	attackSubnetV4Bits = 24
+	attackSubnetV6Bits = 64
+
+	attackAlpha  = 0.02 // EWMA of the calm request rate, roughly the last hour
+	attackWarmup = 30   // calm minutes before the learned rate is trusted
+)
+
+// AttackStatus is reported in the security snapshot and with every mode
+// transition.
+type AttackStatus struct {
+	Enabled     bool      `json:"enabled"`
+	Active      bool      `json:"active"`
+	Since       time.Time `json:"since,omitempty"`       // start of the current or last attack
+	Until       time.Time `json:"until,omitempty"`       // end of the last attack
+	Rpm         int       `json:"rpm"`                   // requests in the last complete minute
+	PeakRpm     int       `json:"peakRpm"`               // peak of the current or last attack
+	BaselineRpm float64   `json:"baselineRpm"`           // learned from calm minutes
+	TriggerRpm  int       `json:"triggerRpm"`            // rate that escalates, 0 while warming up
+	CalmRpm     int       `json:"calmRpm,omitempty"`     // while active, the rate to stay under to de-escalate
+	CalmMinutes int       `json:"calmMinutes,omitempty"` // consecutive minutes under the trigger while active
+	Escalations uint64    `json:"escalations"`
+	SubnetBans  uint64    `json:"subnetBans"`
+	AsnBans     uint64    `json:"asnBans"`
+	GeoBans     uint64    `json:"geoBans"`
+}
+
+// attackState is guarded by e.mu. Workers read the mode and trigger from
+// the engine's attackOn/attackTrigger atomics and count subnets in their
+// shard (see shard.go).
+type attackState struct {
+	AttackStatus
+
+	global    baselineStat    // per-minute request rate while not under attack
+	countries map[string]bool // allow-list, empty = off
+	country   *CountryResolver
+}
+
+func newAttackState(cfg *Config) attackState {
+	a := attackState{
+		countries: make(map[string]bool),
+	}
+	a.Enabled = cfg.SecurityAttackEnabled
+	for _, cc := range cfg.SecurityAttackCountries {
+		if cc = strings.ToUpper(strings.TrimSpace(cc)); cc != "" {
+			a.countries[cc] = true
+		}
+	}
+	if a.Enabled && len(a.countries) > 0 {
+		if cfg.GeoLiteCountryPath == "" {
+			log.Printf("security: securityAttackCountries ignored: no geoLiteCountryPath")
+		} else {
+			a.country = NewCountryResolver(cfg.GeoLiteCountryPath)
+		}
+	}
+	return a
+}
+
+// attackCheck escalates on a surge and, while under attack, applies the
+// aggregated and geo bans. total is the requests so far this minute. It
+// returns true when the request's source is (now) banned.
+func (s *shard) attackCheck(ip string, parsed net.IP, path string, asn, asnCount, total int) bool {
+	e := s.e
+	if !e.attackOn.Load() {
+		if trigger := e.attackTrigger.Load(); trigger <= 0 || int64(total) <= trigger {
+			return false
+		}
+		e.mu.Lock()
+		if !e.attack.Active {
+			e.escalate(total)
+		}
+		e.mu.Unlock()
+	}
+	if e.isBanned(ip) {
+		return true
+	}
+
+	subnet := subnetOf(parsed)
+	if e.isBanned(subnet) {
+		return true
+	}
+	n := s.subnets.Add(subnet)
+
+	if limit := e.cfg.SecurityAttackSubnetRpm; limit > 0 && n > limit {
+		return e.attackBan(&e.attack.SubnetBans, subnet, path, asn, "attack-subnet", fmt.Sprintf("subnet > %d/min under attack", limit))
+	}
+	if limit := e.cfg.SecurityAttackAsnRpm; limit > 0 && asn > 0 && asnCount > limit {
+		return e.attackBan(&e.attack.AsnBans, subnet, path, asn, "attack-asn", fmt.Sprintf("asn %d > %d/min under attack", asn, limit))
+	}
+	if country := e.attack.country; country != nil {
+		if cc := s.lookups.country(ip, country); cc != "" && !e.attack.countries[cc] {
+			return e.attackBan(&e.attack.GeoBans, ip, path, asn, "attack-geo", "country "+cc+" not allowed under attack")
+		}
+	}
+	return false
+}
+
+// attackBan bans target and counts it in counter, a field of e.attack.
+// It returns true like attackCheck.
+func (e *Engine) attackBan(counter *uint64, target, path string, asn int, reason, rule string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, banned := e.bans[target]; banned {
+		return true
+	}
+	*counter++
+	e.applyBanFor(target, path, asn, reason, rule, time.Duration(e.cfg.SecurityAttackBanMinutes)*time.Minute)
+	return true
+}
+
+// attackIPLimit returns the per-IP limit for the current mode.
+func (e *Engine) attackIPLimit(limit int) int {
+	if !e.attackOn.Load() || e.cfg.SecurityAttackIpFactor <= 0 || e.cfg.SecurityAttackIpFactor >= 1 {
+		return limit
+	}
+	tight := int(float64(limit) * e.cfg.SecurityAttackIpFactor)
+	if tight < 1 {
+		tight = 1
+	}
+	return tight
+}
+
+// attackTick closes the minute that had rpm requests: it learns the calm
+// rate, or counts calm minutes towards de-escalation. Caller holds e.mu.
+func (e *Engine) attackTick(rpm int) {
+	a := &e.attack
+	a.Rpm = rpm
+
+	if a.Active {
+		if rpm > a.PeakRpm {
+			a.PeakRpm = rpm
+		}
+		if rpm <= a.CalmRpm {
+			a.CalmMinutes++
+		} else {
+			a.CalmMinutes = 0
+		}
+		cooldown := e.cfg.SecurityAttackCooldownMinutes
+		if cooldown <= 0 {
+			cooldown = 10
+		}
+		if a.CalmMinutes >= cooldown {
+			e.deescalate()
+		}
+		return
+	}
+
+	a.global.observe(float64(rpm), attackAlpha)
+	a.BaselineRpm = round2(a.global.Mean)
+	a.TriggerRpm = 0
+	if a.global.N >= attackWarmup {
+		a.TriggerRpm = max(e.cfg.SecurityAttackMinRpm, e.surgeRpm())
+	}
+	e.attackTrigger.Store(int64(a.TriggerRpm))
+}
+
+// surgeRpm is the learned calm rate times the surge factor, never below
+// the learned rate itself. Caller holds e.mu.
+func (e *Engine) surgeRpm() int {
+	return int(math.Ceil(e.attack.global.Mean * math.Max(e.cfg.SecurityAttackSurgeFactor, 1)))
+}
+
+// Caller holds e.mu.
+func (e *Engine) escalate(rpm int) {
+	a := &e.attack
+	a.Active = true
+	a.Since = time.Now()
+	a.Until = time.Time{}
+	a.PeakRpm = rpm
+	a.CalmMinutes = 0
+	a.CalmRpm = e.surgeRpm()
+	a.Escalations++
+	e.attackOn.Store(true)
+	log.Printf("security: attack mode on: %d requests this minute, trigger %d/min (baseline %.0f/min)",
+		rpm, a.TriggerRpm, a.BaselineRpm)
+	e.notifyAttack("escalate", rpm)
+}
+
+// Caller holds e.mu.
+func (e *Engine) deescalate() {
+	a := &e.attack
+	a.Active = false
+	e.attackOn.Store(false)
+	a.Until = time.Now()
+	a.CalmMinutes = 0
+	a.CalmRpm = 0
+	log.Printf("security: attack mode off after %s, peak %d/min",
+		a.Until.Sub(a.Since).Round(time.Minute), a.PeakRpm)
+	e.notifyAttack("de-escalate", a.Rpm)
+}
+
+func (e *Engine) notifyAttack(reason string, rpm int) {
+	st := e.attack.AttackStatus
+	e.notify(Notification{
+		Type:   NotifyAttackMode,
+		Reason: reason,
+		Count:  rpm,
+		Limit:  st.TriggerRpm,
+		Attack: &st,
+	})
+}
+
+// subnetOf returns the /24 or /64 containing ip.
+func subnetOf(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(attackSubnetV4Bits, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(attackSubnetV6Bits, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
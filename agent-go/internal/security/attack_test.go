@@ -0,0 +1,52 @@
+package security
+
+import "testing"
+
+func TestSubnetBansUseNetIpset(t *testing.T) {
+	e := newTestEngine(t, &Config{FirewallIpsetName: "bans", FirewallSubnetIpsetName: "bans_net"})
+	for ip, want := range map[string]string{
+		"203.0.113.7":     "bans",
+		"2001:db8::1":     "bans",
+		"203.0.113.0/24":  "bans_net",
+		"2001:db8:1::/64": "bans_net",
+	} {
+		if got := e.ipsetFor(ip); got != want {
+			t.Errorf("ipsetFor(%s) = %s, want %s", ip, got, want)
+		}
+	}
+
+	e.cfg.FirewallSubnetIpsetName = ""
+	if got := e.ipsetFor("203.0.113.0/24"); got != "bans_net" {
+		t.Errorf("default subnet set = %s, want bans_net", got)
+	}
+}
+
+func TestAttackModeWaitsForWarmupAndDeescalates(t *testing.T) {
+	e := newTestEngine(t, &Config{SecurityAttackEnabled: true, SecurityAttackMinRpm: 3000,
+		SecurityAttackSurgeFactor: 4, SecurityAttackCooldownMinutes: 3})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// a busy site: above the minimum from its first minute
+	for i := 0; i < attackWarmup-1; i++ {
+		e.attackTick(5000)
+		if trigger := e.attackTrigger.Load(); trigger != 0 {
+			t.Fatalf("minute %d: trigger %d before warmup", i, trigger)
+		}
+	}
+	e.attackTick(5000)
+	if got := e.attack.TriggerRpm; got != 20000 {
+		t.Fatalf("trigger = %d, want 4x the learned 5000", got)
+	}
+
+	e.escalate(25000)
+	if e.attack.CalmRpm != 20000 {
+		t.Fatalf("calm rate = %d, want 20000", e.attack.CalmRpm)
+	}
+	for i := 0; i < 3; i++ {
+		e.attackTick(6000) // normal traffic, still above securityAttackMinRpm
+	}
+	if e.attack.Active || e.attackOn.Load() {
+		t.Fatal("attack mode stuck on at the normal rate")
+	}
+}
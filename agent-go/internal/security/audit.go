@@ -0,0 +1,290 @@
+package security
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Security audit log
+//────────────────────────────────────────────────────────────
+
+// Audit actions
+const (
+	AuditBan         = "ban"
+	AuditUnban       = "unban"
+	AuditManualBan   = "manual-ban"
+	AuditManualUnban = "manual-unban"
+	AuditAllowlist   = "allowlist" // a ban was skipped because the IP is allow-listed
+	AuditFirewall    = "firewall"  // local ipset command
+	AuditCloud       = "cloud"     // cloud enforcer call (NACL, WAFv2, security group)
+)
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Time       time.Time      `json:"time"`
+	Action     string         `json:"action"`
+	IP         string         `json:"ip,omitempty"` // address or subnet
+	ASN        int            `json:"asn,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Rule       string         `json:"rule,omitempty"`     // limit, trap, WAF rules... that caused the decision
+	Counters   map[string]int `json:"counters,omitempty"` // per-minute counters at decision time
+	Origin     string         `json:"origin,omitempty"`   // agent behind a fleet ban
+	TTLSeconds int            `json:"ttlSeconds,omitempty"`
+	Command    string         `json:"command,omitempty"` // firewall command or cloud operation
+	Target     string         `json:"target,omitempty"`  // cloud enforcer
+	Error      string         `json:"error,omitempty"`   // command failure, empty = success
+}
+
+// AuditQuery filters audit records. Zero fields match everything.
+type AuditQuery struct {
+	IP    string // an address also matches records for subnets containing it
+	From  time.Time
+	To    time.Time
+	Limit int // newest records kept, default 1000
+}
+
+const defaultAuditLimit = 1000
+
+// AuditLog appends JSON lines to path and rotates it to path.1 ...
+// path.<keep> once it exceeds maxBytes. Records are never rewritten.
+type AuditLog struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewAuditLog opens (or creates) the audit log.
+func NewAuditLog(path string, maxMB, keep int) (*AuditLog, error) {
+	if maxMB <= 0 {
+		maxMB = 20
+	}
+	if keep <= 0 {
+		keep = 5
+	}
+	a := &AuditLog{path: path, maxBytes: int64(maxMB) << 20, keep: keep}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.size = st.Size()
+	return nil
+}
+
+// Record appends rec. Failures are logged, never returned: the audit log
+// must not stop the engine from enforcing.
+func (a *AuditLog) Record(rec AuditRecord) {
+	if a == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			log.Printf("security: audit log unavailable: %v", err)
+			return
+		}
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			log.Printf("security: audit log rotation failed: %v", err)
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("security: audit log write failed: %v", err)
+	}
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1. Caller holds a.mu.
+func (a *AuditLog) rotate() error {
+	a.f.Close()
+	a.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return a.open()
+}
+
+// Query scans the rotated files oldest first and returns the newest
+// q.Limit matching records in chronological order.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+	out := []AuditRecord{}
+	if a == nil {
+		return out, nil
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	qip := net.ParseIP(strings.TrimSpace(q.IP))
+
+	// open every file under the lock so a rotation can't shift names
+	// mid-scan, and read the active file only up to what has been
+	// written; the scan itself runs without blocking Record
+	type auditFile struct {
+		f     *os.File
+		limit int64 // bytes to read, -1 for all
+	}
+	var files []auditFile
+	defer func() {
+		for _, af := range files {
+			af.f.Close()
+		}
+	}()
+	a.mu.Lock()
+	for i := a.keep; i >= 0; i-- {
+		name, limit := fmt.Sprintf("%s.%d", a.path, i), int64(-1)
+		if i == 0 {
+			name, limit = a.path, a.size
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			a.mu.Unlock()
+			return nil, err
+		}
+		files = append(files, auditFile{f: f, limit: limit})
+	}
+	a.mu.Unlock()
+
+	for _, af := range files {
+		var r io.Reader = af.f
+		if af.limit >= 0 {
+			r = io.LimitReader(af.f, af.limit)
+		}
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var rec AuditRecord
+			if json.Unmarshal(sc.Bytes(), &rec) != nil {
+				continue
+			}
+			if !q.From.IsZero() && rec.Time.Before(q.From) {
+				continue
+			}
+			if !q.To.IsZero() && rec.Time.After(q.To) {
+				continue
+			}
+			if q.IP != "" && !auditIPMatch(rec.IP, q.IP, qip) {
+				continue
+			}
+			out = append(out, rec)
+			if len(out) > limit {
+				out = out[1:]
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func auditIPMatch(recIP, want string, wantIP net.IP) bool {
+	if recIP == want {
+		return true
+	}
+	if wantIP == nil || !strings.Contains(recIP, "/") {
+		return false
+	}
+	_, n, err := net.ParseCIDR(recIP)
+	return err == nil && n.Contains(wantIP)
+}
+
+//────────────────────────────────────────────────────────────
+//  Engine hooks
+//────────────────────────────────────────────────────────────
+
+// auditCounters snapshots the per-minute counters behind a decision.
+// Caller holds e.mu.
+func (e *Engine) auditCounters(ip, path string, asn int) map[string]int {
+	c := map[string]int{"ipRpm": e.ipCount(ip)}
+	if path != "" {
+		c["pathRpm"] = e.paths.Count(path)
+	}
+	if asn > 0 {
+		c["asnRpm"] = e.asns.Get(asn)
+	}
+	if e.attack.Active {
+		c["totalRpm"] = int(e.requests.Load())
+	}
+	return c
+}
+
+// auditCommand records the result of a local firewall command.
+func (e *Engine) auditCommand(ip string, args []string, out []byte, err error) {
+	rec := AuditRecord{Action: AuditFirewall, IP: ip, Command: strings.Join(args, " ")}
+	if err != nil {
+		rec.Error = err.Error()
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			rec.Error += ": " + msg
+		}
+	}
+	e.audit.Record(rec)
+}
+
+// auditCloud records each IP of a cloud enforcer call. It runs on the
+// enforcer's worker goroutine.
+func (e *Engine) auditCloud(r CloudResult) {
+	for _, ip := range r.IPs {
+		rec := AuditRecord{Action: AuditCloud, IP: ip, Command: r.Op, Target: r.Enforcer}
+		if r.Err != nil {
+			rec.Error = r.Err.Error()
+		}
+		e.audit.Record(rec)
+	}
+}
+
+// AuditQuery returns audit records, or an empty list when the audit log
+// is disabled.
+func (e *Engine) AuditQuery(q AuditQuery) ([]AuditRecord, error) {
+	return e.audit.Query(q)
+}
@@ -0,0 +1,66 @@
+package security
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestAuditLog(t *testing.T, maxBytes int64, keep int) *AuditLog {
+	t.Helper()
+	a := &AuditLog{path: filepath.Join(t.TempDir(), "audit.log"), maxBytes: maxBytes, keep: keep}
+	if err := a.open(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuditQueryAcrossRotations(t *testing.T) {
+	a := newTestAuditLog(t, 300, 2) // about two records per file
+	for i := 0; i < 20; i++ {
+		a.Record(AuditRecord{Action: AuditBan, IP: fmt.Sprintf("203.0.113.%d", i), Reason: "rate"})
+	}
+
+	recs, err := a.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) < 3 || len(recs) > 8 {
+		t.Fatalf("got %d records, want what the active file and 2 rotations hold", len(recs))
+	}
+	for i, rec := range recs {
+		if want := fmt.Sprintf("203.0.113.%d", 20-len(recs)+i); rec.IP != want {
+			t.Fatalf("record %d is %s, want %s (newest, in order)", i, rec.IP, want)
+		}
+	}
+
+	recs, _ = a.Query(AuditQuery{Limit: 2})
+	if len(recs) != 2 || recs[1].IP != "203.0.113.19" {
+		t.Fatalf("limited query = %+v", recs)
+	}
+}
+
+func TestAuditQueryWhileRecording(t *testing.T) {
+	a := newTestAuditLog(t, 4096, 3)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			a.Record(AuditRecord{Action: AuditBan, IP: "198.51.100.1", Reason: "rate"})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		recs, err := a.Query(AuditQuery{IP: "198.51.100.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			if rec.Action != AuditBan {
+				t.Fatalf("torn record %+v", rec)
+			}
+		}
+	}
+	wg.Wait()
+}
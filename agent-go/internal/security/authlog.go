@@ -0,0 +1,189 @@
+package security
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Auth log parsing (sshd, Postfix/Dovecot SASL, FTP)
+//────────────────────────────────────────────────────────────
+
+// Auth services reported in AuthFailure.Service
+const (
+	AuthSSH  = "ssh"
+	AuthSMTP = "smtp"
+	AuthIMAP = "imap"
+	AuthPOP3 = "pop3"
+	AuthFTP  = "ftp"
+)
+
+// AuthFailure is one failed login parsed from a service log.
+type AuthFailure struct {
+	Service string    `json:"service"`
+	IP      string    `json:"ip"`
+	User    string    `json:"user,omitempty"`
+	Count   int       `json:"count"` // attempts covered by the line (Dovecot reports several)
+	Time    time.Time `json:"time"`
+}
+
+type authPattern struct {
+	service string
+	re      *regexp.Regexp
+	ip      int // submatch indexes, 0 = absent
+	user    int
+	count   int
+	svc     int // submatch holding the service name (Dovecot)
+}
+
+var authPatterns = []authPattern{
+	// sshd[123]: Failed password for invalid user admin from 1.2.3.4 port 52044 ssh2
+	// ("Invalid user admin from ..." precedes it for the same attempt and
+	// is not counted)
+	{service: AuthSSH, re: regexp.MustCompile(`sshd\[\d+\]: Failed \S+ for (?:invalid user )?(\S*) from (\S+) port \d+`), user: 1, ip: 2},
+	// sshd[123]: error: maximum authentication attempts exceeded for root from 1.2.3.4 port 52044 ssh2 [preauth]
+	{service: AuthSSH, re: regexp.MustCompile(`sshd\[\d+\]: (?:error: )?maximum authentication attempts exceeded for (?:invalid user )?(\S*) from (\S+)`), user: 1, ip: 2},
+
+	// postfix/smtpd[123]: warning: unknown[1.2.3.4]: SASL LOGIN authentication failed: UGFzc3dvcmQ6
+	{service: AuthSMTP, re: regexp.MustCompile(`postfix/\S*smtpd\[\d+\]: warning: [^\[\s]*\[([0-9A-Fa-f:.]+)\]: SASL \S+ authentication failed`), ip: 1},
+
+	// dovecot: imap-login: Disconnected (auth failed, 3 attempts in 12 secs): user=<bob>, method=PLAIN, rip=1.2.3.4, lip=...
+	{re: regexp.MustCompile(`dovecot(?:\[\d+\])?: (imap|pop3|submission)-login: [^:]*\(auth failed, (\d+) attempts?[^)]*\): user=<([^>]*)>.*?rip=([0-9A-Fa-f:.]+)`), svc: 1, count: 2, user: 3, ip: 4},
+
+	// pure-ftpd: (?@1.2.3.4) [WARNING] Authentication failed for user [bob]
+	{service: AuthFTP, re: regexp.MustCompile(`pure-ftpd(?:\[\d+\])?: \(\S*@([0-9A-Fa-f:.]+)\) \[WARNING\] Authentication failed for user \[([^\]]*)\]`), ip: 1, user: 2},
+	// proftpd[123]: host (1.2.3.4[1.2.3.4]) - USER bob (Login failed): Incorrect password
+	{service: AuthFTP, re: regexp.MustCompile(`proftpd\[\d+\]: \S+ \(\S*\[([0-9A-Fa-f:.]+)\]\) - USER (\S+)(?: \(Login failed\)| \(no such user found\))`), ip: 1, user: 2},
+	// vsftpd: [bob] FAIL LOGIN: Client "::ffff:1.2.3.4"
+	{service: AuthFTP, re: regexp.MustCompile(`\[([^\]]*)\] FAIL LOGIN: Client "(?:::ffff:)?([0-9A-Fa-f:.]+)"`), user: 1, ip: 2},
+}
+
+// ParseAuthLine recognizes a failed login in a syslog line.
+func ParseAuthLine(line string) (AuthFailure, bool) {
+	for _, p := range authPatterns {
+		m := p.re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		f := AuthFailure{Service: p.service, Count: 1, Time: time.Now()}
+		if p.svc > 0 {
+			f.Service = m[p.svc]
+			if f.Service == "submission" {
+				f.Service = AuthSMTP
+			}
+		}
+		if p.user > 0 {
+			f.User = m[p.user]
+		}
+		if p.count > 0 {
+			if n, err := strconv.Atoi(m[p.count]); err == nil && n > 0 {
+				f.Count = n
+			}
+		}
+		ip := net.ParseIP(strings.TrimSpace(m[p.ip]))
+		if ip == nil {
+			return AuthFailure{}, false // e.g. sshd logging a hostname with UseDNS yes
+		}
+		f.IP = ip.String()
+		return f, true
+	}
+	return AuthFailure{}, false
+}
+
+//────────────────────────────────────────────────────────────
+//  Failed-auth detector
+//────────────────────────────────────────────────────────────
+
+// AuthStats is reported in the security snapshot.
+type AuthStats struct {
+	Failures   map[string]uint64 `json:"failures"` // per service since start
+	Bans       map[string]uint64 `json:"bans"`     // per service since start
+	TrackedIPs int               `json:"trackedIps"`
+	Recent     []AuthFailure     `json:"recent"`
+}
+
+const maxAuthRecent = 100
+
+// ProcessAuth counts a failed login and bans the IP once it reaches
+// SecurityAuthMaxFailures within SecurityAuthWindowMinutes, across all
+// services.
+func (e *Engine) ProcessAuth(f AuthFailure) {
+	if !e.cfg.SecurityEnabled || !e.cfg.SecurityAuthEnabled {
+		return
+	}
+	ip := net.ParseIP(f.IP)
+	if ip == nil || ip.IsLoopback() {
+		return
+	}
+	if f.Count <= 0 {
+		f.Count = 1
+	}
+	if f.Time.IsZero() {
+		f.Time = time.Now()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.authStats.Failures[f.Service] += uint64(f.Count)
+	e.authStats.Recent = append(e.authStats.Recent, f)
+	if len(e.authStats.Recent) > maxAuthRecent {
+		e.authStats.Recent = e.authStats.Recent[len(e.authStats.Recent)-maxAuthRecent:]
+	}
+
+	if _, banned := e.bans[f.IP]; banned {
+		return
+	}
+
+	limit := e.cfg.SecurityAuthMaxFailures
+	if limit <= 0 {
+		limit = 5
+	}
+	cut := f.Time.Add(-e.authWindow())
+
+	times := e.authFails[f.IP][:0]
+	for _, ts := range e.authFails[f.IP] {
+		if ts.After(cut) {
+			times = append(times, ts)
+		}
+	}
+	for i := 0; i < f.Count && len(times) < limit; i++ {
+		times = append(times, f.Time)
+	}
+	e.authFails[f.IP] = times
+
+	if len(times) < limit {
+		return
+	}
+
+	var asn int
+	if e.asn != nil {
+		asn = e.asn.ASN(f.IP)
+	}
+	delete(e.authFails, f.IP)
+	e.authStats.Bans[f.Service]++
+	rule := fmt.Sprintf("%d failed logins in %s", limit, e.authWindow())
+	e.applyBanFor(f.IP, "", asn, "auth-"+f.Service, rule, time.Duration(e.cfg.SecurityAuthBanMinutes)*time.Minute)
+}
+
+// pruneAuthFails forgets IPs with no failure inside the window.
+// Caller holds e.mu.
+func (e *Engine) pruneAuthFails(now time.Time) {
+	cut := now.Add(-e.authWindow())
+	for ip, times := range e.authFails {
+		if len(times) == 0 || !times[len(times)-1].After(cut) {
+			delete(e.authFails, ip)
+		}
+	}
+}
+
+func (e *Engine) authWindow() time.Duration {
+	if e.cfg.SecurityAuthWindowMinutes <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(e.cfg.SecurityAuthWindowMinutes) * time.Minute
+}
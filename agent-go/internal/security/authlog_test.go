@@ -0,0 +1,35 @@
+package security
+
+import "testing"
+
+func TestParseAuthLine(t *testing.T) {
+	cases := []struct {
+		line    string
+		ok      bool
+		service string
+		ip      string
+		user    string
+		count   int
+	}{
+		{`Oct 18 09:12:01 web sshd[812]: Failed password for root from 203.0.113.7 port 52044 ssh2`, true, AuthSSH, "203.0.113.7", "root", 1},
+		{`Oct 18 09:12:01 web sshd[812]: Failed password for invalid user admin from 203.0.113.7 port 52044 ssh2`, true, AuthSSH, "203.0.113.7", "admin", 1},
+		{`Oct 18 09:12:01 web sshd[812]: Invalid user admin from 203.0.113.7 port 52044`, false, "", "", "", 0},
+		{`Oct 18 09:12:01 web sshd[812]: error: maximum authentication attempts exceeded for root from 2001:db8::7 port 52044 ssh2 [preauth]`, true, AuthSSH, "2001:db8::7", "root", 1},
+		{`Oct 18 09:12:01 web sshd[812]: Failed password for root from scanner.example.com port 52044 ssh2`, false, "", "", "", 0},
+		{`Oct 18 09:12:01 mail postfix/smtpd[90]: warning: unknown[198.51.100.2]: SASL LOGIN authentication failed: UGFzc3dvcmQ6`, true, AuthSMTP, "198.51.100.2", "", 1},
+		{`Oct 18 09:12:01 mail dovecot: imap-login: Disconnected (auth failed, 3 attempts in 12 secs): user=<bob>, method=PLAIN, rip=198.51.100.3, lip=10.0.0.1`, true, AuthIMAP, "198.51.100.3", "bob", 3},
+		{`Oct 18 09:12:01 mail dovecot: submission-login: Disconnected (auth failed, 1 attempt in 2 secs): user=<bob>, method=PLAIN, rip=198.51.100.3, lip=10.0.0.1`, true, AuthSMTP, "198.51.100.3", "bob", 1},
+		{`Oct 18 09:12:01 ftp vsftpd[5]: [bob] FAIL LOGIN: Client "::ffff:198.51.100.4"`, true, AuthFTP, "198.51.100.4", "bob", 1},
+		{`Oct 18 09:12:01 web sshd[812]: Accepted publickey for deploy from 203.0.113.7 port 52044 ssh2`, false, "", "", "", 0},
+	}
+	for _, c := range cases {
+		f, ok := ParseAuthLine(c.line)
+		if ok != c.ok {
+			t.Errorf("%s: ok = %v, want %v", c.line, ok, c.ok)
+			continue
+		}
+		if ok && (f.Service != c.service || f.IP != c.ip || f.User != c.user || f.Count != c.count) {
+			t.Errorf("%s: got %+v", c.line, f)
+		}
+	}
+}
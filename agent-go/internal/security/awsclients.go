@@ -0,0 +1,127 @@
+package security
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+//────────────────────────────────────────────────────────────
+//  Swappable AWS clients for the cloud enforcers
+//────────────────────────────────────────────────────────────
+
+// AWSConfigLoader returns the SDK config for region. The agent passes one
+// that knows about stored credentials and assumed roles; nil means the
+// default credential chain.
+type AWSConfigLoader func(ctx context.Context, region string) (aws.Config, error)
+
+// awsClients sits between the cloud enforcers and the EC2 and WAFv2
+// clients so both can be rebuilt, without restarting the enforcers, when
+// the agent's AWS credentials change. It implements EC2NetworkAclAPI,
+// EC2SecurityGroupAPI and WAFv2API by delegating to the current clients.
+type awsClients struct {
+	load     AWSConfigLoader
+	region   string
+	wafScope string
+
+	mu  sync.RWMutex
+	ec2 *ec2.Client
+	waf WAFv2API
+}
+
+func newAWSClients(ctx context.Context, load AWSConfigLoader, region, wafScope string) (*awsClients, error) {
+	if load == nil {
+		load = func(ctx context.Context, region string) (aws.Config, error) {
+			return awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+		}
+	}
+	c := &awsClients{load: load, region: region, wafScope: wafScope}
+	if err := c.reload(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload builds new clients; calls in flight finish with the old ones.
+func (c *awsClients) reload(ctx context.Context) error {
+	cfg, err := c.load(ctx, c.region)
+	if err != nil {
+		return err
+	}
+	cfg.Region = c.region
+	ec2Client := ec2.NewFromConfig(cfg)
+	waf := NewWafv2Client(cfg, c.wafScope)
+	c.mu.Lock()
+	c.ec2, c.waf = ec2Client, waf
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *awsClients) ec2Client() *ec2.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ec2
+}
+
+func (c *awsClients) wafClient() WAFv2API {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.waf
+}
+
+func (c *awsClients) DescribeNetworkAcls(ctx context.Context, params *ec2.DescribeNetworkAclsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkAclsOutput, error) {
+	return c.ec2Client().DescribeNetworkAcls(ctx, params, optFns...)
+}
+
+func (c *awsClients) CreateNetworkAclEntry(ctx context.Context, params *ec2.CreateNetworkAclEntryInput, optFns ...func(*ec2.Options)) (*ec2.CreateNetworkAclEntryOutput, error) {
+	return c.ec2Client().CreateNetworkAclEntry(ctx, params, optFns...)
+}
+
+func (c *awsClients) DeleteNetworkAclEntry(ctx context.Context, params *ec2.DeleteNetworkAclEntryInput, optFns ...func(*ec2.Options)) (*ec2.DeleteNetworkAclEntryOutput, error) {
+	return c.ec2Client().DeleteNetworkAclEntry(ctx, params, optFns...)
+}
+
+func (c *awsClients) DescribeSecurityGroupRules(ctx context.Context, params *ec2.DescribeSecurityGroupRulesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error) {
+	return c.ec2Client().DescribeSecurityGroupRules(ctx, params, optFns...)
+}
+
+func (c *awsClients) AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	return c.ec2Client().AuthorizeSecurityGroupIngress(ctx, params, optFns...)
+}
+
+func (c *awsClients) RevokeSecurityGroupIngress(ctx context.Context, params *ec2.RevokeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	return c.ec2Client().RevokeSecurityGroupIngress(ctx, params, optFns...)
+}
+
+func (c *awsClients) DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	return c.ec2Client().DescribeNetworkInterfaces(ctx, params, optFns...)
+}
+
+func (c *awsClients) GetIPSet(ctx context.Context, in *WafGetIPSetInput) (*WafGetIPSetOutput, error) {
+	return c.wafClient().GetIPSet(ctx, in)
+}
+
+func (c *awsClients) UpdateIPSet(ctx context.Context, in *WafUpdateIPSetInput) (*WafUpdateIPSetOutput, error) {
+	return c.wafClient().UpdateIPSet(ctx, in)
+}
+
+// ReloadAWSCredentials rebuilds the EC2 and WAFv2 clients of the cloud
+// enforcers from the current credentials. It does nothing when no cloud
+// enforcer is configured.
+func (e *Engine) ReloadAWSCredentials(ctx context.Context) error {
+	e.awsMu.Lock()
+	clients := e.aws
+	e.awsMu.Unlock()
+	if clients == nil {
+		return nil
+	}
+	if err := clients.reload(ctx); err != nil {
+		return err
+	}
+	log.Printf("security: AWS clients reloaded with new credentials")
+	return nil
+}
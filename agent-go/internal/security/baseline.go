@@ -0,0 +1,273 @@
+package security
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Traffic baselines and anomaly detection
+//────────────────────────────────────────────────────────────
+
+// Anomaly is a per-minute request count that exceeded its baseline by
+// more than the configured number of standard deviations.
+type Anomaly struct {
+	Key   string    `json:"key"`   // "site:<log>", "path:<path>" or "asn:<n>"
+	Scope string    `json:"scope"` // site, path, asn
+	Count int       `json:"count"`
+	Mean  float64   `json:"mean"`
+	Std   float64   `json:"std"`
+	Sigma float64   `json:"sigma"` // (count - mean) / std
+	Time  time.Time `json:"time"`  // start of the minute
+}
+
+// BaselineStatus is reported in the security snapshot.
+type BaselineStatus struct {
+	Keys      int       `json:"keys"`
+	Warm      int       `json:"warm"` // keys with enough history to flag anomalies
+	LastSaved time.Time `json:"lastSaved,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+const (
+	baselineAlpha         = 0.01 // overall EWMA, roughly the last few hours
+	baselineSeasonalAlpha = 0.05 // hour-of-week slot, roughly the last few weeks
+	baselineWarmup        = 60   // observations before a key can flag anomalies
+	baselineSlotWarmup    = 30   // observations before a slot replaces the overall EWMA
+	baselineAdmitMin      = 5    // requests per minute before a new path/asn is tracked
+	baselineMaxKeys       = 5000
+	baselineIdle          = 7 * 24 * time.Hour // forget keys unseen this long
+	hoursPerWeek          = 7 * 24
+)
+
+// baselineStat is an exponentially weighted mean and variance.
+type baselineStat struct {
+	Mean float64 `json:"m"`
+	Var  float64 `json:"v"`
+	N    int     `json:"n"`
+}
+
+func (s *baselineStat) observe(x, alpha float64) {
+	// start as a plain running average so early minutes aren't over-weighted
+	if a := 1 / float64(s.N+1); a > alpha {
+		alpha = a
+	}
+	diff := x - s.Mean
+	incr := alpha * diff
+	s.Mean += incr
+	s.Var = (1 - alpha) * (s.Var + diff*incr)
+	s.N++
+}
+
+// std never drops below the Poisson noise of the mean, so a path that is
+// almost always hit exactly 3 times a minute does not alarm at 5.
+func (s *baselineStat) std() float64 {
+	return math.Max(math.Sqrt(s.Var), math.Max(math.Sqrt(s.Mean), 1))
+}
+
+type baselineEntry struct {
+	Overall  baselineStat   `json:"o"`
+	Seasonal []baselineStat `json:"s,omitempty"` // hour-of-week slots, sites only
+	LastSeen int64          `json:"t"`           // unix seconds
+}
+
+// stat returns the profile to compare against at t.
+func (b *baselineEntry) stat(t time.Time) *baselineStat {
+	if len(b.Seasonal) == hoursPerWeek {
+		if s := &b.Seasonal[hourOfWeek(t)]; s.N >= baselineSlotWarmup {
+			return s
+		}
+	}
+	return &b.Overall
+}
+
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Baseline learns per-minute request counts per site, path and ASN.
+// Sites get hour-of-week profiles; paths and ASNs, which are far more
+// numerous, get a single EWMA. Not safe for concurrent use: the engine
+// calls it with e.mu held.
+type Baseline struct {
+	path     string
+	sigma    float64
+	minCount int
+
+	entries   map[string]*baselineEntry
+	lastSaved time.Time
+	lastError string
+}
+
+// NewBaseline loads the profiles persisted at path, if any.
+func NewBaseline(path string, sigma float64, minCount int) *Baseline {
+	if sigma <= 0 {
+		sigma = 4
+	}
+	if minCount <= 0 {
+		minCount = 30
+	}
+	b := &Baseline{
+		path:     path,
+		sigma:    sigma,
+		minCount: minCount,
+		entries:  make(map[string]*baselineEntry),
+	}
+	if path == "" {
+		return b
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("security: could not read baseline %s: %v", path, err)
+		}
+		return b
+	}
+	if err := json.Unmarshal(data, &b.entries); err != nil {
+		log.Printf("security: ignoring corrupt baseline %s: %v", path, err)
+		b.entries = make(map[string]*baselineEntry)
+	}
+	log.Printf("security: loaded %d baseline profiles from %s", len(b.entries), path)
+	return b
+}
+
+// Observe feeds one completed minute of counts and returns the keys whose
+// count was anomalous. Keys without traffic this minute observe zero.
+// Anomalous minutes are learned at a tenth of the normal rate so an
+// attack doesn't become the new normal within minutes.
+func (b *Baseline) Observe(minute time.Time, counts map[string]int) []Anomaly {
+	var out []Anomaly
+	now := minute.Unix()
+	slot := hourOfWeek(minute)
+
+	for key, n := range counts {
+		if _, ok := b.entries[key]; ok || n < baselineAdmitMin || len(b.entries) >= baselineMaxKeys {
+			continue
+		}
+		e := &baselineEntry{}
+		if strings.HasPrefix(key, "site:") {
+			e.Seasonal = make([]baselineStat, hoursPerWeek)
+		}
+		b.entries[key] = e
+	}
+
+	for key, e := range b.entries {
+		n := counts[key]
+		if n > 0 {
+			e.LastSeen = now
+		} else if now-e.LastSeen > int64(baselineIdle/time.Second) {
+			delete(b.entries, key)
+			continue
+		}
+
+		x := float64(n)
+		st := e.stat(minute)
+		anomalous := false
+		if e.Overall.N >= baselineWarmup && n >= b.minCount {
+			if sigma := (x - st.Mean) / st.std(); sigma > b.sigma {
+				anomalous = true
+				out = append(out, Anomaly{
+					Key:   key,
+					Scope: key[:strings.Index(key, ":")],
+					Count: n,
+					Mean:  round2(st.Mean),
+					Std:   round2(st.std()),
+					Sigma: round2(sigma),
+					Time:  minute,
+				})
+			}
+		}
+
+		alpha, seasonalAlpha := baselineAlpha, baselineSeasonalAlpha
+		if anomalous {
+			alpha /= 10
+			seasonalAlpha /= 10
+		}
+		e.Overall.observe(x, alpha)
+		if len(e.Seasonal) == hoursPerWeek {
+			e.Seasonal[slot].observe(x, seasonalAlpha)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Sigma > out[j].Sigma })
+	return out
+}
+
+// Limit returns the adaptive per-minute threshold for key at t, or false
+// while the key has too little history.
+func (b *Baseline) Limit(key string, t time.Time) (int, bool) {
+	e, ok := b.entries[key]
+	if !ok || e.Overall.N < baselineWarmup {
+		return 0, false
+	}
+	st := e.stat(t)
+	limit := int(math.Ceil(st.Mean + b.sigma*st.std()))
+	if limit < b.minCount {
+		limit = b.minCount
+	}
+	return limit, true
+}
+
+// Keys returns the tracked keys starting with prefix.
+func (b *Baseline) Keys(prefix string) []string {
+	var out []string
+	for key := range b.entries {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// Encode serializes the profiles for Write. Like every method that reads
+// the profiles, it needs the engine's lock.
+func (b *Baseline) Encode() ([]byte, error) {
+	return json.Marshal(b.entries)
+}
+
+// Write stores data from Encode atomically. It touches no profile state,
+// so it runs without the engine's lock; report the result with Saved.
+func (b *Baseline) Write(data []byte) error {
+	if b.path == "" {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(b.path), 0o755)
+	if err == nil {
+		tmp := b.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, b.path)
+		}
+	}
+	return err
+}
+
+// Saved records the outcome of Write for Status.
+func (b *Baseline) Saved(err error) {
+	if err != nil {
+		b.lastError = err.Error()
+		return
+	}
+	b.lastSaved = time.Now()
+	b.lastError = ""
+}
+
+func (b *Baseline) Status() BaselineStatus {
+	st := BaselineStatus{Keys: len(b.entries), LastSaved: b.lastSaved, LastError: b.lastError}
+	for _, e := range b.entries {
+		if e.Overall.N >= baselineWarmup {
+			st.Warm++
+		}
+	}
+	return st
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
@@ -0,0 +1,34 @@
+package security
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBaselineSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "baseline.json")
+	b := NewBaseline(path, 4, 30)
+	minute := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		b.Observe(minute.Add(time.Duration(i)*time.Minute), map[string]int{"site:shop.access.log": 120, "path:/": 40})
+	}
+
+	data, err := b.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Write(data)
+	b.Saved(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Status(); st.LastSaved.IsZero() || st.LastError != "" {
+		t.Fatalf("status = %+v", st)
+	}
+
+	loaded := NewBaseline(path, 4, 30)
+	if got, want := loaded.Status().Keys, b.Status().Keys; got != want || got != 2 {
+		t.Fatalf("loaded %d keys, saved %d, want 2", got, want)
+	}
+}
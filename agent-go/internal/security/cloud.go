@@ -0,0 +1,538 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Cloud firewall enforcement (NACL, WAFv2 IP set, security group)
+//────────────────────────────────────────────────────────────
+
+// Cloud enforcer kinds accepted in Config.CloudEnforcers
+const (
+	CloudNACL          = "nacl"
+	CloudWAFv2         = "wafv2"
+	CloudSecurityGroup = "security-group"
+)
+
+// CloudEnforcer pushes bans to a cloud-side firewall. Block and Unblock
+// never block the caller; Reconcile converges the remote state to the
+// given set of banned IPs (oldest first), healing drift and failed calls.
+type CloudEnforcer interface {
+	Name() string
+	Block(ip string)
+	Unblock(ip string)
+	Reconcile(desired []string)
+	Status() CloudEnforcerStatus
+}
+
+// CloudEntry is one agent-owned block in a cloud firewall.
+type CloudEntry struct {
+	IP      string    `json:"ip"`
+	Rule    int32     `json:"rule,omitempty"`    // NACL rule number
+	RuleId  string    `json:"ruleId,omitempty"`  // security group rule id
+	Created time.Time `json:"created,omitempty"` // zero for entries found on an earlier run
+}
+
+// CloudEnforcerStatus is reported in the security snapshot.
+type CloudEnforcerStatus struct {
+	Name          string       `json:"name"`
+	Kind          string       `json:"kind"`
+	Target        string       `json:"target"`
+	Capacity      int          `json:"capacity"`
+	Used          int          `json:"used"`
+	Pending       int          `json:"pending"`
+	Evictions     uint64       `json:"evictions"`
+	LastSync      time.Time    `json:"lastSync"`
+	LastReconcile time.Time    `json:"lastReconcile,omitempty"`
+	LastError     string       `json:"lastError,omitempty"`
+	Entries       []CloudEntry `json:"entries"`
+}
+
+// CloudResult is the outcome of one provider call, reported for the
+// audit log.
+type CloudResult struct {
+	Enforcer string
+	Op       string // add, remove, evict
+	IPs      []string
+	Err      error
+}
+
+// cloudResultReporter is implemented by enforcers that report every
+// provider call.
+type cloudResultReporter interface {
+	setResultHook(fn func(CloudResult))
+}
+
+// cloudBackend is the provider-specific part of an enforcer. Its methods
+// are only called from the enforcer's worker goroutine, so backends need
+// no locking of their own.
+type cloudBackend interface {
+	kind() string
+	target() string
+	// sync re-reads the remote firewall and rebuilds the owned entries.
+	sync(ctx context.Context) error
+	// entries returns the agent-owned blocks, in any order.
+	entries() []CloudEntry
+	// capacity is how many blocks the agent may own right now.
+	capacity() int
+	add(ctx context.Context, ips []string) error
+	remove(ctx context.Context, ips []string) error
+}
+
+// errCloudFull is returned (wrapped) by a backend when the provider
+// rejected an add because a quota was reached.
+var errCloudFull = errors.New("cloud firewall is full")
+
+const (
+	cloudRetryAttempts = 4
+	cloudRetryBase     = 500 * time.Millisecond
+	cloudSyncEvery     = 5 * time.Minute
+	cloudQueueSize     = 4096
+	cloudBatchMax      = 100 // block/unblock ops coalesced into one provider call
+)
+
+type cloudOp struct {
+	ip        string
+	block     bool
+	reconcile bool
+	desired   []string
+}
+
+// cloudEnforcer runs one backend on a single worker goroutine, batching
+// queued ops, evicting the oldest agent-owned entry when full and
+// publishing a copy of the state for Status.
+type cloudEnforcer struct {
+	name    string
+	backend cloudBackend
+	ops     chan cloudOp
+
+	mu            sync.Mutex
+	entries       []CloudEntry
+	capacity      int
+	evictions     uint64
+	lastSync      time.Time
+	lastReconcile time.Time
+	lastError     string
+	onResult      func(CloudResult)
+}
+
+func newCloudEnforcer(b cloudBackend) *cloudEnforcer {
+	c := &cloudEnforcer{
+		name:    b.kind() + ":" + b.target(),
+		backend: b,
+		ops:     make(chan cloudOp, cloudQueueSize),
+	}
+	go c.run()
+	return c
+}
+
+func (c *cloudEnforcer) Name() string {
+	return c.name
+}
+
+func (c *cloudEnforcer) Block(ip string) {
+	c.enqueue(cloudOp{ip: ip, block: true})
+}
+
+func (c *cloudEnforcer) Unblock(ip string) {
+	c.enqueue(cloudOp{ip: ip})
+}
+
+func (c *cloudEnforcer) Reconcile(desired []string) {
+	c.enqueue(cloudOp{reconcile: true, desired: desired})
+}
+
+func (c *cloudEnforcer) enqueue(op cloudOp) {
+	select {
+	case c.ops <- op:
+	default:
+		// dropped ops are repaired by the next reconcile
+		c.setError(fmt.Errorf("%s queue full, dropped op for %s", c.name, op.ip))
+	}
+}
+
+func (c *cloudEnforcer) run() {
+	ctx := context.Background()
+	c.sync(ctx)
+
+	ticker := time.NewTicker(cloudSyncEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op := <-c.ops:
+			if op.reconcile {
+				c.reconcile(ctx, op.desired)
+				continue
+			}
+			batch := []cloudOp{op}
+		drain:
+			for len(batch) < cloudBatchMax {
+				select {
+				case next := <-c.ops:
+					if next.reconcile {
+						c.apply(ctx, batch)
+						batch = nil
+						c.reconcile(ctx, next.desired)
+						continue
+					}
+					batch = append(batch, next)
+				default:
+					break drain
+				}
+			}
+			c.apply(ctx, batch)
+		case <-ticker.C:
+			c.sync(ctx)
+		}
+	}
+}
+
+func (c *cloudEnforcer) sync(ctx context.Context) bool {
+	if err := c.backend.sync(ctx); err != nil {
+		c.setError(err)
+		log.Printf("security: %s sync failed: %v", c.name, err)
+		return false
+	}
+	c.mu.Lock()
+	c.lastSync = time.Now()
+	c.lastError = ""
+	c.mu.Unlock()
+	c.publish()
+	return true
+}
+
+// apply runs ops, in ban order: the last op for an IP wins, and adds
+// keep their order so that add trims the oldest when short of room.
+func (c *cloudEnforcer) apply(ctx context.Context, ops []cloudOp) {
+	if len(ops) == 0 {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, e := range c.backend.entries() {
+		current[e.IP] = true
+	}
+	last := make(map[string]int, len(ops))
+	for i, op := range ops {
+		last[op.ip] = i
+	}
+	var add, remove []string
+	for i, op := range ops {
+		switch {
+		case last[op.ip] != i:
+		case op.block && !current[op.ip]:
+			add = append(add, op.ip)
+		case !op.block && current[op.ip]:
+			remove = append(remove, op.ip)
+		}
+	}
+	sort.Strings(remove)
+
+	var errs []error
+	if len(remove) > 0 {
+		err := c.backend.remove(ctx, remove)
+		c.report("remove", remove, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(add) > 0 {
+		if err := c.add(ctx, add); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		c.setError(err)
+		log.Printf("security: %s update failed: %v", c.name, err)
+	}
+	c.publish()
+}
+
+// add makes room by evicting the oldest agent-owned entries, then adds.
+// ips are oldest first; when more than fit, the newest are kept.
+func (c *cloudEnforcer) add(ctx context.Context, ips []string) error {
+	capacity := c.backend.capacity()
+	if capacity <= 0 {
+		return fmt.Errorf("%s has no capacity for agent rules", c.name)
+	}
+	if len(ips) > capacity {
+		ips = ips[len(ips)-capacity:]
+	}
+	if need := len(c.backend.entries()) + len(ips) - capacity; need > 0 {
+		if err := c.evict(ctx, need); err != nil {
+			return err
+		}
+	}
+
+	err := c.backend.add(ctx, ips)
+	if errors.Is(err, errCloudFull) {
+		// quota smaller than we thought: free one slot and retry once
+		if err := c.evict(ctx, 1); err != nil {
+			return err
+		}
+		err = c.backend.add(ctx, ips)
+	}
+	c.report("add", ips, err)
+	return err
+}
+
+// evict removes the n oldest agent-owned entries.
+func (c *cloudEnforcer) evict(ctx context.Context, n int) error {
+	entries := c.backend.entries()
+	if len(entries) == 0 {
+		return fmt.Errorf("%s is full and has no agent-owned entries to evict", c.name)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Created.Equal(entries[j].Created) {
+			return entries[i].IP < entries[j].IP
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	if n > len(entries) {
+		n = len(entries)
+	}
+	victims := make([]string, 0, n)
+	for _, e := range entries[:n] {
+		victims = append(victims, e.IP)
+	}
+
+	err := c.backend.remove(ctx, victims)
+	c.report("evict", victims, err)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.evictions += uint64(n)
+	c.mu.Unlock()
+	log.Printf("security: %s full, evicted %d oldest entries (%v)", c.name, n, victims)
+	return nil
+}
+
+// reconcile re-reads the remote state and converges it to desired,
+// keeping the newest bans when there are more than fit.
+func (c *cloudEnforcer) reconcile(ctx context.Context, desired []string) {
+	if !c.sync(ctx) {
+		return
+	}
+	if capacity := c.backend.capacity(); len(desired) > capacity {
+		desired = desired[len(desired)-capacity:]
+	}
+
+	want := make(map[string]bool, len(desired))
+	for _, ip := range desired {
+		want[ip] = true
+	}
+	var ops []cloudOp
+	for _, e := range c.backend.entries() {
+		if !want[e.IP] {
+			ops = append(ops, cloudOp{ip: e.IP})
+		}
+	}
+	for _, ip := range desired {
+		ops = append(ops, cloudOp{ip: ip, block: true})
+	}
+	c.apply(ctx, ops)
+
+	c.mu.Lock()
+	c.lastReconcile = time.Now()
+	c.mu.Unlock()
+}
+
+// publish copies the backend state for Status.
+func (c *cloudEnforcer) publish() {
+	entries := c.backend.entries()
+	capacity := c.backend.capacity()
+	c.mu.Lock()
+	c.entries = entries
+	c.capacity = capacity
+	c.mu.Unlock()
+}
+
+func (c *cloudEnforcer) setResultHook(fn func(CloudResult)) {
+	c.mu.Lock()
+	c.onResult = fn
+	c.mu.Unlock()
+}
+
+func (c *cloudEnforcer) report(op string, ips []string, err error) {
+	c.mu.Lock()
+	fn := c.onResult
+	c.mu.Unlock()
+	if fn != nil {
+		fn(CloudResult{Enforcer: c.name, Op: op, IPs: ips, Err: err})
+	}
+}
+
+func (c *cloudEnforcer) setError(err error) {
+	c.mu.Lock()
+	c.lastError = err.Error()
+	c.mu.Unlock()
+}
+
+func (c *cloudEnforcer) Status() CloudEnforcerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := append([]CloudEntry(nil), c.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Rule != entries[j].Rule {
+			return entries[i].Rule < entries[j].Rule
+		}
+		return entries[i].IP < entries[j].IP
+	})
+
+	return CloudEnforcerStatus{
+		Name:          c.name,
+		Kind:          c.backend.kind(),
+		Target:        c.backend.target(),
+		Capacity:      c.capacity,
+		Used:          len(entries),
+		Pending:       len(c.ops),
+		Evictions:     c.evictions,
+		LastSync:      c.lastSync,
+		LastReconcile: c.lastReconcile,
+		LastError:     c.lastError,
+		Entries:       entries,
+	}
+}
+
+// deferredEnforcer stands in for a cloud enforcer that could not start,
+// e.g. on an AWS credentials error, a transient API error or an attached
+// security group. It reports the error in its status and retries start
+// every interval; once started it delegates, and the engine's next
+// reconcile pushes the active bans. One built for a config error is
+// never started.
+type deferredEnforcer struct {
+	name   string
+	kind   string
+	target string
+
+	mu        sync.Mutex
+	started   CloudEnforcer
+	lastError string
+	lastTry   time.Time
+	onResult  func(CloudResult)
+}
+
+// startCloudEnforcer runs start once and returns its enforcer, or a
+// deferredEnforcer retrying it every interval when it fails.
+func startCloudEnforcer(kind, target string, interval time.Duration, start func() (CloudEnforcer, error)) CloudEnforcer {
+	d := &deferredEnforcer{name: kind + ":" + target, kind: kind, target: target}
+	if c, err := d.try(start); err == nil {
+		return c
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, err := d.try(start); err == nil {
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *deferredEnforcer) try(start func() (CloudEnforcer, error)) (CloudEnforcer, error) {
+	c, err := start()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastTry = time.Now()
+	if err != nil {
+		d.lastError = err.Error()
+		log.Printf("security: cloud enforcer %s not started: %v", d.name, err)
+		return nil, err
+	}
+	if r, ok := c.(cloudResultReporter); ok && d.onResult != nil {
+		r.setResultHook(d.onResult)
+	}
+	d.started = c
+	d.lastError = ""
+	log.Printf("security: cloud enforcer %s started", d.name)
+	return c, nil
+}
+
+func (d *deferredEnforcer) enforcer() CloudEnforcer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.started
+}
+
+func (d *deferredEnforcer) Name() string {
+	return d.name
+}
+
+// Block and Unblock are dropped until started; the first reconcile after
+// the start catches up.
+func (d *deferredEnforcer) Block(ip string) {
+	if c := d.enforcer(); c != nil {
+		c.Block(ip)
+	}
+}
+
+func (d *deferredEnforcer) Unblock(ip string) {
+	if c := d.enforcer(); c != nil {
+		c.Unblock(ip)
+	}
+}
+
+func (d *deferredEnforcer) Reconcile(desired []string) {
+	if c := d.enforcer(); c != nil {
+		c.Reconcile(desired)
+	}
+}
+
+func (d *deferredEnforcer) setResultHook(fn func(CloudResult)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onResult = fn
+	if r, ok := d.started.(cloudResultReporter); ok {
+		r.setResultHook(fn)
+	}
+}
+
+func (d *deferredEnforcer) Status() CloudEnforcerStatus {
+	if c := d.enforcer(); c != nil {
+		return c.Status()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return CloudEnforcerStatus{
+		Name:      d.name,
+		Kind:      d.kind,
+		Target:    d.target,
+		LastSync:  d.lastTry,
+		LastError: d.lastError,
+	}
+}
+
+// withRetry runs fn with exponential backoff.
+func withRetry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < cloudRetryAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < cloudRetryAttempts-1 && !sleepCtx(ctx, cloudRetryBase<<attempt) {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
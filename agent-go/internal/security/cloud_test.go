@@ -0,0 +1,145 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestEnforcer wraps b without starting the worker, so tests drive
+// sync, apply and reconcile synchronously.
+func newTestEnforcer(t *testing.T, b cloudBackend) *cloudEnforcer {
+	t.Helper()
+	c := &cloudEnforcer{
+		name:    b.kind() + ":" + b.target(),
+		backend: b,
+		ops:     make(chan cloudOp, cloudQueueSize),
+	}
+	if !c.sync(context.Background()) {
+		t.Fatalf("initial sync failed: %s", c.Status().LastError)
+	}
+	return c
+}
+
+// block bans ips in order, oldest first.
+func block(c *cloudEnforcer, ips ...string) {
+	ops := make([]cloudOp, 0, len(ips))
+	for _, ip := range ips {
+		ops = append(ops, cloudOp{ip: ip, block: true})
+	}
+	c.apply(context.Background(), ops)
+}
+
+func unblock(c *cloudEnforcer, ips ...string) {
+	ops := make([]cloudOp, 0, len(ips))
+	for _, ip := range ips {
+		ops = append(ops, cloudOp{ip: ip})
+	}
+	c.apply(context.Background(), ops)
+}
+
+// ownedIPs lists the backend's agent-owned entries, sorted.
+func ownedIPs(b cloudBackend) []string {
+	var out []string
+	for _, e := range b.entries() {
+		out = append(out, e.IP)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCloudEnforcerReportsResults(t *testing.T) {
+	api := newFakeNacl()
+	c := newTestEnforcer(t, &naclBackend{
+		api: api, aclID: "acl-1", ruleMin: 100, ruleMax: 110, maxEntries: 20,
+		owned: map[string]CloudEntry{}, used: map[int32]bool{},
+	})
+	var results []CloudResult
+	c.setResultHook(func(r CloudResult) { results = append(results, r) })
+
+	block(c, "203.0.113.7")
+	unblock(c, "203.0.113.7")
+
+	if len(results) != 2 || results[0].Op != "add" || results[1].Op != "remove" {
+		t.Fatalf("results = %+v, want add then remove", results)
+	}
+	for _, r := range results {
+		if r.Err != nil || !equalStrings(r.IPs, []string{"203.0.113.7"}) {
+			t.Fatalf("result %+v", r)
+		}
+	}
+}
+
+// stubEnforcer records the reconciles it receives.
+type stubEnforcer struct {
+	mu         sync.Mutex
+	reconciled [][]string
+}
+
+func (s *stubEnforcer) Name() string      { return "stub" }
+func (s *stubEnforcer) Block(ip string)   {}
+func (s *stubEnforcer) Unblock(ip string) {}
+func (s *stubEnforcer) Reconcile(desired []string) {
+	s.mu.Lock()
+	s.reconciled = append(s.reconciled, desired)
+	s.mu.Unlock()
+}
+func (s *stubEnforcer) Status() CloudEnforcerStatus { return CloudEnforcerStatus{Name: "stub"} }
+
+func TestDeferredEnforcerRetries(t *testing.T) {
+	var attempts atomic.Int32
+	stub := &stubEnforcer{}
+	c := startCloudEnforcer(CloudSecurityGroup, "sg-1", 10*time.Millisecond, func() (CloudEnforcer, error) {
+		if attempts.Add(1) < 3 {
+			return nil, errors.New("security group sg-1 is attached to eni-1")
+		}
+		return stub, nil
+	})
+	if st := c.Status(); !strings.Contains(st.LastError, "eni-1") || st.Target != "sg-1" {
+		t.Fatalf("status = %+v, want the start error", st)
+	}
+	c.Reconcile([]string{"203.0.113.1"}) // dropped: not started yet
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Status().Name != "stub" {
+		if time.Now().After(deadline) {
+			t.Fatalf("not started after %d attempts", attempts.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Reconcile([]string{"203.0.113.2"})
+	if len(stub.reconciled) != 1 || stub.reconciled[0][0] != "203.0.113.2" {
+		t.Fatalf("reconciled = %v, want only the one after the start", stub.reconciled)
+	}
+}
+
+func TestCloudConfigErrorKeepsEngine(t *testing.T) {
+	e := newTestEngine(t, &Config{
+		AwsRegion:      "eu-west-1",
+		CloudEnforcers: []string{CloudSecurityGroup, "bogus"},
+	})
+	st := e.Snapshot().Cloud
+	if len(st) != 2 || !strings.Contains(st[0].LastError, "awsSecurityGroupId") || !strings.Contains(st[1].LastError, "unknown") {
+		t.Fatalf("cloud status = %+v, want both config errors", st)
+	}
+	if err := e.Ban("203.0.113.7", "test", time.Minute); err != nil || !e.isBanned("203.0.113.7") {
+		t.Fatalf("local ban failed: %v", err)
+	}
+}
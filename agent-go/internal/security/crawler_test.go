@@ -0,0 +1,147 @@
+package security
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// stubDNS answers PTR, A and AAAA queries over UDP from fixed records.
+// Unknown names get NXDOMAIN.
+type stubDNS struct {
+	ptr  map[string]string   // reverse name -> host
+	addr map[string][]net.IP // host -> addresses
+}
+
+func startStubDNS(t *testing.T, s *stubDNS) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.answer(buf[:n]); resp != nil {
+				conn.WriteTo(resp, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func (s *stubDNS) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	// question: labels, then type and class
+	var labels []string
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		l := int(q[i])
+		if i+1+l > len(q) {
+			return nil
+		}
+		labels = append(labels, string(q[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(q) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(q[i+1:])
+	question := q[12 : i+5]
+
+	var answers [][]byte
+	known := false
+	switch qtype {
+	case 12: // PTR
+		if host, ok := s.ptr[name]; ok {
+			known = true
+			answers = append(answers, encodeDNSName(host))
+		}
+	case 1, 28: // A, AAAA
+		if ips, ok := s.addr[name]; ok {
+			known = true
+			for _, ip := range ips {
+				if v4 := ip.To4(); v4 != nil && qtype == 1 {
+					answers = append(answers, v4)
+				} else if v4 == nil && qtype == 28 {
+					answers = append(answers, ip.To16())
+				}
+			}
+		}
+	}
+
+	resp := make([]byte, 12, 512)
+	copy(resp, q[:2])
+	flags := uint16(0x8180) // response, recursion desired and available
+	if !known {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, rdata := range answers {
+		resp = append(resp, 0xc0, 12) // name: pointer to the question
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1)  // IN
+		resp = binary.BigEndian.AppendUint32(resp, 60) // TTL
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(l)))
+		out = append(out, l...)
+	}
+	return append(out, 0)
+}
+
+func TestCrawlerVerification(t *testing.T) {
+	addr := startStubDNS(t, &stubDNS{
+		ptr: map[string]string{
+			"1.66.249.66.in-addr.arpa": "crawl-66-249-66-1.googlebot.com",
+			"7.113.0.203.in-addr.arpa": "7.113.0.203.bc.googleusercontent.com", // a Google Cloud VM
+			"9.113.0.203.in-addr.arpa": "crawl-66-249-66-9.googlebot.com",      // PTR set by the IP's owner
+			"1.39.55.157.in-addr.arpa": "msnbot-157-55-39-1.search.msn.com",
+		},
+		addr: map[string][]net.IP{
+			"crawl-66-249-66-1.googlebot.com":      {net.ParseIP("66.249.66.1")},
+			"7.113.0.203.bc.googleusercontent.com": {net.ParseIP("203.0.113.7")},
+			"crawl-66-249-66-9.googlebot.com":      {net.ParseIP("66.249.66.9")},
+			"msnbot-157-55-39-1.search.msn.com":    {net.ParseIP("157.55.39.1")},
+		},
+	})
+	v := NewCrawlerVerifier(addr, 0, nil)
+	googlebot, _ := matchCrawler("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	bingbot, _ := matchCrawler("Mozilla/5.0 (compatible; bingbot/2.0)")
+
+	for _, tc := range []struct {
+		ip   string
+		bot  knownCrawler
+		want CrawlerStatus
+	}{
+		{"66.249.66.1", googlebot, CrawlerVerified},
+		{"203.0.113.7", googlebot, CrawlerImpostor},  // forward-confirmed, but not a Google crawler domain
+		{"203.0.113.9", googlebot, CrawlerImpostor},  // PTR doesn't resolve back
+		{"198.51.100.1", googlebot, CrawlerImpostor}, // no PTR at all
+		{"157.55.39.1", googlebot, CrawlerImpostor},  // bingbot's PTR for a Googlebot UA
+		{"157.55.39.1", bingbot, CrawlerVerified},
+	} {
+		if got := v.verify(tc.ip, tc.bot).status; got != tc.want {
+			t.Errorf("verify(%s as %s) = %d, want %d", tc.ip, tc.bot.Name, got, tc.want)
+		}
+	}
+}
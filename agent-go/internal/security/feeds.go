@@ -0,0 +1,429 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Threat-intel blocklist feeds
+//────────────────────────────────────────────────────────────
+
+// FeedConfig describes one IP reputation list (Spamhaus DROP, FireHOL, custom).
+// Source is either an http(s) URL or a local file path.
+type FeedConfig struct {
+	Name           string `json:"name"`
+	Source         string `json:"source"`
+	Format         string `json:"format"`         // "plain" (default), "cidr" or "csv"
+	CsvColumn      int    `json:"csvColumn"`      // zero-based column holding the IP/CIDR for csv feeds
+	RefreshMinutes int    `json:"refreshMinutes"` // default 60
+}
+
+// FeedStatus is reported by GET /security/feeds
+type FeedStatus struct {
+	Name        string    `json:"name"`
+	Source      string    `json:"source"`
+	Format      string    `json:"format"`
+	LastRefresh time.Time `json:"lastRefresh"`
+	LastError   string    `json:"lastError,omitempty"`
+	EntryCount  int       `json:"entryCount"`
+	Hits        uint64    `json:"hits"`
+}
+
+type feedState struct {
+	cfg         FeedConfig
+	entries     map[string]*net.IPNet // canonical CIDR -> network
+	lastRefresh time.Time
+	lastError   string
+	hits        atomic.Uint64 // counted under the read lock
+}
+
+// FeedManager loads blocklists on a schedule and keeps the dedicated feed
+// ipsets (IPv4, and IPv6 in ipset+"_v6") in sync with the union of all
+// feeds. They are separate from the rate-limit ban set so refreshing a
+// feed never lifts an active ban.
+type FeedManager struct {
+	ipset  string
+	ipset6 string
+	client *http.Client
+	fwMu   sync.Mutex // serializes diff + ipset commands across feeds
+
+	// onRefresh is called after every refresh attempt (set by the engine)
+	onRefresh func(FeedStatus)
+
+	mu      sync.RWMutex
+	feeds   []*feedState
+	applied map[string]*net.IPNet          // CIDRs currently in the ipsets
+	index   map[prefixLen]map[string][]int // prefix length -> masked network -> feed indexes
+}
+
+type prefixLen struct {
+	ones, bits int
+}
+
+func NewFeedManager(ipset string, feeds []FeedConfig) *FeedManager {
+	m := &FeedManager{
+		ipset:   ipset,
+		ipset6:  ipset + "_v6",
+		client:  &http.Client{Timeout: 60 * time.Second},
+		applied: make(map[string]*net.IPNet),
+		index:   make(map[prefixLen]map[string][]int),
+	}
+	for _, f := range feeds {
+		if f.Name == "" || f.Source == "" {
+			log.Printf("security: skipping threat feed with missing name or source")
+			continue
+		}
+		if f.RefreshMinutes <= 0 {
+			f.RefreshMinutes = 60
+		}
+		if f.Format == "" {
+			f.Format = "plain"
+		}
+		m.feeds = append(m.feeds, &feedState{cfg: f, entries: map[string]*net.IPNet{}})
+	}
+	return m
+}
+
+// ensureFirewall creates the feed ipsets and the nft drop rules for them.
+func (m *FeedManager) ensureFirewall(table, chain string) {
+	exec.Command("ipset", "create", m.ipset, "hash:net").Run()
+	exec.Command("ipset", "create", m.ipset6, "hash:net", "family", "inet6").Run()
+	exec.Command("nft", "add", "rule", table, chain,
+		fmt.Sprintf("ip saddr @%s drop", m.ipset)).Run()
+	exec.Command("nft", "add", "rule", table, chain,
+		fmt.Sprintf("ip6 saddr @%s drop", m.ipset6)).Run()
+}
+
+// Start refreshes every feed immediately and then on its own interval.
+func (m *FeedManager) Start() {
+	for i := range m.feeds {
+		go m.refreshLoop(i)
+	}
+}
+
+func (m *FeedManager) refreshLoop(i int) {
+	m.mu.RLock()
+	interval := time.Duration(m.feeds[i].cfg.RefreshMinutes) * time.Minute
+	m.mu.RUnlock()
+
+	for {
+		m.Refresh(i)
+		time.Sleep(interval)
+	}
+}
+
+// RefreshAll reloads every feed synchronously.
+func (m *FeedManager) RefreshAll() {
+	for i := range m.feeds {
+		m.Refresh(i)
+	}
+}
+
+// Refresh reloads feed i and reconciles the firewall set.
+// On error the previous entries are kept.
+func (m *FeedManager) Refresh(i int) {
+	m.mu.RLock()
+	cfg := m.feeds[i].cfg
+	m.mu.RUnlock()
+
+	entries, err := m.load(cfg)
+
+	m.fwMu.Lock()
+	defer m.fwMu.Unlock()
+
+	m.mu.Lock()
+	st := m.feeds[i]
+	st.lastRefresh = time.Now()
+	if err != nil {
+		st.lastError = err.Error()
+		status := st.status()
+		m.mu.Unlock()
+		log.Printf("security: threat feed %s refresh failed: %v", cfg.Name, err)
+		if m.onRefresh != nil {
+			m.onRefresh(status)
+		}
+		return
+	}
+	st.lastError = ""
+	st.entries = entries
+	m.rebuildIndex()
+	want, add, del := m.diff()
+	m.mu.Unlock()
+
+	// one ipset process for the whole change; -exist ignores entries
+	// added or removed behind our back
+	var errMsg string
+	if len(add)+len(del) > 0 {
+		cmd := exec.Command("ipset", "restore", "-exist")
+		cmd.Stdin = strings.NewReader(m.restoreScript(add, del))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			errMsg = fmt.Sprintf("ipset restore: %v: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	m.mu.Lock()
+	if errMsg == "" {
+		m.applied = want
+	} else {
+		// applied is left as it was, so the next refresh retries the change
+		st.lastError = errMsg
+	}
+	status := st.status()
+	m.mu.Unlock()
+
+	if errMsg != "" {
+		log.Printf("security: threat feed %s: %s", cfg.Name, errMsg)
+	} else {
+		log.Printf("security: threat feed %s refreshed: %d entries (+%d -%d)", cfg.Name, len(entries), len(add), len(del))
+	}
+	if m.onRefresh != nil {
+		m.onRefresh(status)
+	}
+}
+
+// diff computes the union of all feeds and the ipset changes needed to
+// match it. Caller holds m.mu.
+func (m *FeedManager) diff() (want map[string]*net.IPNet, add, del []string) {
+	want = make(map[string]*net.IPNet)
+	for _, st := range m.feeds {
+		for cidr, n := range st.entries {
+			want[cidr] = n
+		}
+	}
+	for cidr := range want {
+		if _, ok := m.applied[cidr]; !ok {
+			add = append(add, cidr)
+		}
+	}
+	for cidr := range m.applied {
+		if _, ok := want[cidr]; !ok {
+			del = append(del, cidr)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(del)
+	return want, add, del
+}
+
+// restoreScript is the "ipset restore" input that deletes del and adds
+// add, each CIDR in the set of its address family.
+func (m *FeedManager) restoreScript(add, del []string) string {
+	var b strings.Builder
+	line := func(op, cidr string) {
+		set := m.ipset
+		if strings.Contains(cidr, ":") {
+			set = m.ipset6
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", op, set, cidr)
+	}
+	for _, cidr := range del {
+		line("del", cidr)
+	}
+	for _, cidr := range add {
+		line("add", cidr)
+	}
+	return b.String()
+}
+
+// rebuildIndex groups feed networks by prefix length so Match does one map
+// lookup per distinct prefix length instead of scanning every CIDR.
+// Caller holds m.mu.
+func (m *FeedManager) rebuildIndex() {
+	idx := make(map[prefixLen]map[string][]int)
+	for i, st := range m.feeds {
+		for _, n := range st.entries {
+			ones, bits := n.Mask.Size()
+			key := prefixLen{ones, bits}
+			if idx[key] == nil {
+				idx[key] = make(map[string][]int)
+			}
+			idx[key][n.IP.String()] = append(idx[key][n.IP.String()], i)
+		}
+	}
+	m.index = idx
+}
+
+// Match returns the names of the feeds listing ip and counts a hit for each.
+func (m *FeedManager) Match(ip net.IP) []string {
+	if ip == nil {
+		return nil
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	} else {
+		ip = ip.To4()
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var names []string
+	for key, nets := range m.index {
+		if key.bits != bits {
+			continue
+		}
+		masked := ip.Mask(net.CIDRMask(key.ones, key.bits)).String()
+		for _, i := range nets[masked] {
+			m.feeds[i].hits.Add(1)
+			names = append(names, m.feeds[i].cfg.Name)
+		}
+	}
+	return names
+}
+
+// Status returns the current state of every feed.
+func (m *FeedManager) Status() []FeedStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]FeedStatus, 0, len(m.feeds))
+	for _, st := range m.feeds {
+		out = append(out, st.status())
+	}
+	return out
+}
+
+func (st *feedState) status() FeedStatus {
+	return FeedStatus{
+		Name:        st.cfg.Name,
+		Source:      st.cfg.Source,
+		Format:      st.cfg.Format,
+		LastRefresh: st.lastRefresh,
+		LastError:   st.lastError,
+		EntryCount:  len(st.entries),
+		Hits:        st.hits.Load(),
+	}
+}
+
+//────────────────────────────────────────────────────────────
+//  Loading / parsing
+//────────────────────────────────────────────────────────────
+
+func (m *FeedManager) load(cfg FeedConfig) (map[string]*net.IPNet, error) {
+	data, err := m.fetch(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	return parseFeed(data, cfg)
+}
+
+func (m *FeedManager) fetch(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, source)
+	}
+	// feeds are small text files; cap at 64MB to protect the agent
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
+
+// parseFeed understands:
+//   - plain/cidr: one IP or CIDR per line, "#" or ";" comments
+//     (covers Spamhaus DROP "1.2.3.0/24 ; SBL123" and FireHOL .netset files)
+//   - csv: the IP/CIDR is taken from cfg.CsvColumn
+func parseFeed(data []byte, cfg FeedConfig) (map[string]*net.IPNet, error) {
+	out := make(map[string]*net.IPNet)
+	add := func(field string) {
+		if n := parseIPOrCIDR(field); n != nil {
+			out[n.String()] = n
+		}
+	}
+
+	switch cfg.Format {
+	case "csv":
+		r := csv.NewReader(bytes.NewReader(data))
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		for {
+			rec, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("csv: %w", err)
+			}
+			if cfg.CsvColumn < len(rec) {
+				add(rec[cfg.CsvColumn])
+			}
+		}
+	case "plain", "cidr":
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.IndexAny(line, "#;"); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			add(fields[0])
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown feed format %q", cfg.Format)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("feed contained no valid entries")
+	}
+	return out, nil
+}
+
+// parseIPOrCIDR accepts "1.2.3.4" or "1.2.3.0/24" and returns the network.
+func parseIPOrCIDR(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		if v4 := n.IP.To4(); v4 != nil {
+			n.IP = v4
+		}
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,147 @@
+package security
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func feedKeys(entries map[string]*net.IPNet) []string {
+	var out []string
+	for cidr := range entries {
+		out = append(out, cidr)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  FeedConfig
+		data string
+		want []string
+		err  string
+	}{
+		{
+			name: "spamhaus drop",
+			cfg:  FeedConfig{Format: "plain"},
+			data: "; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n2.56.192.0/22 ; SBL459831\n",
+			want: []string{"1.10.16.0/20", "2.56.192.0/22"},
+		},
+		{
+			name: "firehol netset",
+			cfg:  FeedConfig{Format: "cidr"},
+			data: "#\n# firehol_level1\n#\n0.0.0.0/8\n5.188.10.0/23\n  203.0.113.7  \n",
+			want: []string{"0.0.0.0/8", "203.0.113.7/32", "5.188.10.0/23"},
+		},
+		{
+			name: "host bits masked and duplicates merged",
+			cfg:  FeedConfig{Format: "plain"},
+			data: "198.51.100.77/24\n198.51.100.0/24\n",
+			want: []string{"198.51.100.0/24"},
+		},
+		{
+			name: "ipv6 and mapped ipv4",
+			cfg:  FeedConfig{Format: "plain"},
+			data: "2001:db8::/32\n2001:db8:1::1\n::ffff:192.0.2.1\n",
+			want: []string{"192.0.2.1/32", "2001:db8:1::1/128", "2001:db8::/32"},
+		},
+		{
+			name: "junk lines skipped",
+			cfg:  FeedConfig{Format: "plain"},
+			data: "not-an-ip\n10.0.0.0/33\n300.1.1.1\n192.0.2.0/24 extra words\n",
+			want: []string{"192.0.2.0/24"},
+		},
+		{
+			name: "csv column",
+			cfg:  FeedConfig{Format: "csv", CsvColumn: 1},
+			data: "# first_seen,ip,port\n2024-01-01,192.0.2.10,443\n2024-01-02, 2001:db8::5 ,22\nshort\n",
+			want: []string{"192.0.2.10/32", "2001:db8::5/128"},
+		},
+		{
+			name: "csv syntax error",
+			cfg:  FeedConfig{Format: "csv"},
+			data: "\"192.0.2.1\n",
+			err:  "csv:",
+		},
+		{
+			name: "empty feed",
+			cfg:  FeedConfig{Format: "plain"},
+			data: "# nothing here\n\n",
+			err:  "no valid entries",
+		},
+		{
+			name: "unknown format",
+			cfg:  FeedConfig{Format: "json"},
+			data: "192.0.2.1\n",
+			err:  "unknown feed format",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFeed([]byte(tt.data), tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := feedKeys(got); !equalStrings(keys, tt.want) {
+				t.Fatalf("entries = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedRestoreScriptSplitsFamilies(t *testing.T) {
+	m := NewFeedManager("jetcamer_feeds", []FeedConfig{
+		{Name: "a", Source: "a.txt"},
+		{Name: "b", Source: "b.txt"},
+	})
+	parse := func(data string) map[string]*net.IPNet {
+		entries, err := parseFeed([]byte(data), FeedConfig{Format: "plain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	m.feeds[0].entries = parse("192.0.2.0/24\n2001:db8::/32\n")
+	m.feeds[1].entries = parse("192.0.2.0/24\n198.51.100.1\n")
+	m.rebuildIndex()
+
+	want, add, del := m.diff()
+	if len(want) != 3 || len(del) != 0 {
+		t.Fatalf("want %v, del %v", feedKeys(want), del)
+	}
+	script := m.restoreScript(add, del)
+	wantScript := "add jetcamer_feeds 192.0.2.0/24\n" +
+		"add jetcamer_feeds 198.51.100.1/32\n" +
+		"add jetcamer_feeds_v6 2001:db8::/32\n"
+	if script != wantScript {
+		t.Fatalf("script =\n%s\nwant\n%s", script, wantScript)
+	}
+	m.applied = want
+
+	// both feeds list 192.0.2.0/24: dropping it from one keeps it
+	m.feeds[0].entries = parse("2001:db8:ffff::1\n")
+	m.rebuildIndex()
+	_, add, del = m.diff()
+	script = m.restoreScript(add, del)
+	wantScript = "del jetcamer_feeds_v6 2001:db8::/32\n" +
+		"add jetcamer_feeds_v6 2001:db8:ffff::1/128\n"
+	if script != wantScript {
+		t.Fatalf("script =\n%s\nwant\n%s", script, wantScript)
+	}
+
+	if got := m.Match(net.ParseIP("2001:db8:ffff::1")); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("Match v6 = %v, want [a]", got)
+	}
+	if got := m.Match(net.ParseIP("192.0.2.9")); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("Match v4 = %v, want [b]", got)
+	}
+}
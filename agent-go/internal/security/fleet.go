@@ -0,0 +1,131 @@
+package security
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Fleet-wide ban sharing
+//────────────────────────────────────────────────────────────
+
+// FleetBan is a ban decision received from the control panel on behalf of
+// another agent of the same customer.
+type FleetBan struct {
+	ID     string // unique per decision, used for de-duplication
+	IP     string
+	Reason string
+	Origin string        // agent that made the decision
+	TTL    time.Duration // 0 = local SecurityBanMinutes
+}
+
+// ApplyFleetBan applies a ban shared by another agent. It returns false
+// when the ban was ignored (duplicate, our own echo, no origin, invalid or
+// allow-listed IP, or the IP is already banned, in which case the expiry
+// is extended if needed). The origin marks the ban as the fleet's, so it
+// is never re-published and only its origin can lift it.
+func (e *Engine) ApplyFleetBan(b FleetBan) bool {
+	if !e.cfg.FleetBanSharing {
+		return false
+	}
+
+	ip := strings.TrimSpace(b.IP)
+	if net.ParseIP(ip) == nil && banFromCIDR(ip, "") != ip {
+		// only single addresses and attack mode subnets (/24, /64)
+		log.Printf("security: ignoring fleet ban with invalid ip %q from %s", b.IP, b.Origin)
+		return false
+	}
+	if b.Origin == "" {
+		log.Printf("security: ignoring fleet ban for %s without origin", ip)
+		return false
+	}
+	if b.Origin == e.cfg.InstanceId {
+		return false // our own decision echoed back
+	}
+
+	ttl := b.TTL
+	if ttl <= 0 {
+		ttl = time.Duration(e.cfg.SecurityBanMinutes) * time.Minute
+	}
+	if maxTTL := time.Duration(e.cfg.FleetBanMaxTTLMinutes) * time.Minute; maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	if b.ID != "" {
+		if _, seen := e.fleetSeen[b.ID]; seen {
+			return false
+		}
+		e.fleetSeen[b.ID] = expires
+	}
+
+	if entry, ok := e.allowlisted(ip); ok {
+		e.audit.Record(AuditRecord{
+			Action: AuditAllowlist,
+			IP:     ip,
+			Reason: b.Reason,
+			Rule:   "fleet ban (allowed by " + entry + ")",
+			Origin: b.Origin,
+		})
+		return false
+	}
+
+	if existing, banned := e.bans[ip]; banned {
+		if expires.After(existing.ExpiresAt) {
+			existing.ExpiresAt = expires
+		}
+		return false
+	}
+
+	reason := b.Reason
+	if reason == "" {
+		reason = "fleet"
+	}
+	e.enforceBan(&SecurityEvent{
+		IP:        ip,
+		Reason:    reason,
+		FirstSeen: now,
+		LastSeen:  now,
+		ExpiresAt: expires,
+		Origin:    b.Origin,
+	})
+	log.Printf("security: applied fleet ban %s from %s (reason=%s ttl=%s)", ip, b.Origin, reason, ttl)
+	return true
+}
+
+// RemoveFleetBan lifts a fleet ban on request of the control panel. Only
+// a ban received from origin is lifted: local decisions (rate, trap, WAF,
+// manual) and other agents' bans on the same IP stay.
+func (e *Engine) RemoveFleetBan(ip, origin string) bool {
+	if !e.cfg.FleetBanSharing || origin == "" {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ev, banned := e.bans[strings.TrimSpace(ip)]
+	if !banned || ev.Origin != origin {
+		return false
+	}
+	e.liftBan(ev, "fleet-unban")
+	log.Printf("security: lifted ban %s on fleet request from %s", ev.IP, origin)
+	return true
+}
+
+// pruneFleetSeen forgets de-duplication IDs whose ban has expired.
+// Caller holds e.mu.
+func (e *Engine) pruneFleetSeen(now time.Time) {
+	for id, exp := range e.fleetSeen {
+		if now.After(exp) {
+			delete(e.fleetSeen, id)
+		}
+	}
+}
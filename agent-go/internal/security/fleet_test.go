@@ -0,0 +1,33 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemoveFleetBanOnlyLiftsOwnOrigin(t *testing.T) {
+	e := newTestEngine(t, &Config{FleetBanSharing: true, InstanceId: "i-self"})
+
+	if !e.ApplyFleetBan(FleetBan{ID: "1", IP: "203.0.113.1", Reason: "trap", Origin: "i-a"}) {
+		t.Fatal("fleet ban not applied")
+	}
+	if err := e.Ban("203.0.113.2", "local", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if e.ApplyFleetBan(FleetBan{ID: "2", IP: "203.0.113.3", Reason: "trap"}) {
+		t.Fatal("fleet ban without origin applied")
+	}
+
+	if e.RemoveFleetBan("203.0.113.1", "i-b") {
+		t.Fatal("another agent lifted i-a's ban")
+	}
+	if e.RemoveFleetBan("203.0.113.2", "i-a") || e.RemoveFleetBan("203.0.113.2", "") {
+		t.Fatal("fleet request lifted a local ban")
+	}
+	if !e.isBanned("203.0.113.2") {
+		t.Fatal("local ban gone")
+	}
+	if !e.RemoveFleetBan("203.0.113.1", "i-a") || e.isBanned("203.0.113.1") {
+		t.Fatal("origin could not lift its own ban")
+	}
+}
@@ -0,0 +1,404 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  ModSecurity audit log ingestion
+//────────────────────────────────────────────────────────────
+
+// WafAlert is one ModSecurity transaction that matched at least one rule.
+type WafAlert struct {
+	IP           string    `json:"ip"`
+	Time         time.Time `json:"time"`
+	Host         string    `json:"host,omitempty"`
+	URI          string    `json:"uri,omitempty"`
+	Status       int       `json:"status,omitempty"`
+	RuleIDs      []string  `json:"ruleIds"`
+	Messages     []string  `json:"messages,omitempty"`
+	AnomalyScore int       `json:"anomalyScore,omitempty"`
+	Intercepted  bool      `json:"intercepted"`
+}
+
+var (
+	modsecBoundary = regexp.MustCompile(`^--([0-9A-Za-z]+)-([A-Z])--$`)
+	modsecRuleID   = regexp.MustCompile(`\[id "(\d+)"\]`)
+	modsecMsg      = regexp.MustCompile(`\[msg "([^"]*)"\]`)
+	modsecScore    = regexp.MustCompile(`Total Score: (\d+)`)
+)
+
+const maxWafMessages = 10
+
+// ModSecParser turns audit log lines into alerts. Serial-format entries
+// span many lines (parts A to Z) so the parser keeps state; use one parser
+// per file. JSON entries (SecAuditLogFormat JSON, ModSecurity v2 or v3)
+// are one line each.
+type ModSecParser struct {
+	id      string // transaction boundary id, "" outside an entry
+	part    byte
+	partPos int // line number inside the current part
+	alert   WafAlert
+}
+
+func NewModSecParser() *ModSecParser {
+	return &ModSecParser{}
+}
+
+// Feed consumes one line and returns an alert when an entry completes.
+func (p *ModSecParser) Feed(line string) (WafAlert, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "{") {
+		return parseModSecJSON(line)
+	}
+
+	if m := modsecBoundary.FindStringSubmatch(line); m != nil {
+		if m[2] == "A" {
+			p.id = m[1]
+			p.alert = WafAlert{}
+		} else if m[1] != p.id {
+			p.id = "" // lines from an interleaved or truncated entry
+			return WafAlert{}, false
+		}
+		p.part = m[2][0]
+		p.partPos = 0
+		if p.part == 'Z' {
+			p.id = ""
+			return finishWafAlert(p.alert)
+		}
+		return WafAlert{}, false
+	}
+	if p.id == "" || line == "" {
+		return WafAlert{}, false
+	}
+
+	p.partPos++
+	switch p.part {
+	case 'A':
+		// [18/Oct/2026:10:00:00.123456 +0000] uniqueid 1.2.3.4 52044 10.0.0.1 443
+		if p.partPos == 1 {
+			if end := strings.Index(line, "]"); end > 0 {
+				p.alert.Time = parseModSecTime(line[1:end])
+				if f := strings.Fields(line[end+1:]); len(f) >= 2 {
+					p.alert.IP = f[1]
+				}
+			}
+		}
+	case 'B':
+		if p.partPos == 1 {
+			if f := strings.Fields(line); len(f) >= 2 {
+				p.alert.URI = f[1]
+			}
+		} else if strings.HasPrefix(strings.ToLower(line), "host:") {
+			p.alert.Host = strings.TrimSpace(line[5:])
+		}
+	case 'F':
+		// HTTP/1.1 403 Forbidden
+		if p.partPos == 1 {
+			if f := strings.Fields(line); len(f) >= 2 {
+				p.alert.Status, _ = strconv.Atoi(f[1])
+			}
+		}
+	case 'H':
+		if strings.HasPrefix(line, "Action: Intercepted") {
+			p.alert.Intercepted = true
+		}
+		// Apache-Error lines repeat the Message lines
+		if strings.Contains(line, `[id "`) && !strings.HasPrefix(line, "Apache-Error:") {
+			addWafMessage(&p.alert, line)
+		}
+	}
+	return WafAlert{}, false
+}
+
+// addWafMessage extracts rule id, message and anomaly score from one
+// ModSecurity message line.
+func addWafMessage(a *WafAlert, msg string) {
+	for _, m := range modsecRuleID.FindAllStringSubmatch(msg, -1) {
+		a.RuleIDs = appendUnique(a.RuleIDs, m[1])
+	}
+	text := msg
+	if m := modsecMsg.FindStringSubmatch(msg); m != nil {
+		text = m[1]
+	}
+	if m := modsecScore.FindStringSubmatch(text); m != nil {
+		if n, err := strconv.Atoi(m[1]); err == nil && n > a.AnomalyScore {
+			a.AnomalyScore = n
+		}
+	}
+	if len(a.Messages) < maxWafMessages {
+		a.Messages = append(a.Messages, text)
+	}
+}
+
+func finishWafAlert(a WafAlert) (WafAlert, bool) {
+	ip := net.ParseIP(strings.TrimSpace(a.IP))
+	if ip == nil || len(a.RuleIDs) == 0 {
+		return WafAlert{}, false
+	}
+	a.IP = ip.String()
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	return a, true
+}
+
+// modsecJSON covers the v2 (audit_data) and v3 (transaction.messages)
+// JSON audit log layouts.
+type modsecJSON struct {
+	Transaction struct {
+		// v2
+		Time          string `json:"time"`
+		RemoteAddress string `json:"remote_address"`
+		// v3
+		ClientIP  string `json:"client_ip"`
+		TimeStamp string `json:"time_stamp"`
+		Request   struct {
+			URI     string            `json:"uri"`
+			Headers map[string]string `json:"headers"`
+		} `json:"request"`
+		Response struct {
+			HTTPCode int `json:"http_code"`
+		} `json:"response"`
+		Messages []struct {
+			Message string `json:"message"`
+			Details struct {
+				RuleID string `json:"ruleId"`
+				Data   string `json:"data"`
+			} `json:"details"`
+		} `json:"messages"`
+	} `json:"transaction"`
+
+	// v2
+	Request struct {
+		RequestLine string            `json:"request_line"`
+		Headers     map[string]string `json:"headers"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+	AuditData struct {
+		Messages []string `json:"messages"`
+		Action   struct {
+			Intercepted bool `json:"intercepted"`
+		} `json:"action"`
+	} `json:"audit_data"`
+}
+
+func parseModSecJSON(line string) (WafAlert, bool) {
+	var j modsecJSON
+	if err := json.Unmarshal([]byte(line), &j); err != nil {
+		return WafAlert{}, false
+	}
+	tx := j.Transaction
+
+	a := WafAlert{IP: tx.RemoteAddress, Status: j.Response.Status}
+	if a.IP == "" {
+		a.IP = tx.ClientIP
+	}
+	if a.Time = parseModSecTime(tx.Time); a.Time.IsZero() {
+		a.Time = parseModSecTime(tx.TimeStamp)
+	}
+
+	headers := j.Request.Headers
+	if f := strings.Fields(j.Request.RequestLine); len(f) >= 2 {
+		a.URI = f[1]
+	} else {
+		a.URI = tx.Request.URI
+		headers = tx.Request.Headers
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, "host") {
+			a.Host = v
+		}
+	}
+	if a.Status == 0 {
+		a.Status = tx.Response.HTTPCode
+	}
+
+	// v2
+	a.Intercepted = j.AuditData.Action.Intercepted
+	for _, msg := range j.AuditData.Messages {
+		addWafMessage(&a, msg)
+	}
+	// v3
+	for _, m := range tx.Messages {
+		if m.Details.RuleID == "" {
+			continue
+		}
+		a.RuleIDs = appendUnique(a.RuleIDs, m.Details.RuleID)
+		if sm := modsecScore.FindStringSubmatch(m.Message); sm != nil {
+			if n, err := strconv.Atoi(sm[1]); err == nil && n > a.AnomalyScore {
+				a.AnomalyScore = n
+			}
+		}
+		if len(a.Messages) < maxWafMessages {
+			a.Messages = append(a.Messages, m.Message)
+		}
+	}
+	if len(tx.Messages) > 0 && a.Status >= 400 {
+		a.Intercepted = true // v3 does not log the disruptive action separately
+	}
+
+	return finishWafAlert(a)
+}
+
+// parseModSecTime accepts the audit log timestamp layouts of v2 and v3.
+func parseModSecTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{
+		"02/Jan/2006:15:04:05.000000 -0700",
+		"02/Jan/2006:15:04:05 -0700",
+		"Mon Jan _2 15:04:05 2006",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+//────────────────────────────────────────────────────────────
+//  WAF repeat-offender detector
+//────────────────────────────────────────────────────────────
+
+// WafStats is reported in the security snapshot.
+type WafStats struct {
+	Alerts     uint64            `json:"alerts"`
+	Bans       uint64            `json:"bans"`
+	Rules      map[string]uint64 `json:"rules"` // rule id -> alerts
+	TrackedIPs int               `json:"trackedIps"`
+	Recent     []WafAlert        `json:"recent"`
+}
+
+const (
+	maxWafRecent = 100
+	maxWafRules  = 1000 // distinct rule ids tallied
+)
+
+type wafHit struct {
+	time  time.Time
+	score int
+	rules []string
+}
+
+// ProcessWaf records a ModSecurity alert and bans the IP once it triggers
+// SecurityWafMaxHits alerts, or a total anomaly score of
+// SecurityWafMaxScore, within SecurityWafWindowMinutes.
+func (e *Engine) ProcessWaf(a WafAlert) {
+	if !e.cfg.SecurityEnabled || !e.cfg.SecurityWafEnabled {
+		return
+	}
+	if ip := net.ParseIP(a.IP); ip == nil || ip.IsLoopback() {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	e.wafStats.Alerts++
+	for _, id := range a.RuleIDs {
+		if _, ok := e.wafStats.Rules[id]; ok || len(e.wafStats.Rules) < maxWafRules {
+			e.wafStats.Rules[id]++
+		}
+	}
+	e.wafStats.Recent = append(e.wafStats.Recent, a)
+	if len(e.wafStats.Recent) > maxWafRecent {
+		e.wafStats.Recent = e.wafStats.Recent[len(e.wafStats.Recent)-maxWafRecent:]
+	}
+
+	if _, banned := e.bans[a.IP]; banned {
+		return
+	}
+
+	cut := now.Add(-e.wafWindow())
+	hits := e.wafHits[a.IP][:0]
+	for _, h := range e.wafHits[a.IP] {
+		if h.time.After(cut) {
+			hits = append(hits, h)
+		}
+	}
+	hits = append(hits, wafHit{time: now, score: a.AnomalyScore, rules: a.RuleIDs})
+	e.wafHits[a.IP] = hits
+
+	score := 0
+	var rules []string
+	for _, h := range hits {
+		score += h.score
+		for _, id := range h.rules {
+			rules = appendUnique(rules, id)
+		}
+	}
+
+	maxHits := e.cfg.SecurityWafMaxHits
+	if maxHits <= 0 {
+		maxHits = 5
+	}
+	maxScore := e.cfg.SecurityWafMaxScore
+	if len(hits) < maxHits && (maxScore <= 0 || score < maxScore) {
+		return
+	}
+
+	delete(e.wafHits, a.IP)
+
+	var asn int
+	if e.asn != nil {
+		asn = e.asn.ASN(a.IP)
+	}
+	rule := fmt.Sprintf("%d alerts, score %d in %s, rules %s", len(hits), score, e.wafWindow(), strings.Join(rules, ","))
+	if e.spareAllowlisted(a.IP, a.URI, asn, "waf", rule) {
+		return
+	}
+	e.wafStats.Bans++
+
+	ttl := time.Duration(e.cfg.SecurityWafBanMinutes) * time.Minute
+	if ttl <= 0 {
+		ttl = time.Duration(e.cfg.SecurityBanMinutes) * time.Minute
+	}
+	e.enforceBan(&SecurityEvent{
+		IP:        a.IP,
+		ASN:       asn,
+		Path:      a.URI,
+		Reason:    "waf",
+		Count:     len(hits),
+		Rules:     rules,
+		Rule:      rule,
+		FirstSeen: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
+	})
+}
+
+// pruneWafHits forgets IPs with no alert inside the window.
+// Caller holds e.mu.
+func (e *Engine) pruneWafHits(now time.Time) {
+	cut := now.Add(-e.wafWindow())
+	for ip, hits := range e.wafHits {
+		if len(hits) == 0 || !hits[len(hits)-1].time.After(cut) {
+			delete(e.wafHits, ip)
+		}
+	}
+}
+
+func (e *Engine) wafWindow() time.Duration {
+	if e.cfg.SecurityWafWindowMinutes <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(e.cfg.SecurityWafWindowMinutes) * time.Minute
+}
@@ -0,0 +1,55 @@
+package security
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestEngine starts an engine that never touches the host firewall.
+func newTestEngine(t testing.TB, cfg *Config) *Engine {
+	t.Helper()
+	cfg.SecurityEnabled = true
+	cfg.FirewallDisabled = true
+	if cfg.SecurityBanMinutes == 0 {
+		cfg.SecurityBanMinutes = 10
+	}
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestProcessWafRespectsAllowlist(t *testing.T) {
+	e := newTestEngine(t, &Config{
+		SecurityWafEnabled: true,
+		SecurityWafMaxHits: 2,
+		SecurityAllowlist:  []string{"203.0.113.0/24"},
+		SecurityAuditPath:  filepath.Join(t.TempDir(), "audit.log"),
+	})
+
+	for _, ip := range []string{"203.0.113.5", "198.51.100.5"} {
+		for i := 0; i < 2; i++ {
+			e.ProcessWaf(WafAlert{IP: ip, Time: time.Now(), URI: "/wp-login.php", RuleIDs: []string{"942100"}})
+		}
+	}
+
+	if e.isBanned("203.0.113.5") {
+		t.Fatal("allow-listed IP was banned by the WAF")
+	}
+	if !e.isBanned("198.51.100.5") {
+		t.Fatal("WAF ban not applied")
+	}
+	if n := e.wafStats.Bans; n != 1 {
+		t.Fatalf("wafStats.Bans = %d, want 1", n)
+	}
+
+	recs, err := e.AuditQuery(AuditQuery{IP: "203.0.113.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Action != AuditAllowlist || recs[0].Reason != "waf" {
+		t.Fatalf("audit records = %+v, want one allowlist record", recs)
+	}
+}
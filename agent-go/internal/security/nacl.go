@@ -0,0 +1,260 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+//────────────────────────────────────────────────────────────
+//  AWS NACL enforcement (rule-number allocation)
+//────────────────────────────────────────────────────────────
+
+// EC2NetworkAclAPI is the subset of the EC2 client used for NACL bans.
+// *ec2.Client satisfies it; tests can pass a fake.
+type EC2NetworkAclAPI interface {
+	DescribeNetworkAcls(ctx context.Context, params *ec2.DescribeNetworkAclsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkAclsOutput, error)
+	CreateNetworkAclEntry(ctx context.Context, params *ec2.CreateNetworkAclEntryInput, optFns ...func(*ec2.Options)) (*ec2.CreateNetworkAclEntryOutput, error)
+	DeleteNetworkAclEntry(ctx context.Context, params *ec2.DeleteNetworkAclEntryInput, optFns ...func(*ec2.Options)) (*ec2.DeleteNetworkAclEntryOutput, error)
+}
+
+// naclBackend owns deny rules inside [ruleMin, ruleMax] of one NACL.
+type naclBackend struct {
+	api        EC2NetworkAclAPI
+	aclID      string
+	ruleMin    int32
+	ruleMax    int32
+	maxEntries int // AWS per-direction rule limit for the NACL
+
+	owned   map[string]CloudEntry // ip -> rule
+	used    map[int32]bool        // every ingress rule number on the NACL
+	foreign int                   // ingress rules not owned by the agent
+}
+
+// NewNaclEnforcer creates an enforcer and starts its worker. maxEntries is
+// the NACL's ingress rule quota (20 unless raised with AWS).
+func NewNaclEnforcer(api EC2NetworkAclAPI, aclID string, ruleMin, ruleMax, maxEntries int) CloudEnforcer {
+	if ruleMax < ruleMin {
+		ruleMax = ruleMin + 99
+	}
+	if maxEntries <= 0 {
+		maxEntries = 20
+	}
+	return newCloudEnforcer(&naclBackend{
+		api:        api,
+		aclID:      aclID,
+		ruleMin:    int32(ruleMin),
+		ruleMax:    int32(ruleMax),
+		maxEntries: maxEntries,
+		owned:      make(map[string]CloudEntry),
+		used:       make(map[int32]bool),
+	})
+}
+
+func (n *naclBackend) kind() string   { return CloudNACL }
+func (n *naclBackend) target() string { return n.aclID }
+
+// sync reads the NACL and rebuilds the used/owned rule tables. Deny
+// rules for a single host inside the configured range are treated as
+// agent-owned, so rules survive agent restarts.
+func (n *naclBackend) sync(ctx context.Context) error {
+	var out *ec2.DescribeNetworkAclsOutput
+	err := withRetry(ctx, func() error {
+		var err error
+		out, err = n.api.DescribeNetworkAcls(ctx, &ec2.DescribeNetworkAclsInput{
+			NetworkAclIds: []string{n.aclID},
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.NetworkAcls) == 0 {
+		return fmt.Errorf("network ACL %s not found", n.aclID)
+	}
+
+	used := make(map[int32]bool)
+	owned := make(map[string]CloudEntry)
+	foreign := 0
+	for _, e := range out.NetworkAcls[0].Entries {
+		if aws.ToBool(e.Egress) || e.RuleNumber == nil {
+			continue
+		}
+		num := aws.ToInt32(e.RuleNumber)
+		if num == 32767 {
+			continue // default "*" rule, not counted against the quota
+		}
+		used[num] = true
+
+		ip := banFromCIDR(aws.ToString(e.CidrBlock), aws.ToString(e.Ipv6CidrBlock))
+		if ip != "" && num >= n.ruleMin && num <= n.ruleMax && e.RuleAction == types.RuleActionDeny {
+			entry := CloudEntry{IP: ip, Rule: num}
+			// keep creation times for rules we created in this process
+			if prev, ok := n.owned[ip]; ok && prev.Rule == num {
+				entry = prev
+			}
+			owned[ip] = entry
+			continue
+		}
+		foreign++
+	}
+
+	n.owned = owned
+	n.used = used
+	n.foreign = foreign
+	return nil
+}
+
+func (n *naclBackend) entries() []CloudEntry {
+	out := make([]CloudEntry, 0, len(n.owned))
+	for _, e := range n.owned {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (n *naclBackend) capacity() int {
+	c := int(n.ruleMax-n.ruleMin) + 1
+	if quota := n.maxEntries - n.foreign; quota < c {
+		c = quota
+	}
+	if c < 0 {
+		c = 0
+	}
+	return c
+}
+
+func (n *naclBackend) add(ctx context.Context, ips []string) error {
+	var errs []error
+	for _, ip := range ips {
+		if err := n.addOne(ctx, ip); err != nil {
+			if errors.Is(err, errCloudFull) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *naclBackend) addOne(ctx context.Context, ip string) error {
+	if _, ok := n.owned[ip]; ok {
+		return nil
+	}
+
+	in := &ec2.CreateNetworkAclEntryInput{
+		Egress:       aws.Bool(false),
+		NetworkAclId: aws.String(n.aclID),
+		Protocol:     aws.String("-1"),
+		RuleAction:   types.RuleActionDeny,
+	}
+	if strings.Contains(ip, ":") {
+		in.Ipv6CidrBlock = aws.String(banCIDR(ip))
+	} else {
+		in.CidrBlock = aws.String(banCIDR(ip))
+	}
+
+	for attempt := 0; attempt < cloudRetryAttempts; attempt++ {
+		rule, ok := n.freeRule()
+		if !ok {
+			return fmt.Errorf("no free NACL rule number in %d-%d: %w", n.ruleMin, n.ruleMax, errCloudFull)
+		}
+		in.RuleNumber = aws.Int32(rule)
+
+		_, err := n.api.CreateNetworkAclEntry(ctx, in)
+		if err == nil {
+			n.used[rule] = true
+			n.owned[ip] = CloudEntry{IP: ip, Rule: rule, Created: time.Now()}
+			return nil
+		}
+
+		switch {
+		case strings.Contains(err.Error(), "NetworkAclEntryAlreadyExists"):
+			// someone else took the number: refresh and pick another
+			if err := n.sync(ctx); err != nil {
+				return err
+			}
+			if _, ok := n.owned[ip]; ok {
+				return nil
+			}
+		case strings.Contains(err.Error(), "NetworkAclEntryLimitExceeded"):
+			// the quota is reached, whatever we counted
+			n.foreign = n.maxEntries - len(n.owned)
+			return fmt.Errorf("NACL %s: %v: %w", n.aclID, err, errCloudFull)
+		default:
+			if attempt == cloudRetryAttempts-1 {
+				return err
+			}
+			if !sleepCtx(ctx, cloudRetryBase<<attempt) {
+				return ctx.Err()
+			}
+		}
+	}
+	return fmt.Errorf("could not create NACL entry for %s after %d attempts", ip, cloudRetryAttempts)
+}
+
+// freeRule returns the lowest unused rule number in range.
+func (n *naclBackend) freeRule() (int32, bool) {
+	for r := n.ruleMin; r <= n.ruleMax; r++ {
+		if !n.used[r] {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+func (n *naclBackend) remove(ctx context.Context, ips []string) error {
+	var errs []error
+	for _, ip := range ips {
+		e, ok := n.owned[ip]
+		if !ok {
+			continue
+		}
+		err := withRetry(ctx, func() error {
+			_, err := n.api.DeleteNetworkAclEntry(ctx, &ec2.DeleteNetworkAclEntryInput{
+				Egress:       aws.Bool(false),
+				NetworkAclId: aws.String(n.aclID),
+				RuleNumber:   aws.Int32(e.Rule),
+			})
+			if err != nil && strings.Contains(err.Error(), "NotFound") {
+				return nil // already gone
+			}
+			return err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(n.owned, ip)
+		delete(n.used, e.Rule)
+	}
+	return errors.Join(errs...)
+}
+
+// banFromCIDR returns the ban key for a CIDR written by the agent: the
+// address of a single-host CIDR (/32 or /128), the network of an attack
+// mode subnet ban (/24 or /64), or "" for anything else.
+func banFromCIDR(v4, v6 string) string {
+	cidr := v4
+	if cidr == "" {
+		cidr = v6
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	switch ones, bits := ipnet.Mask.Size(); {
+	case ones == bits:
+		return ip.String()
+	case bits == 32 && ones == attackSubnetV4Bits, bits == 128 && ones == attackSubnetV6Bits:
+		return ipnet.String()
+	}
+	return ""
+}
@@ -0,0 +1,236 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeNacl is an in-memory EC2NetworkAclAPI for one ACL's ingress rules.
+type fakeNacl struct {
+	entries map[int32]types.NetworkAclEntry
+	limit   int // ingress rules AWS accepts, excluding the default rule
+
+	// beforeCreate runs before each create, e.g. to simulate another writer
+	beforeCreate func(f *fakeNacl, in *ec2.CreateNetworkAclEntryInput)
+	creates      int
+}
+
+func newFakeNacl() *fakeNacl {
+	f := &fakeNacl{entries: make(map[int32]types.NetworkAclEntry), limit: 20}
+	f.put(32767, "0.0.0.0/0", types.RuleActionDeny)
+	return f
+}
+
+func (f *fakeNacl) put(rule int32, cidr string, action types.RuleAction) {
+	f.entries[rule] = types.NetworkAclEntry{
+		RuleNumber: aws.Int32(rule),
+		Egress:     aws.Bool(false),
+		CidrBlock:  aws.String(cidr),
+		RuleAction: action,
+		Protocol:   aws.String("-1"),
+	}
+}
+
+// rules maps rule number to CIDR, without the default rule.
+func (f *fakeNacl) rules() map[int32]string {
+	out := make(map[int32]string)
+	for n, e := range f.entries {
+		if n != 32767 {
+			out[n] = aws.ToString(e.CidrBlock) + aws.ToString(e.Ipv6CidrBlock)
+		}
+	}
+	return out
+}
+
+func (f *fakeNacl) DescribeNetworkAcls(ctx context.Context, in *ec2.DescribeNetworkAclsInput, _ ...func(*ec2.Options)) (*ec2.DescribeNetworkAclsOutput, error) {
+	acl := types.NetworkAcl{NetworkAclId: aws.String(in.NetworkAclIds[0])}
+	for _, e := range f.entries {
+		acl.Entries = append(acl.Entries, e)
+	}
+	// an egress rule, which the backend must ignore
+	acl.Entries = append(acl.Entries, types.NetworkAclEntry{
+		RuleNumber: aws.Int32(100), Egress: aws.Bool(true),
+		CidrBlock: aws.String("0.0.0.0/0"), RuleAction: types.RuleActionAllow,
+	})
+	return &ec2.DescribeNetworkAclsOutput{NetworkAcls: []types.NetworkAcl{acl}}, nil
+}
+
+func (f *fakeNacl) CreateNetworkAclEntry(ctx context.Context, in *ec2.CreateNetworkAclEntryInput, _ ...func(*ec2.Options)) (*ec2.CreateNetworkAclEntryOutput, error) {
+	f.creates++
+	if f.beforeCreate != nil {
+		f.beforeCreate(f, in)
+	}
+	rule := aws.ToInt32(in.RuleNumber)
+	if _, ok := f.entries[rule]; ok {
+		return nil, errors.New("api error NetworkAclEntryAlreadyExists: rule number exists")
+	}
+	if len(f.entries)-1 >= f.limit {
+		return nil, errors.New("api error NetworkAclEntryLimitExceeded: too many entries")
+	}
+	f.entries[rule] = types.NetworkAclEntry{
+		RuleNumber:    in.RuleNumber,
+		Egress:        in.Egress,
+		CidrBlock:     in.CidrBlock,
+		Ipv6CidrBlock: in.Ipv6CidrBlock,
+		RuleAction:    in.RuleAction,
+		Protocol:      in.Protocol,
+	}
+	return &ec2.CreateNetworkAclEntryOutput{}, nil
+}
+
+func (f *fakeNacl) DeleteNetworkAclEntry(ctx context.Context, in *ec2.DeleteNetworkAclEntryInput, _ ...func(*ec2.Options)) (*ec2.DeleteNetworkAclEntryOutput, error) {
+	rule := aws.ToInt32(in.RuleNumber)
+	if _, ok := f.entries[rule]; !ok {
+		return nil, fmt.Errorf("api error InvalidNetworkAclEntry.NotFound: no rule %d", rule)
+	}
+	delete(f.entries, rule)
+	return &ec2.DeleteNetworkAclEntryOutput{}, nil
+}
+
+func newTestNacl(t *testing.T, api *fakeNacl, ruleMin, ruleMax int32, maxEntries int) (*cloudEnforcer, *naclBackend) {
+	t.Helper()
+	b := &naclBackend{
+		api: api, aclID: "acl-1", ruleMin: ruleMin, ruleMax: ruleMax, maxEntries: maxEntries,
+		owned: make(map[string]CloudEntry), used: make(map[int32]bool),
+	}
+	return newTestEnforcer(t, b), b
+}
+
+func TestNaclAllocatesLowestFreeRule(t *testing.T) {
+	api := newFakeNacl()
+	api.put(100, "10.0.0.0/8", types.RuleActionAllow) // foreign rule inside the range
+	api.put(50, "192.0.2.1/32", types.RuleActionDeny) // outside the range: not ours
+	c, b := newTestNacl(t, api, 100, 110, 20)
+
+	block(c, "203.0.113.1", "203.0.113.2", "203.0.113.3")
+	want := map[int32]string{
+		50: "192.0.2.1/32", 100: "10.0.0.0/8",
+		101: "203.0.113.1/32", 102: "203.0.113.2/32", 103: "203.0.113.3/32",
+	}
+	if got := api.rules(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("rules = %v, want %v", got, want)
+	}
+
+	unblock(c, "203.0.113.2")
+	block(c, "2001:db8::1")
+	if got := api.rules()[102]; got != "2001:db8::1/128" {
+		t.Fatalf("rule 102 = %q, want the freed number reused for 2001:db8::1/128", got)
+	}
+	if got := b.capacity(); got != 11 {
+		t.Fatalf("capacity = %d, want 11 (range of 11, 2 foreign of 20)", got)
+	}
+	if st := c.Status(); st.LastError != "" || st.Used != 3 {
+		t.Fatalf("status = %+v", st)
+	}
+}
+
+func TestNaclRuleNumberTakenByAnotherWriter(t *testing.T) {
+	api := newFakeNacl()
+	api.beforeCreate = func(f *fakeNacl, in *ec2.CreateNetworkAclEntryInput) {
+		if f.creates == 1 {
+			f.put(aws.ToInt32(in.RuleNumber), "198.51.100.0/24", types.RuleActionAllow)
+		}
+	}
+	c, _ := newTestNacl(t, api, 100, 110, 20)
+
+	block(c, "203.0.113.1")
+	rules := api.rules()
+	if rules[100] != "198.51.100.0/24" || rules[101] != "203.0.113.1/32" {
+		t.Fatalf("rules = %v, want the ban moved to 101 after the conflict", rules)
+	}
+	if st := c.Status(); st.LastError != "" {
+		t.Fatalf("unexpected error: %s", st.LastError)
+	}
+}
+
+func TestNaclLimitExceededEvictsOldest(t *testing.T) {
+	api := newFakeNacl()
+	api.limit = 3 // lower than the configured quota
+	c, b := newTestNacl(t, api, 100, 110, 20)
+
+	block(c, "203.0.113.1")
+	block(c, "203.0.113.2")
+	block(c, "203.0.113.3")
+	block(c, "203.0.113.4")
+
+	if got, want := ownedIPs(b), []string{"203.0.113.2", "203.0.113.3", "203.0.113.4"}; !equalStrings(got, want) {
+		t.Fatalf("owned = %v, want %v", got, want)
+	}
+	st := c.Status()
+	if st.Evictions != 1 || st.LastError != "" {
+		t.Fatalf("status = %+v, want one eviction and no error", st)
+	}
+	if st.Capacity != 3 {
+		t.Fatalf("capacity = %d, want the quota learned from the error", st.Capacity)
+	}
+}
+
+func TestNaclRangeExhausted(t *testing.T) {
+	api := newFakeNacl()
+	_, b := newTestNacl(t, api, 100, 101, 20)
+
+	err := b.add(context.Background(), []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"})
+	if !errors.Is(err, errCloudFull) {
+		t.Fatalf("err = %v, want errCloudFull", err)
+	}
+	if n := len(api.rules()); n != 2 {
+		t.Fatalf("%d rules written, want 2", n)
+	}
+}
+
+func TestNaclReconcile(t *testing.T) {
+	api := newFakeNacl()
+	api.put(100, "203.0.113.1/32", types.RuleActionDeny) // left by an earlier run
+	api.put(101, "203.0.113.2/32", types.RuleActionDeny)
+	api.put(102, "198.51.100.0/24", types.RuleActionDeny) // attack mode subnet ban
+	api.put(120, "10.0.0.0/8", types.RuleActionAllow)
+	c, b := newTestNacl(t, api, 100, 110, 20)
+
+	if got := ownedIPs(b); !equalStrings(got, []string{"198.51.100.0/24", "203.0.113.1", "203.0.113.2"}) {
+		t.Fatalf("owned after sync = %v", got)
+	}
+
+	c.reconcile(context.Background(), []string{"203.0.113.2", "203.0.113.9"})
+	want := map[int32]string{101: "203.0.113.2/32", 100: "203.0.113.9/32", 120: "10.0.0.0/8"}
+	if got := api.rules(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("rules = %v, want %v", got, want)
+	}
+	if c.Status().LastReconcile.IsZero() {
+		t.Fatal("LastReconcile not set")
+	}
+}
+
+func TestNaclReconcileKeepsNewestWithinCapacity(t *testing.T) {
+	api := newFakeNacl()
+	c, b := newTestNacl(t, api, 100, 101, 20)
+
+	c.reconcile(context.Background(), []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"})
+	if got, want := ownedIPs(b), []string{"203.0.113.2", "203.0.113.3"}; !equalStrings(got, want) {
+		t.Fatalf("owned = %v, want %v", got, want)
+	}
+}
+
+func TestNaclRemoveToleratesMissingRule(t *testing.T) {
+	api := newFakeNacl()
+	c, b := newTestNacl(t, api, 100, 110, 20)
+	block(c, "203.0.113.1", "203.0.113.2")
+
+	delete(api.entries, 100) // removed by hand
+	unblock(c, "203.0.113.1", "203.0.113.2")
+
+	if got := ownedIPs(b); len(got) != 0 {
+		t.Fatalf("owned = %v, want none", got)
+	}
+	if len(api.rules()) != 0 || len(b.used) != 0 {
+		t.Fatalf("rules = %v, used = %v", api.rules(), b.used)
+	}
+	if st := c.Status(); st.LastError != "" {
+		t.Fatalf("unexpected error: %s", st.LastError)
+	}
+}
@@ -0,0 +1,386 @@
+package security
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Notifications (webhooks, WebSocket, syslog)
+//────────────────────────────────────────────────────────────
+
+// Notification types
+const (
+	NotifyBan         = "ban"
+	NotifyUnban       = "unban"
+	NotifyThreshold   = "threshold"
+	NotifyFeedRefresh = "feed_refresh"
+	NotifyAnomaly     = "anomaly"
+	NotifyAttackMode  = "attack_mode"
+)
+
+// Notification is one structured security event sent to every channel.
+type Notification struct {
+	Type    string        `json:"type"`
+	Time    time.Time     `json:"time"`
+	IP      string        `json:"ip,omitempty"`
+	ASN     int           `json:"asn,omitempty"`
+	Path    string        `json:"path,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Count   int           `json:"count,omitempty"`
+	Limit   int           `json:"limit,omitempty"`
+	Scope   string        `json:"scope,omitempty"` // threshold scope: ip, path, asn
+	Feed    *FeedStatus   `json:"feed,omitempty"`
+	Rules   []string      `json:"rules,omitempty"` // WAF rule ids behind a ban
+	Anomaly *Anomaly      `json:"anomaly,omitempty"`
+	Attack  *AttackStatus `json:"attack,omitempty"` // attack mode transition
+
+	Origin     string `json:"origin,omitempty"`     // set for bans received from the fleet
+	TTLSeconds int    `json:"ttlSeconds,omitempty"` // ban duration
+}
+
+// NotifyBatch is what a channel receives on each flush. Dropped counts
+// notifications discarded since the previous batch because the channel
+// was over its rate limit or buffer.
+type NotifyBatch struct {
+	AgentID string         `json:"agentId"`
+	Events  []Notification `json:"events"`
+	Dropped uint64         `json:"dropped,omitempty"`
+}
+
+// NotifyChannel delivers batches to one destination.
+type NotifyChannel interface {
+	Name() string
+	Send(batch NotifyBatch) error
+}
+
+// NotifyChannelStats is reported in the security snapshot.
+type NotifyChannelStats struct {
+	Name      string    `json:"name"`
+	Sent      uint64    `json:"sent"`
+	Dropped   uint64    `json:"dropped"`
+	Failed    uint64    `json:"failed"`
+	LastError string    `json:"lastError,omitempty"`
+	LastSent  time.Time `json:"lastSent,omitempty"`
+}
+
+// WebhookConfig is one webhook destination. Events limits which
+// notification types are sent (empty = all).
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+const (
+	notifyBufferMax = 500 // per channel; excess is counted as dropped
+	notifyQueueSize = 1024
+)
+
+type notifyQueue struct {
+	ch     NotifyChannel
+	events map[string]bool // nil = all
+	in     chan Notification
+
+	interval     time.Duration
+	maxPerMinute int
+
+	sent, dropped, failed uint64 // atomic
+
+	mu        sync.Mutex
+	lastError string
+	lastSent  time.Time
+}
+
+// Notifier fans notifications out to channels, batching per flush
+// interval and capping batches per minute so a flood of bans during a
+// DDoS becomes a handful of summarized messages.
+type Notifier struct {
+	agentID      string
+	interval     time.Duration
+	maxPerMinute int
+
+	mu     sync.RWMutex
+	queues []*notifyQueue
+}
+
+func NewNotifier(agentID string, batchInterval time.Duration, maxPerMinute int) *Notifier {
+	if batchInterval <= 0 {
+		batchInterval = 5 * time.Second
+	}
+	if maxPerMinute <= 0 {
+		maxPerMinute = 30
+	}
+	return &Notifier{
+		agentID:      agentID,
+		interval:     batchInterval,
+		maxPerMinute: maxPerMinute,
+	}
+}
+
+// AddChannel registers a channel; events limits which notification types
+// it receives (nil = all).
+func (n *Notifier) AddChannel(ch NotifyChannel, events []string) {
+	q := &notifyQueue{
+		ch:           ch,
+		in:           make(chan Notification, notifyQueueSize),
+		interval:     n.interval,
+		maxPerMinute: n.maxPerMinute,
+	}
+	if len(events) > 0 {
+		q.events = make(map[string]bool, len(events))
+		for _, t := range events {
+			q.events[t] = true
+		}
+	}
+
+	n.mu.Lock()
+	n.queues = append(n.queues, q)
+	n.mu.Unlock()
+
+	go q.run(n.agentID)
+	log.Printf("security: notification channel %s enabled", ch.Name())
+}
+
+// Notify enqueues a notification on every channel. It never blocks.
+func (n *Notifier) Notify(ev Notification) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, q := range n.queues {
+		if q.events != nil && !q.events[ev.Type] {
+			continue
+		}
+		select {
+		case q.in <- ev:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	}
+}
+
+// Stats returns per-channel delivery counters.
+func (n *Notifier) Stats() []NotifyChannelStats {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	out := make([]NotifyChannelStats, 0, len(n.queues))
+	for _, q := range n.queues {
+		q.mu.Lock()
+		out = append(out, NotifyChannelStats{
+			Name:      q.ch.Name(),
+			Sent:      atomic.LoadUint64(&q.sent),
+			Dropped:   atomic.LoadUint64(&q.dropped),
+			Failed:    atomic.LoadUint64(&q.failed),
+			LastError: q.lastError,
+			LastSent:  q.lastSent,
+		})
+		q.mu.Unlock()
+	}
+	return out
+}
+
+func (q *notifyQueue) run(agentID string) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	// token bucket: maxPerMinute batches, refilled continuously
+	tokens := float64(q.maxPerMinute)
+	refill := float64(q.maxPerMinute) / 60.0
+	last := time.Now()
+
+	var buf []Notification
+	var reported uint64 // dropped count already included in a batch
+
+	for {
+		select {
+		case ev := <-q.in:
+			if len(buf) >= notifyBufferMax {
+				atomic.AddUint64(&q.dropped, 1)
+				continue
+			}
+			buf = append(buf, ev)
+		case <-ticker.C:
+			now := time.Now()
+			tokens += now.Sub(last).Seconds() * refill
+			if tokens > float64(q.maxPerMinute) {
+				tokens = float64(q.maxPerMinute)
+			}
+			last = now
+
+			dropped := atomic.LoadUint64(&q.dropped)
+			if len(buf) == 0 && dropped == reported {
+				continue
+			}
+			if tokens < 1 {
+				continue // over the rate limit: keep buffering
+			}
+			tokens--
+
+			batch := NotifyBatch{AgentID: agentID, Events: buf, Dropped: dropped - reported}
+			reported = dropped
+			buf = nil
+
+			err := q.ch.Send(batch)
+			q.mu.Lock()
+			if err != nil {
+				atomic.AddUint64(&q.failed, uint64(len(batch.Events)))
+				q.lastError = err.Error()
+				log.Printf("security: notification channel %s failed: %v", q.ch.Name(), err)
+			} else {
+				atomic.AddUint64(&q.sent, uint64(len(batch.Events)))
+				q.lastError = ""
+				q.lastSent = now
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+//────────────────────────────────────────────────────────────
+//  Channels
+//────────────────────────────────────────────────────────────
+
+// WebhookChannel POSTs each batch as JSON. When a secret is set the body is
+// signed with HMAC-SHA256 over "<timestamp>.<body>" and sent as
+// X-Jetcamer-Signature: sha256=<hex> with X-Jetcamer-Timestamp.
+type WebhookChannel struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewWebhookChannel(rawURL, secret string) *WebhookChannel {
+	return &WebhookChannel{
+		url:    rawURL,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name omits the query string so tokens embedded in webhook URLs don't
+// show up in /security.
+func (w *WebhookChannel) Name() string {
+	if u, err := url.Parse(w.url); err == nil {
+		return "webhook:" + u.Host + u.Path
+	}
+	return "webhook"
+}
+
+func (w *WebhookChannel) Send(batch NotifyBatch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jetcamer-agent")
+
+	if w.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Jetcamer-Timestamp", ts)
+		req.Header.Set("X-Jetcamer-Signature", "sha256="+SignWebhook(w.secret, ts, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<ts>.<body>" under secret,
+// the X-Jetcamer-Signature scheme shared by every signed webhook.
+func SignWebhook(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SyslogChannel writes one JSON line per notification to syslog.
+// addr is "" for the local daemon or "udp://host:514" / "tcp://host:514".
+type SyslogChannel struct {
+	w *syslog.Writer
+}
+
+func NewSyslogChannel(addr string) (*SyslogChannel, error) {
+	network, raddr := "", ""
+	if addr != "" {
+		if i := strings.Index(addr, "://"); i > 0 {
+			network, raddr = addr[:i], addr[i+3:]
+		} else {
+			network, raddr = "udp", addr
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_WARNING|syslog.LOG_DAEMON, "jetcamer-agent")
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogChannel{w: w}, nil
+}
+
+func (s *SyslogChannel) Name() string {
+	return "syslog"
+}
+
+func (s *SyslogChannel) Send(batch NotifyBatch) error {
+	for _, ev := range batch.Events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		if err := s.w.Warning(string(line)); err != nil {
+			return err
+		}
+	}
+	if batch.Dropped > 0 {
+		return s.w.Warning(fmt.Sprintf(`{"type":"dropped","count":%d}`, batch.Dropped))
+	}
+	return nil
+}
+
+// FuncChannel adapts a function (e.g. the WebSocket client) to NotifyChannel.
+type FuncChannel struct {
+	name string
+	fn   func(batch NotifyBatch) error
+}
+
+func NewFuncChannel(name string, fn func(batch NotifyBatch) error) *FuncChannel {
+	return &FuncChannel{name: name, fn: fn}
+}
+
+func (f *FuncChannel) Name() string {
+	return f.name
+}
+
+func (f *FuncChannel) Send(batch NotifyBatch) error {
+	return f.fn(batch)
+}
@@ -0,0 +1,259 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+//────────────────────────────────────────────────────────────
+//  AWS security group enforcement
+//────────────────────────────────────────────────────────────
+
+// EC2SecurityGroupAPI is the subset of the EC2 client used for security
+// group bans. *ec2.Client satisfies it; tests can pass a fake.
+type EC2SecurityGroupAPI interface {
+	DescribeSecurityGroupRules(ctx context.Context, params *ec2.DescribeSecurityGroupRulesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error)
+	AuthorizeSecurityGroupIngress(ctx context.Context, params *ec2.AuthorizeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	RevokeSecurityGroupIngress(ctx context.Context, params *ec2.RevokeSecurityGroupIngressInput, optFns ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error)
+	DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error)
+}
+
+// sgRuleDescription marks ingress rules written by the agent.
+const sgRuleDescription = "jetcamer-ban"
+
+// sgBackend keeps one ingress rule per banned IP in a dedicated security
+// group. Security groups can only allow traffic, so every ban is an allow
+// rule: the group is a ban list for deny-capable consumers that reference
+// it (e.g. an AWS Network Firewall or appliance rule sync) and must never
+// be attached to a network interface. The agent checks that it is not, at
+// startup and on every sync, and writes nothing while it is.
+type sgBackend struct {
+	api      EC2SecurityGroupAPI
+	groupID  string
+	maxRules int
+
+	detached bool // the last sync found no network interface using the group
+	owned    map[string]CloudEntry
+	foreign  int // ingress rules not written by the agent
+}
+
+// NewSecurityGroupEnforcer creates an enforcer for a dedicated security
+// group. maxRules is the inbound rule quota (60 unless raised with AWS).
+// It fails when the group is attached to any network interface.
+func NewSecurityGroupEnforcer(ctx context.Context, api EC2SecurityGroupAPI, groupID string, maxRules int) (CloudEnforcer, error) {
+	if maxRules <= 0 {
+		maxRules = 60
+	}
+	s := &sgBackend{
+		api:      api,
+		groupID:  groupID,
+		maxRules: maxRules,
+		owned:    make(map[string]CloudEntry),
+	}
+	if err := s.checkDetached(ctx); err != nil {
+		return nil, err
+	}
+	return newCloudEnforcer(s), nil
+}
+
+func (s *sgBackend) kind() string   { return CloudSecurityGroup }
+func (s *sgBackend) target() string { return s.groupID }
+
+// checkDetached fails unless no network interface uses the group: an
+// attached ban list would let every banned IP in on all ports.
+func (s *sgBackend) checkDetached(ctx context.Context) error {
+	var out *ec2.DescribeNetworkInterfacesOutput
+	err := withRetry(ctx, func() error {
+		var err error
+		out, err = s.api.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+			Filters: []types.Filter{
+				{Name: aws.String("group-id"), Values: []string{s.groupID}},
+			},
+			MaxResults: aws.Int32(5),
+		})
+		return err
+	})
+	if err != nil {
+		s.detached = false
+		return fmt.Errorf("security group %s: cannot check attachments: %w", s.groupID, err)
+	}
+	if len(out.NetworkInterfaces) > 0 {
+		s.detached = false
+		ids := make([]string, 0, len(out.NetworkInterfaces))
+		for _, ni := range out.NetworkInterfaces {
+			ids = append(ids, aws.ToString(ni.NetworkInterfaceId))
+		}
+		return fmt.Errorf("security group %s is attached to %s; its ban rules would allow the banned IPs in, refusing to use it",
+			s.groupID, strings.Join(ids, ", "))
+	}
+	s.detached = true
+	return nil
+}
+
+func (s *sgBackend) sync(ctx context.Context) error {
+	if err := s.checkDetached(ctx); err != nil {
+		return err
+	}
+
+	owned := make(map[string]CloudEntry)
+	foreign := 0
+
+	var token *string
+	for {
+		var out *ec2.DescribeSecurityGroupRulesOutput
+		err := withRetry(ctx, func() error {
+			var err error
+			out, err = s.api.DescribeSecurityGroupRules(ctx, &ec2.DescribeSecurityGroupRulesInput{
+				Filters: []types.Filter{
+					{Name: aws.String("group-id"), Values: []string{s.groupID}},
+				},
+				NextToken: token,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range out.SecurityGroupRules {
+			if aws.ToBool(r.IsEgress) {
+				continue
+			}
+			ip := banFromCIDR(aws.ToString(r.CidrIpv4), aws.ToString(r.CidrIpv6))
+			if ip == "" || aws.ToString(r.Description) != sgRuleDescription {
+				foreign++
+				continue
+			}
+			entry := CloudEntry{IP: ip, RuleId: aws.ToString(r.SecurityGroupRuleId)}
+			if prev, ok := s.owned[ip]; ok && prev.RuleId == entry.RuleId {
+				entry = prev
+			}
+			owned[ip] = entry
+		}
+
+		if out.NextToken == nil || aws.ToString(out.NextToken) == "" {
+			break
+		}
+		token = out.NextToken
+	}
+
+	s.owned = owned
+	s.foreign = foreign
+	return nil
+}
+
+func (s *sgBackend) entries() []CloudEntry {
+	out := make([]CloudEntry, 0, len(s.owned))
+	for _, e := range s.owned {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (s *sgBackend) capacity() int {
+	c := s.maxRules - s.foreign
+	if c < 0 {
+		c = 0
+	}
+	return c
+}
+
+// add authorizes all IPs in one call.
+func (s *sgBackend) add(ctx context.Context, ips []string) error {
+	if !s.detached {
+		return fmt.Errorf("security group %s: not adding rules until it is verified to be detached", s.groupID)
+	}
+	perm := types.IpPermission{IpProtocol: aws.String("-1")}
+	for _, ip := range ips {
+		if _, ok := s.owned[ip]; ok {
+			continue
+		}
+		if strings.Contains(ip, ":") {
+			perm.Ipv6Ranges = append(perm.Ipv6Ranges, types.Ipv6Range{
+				CidrIpv6:    aws.String(banCIDR(ip)),
+				Description: aws.String(sgRuleDescription),
+			})
+		} else {
+			perm.IpRanges = append(perm.IpRanges, types.IpRange{
+				CidrIp:      aws.String(banCIDR(ip)),
+				Description: aws.String(sgRuleDescription),
+			})
+		}
+	}
+	if len(perm.IpRanges) == 0 && len(perm.Ipv6Ranges) == 0 {
+		return nil
+	}
+
+	var out *ec2.AuthorizeSecurityGroupIngressOutput
+	for attempt := 0; ; attempt++ {
+		var err error
+		out, err = s.api.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(s.groupID),
+			IpPermissions: []types.IpPermission{perm},
+		})
+		if err == nil {
+			break
+		}
+
+		switch {
+		case strings.Contains(err.Error(), "RulesPerSecurityGroupLimitExceeded"):
+			return fmt.Errorf("security group %s: %v: %w", s.groupID, err, errCloudFull)
+		case strings.Contains(err.Error(), "InvalidPermission.Duplicate"):
+			// some rules already exist: pick everything up from the group
+			return s.sync(ctx)
+		}
+		if attempt == cloudRetryAttempts-1 {
+			return err
+		}
+		if !sleepCtx(ctx, cloudRetryBase<<attempt) {
+			return ctx.Err()
+		}
+	}
+
+	now := time.Now()
+	for _, r := range out.SecurityGroupRules {
+		ip := banFromCIDR(aws.ToString(r.CidrIpv4), aws.ToString(r.CidrIpv6))
+		if ip == "" {
+			continue
+		}
+		s.owned[ip] = CloudEntry{IP: ip, RuleId: aws.ToString(r.SecurityGroupRuleId), Created: now}
+	}
+	return nil
+}
+
+// remove revokes the rules of all IPs in one call.
+func (s *sgBackend) remove(ctx context.Context, ips []string) error {
+	var ids []string
+	for _, ip := range ips {
+		if e, ok := s.owned[ip]; ok && e.RuleId != "" {
+			ids = append(ids, e.RuleId)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := withRetry(ctx, func() error {
+		_, err := s.api.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:              aws.String(s.groupID),
+			SecurityGroupRuleIds: ids,
+		})
+		if err != nil && strings.Contains(err.Error(), "NotFound") {
+			return nil // already gone
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		delete(s.owned, ip)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeSecurityGroup is an in-memory EC2SecurityGroupAPI for one group.
+type fakeSecurityGroup struct {
+	rules    map[string]types.SecurityGroupRule
+	next     int
+	limit    int      // ingress rules AWS accepts; 0 = no limit
+	attached []string // network interfaces using the group
+
+	authorizes int
+}
+
+func newFakeSecurityGroup() *fakeSecurityGroup {
+	return &fakeSecurityGroup{rules: make(map[string]types.SecurityGroupRule)}
+}
+
+func (f *fakeSecurityGroup) put(cidr, description string) {
+	f.next++
+	r := types.SecurityGroupRule{
+		SecurityGroupRuleId: aws.String(fmt.Sprintf("sgr-%d", f.next)),
+		GroupId:             aws.String("sg-1"),
+		IsEgress:            aws.Bool(false),
+		IpProtocol:          aws.String("-1"),
+		Description:         aws.String(description),
+	}
+	if strings.Contains(cidr, ":") {
+		r.CidrIpv6 = aws.String(cidr)
+	} else {
+		r.CidrIpv4 = aws.String(cidr)
+	}
+	f.rules[*r.SecurityGroupRuleId] = r
+}
+
+func (f *fakeSecurityGroup) cidrs() []string {
+	var out []string
+	for _, r := range f.rules {
+		out = append(out, aws.ToString(r.CidrIpv4)+aws.ToString(r.CidrIpv6))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (f *fakeSecurityGroup) DescribeSecurityGroupRules(ctx context.Context, in *ec2.DescribeSecurityGroupRulesInput, _ ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error) {
+	out := &ec2.DescribeSecurityGroupRulesOutput{}
+	for _, r := range f.rules {
+		out.SecurityGroupRules = append(out.SecurityGroupRules, r)
+	}
+	// the default egress rule, which the backend must ignore
+	out.SecurityGroupRules = append(out.SecurityGroupRules, types.SecurityGroupRule{
+		SecurityGroupRuleId: aws.String("sgr-egress"), IsEgress: aws.Bool(true), CidrIpv4: aws.String("0.0.0.0/0"),
+	})
+	return out, nil
+}
+
+func (f *fakeSecurityGroup) AuthorizeSecurityGroupIngress(ctx context.Context, in *ec2.AuthorizeSecurityGroupIngressInput, _ ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.authorizes++
+	var cidrs []string
+	for _, p := range in.IpPermissions {
+		for _, r := range p.IpRanges {
+			cidrs = append(cidrs, aws.ToString(r.CidrIp))
+		}
+		for _, r := range p.Ipv6Ranges {
+			cidrs = append(cidrs, aws.ToString(r.CidrIpv6))
+		}
+	}
+	if f.limit > 0 && len(f.rules)+len(cidrs) > f.limit {
+		return nil, errors.New("api error RulesPerSecurityGroupLimitExceeded: the maximum number of rules per security group has been reached")
+	}
+	out := &ec2.AuthorizeSecurityGroupIngressOutput{Return: aws.Bool(true)}
+	for _, cidr := range cidrs {
+		f.put(cidr, sgRuleDescription)
+		out.SecurityGroupRules = append(out.SecurityGroupRules, f.rules[fmt.Sprintf("sgr-%d", f.next)])
+	}
+	return out, nil
+}
+
+func (f *fakeSecurityGroup) RevokeSecurityGroupIngress(ctx context.Context, in *ec2.RevokeSecurityGroupIngressInput, _ ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	for _, id := range in.SecurityGroupRuleIds {
+		if _, ok := f.rules[id]; !ok {
+			return nil, fmt.Errorf("api error InvalidSecurityGroupRuleId.NotFound: %s", id)
+		}
+	}
+	for _, id := range in.SecurityGroupRuleIds {
+		delete(f.rules, id)
+	}
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeSecurityGroup) DescribeNetworkInterfaces(ctx context.Context, in *ec2.DescribeNetworkInterfacesInput, _ ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	if len(in.Filters) != 1 || aws.ToString(in.Filters[0].Name) != "group-id" || in.Filters[0].Values[0] != "sg-1" {
+		return nil, fmt.Errorf("unexpected filters %+v", in.Filters)
+	}
+	out := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, id := range f.attached {
+		out.NetworkInterfaces = append(out.NetworkInterfaces, types.NetworkInterface{NetworkInterfaceId: aws.String(id)})
+	}
+	return out, nil
+}
+
+func newTestSecurityGroup(t *testing.T, api *fakeSecurityGroup, maxRules int) (*cloudEnforcer, *sgBackend) {
+	t.Helper()
+	b := &sgBackend{api: api, groupID: "sg-1", maxRules: maxRules, owned: make(map[string]CloudEntry)}
+	return newTestEnforcer(t, b), b
+}
+
+func TestSecurityGroupRefusesAttachedGroup(t *testing.T) {
+	api := newFakeSecurityGroup()
+	api.attached = []string{"eni-1", "eni-2"}
+
+	_, err := NewSecurityGroupEnforcer(context.Background(), api, "sg-1", 60)
+	if err == nil || !strings.Contains(err.Error(), "eni-1, eni-2") {
+		t.Fatalf("err = %v, want a refusal naming the interfaces", err)
+	}
+}
+
+func TestSecurityGroupStopsWhenAttachedLater(t *testing.T) {
+	api := newFakeSecurityGroup()
+	c, _ := newTestSecurityGroup(t, api, 60)
+	block(c, "203.0.113.1")
+
+	api.attached = []string{"eni-1"}
+	if c.sync(context.Background()) {
+		t.Fatal("sync succeeded on an attached group")
+	}
+	block(c, "203.0.113.2")
+	if api.authorizes != 1 {
+		t.Fatalf("%d authorize calls, want none after the group was attached", api.authorizes)
+	}
+	if st := c.Status(); !strings.Contains(st.LastError, "detached") {
+		t.Fatalf("LastError = %q", st.LastError)
+	}
+}
+
+func TestSecurityGroupAddAndRemove(t *testing.T) {
+	api := newFakeSecurityGroup()
+	api.put("10.0.0.0/8", "office") // foreign rule
+	c, b := newTestSecurityGroup(t, api, 60)
+
+	block(c, "203.0.113.1", "2001:db8::1", "198.51.100.0/24")
+	if api.authorizes != 1 {
+		t.Fatalf("%d authorize calls, want the batch in one call", api.authorizes)
+	}
+	want := []string{"10.0.0.0/8", "198.51.100.0/24", "2001:db8::1/128", "203.0.113.1/32"}
+	if got := api.cidrs(); !equalStrings(got, want) {
+		t.Fatalf("rules = %v, want %v", got, want)
+	}
+	if got := b.capacity(); got != 59 {
+		t.Fatalf("capacity = %d, want 59", got)
+	}
+
+	unblock(c, "203.0.113.1", "2001:db8::1")
+	if got := api.cidrs(); !equalStrings(got, []string{"10.0.0.0/8", "198.51.100.0/24"}) {
+		t.Fatalf("rules = %v", got)
+	}
+}
+
+func TestSecurityGroupRemoveToleratesMissingRule(t *testing.T) {
+	api := newFakeSecurityGroup()
+	c, b := newTestSecurityGroup(t, api, 60)
+	block(c, "203.0.113.1")
+
+	for id := range api.rules {
+		delete(api.rules, id) // revoked by hand
+	}
+	unblock(c, "203.0.113.1")
+	if got := ownedIPs(b); len(got) != 0 {
+		t.Fatalf("owned = %v, want none", got)
+	}
+	if st := c.Status(); st.LastError != "" {
+		t.Fatalf("unexpected error: %s", st.LastError)
+	}
+}
+
+func TestSecurityGroupLimitExceededEvictsOldest(t *testing.T) {
+	api := newFakeSecurityGroup()
+	api.limit = 2
+	c, b := newTestSecurityGroup(t, api, 60)
+
+	block(c, "203.0.113.1")
+	block(c, "203.0.113.2")
+	block(c, "203.0.113.3")
+
+	if got, want := ownedIPs(b), []string{"203.0.113.2", "203.0.113.3"}; !equalStrings(got, want) {
+		t.Fatalf("owned = %v, want %v", got, want)
+	}
+	if st := c.Status(); st.Evictions != 1 || st.LastError != "" {
+		t.Fatalf("status = %+v, want one eviction", st)
+	}
+}
+
+func TestSecurityGroupReconcile(t *testing.T) {
+	api := newFakeSecurityGroup()
+	api.put("203.0.113.1/32", sgRuleDescription) // left by an earlier run
+	api.put("203.0.113.2/32", sgRuleDescription)
+	api.put("203.0.113.3/32", "added by hand")
+	c, b := newTestSecurityGroup(t, api, 60)
+
+	if got := ownedIPs(b); !equalStrings(got, []string{"203.0.113.1", "203.0.113.2"}) {
+		t.Fatalf("owned after sync = %v", got)
+	}
+	c.reconcile(context.Background(), []string{"203.0.113.2", "203.0.113.9"})
+	want := []string{"203.0.113.2/32", "203.0.113.3/32", "203.0.113.9/32"}
+	if got := api.cidrs(); !equalStrings(got, want) {
+		t.Fatalf("rules = %v, want %v", got, want)
+	}
+}
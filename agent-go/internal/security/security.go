@@ -3,16 +3,17 @@ package security
 import (
 	"context"
 	"fmt"
+	"hash/maphash"
+	"log"
 	"net"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
 //────────────────────────────────────────────────────────────
@@ -22,16 +23,52 @@ import (
 type Engine struct {
 	cfg *Config
 
-	mu sync.Mutex
+	mu sync.Mutex // guards everything below except the lock-free block
 
-	perIPMinute   map[string]int
-	perPathMinute map[string]int
-	perASNMinute  map[int]int
+	// lock-free, see shard.go
+	shards        []*shard
+	shardSeed     maphash.Seed
+	paths         *sharedCounter                 // normalized paths, fixed memory
+	asns          *countMap[int]                 // per-minute requests per ASN
+	sites         *countMap[string]              // per access log file
+	requests      atomic.Int64                   // all requests this minute
+	banned        sync.Map                       // mirror of bans keys
+	limits        atomic.Pointer[adaptiveLimits] // learned path/asn limits for this window
+	attackOn      atomic.Bool                    // mirror of attack.Active
+	attackTrigger atomic.Int64                   // mirror of attack.TriggerRpm
 
 	bans    map[string]*SecurityEvent      // active bans
 	history []SecurityEvent                // last 24h bans
 	asn     *ASNResolver
-	aws     *ec2.Client
+	cloud   []CloudEnforcer
+	aws     *awsClients // behind the cloud enforcers, nil until they have credentials
+	awsMu   sync.Mutex  // guards aws
+	feeds   *FeedManager
+
+	crawlers  *CrawlerVerifier
+	impostors []CrawlerImpostorEvent // last maxImpostors fake crawler IPs
+
+	notifier *Notifier
+	breached map[string]bool // thresholds already reported this window
+
+	fleetSeen map[string]time.Time // fleet ban IDs already applied -> expiry
+
+	traps     *TrapSet
+	trapStats TrapStats
+
+	authFails map[string][]time.Time // failed logins per IP inside the window
+	authStats AuthStats
+
+	wafHits  map[string][]wafHit // ModSecurity alerts per IP inside the window
+	wafStats WafStats
+
+	baseline  *Baseline
+	anomalies []Anomaly // last maxAnomalies baseline deviations
+
+	attack attackState
+
+	audit     *AuditLog
+	allowlist []*net.IPNet
 
 	windowStart time.Time
 }
@@ -45,6 +82,10 @@ type SecurityEvent struct {
 	Count     int       `json:"count"`
 	FirstSeen time.Time `json:"firstSeen"`
 	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Origin    string    `json:"origin,omitempty"` // agent that decided a fleet-shared ban
+	Rules     []string  `json:"rules,omitempty"`  // WAF rule ids that triggered the ban
+	Rule      string    `json:"rule,omitempty"`   // limit or trap that triggered the ban
 }
 
 // Config (matches agent.config.json)
@@ -57,11 +98,100 @@ type Config struct {
 	SecurityBanMinutes      int     `json:"securityBanMinutes"`
 	GeoLiteAsnPath          string  `json:"geoLiteAsnPath"`
 	FirewallIpsetName       string  `json:"firewallIpsetName"`
+	FirewallSubnetIpsetName string  `json:"firewallSubnetIpsetName"` // hash:net set for /24 and /64 bans
 	FirewallNftTable        string  `json:"firewallNftTable"`
 	FirewallNftChain        string  `json:"firewallNftChain"`
 	AwsRegion               string  `json:"awsRegion"`
 	AwsNetworkAclId         string  `json:"awsNetworkAclId"`
+	SecuritySketchWidth     int     `json:"securitySketchWidth"` // count-min sketch cells per row for ip/path counters
+	SecurityTopK            int     `json:"securityTopK"`        // heavy hitters tracked by name per counter
+	SecurityShards          int     `json:"securityShards"`          // event workers, 0 = GOMAXPROCS
+	SecurityLookupCacheSize int     `json:"securityLookupCacheSize"` // cached ASN/country lookups across all workers
+	FirewallDisabled        bool    `json:"firewallDisabled"`        // bans skip the local ipset (benchmarks, hosts without root)
 	AwsNetworkAclDenyRuleBase int   `json:"awsNetworkAclDenyRuleBase"`
+	AwsNetworkAclDenyRuleMax  int   `json:"awsNetworkAclDenyRuleMax"`
+	AwsNetworkAclMaxEntries   int   `json:"awsNetworkAclMaxEntries"`
+
+	// Cloud-side enforcement: nacl, wafv2, security-group (empty = nacl
+	// when AwsNetworkAclId is set)
+	CloudEnforcers          []string `json:"cloudEnforcers"`
+	AwsWafScope             string  `json:"awsWafScope"` // REGIONAL or CLOUDFRONT
+	AwsWafIpSetName         string  `json:"awsWafIpSetName"`
+	AwsWafIpSetId           string  `json:"awsWafIpSetId"`
+	AwsWafIpSetV6Name       string  `json:"awsWafIpSetV6Name"` // optional IPv6 set
+	AwsWafIpSetV6Id         string  `json:"awsWafIpSetV6Id"`
+	AwsSecurityGroupId      string  `json:"awsSecurityGroupId"`
+	AwsSecurityGroupMaxRules int    `json:"awsSecurityGroupMaxRules"`
+	AwsConfigLoader         AWSConfigLoader `json:"-"` // nil = default credential chain
+
+	// Search-engine crawler verification (forward-confirmed reverse DNS)
+	SecurityVerifyCrawlers  bool    `json:"securityVerifyCrawlers"`
+	SecurityBanFakeCrawlers bool    `json:"securityBanFakeCrawlers"`
+	SecurityCrawlerResolver string  `json:"securityCrawlerResolver"` // host:port, empty = system resolver
+	SecurityCrawlerCacheMinutes int     `json:"securityCrawlerCacheMinutes"`
+
+	// Notifications (ban, unban, threshold breach, feed refresh)
+	InstanceId              string  `json:"instanceId"`
+	NotifyWebhooks          []WebhookConfig `json:"notifyWebhooks"`
+	NotifySyslog            bool    `json:"notifySyslog"`
+	NotifySyslogAddr        string  `json:"notifySyslogAddr"` // empty = local syslog, or udp://host:514
+	NotifyBatchSeconds      int     `json:"notifyBatchSeconds"`
+	NotifyMaxPerMinute      int     `json:"notifyMaxPerMinute"` // batches per minute per channel
+
+	// Fleet-wide ban sharing between agents of the same customer
+	FleetBanSharing         bool    `json:"fleetBanSharing"`
+	FleetBanMaxTTLMinutes   int     `json:"fleetBanMaxTtlMinutes"`
+
+	// Honeypot paths: first hit bans immediately
+	SecurityTraps           []TrapConfig `json:"securityTraps"`
+	SecurityTrapLinks       int     `json:"securityTrapLinks"`      // hidden links to generate, 0 = none
+	SecurityTrapLinkPrefix  string  `json:"securityTrapLinkPrefix"`
+	SecurityTrapBanMinutes  int     `json:"securityTrapBanMinutes"` // 0 = SecurityBanMinutes
+
+	// Failed logins from sshd, Postfix/Dovecot and FTP logs
+	SecurityAuthEnabled     bool    `json:"securityAuthEnabled"`
+	SecurityAuthMaxFailures int     `json:"securityAuthMaxFailures"`   // failures per IP within the window
+	SecurityAuthWindowMinutes int   `json:"securityAuthWindowMinutes"`
+	SecurityAuthBanMinutes  int     `json:"securityAuthBanMinutes"`    // 0 = SecurityBanMinutes
+
+	// ModSecurity audit log alerts
+	SecurityWafEnabled      bool    `json:"securityWafEnabled"`
+	SecurityWafMaxHits      int     `json:"securityWafMaxHits"`  // alerts per IP within the window
+	SecurityWafMaxScore     int     `json:"securityWafMaxScore"` // summed anomaly score within the window, 0 = off
+	SecurityStateDir        string  `json:"securityStateDir"` // state kept across restarts, "" = none
+	SecurityWafWindowMinutes int    `json:"securityWafWindowMinutes"`
+	SecurityWafBanMinutes   int     `json:"securityWafBanMinutes"` // 0 = SecurityBanMinutes
+
+	// Learned per-minute baselines per site, path and ASN
+	SecurityBaselineEnabled bool    `json:"securityBaselineEnabled"`
+	SecurityBaselinePath    string  `json:"securityBaselinePath"`
+	SecurityAnomalySigma    float64 `json:"securityAnomalySigma"`    // deviations above the mean that count as an anomaly
+	SecurityAnomalyMinCount int     `json:"securityAnomalyMinCount"` // requests per minute below which nothing is anomalous
+	SecurityAdaptiveThresholds bool `json:"securityAdaptiveThresholds"` // use the baseline instead of fixed path/asn limits once learned
+
+	// Layer-7 DDoS attack mode
+	SecurityAttackEnabled   bool    `json:"securityAttackEnabled"`
+	SecurityAttackMinRpm    int     `json:"securityAttackMinRpm"`      // total requests per minute below which attack mode never triggers
+	SecurityAttackSurgeFactor float64 `json:"securityAttackSurgeFactor"` // multiple of the learned rate that escalates
+	SecurityAttackIpFactor  float64 `json:"securityAttackIpFactor"`    // per-IP limit multiplier while under attack
+	SecurityAttackSubnetRpm int     `json:"securityAttackSubnetRpm"`   // requests per /24 or /64 per minute, 0 = off
+	SecurityAttackAsnRpm    int     `json:"securityAttackAsnRpm"`      // ASN rate above which its subnets are banned, 0 = off
+	SecurityAttackCountries []string `json:"securityAttackCountries"`  // ISO codes allowed while under attack, empty = all
+	SecurityAttackCooldownMinutes int `json:"securityAttackCooldownMinutes"`
+	SecurityAttackBanMinutes int    `json:"securityAttackBanMinutes"`  // 0 = SecurityBanMinutes
+	GeoLiteCountryPath      string  `json:"geoLiteCountryPath"`
+
+	// Never banned automatically (IPs or CIDRs)
+	SecurityAllowlist       []string `json:"securityAllowlist"`
+
+	// Append-only JSONL audit log of every decision, empty path = off
+	SecurityAuditPath       string  `json:"securityAuditPath"`
+	SecurityAuditMaxMB      int     `json:"securityAuditMaxMb"` // rotate after this size
+	SecurityAuditKeep       int     `json:"securityAuditKeep"`  // rotated files kept
+
+	// Threat-intel blocklists, enforced through their own ipset
+	ThreatFeeds             []FeedConfig `json:"threatFeeds"`
+	FirewallFeedIpsetName   string  `json:"firewallFeedIpsetName"`
 }
 
 // Event from log parser
@@ -70,6 +200,7 @@ type LogEvent struct {
 	Path   string
 	Agent  string
 	Time   time.Time
+	Source string // access log file name, identifies the site
 }
 
 // Snapshot for /security endpoint
@@ -82,8 +213,42 @@ type SecuritySnapshot struct {
 	PerPathMinute     map[string]int            `json:"perPathMinute"`
 	PerASNMinute      map[int]int               `json:"perAsnMinute"`
 	BanDurationMinutes int                      `json:"banDurationMinutes"`
+	VerifiedCrawlers  int                       `json:"verifiedCrawlers"`
+	CrawlerImpostors  []CrawlerImpostorEvent    `json:"crawlerImpostors"`
+	Notifications     []NotifyChannelStats      `json:"notifications"`
+	Cloud             []CloudEnforcerStatus     `json:"cloud"`
+	Traps             TrapStats                 `json:"traps"`
+	Auth              AuthStats                 `json:"auth"`
+	Waf               WafStats                  `json:"waf"`
+	Baseline          BaselineStatus            `json:"baseline"`
+	Anomalies         []Anomaly                 `json:"anomalies"`
+	Attack            AttackStatus              `json:"attack"`
+	Memory            MemoryStats               `json:"memory"`
 }
 
+// MemoryStats shows what the engine holds in memory.
+type MemoryStats struct {
+	Counters     []CounterStats   `json:"counters"`
+	ASNKeys      int              `json:"asnKeys"`
+	SiteKeys     int              `json:"siteKeys"`
+	ActiveBans   int              `json:"activeBans"`
+	History      int              `json:"history"`
+	AuthTracked  int              `json:"authTracked"`
+	WafTracked   int              `json:"wafTracked"`
+	BaselineKeys int              `json:"baselineKeys"`
+	Shards       int              `json:"shards"`
+	Queued       int              `json:"queued"` // events waiting for a worker
+	LookupCache  LookupCacheStats `json:"lookupCache"`
+	HeapAlloc    uint64           `json:"heapAlloc"` // whole agent process
+}
+
+const (
+	maxImpostors = 100
+	maxAnomalies = 100
+
+	baselineSaveEvery = 10 * time.Minute
+)
+
 //────────────────────────────────────────────────────────────
 //  Engine initialization
 //────────────────────────────────────────────────────────────
@@ -91,22 +256,104 @@ type SecuritySnapshot struct {
 func NewEngine(cfg *Config) (*Engine, error) {
 	e := &Engine{
 		cfg:           cfg,
-		perIPMinute:   make(map[string]int),
-		perPathMinute: make(map[string]int),
-		perASNMinute:  make(map[int]int),
+		shardSeed:     maphash.MakeSeed(),
+		paths:         newSharedCounter(cfg.SecuritySketchWidth),
+		asns:          newCountMap[int](),
+		sites:         newCountMap[string](),
 		bans:          make(map[string]*SecurityEvent),
 		history:       []SecurityEvent{},
+		breached:      make(map[string]bool),
+		fleetSeen:     make(map[string]time.Time),
+		trapStats:     TrapStats{PerTrap: map[string]uint64{}, Recent: []TrapHit{}},
+		authFails:     make(map[string][]time.Time),
+		authStats:     AuthStats{Failures: map[string]uint64{}, Bans: map[string]uint64{}, Recent: []AuthFailure{}},
+		wafHits:       make(map[string][]wafHit),
+		wafStats:      WafStats{Rules: map[string]uint64{}, Recent: []WafAlert{}},
+		anomalies:     []Anomaly{},
+		attack:        newAttackState(cfg),
 		windowStart:   time.Now(),
 	}
+	e.attackTrigger.Store(int64(e.attack.TriggerRpm))
+
+	// Event workers, sharded by subnet
+	shards := cfg.SecurityShards
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	cacheSize := cfg.SecurityLookupCacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultLookupCacheSize
+	}
+	for i := 0; i < shards; i++ {
+		e.shards = append(e.shards, newShard(e, i, cacheSize/shards))
+	}
+
+	// Notification channels (the WebSocket channel is added by main)
+	e.notifier = NewNotifier(cfg.InstanceId,
+		time.Duration(cfg.NotifyBatchSeconds)*time.Second, cfg.NotifyMaxPerMinute)
+	for _, wh := range cfg.NotifyWebhooks {
+		if wh.URL == "" {
+			continue
+		}
+		e.notifier.AddChannel(NewWebhookChannel(wh.URL, wh.Secret), wh.Events)
+	}
+	if cfg.NotifySyslog {
+		ch, err := NewSyslogChannel(cfg.NotifySyslogAddr)
+		if err != nil {
+			log.Printf("security: syslog notifications disabled: %v", err)
+		} else {
+			e.notifier.AddChannel(ch, nil)
+		}
+	}
 
 	// ASN Resolver
 	if cfg.GeoLiteAsnPath != "" {
 		e.asn = NewASNResolver(cfg.GeoLiteAsnPath)
 	}
 
-	// AWS Firewall
-	if err := e.initAwsFirewall(cfg); err != nil {
-		return nil, err
+	// Trap paths
+	if len(cfg.SecurityTraps) > 0 || cfg.SecurityTrapLinks > 0 {
+		e.traps = NewTrapSet(cfg.SecurityTraps, trapKey(cfg), cfg.SecurityTrapLinks, cfg.SecurityTrapLinkPrefix)
+	}
+
+	// Audit log and allow-list
+	if cfg.SecurityAuditPath != "" {
+		audit, err := NewAuditLog(cfg.SecurityAuditPath, cfg.SecurityAuditMaxMB, cfg.SecurityAuditKeep)
+		if err != nil {
+			log.Printf("security: audit log disabled: %v", err)
+		} else {
+			e.audit = audit
+		}
+	}
+	for _, entry := range cfg.SecurityAllowlist {
+		if n := parseAllowEntry(entry); n != nil {
+			e.allowlist = append(e.allowlist, n)
+		} else {
+			log.Printf("security: ignoring invalid allowlist entry %q", entry)
+		}
+	}
+
+	// Traffic baselines
+	if cfg.SecurityBaselineEnabled {
+		e.baseline = NewBaseline(cfg.SecurityBaselinePath, cfg.SecurityAnomalySigma, cfg.SecurityAnomalyMinCount)
+		e.updateLimits()
+	}
+
+	// Crawler verification
+	if cfg.SecurityVerifyCrawlers {
+		ttl := time.Duration(cfg.SecurityCrawlerCacheMinutes) * time.Minute
+		e.crawlers = NewCrawlerVerifier(cfg.SecurityCrawlerResolver, ttl, e.onCrawlerImpostor)
+	}
+
+	// Cloud firewalls (NACL, WAFv2 IP set, security group). One that fails
+	// is reported in its status and retried; local bans never wait on it.
+	e.initCloudEnforcers(cfg)
+	if e.audit != nil {
+		for _, c := range e.cloud {
+			if r, ok := c.(cloudResultReporter); ok {
+				r.setResultHook(e.auditCloud)
+			}
+		}
 	}
 
 	// Local firewall: ensure ipset + nftables exist
@@ -114,7 +361,20 @@ func NewEngine(cfg *Config) (*Engine, error) {
 		return nil, err
 	}
 
+	// Threat feeds: separate ipset so feed refreshes never touch rate-limit bans
+	if len(cfg.ThreatFeeds) > 0 && cfg.FirewallFeedIpsetName != "" {
+		e.feeds = NewFeedManager(cfg.FirewallFeedIpsetName, cfg.ThreatFeeds)
+		e.feeds.onRefresh = func(st FeedStatus) {
+			e.notify(Notification{Type: NotifyFeedRefresh, Feed: &st})
+		}
+		e.feeds.ensureFirewall(cfg.FirewallNftTable, cfg.FirewallNftChain)
+		e.feeds.Start()
+	}
+
 	// Start background loops
+	for _, sh := range e.shards {
+		go sh.run()
+	}
 	go e.windowResetLoop()
 	go e.expiryLoop()
 
@@ -122,24 +382,96 @@ func NewEngine(cfg *Config) (*Engine, error) {
 }
 
 //────────────────────────────────────────────────────────────
-//  AWS FIREWALL INIT
+//  CLOUD FIREWALL INIT
 //────────────────────────────────────────────────────────────
 
-func (e *Engine) initAwsFirewall(cfg *Config) error {
-	if cfg.AwsRegion == "" || cfg.AwsNetworkAclId == "" {
-		return nil // AWS firewall disabled
+func (e *Engine) initCloudEnforcers(cfg *Config) {
+	kinds := cfg.CloudEnforcers
+	if len(kinds) == 0 && cfg.AwsNetworkAclId != "" {
+		kinds = []string{CloudNACL}
+	}
+	if cfg.AwsRegion == "" || len(kinds) == 0 {
+		return // AWS firewall disabled
 	}
 
-	awsCfg, err := awsconfig.LoadDefaultConfig(
-		context.Background(),
-		awsconfig.WithRegion(cfg.AwsRegion),
-	)
-	if err != nil {
-		return err
+	add := func(kind, target string, start func(clients *awsClients) (CloudEnforcer, error)) {
+		e.cloud = append(e.cloud, startCloudEnforcer(kind, target, cloudSyncEvery, func() (CloudEnforcer, error) {
+			clients, err := e.awsClients(cfg)
+			if err != nil {
+				return nil, err
+			}
+			return start(clients)
+		}))
+	}
+	invalid := func(kind, target string, err error) {
+		log.Printf("security: cloud enforcer %q disabled: %v", kind, err)
+		e.cloud = append(e.cloud, &deferredEnforcer{
+			name: kind + ":" + target, kind: kind, target: target, lastError: err.Error(),
+		})
 	}
 
-	e.aws = ec2.NewFromConfig(awsCfg)
-	return nil
+	for _, kind := range kinds {
+		switch kind = strings.ToLower(strings.TrimSpace(kind)); kind {
+		case CloudNACL:
+			if cfg.AwsNetworkAclId == "" {
+				invalid(kind, "", fmt.Errorf("requires awsNetworkAclId"))
+				continue
+			}
+			add(kind, cfg.AwsNetworkAclId, func(clients *awsClients) (CloudEnforcer, error) {
+				return NewNaclEnforcer(clients, cfg.AwsNetworkAclId,
+					cfg.AwsNetworkAclDenyRuleBase, cfg.AwsNetworkAclDenyRuleMax, cfg.AwsNetworkAclMaxEntries), nil
+			})
+		case CloudWAFv2:
+			if cfg.AwsWafIpSetName == "" || cfg.AwsWafIpSetId == "" {
+				invalid(kind, cfg.AwsWafIpSetName, fmt.Errorf("requires awsWafIpSetName and awsWafIpSetId"))
+				continue
+			}
+			add(kind, cfg.AwsWafIpSetName, func(clients *awsClients) (CloudEnforcer, error) {
+				return NewWafIPSetEnforcer(clients, cfg.AwsWafScope, cfg.AwsWafIpSetName, cfg.AwsWafIpSetId, 0,
+					stateFile(cfg, "wafv2-"+cfg.AwsWafIpSetId+".json")), nil
+			})
+			if cfg.AwsWafIpSetV6Name != "" && cfg.AwsWafIpSetV6Id != "" {
+				add(kind, cfg.AwsWafIpSetV6Name, func(clients *awsClients) (CloudEnforcer, error) {
+					return NewWafIPSetEnforcer(clients, cfg.AwsWafScope, cfg.AwsWafIpSetV6Name, cfg.AwsWafIpSetV6Id, 0,
+						stateFile(cfg, "wafv2-"+cfg.AwsWafIpSetV6Id+".json")), nil
+				})
+			}
+		case CloudSecurityGroup:
+			if cfg.AwsSecurityGroupId == "" {
+				invalid(kind, "", fmt.Errorf("requires awsSecurityGroupId"))
+				continue
+			}
+			add(kind, cfg.AwsSecurityGroupId, func(clients *awsClients) (CloudEnforcer, error) {
+				return NewSecurityGroupEnforcer(context.Background(), clients,
+					cfg.AwsSecurityGroupId, cfg.AwsSecurityGroupMaxRules)
+			})
+		default:
+			invalid(kind, "", fmt.Errorf("unknown cloud enforcer"))
+		}
+	}
+}
+
+// stateFile returns name in SecurityStateDir, or "" without one.
+func stateFile(cfg *Config, name string) string {
+	if cfg.SecurityStateDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.SecurityStateDir, name)
+}
+
+// awsClients returns the clients behind the cloud enforcers, building
+// them on first use. A failure is retried by the next caller.
+func (e *Engine) awsClients(cfg *Config) (*awsClients, error) {
+	e.awsMu.Lock()
+	defer e.awsMu.Unlock()
+	if e.aws == nil {
+		clients, err := newAWSClients(context.Background(), cfg.AwsConfigLoader, cfg.AwsRegion, cfg.AwsWafScope)
+		if err != nil {
+			return nil, err
+		}
+		e.aws = clients
+	}
+	return e.aws, nil
 }
 
 //────────────────────────────────────────────────────────────
@@ -147,13 +479,18 @@ func (e *Engine) initAwsFirewall(cfg *Config) error {
 //────────────────────────────────────────────────────────────
 
 func (e *Engine) ensureLocalFirewall() error {
+	if e.cfg.FirewallDisabled {
+		return nil
+	}
 	ipset := e.cfg.FirewallIpsetName
+	subnets := e.subnetIpset()
 	table := e.cfg.FirewallNftTable
 	chain := e.cfg.FirewallNftChain
 
-	// Ensure ipset exists
+	// Ensure ipsets exist: single addresses, and subnets (hash:ip can't hold a CIDR)
 	exec.Command("ipset", "create", ipset, "hash:ip").Run()
 	exec.Command("ipset", "create", ipset, "hash:ip").Run() // 2nd try silently
+	exec.Command("ipset", "create", subnets, "hash:net").Run()
 
 	// Ensure nft table exists
 	exec.Command("nft", "add", "table", table).Run()
@@ -162,9 +499,11 @@ func (e *Engine) ensureLocalFirewall() error {
 	exec.Command("nft", "add", "chain", table, chain,
 		"{ type filter hook prerouting priority -300; }").Run()
 
-	// Ensure rule: drop if in ipset
+	// Ensure rules: drop if in either ipset
 	exec.Command("nft", "add", "rule", table, chain,
 		fmt.Sprintf("ip saddr @%s drop", ipset)).Run()
+	exec.Command("nft", "add", "rule", table, chain,
+		fmt.Sprintf("ip saddr @%s drop", subnets)).Run()
 
 	return nil
 }
@@ -173,97 +512,279 @@ func (e *Engine) ensureLocalFirewall() error {
 //  PROCESS EVENTS
 //────────────────────────────────────────────────────────────
 
-func (e *Engine) Process(evt LogEvent) {
-	if !e.cfg.SecurityEnabled {
-		return
-	}
-
-	ip := strings.TrimSpace(evt.IP)
-	if ip == "" || net.ParseIP(ip) == nil {
-		return
-	}
+// Process and the per-event pipeline are in shard.go.
 
+// onCrawlerImpostor is called by the verifier when an IP fails FCrDNS.
+func (e *Engine) onCrawlerImpostor(ev CrawlerImpostorEvent) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	// Update counters
-	e.perIPMinute[ip]++
-	e.perPathMinute[evt.Path]++
-
-	var asn int
-	if e.asn != nil {
-		asn = e.asn.ASN(ip)
-		if asn > 0 {
-			e.perASNMinute[asn]++
-		}
+	e.impostors = append(e.impostors, ev)
+	if len(e.impostors) > maxImpostors {
+		e.impostors = e.impostors[len(e.impostors)-maxImpostors:]
 	}
 
-	// Check thresholds
-	if e.shouldBanIP(ip, evt.Path, asn) {
-		e.applyBan(ip, evt.Path, asn)
+	if e.cfg.SecurityBanFakeCrawlers {
+		if _, banned := e.bans[ev.IP]; !banned {
+			e.applyBan(ev.IP, "", 0, "fake-crawler", fmt.Sprintf("claimed %s, reverse DNS %q", ev.Claimed, ev.PTR))
+		}
 	}
 }
 
-func (e *Engine) shouldBanIP(ip, path string, asn int) bool {
-	cfg := e.cfg
-
-	if cfg.SecurityMaxRpmPerIp > 0 && e.perIPMinute[ip] > cfg.SecurityMaxRpmPerIp {
-		return true
-	}
-
-	if cfg.SecurityMaxRpmPerPath > 0 && e.perPathMinute[path] > cfg.SecurityMaxRpmPerPath {
-		return true
-	}
-
-	if asn > 0 && cfg.SecurityMaxRpmPerAsn > 0 && e.perASNMinute[asn] > cfg.SecurityMaxRpmPerAsn {
-		return true
+// thresholdBreached reports each ip/path/asn threshold once per window.
+// Caller holds e.mu.
+func (e *Engine) thresholdBreached(ev Notification) {
+	key := fmt.Sprintf("%s|%s|%s|%d", ev.Scope, ev.IP, ev.Path, ev.ASN)
+	if e.breached[key] {
+		return
 	}
-
-	return false
+	e.breached[key] = true
+	ev.Type = NotifyThreshold
+	e.notify(ev)
 }
 
 //────────────────────────────────────────────────────────────
 //  APPLY BAN
 //────────────────────────────────────────────────────────────
 
-func (e *Engine) applyBan(ip, path string, asn int) {
+func (e *Engine) applyBan(ip, path string, asn int, reason, rule string) {
+	e.applyBanFor(ip, path, asn, reason, rule, 0)
+}
+
+// applyBanFor bans ip for ttl (0 = SecurityBanMinutes) unless it is
+// allow-listed. rule describes what triggered the ban. Caller holds e.mu.
+func (e *Engine) applyBanFor(ip, path string, asn int, reason, rule string, ttl time.Duration) {
 	now := time.Now()
+	if ttl <= 0 {
+		ttl = time.Duration(e.cfg.SecurityBanMinutes) * time.Minute
+	}
+	if e.spareAllowlisted(ip, path, asn, reason, rule) {
+		return
+	}
 
-	ev := &SecurityEvent{
+	e.enforceBan(&SecurityEvent{
 		IP:        ip,
 		ASN:       asn,
 		Path:      path,
-		Reason:    "rate-limit",
-		Count:     e.perIPMinute[ip],
+		Reason:    reason,
+		Rule:      rule,
+		Count:     e.ipCount(ip),
 		FirstSeen: now,
 		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
+	})
+}
+
+// spareAllowlisted reports whether ip is allow-listed, recording in the
+// audit log the ban it escaped. Every automatic ban goes through it
+// before enforceBan. Caller holds e.mu.
+func (e *Engine) spareAllowlisted(ip, path string, asn int, reason, rule string) bool {
+	entry, ok := e.allowlisted(ip)
+	if !ok {
+		return false
 	}
+	// record once per window, the IP keeps tripping the rule
+	if key := "allowlist|" + ip; !e.breached[key] {
+		e.breached[key] = true
+		e.audit.Record(AuditRecord{
+			Action:   AuditAllowlist,
+			IP:       ip,
+			ASN:      asn,
+			Path:     path,
+			Reason:   reason,
+			Rule:     rule + " (allowed by " + entry + ")",
+			Counters: e.auditCounters(ip, path, asn),
+		})
+	}
+	return true
+}
 
+// enforceBan records ev as an active ban, notifies and pushes it to the
+// firewalls. Caller holds e.mu.
+func (e *Engine) enforceBan(ev *SecurityEvent) {
+	ip := ev.IP
 	e.bans[ip] = ev
+	e.banned.Store(ip, struct{}{})
 	e.history = append(e.history, *ev)
 
+	e.notify(Notification{
+		Type:       NotifyBan,
+		Time:       ev.FirstSeen,
+		IP:         ip,
+		ASN:        ev.ASN,
+		Path:       ev.Path,
+		Reason:     ev.Reason,
+		Count:      ev.Count,
+		Rules:      ev.Rules,
+		Origin:     ev.Origin,
+		TTLSeconds: int(ev.ExpiresAt.Sub(ev.FirstSeen).Seconds()),
+	})
+
+	action := AuditBan
+	if ev.Reason == reasonManual {
+		action = AuditManualBan
+	}
+	e.audit.Record(AuditRecord{
+		Time:       ev.FirstSeen,
+		Action:     action,
+		IP:         ip,
+		ASN:        ev.ASN,
+		Path:       ev.Path,
+		Reason:     ev.Reason,
+		Rule:       ev.Rule,
+		Counters:   e.auditCounters(ip, ev.Path, ev.ASN),
+		Origin:     ev.Origin,
+		TTLSeconds: int(ev.ExpiresAt.Sub(ev.FirstSeen).Seconds()),
+	})
+
 	// local firewall
-	exec.Command("ipset", "add", e.cfg.FirewallIpsetName, ip).Run()
+	e.firewall("add", ip)
+
+	// cloud firewalls
+	for _, c := range e.cloud {
+		c.Block(ip)
+	}
+}
+
+// liftBan removes an active ban from the engine and the local firewall.
+// Caller holds e.mu.
+func (e *Engine) liftBan(ev *SecurityEvent, why string) {
+	delete(e.bans, ev.IP)
+	e.banned.Delete(ev.IP)
+	action := AuditUnban
+	if why == reasonManual {
+		action = AuditManualUnban
+	}
+	e.audit.Record(AuditRecord{Action: action, IP: ev.IP, ASN: ev.ASN, Reason: why, Origin: ev.Origin})
+	e.firewall("del", ev.IP)
+	for _, c := range e.cloud {
+		c.Unblock(ev.IP)
+	}
+	e.notify(Notification{
+		Type:   NotifyUnban,
+		IP:     ev.IP,
+		ASN:    ev.ASN,
+		Reason: why,
+		Origin: ev.Origin,
+	})
+}
+
+// firewall runs an ipset add/del on the ban set and audits the result.
+func (e *Engine) firewall(op, ip string) {
+	if e.cfg.FirewallDisabled {
+		return
+	}
+	args := []string{"ipset", op, e.ipsetFor(ip), ip}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if e.audit != nil {
+		e.auditCommand(ip, args, out, err)
+	}
+}
+
+// ipsetFor returns the set a ban on ip lives in: subnet bans (attack mode,
+// manual /24 and /64) go to the hash:net set, addresses to the hash:ip set.
+func (e *Engine) ipsetFor(ip string) string {
+	if strings.Contains(ip, "/") {
+		return e.subnetIpset()
+	}
+	return e.cfg.FirewallIpsetName
+}
 
-	// AWS firewall?
-	if e.aws != nil {
-		go e.applyAwsBlock(ip)
+// subnetIpset names the hash:net set, derived from the address set when
+// the config leaves it empty.
+func (e *Engine) subnetIpset() string {
+	if e.cfg.FirewallSubnetIpsetName != "" {
+		return e.cfg.FirewallSubnetIpsetName
 	}
+	return e.cfg.FirewallIpsetName + "_net"
 }
 
-func (e *Engine) applyAwsBlock(ip string) {
-	cfg := e.cfg
+//────────────────────────────────────────────────────────────
+//  MANUAL ACTIONS AND ALLOW-LIST
+//────────────────────────────────────────────────────────────
 
-	rule := cfg.AwsNetworkAclDenyRuleBase + int(time.Now().Unix()%10000)
+const reasonManual = "manual"
 
-	_, _ = e.aws.CreateNetworkAclEntry(context.Background(), &ec2.CreateNetworkAclEntryInput{
-		CidrBlock:      aws.String(fmt.Sprintf("%s/32", ip)),
-		Egress:         aws.Bool(false),
-		NetworkAclId:   aws.String(cfg.AwsNetworkAclId),
-		Protocol:       aws.String("-1"),
-		RuleAction:     types.RuleActionDeny,
-		RuleNumber:     aws.Int32(int32(rule)),
+// Ban bans ip (an address, or a /24 or /64 subnet) on operator request,
+// overriding the allow-list. note is kept as the ban's rule.
+func (e *Engine) Ban(ip, note string, ttl time.Duration) error {
+	ip = strings.TrimSpace(ip)
+	if net.ParseIP(ip) == nil && banFromCIDR(ip, "") != ip {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	if ttl <= 0 {
+		ttl = time.Duration(e.cfg.SecurityBanMinutes) * time.Minute
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if existing, banned := e.bans[ip]; banned {
+		existing.ExpiresAt = now.Add(ttl)
+		return nil
+	}
+	e.enforceBan(&SecurityEvent{
+		IP:        ip,
+		Reason:    reasonManual,
+		Rule:      note,
+		FirstSeen: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
 	})
+	return nil
+}
+
+// Unban lifts an active ban on operator request.
+func (e *Engine) Unban(ip string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ev, banned := e.bans[strings.TrimSpace(ip)]
+	if !banned {
+		return false
+	}
+	e.liftBan(ev, reasonManual)
+	return true
+}
+
+// allowlisted returns the allow-list entry covering ip (an address or a
+// subnet ban). Caller holds e.mu.
+func (e *Engine) allowlisted(ip string) (string, bool) {
+	if addr := net.ParseIP(ip); addr != nil {
+		for _, n := range e.allowlist {
+			if n.Contains(addr) {
+				return n.String(), true
+			}
+		}
+		return "", false
+	}
+	_, subnet, err := net.ParseCIDR(ip)
+	if err != nil {
+		return "", false
+	}
+	for _, n := range e.allowlist {
+		if n.Contains(subnet.IP) || subnet.Contains(n.IP) {
+			return n.String(), true
+		}
+	}
+	return "", false
+}
+
+// parseAllowEntry accepts an address or a CIDR.
+func parseAllowEntry(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
 }
 
 //────────────────────────────────────────────────────────────
@@ -271,29 +792,109 @@ func (e *Engine) applyAwsBlock(ip string) {
 //────────────────────────────────────────────────────────────
 
 func (e *Engine) windowResetLoop() {
+	lastSave := time.Now()
 	for {
 		time.Sleep(1 * time.Minute)
+
+		// shard state first, without e.mu (a worker may be waiting for it)
+		names := make([][]string, len(e.shards))
+		e.eachShard(func(s *shard) {
+			names[s.id] = s.pathNames()
+			s.reset()
+		})
+
 		e.mu.Lock()
-		e.perIPMinute = map[string]int{}
-		e.perPathMinute = map[string]int{}
-		e.perASNMinute = map[int]int{}
+		rpm := int(e.requests.Swap(0))
+		asns := e.asns.Reset()
+		sites := e.sites.Reset()
+		var baseline []byte // encoded under e.mu, written after it
+		if e.baseline != nil {
+			e.observeBaseline(names, sites, asns)
+			if time.Since(lastSave) >= baselineSaveEvery {
+				var err error
+				if baseline, err = e.baseline.Encode(); err != nil {
+					e.baseline.Saved(err)
+					log.Printf("security: saving baseline: %v", err)
+				}
+				lastSave = time.Now()
+			}
+		}
+		e.paths.Reset()
+		if e.attack.Enabled {
+			e.attackTick(rpm)
+		}
+		e.breached = map[string]bool{}
 		e.windowStart = time.Now()
+		e.updateLimits()
 		e.mu.Unlock()
+
+		if baseline != nil {
+			err := e.baseline.Write(baseline)
+			if err != nil {
+				log.Printf("security: saving baseline: %v", err)
+			}
+			e.mu.Lock()
+			e.baseline.Saved(err)
+			e.mu.Unlock()
+		}
+	}
+}
+
+// observeBaseline feeds the minute that just ended into the baseline and
+// reports deviations. paths are the names tracked by each worker; their
+// counts are still in e.paths. Caller holds e.mu.
+func (e *Engine) observeBaseline(paths [][]string, sites map[string]int, asns map[int]int) {
+	counts := make(map[string]int, len(sites)+len(asns)+defaultTopK)
+	for site, n := range sites {
+		counts["site:"+site] = n
+	}
+	// heavy hitters can be admitted; known paths that dropped out of the
+	// top are looked up in the sketch
+	for _, names := range paths {
+		for _, path := range names {
+			counts["path:"+path] = e.paths.Count(path)
+		}
+	}
+	for _, key := range e.baseline.Keys("path:") {
+		if _, ok := counts[key]; !ok {
+			counts[key] = e.paths.Count(strings.TrimPrefix(key, "path:"))
+		}
+	}
+	for asn, n := range asns {
+		counts[fmt.Sprintf("asn:%d", asn)] = n
+	}
+
+	for _, a := range e.baseline.Observe(e.windowStart, counts) {
+		a := a
+		e.anomalies = append(e.anomalies, a)
+		e.notify(Notification{Type: NotifyAnomaly, Time: a.Time, Scope: a.Scope, Count: a.Count, Anomaly: &a})
+	}
+	if len(e.anomalies) > maxAnomalies {
+		e.anomalies = e.anomalies[len(e.anomalies)-maxAnomalies:]
 	}
 }
 
 func (e *Engine) expiryLoop() {
+	var lastReconcile time.Time
 	for {
 		time.Sleep(30 * time.Second)
 
 		e.mu.Lock()
-		cutoff := time.Now().Add(-time.Duration(e.cfg.SecurityBanMinutes) * time.Minute)
+		now := time.Now()
 
-		for ip, ev := range e.bans {
-			if ev.FirstSeen.Before(cutoff) {
-				delete(e.bans, ip)
+		for _, ev := range e.bans {
+			if now.After(ev.ExpiresAt) {
+				e.liftBan(ev, "expired")
 			}
 		}
+		e.pruneFleetSeen(now)
+		e.pruneAuthFails(now)
+		e.pruneWafHits(now)
+
+		if len(e.cloud) > 0 && now.Sub(lastReconcile) >= cloudSyncEvery {
+			e.reconcileCloud()
+			lastReconcile = now
+		}
 
 		// prune 24h history
 		historyCut := time.Now().Add(-24 * time.Hour)
@@ -309,11 +910,139 @@ func (e *Engine) expiryLoop() {
 	}
 }
 
+// reconcileCloud converges every cloud firewall to the active bans,
+// oldest first so the newest win when a firewall is short of room.
+// Caller holds e.mu.
+func (e *Engine) reconcileCloud() {
+	active := make([]*SecurityEvent, 0, len(e.bans))
+	for _, ev := range e.bans {
+		active = append(active, ev)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].FirstSeen.Before(active[j].FirstSeen)
+	})
+	desired := make([]string, len(active))
+	for i, ev := range active {
+		desired[i] = ev.IP
+	}
+	for _, c := range e.cloud {
+		c.Reconcile(desired)
+	}
+}
+
+//────────────────────────────────────────────────────────────
+//  NOTIFICATIONS
+//────────────────────────────────────────────────────────────
+
+// AddNotifyChannel registers an extra notification channel
+// (e.g. the WebSocket client). events limits the types sent (nil = all).
+func (e *Engine) AddNotifyChannel(ch NotifyChannel, events []string) {
+	e.notifier.AddChannel(ch, events)
+}
+
+func (e *Engine) notify(ev Notification) {
+	if e.notifier != nil {
+		e.notifier.Notify(ev)
+	}
+}
+
+//────────────────────────────────────────────────────────────
+//  THREAT FEEDS
+//────────────────────────────────────────────────────────────
+
+// FeedStatus returns the state of every configured threat feed
+// (nil when no feeds are configured).
+func (e *Engine) FeedStatus() []FeedStatus {
+	if e.feeds == nil {
+		return nil
+	}
+	return e.feeds.Status()
+}
+
+// RefreshFeeds reloads all threat feeds immediately.
+func (e *Engine) RefreshFeeds() {
+	if e.feeds != nil {
+		e.feeds.RefreshAll()
+	}
+}
+
+// shardView is what Snapshot collects from each worker.
+type shardView struct {
+	ips     map[string]int
+	paths   []string
+	counter [3]CounterStats // ip, path names, subnet
+	cache   LookupCacheStats
+	queued  int
+}
+
+// memoryStats sizes the engine's state. Caller holds e.mu.
+func (e *Engine) memoryStats(views []shardView) MemoryStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	counters := []CounterStats{{Name: "ip"}, {Name: "path"}, {Name: "subnet"}}
+	st := MemoryStats{
+		ASNKeys:     len(e.asns.Snapshot()),
+		SiteKeys:    len(e.sites.Snapshot()),
+		ActiveBans:  len(e.bans),
+		History:     len(e.history),
+		AuthTracked: len(e.authFails),
+		WafTracked:  len(e.wafHits),
+		Shards:      len(e.shards),
+		HeapAlloc:   ms.HeapAlloc,
+	}
+	for _, v := range views {
+		for i := range counters {
+			counters[i].merge(v.counter[i])
+		}
+		st.LookupCache.Entries += v.cache.Entries
+		st.LookupCache.Capacity += v.cache.Capacity
+		st.LookupCache.Hits += v.cache.Hits
+		st.LookupCache.Misses += v.cache.Misses
+		st.Queued += v.queued
+	}
+	// path counts live in one shared sketch
+	counters[1].Total = e.paths.total.Load()
+	counters[1].SketchBytes = e.paths.sketch.bytes()
+	st.Counters = counters
+	if e.baseline != nil {
+		st.BaselineKeys = len(e.baseline.entries)
+	}
+	return st
+}
+
 //────────────────────────────────────────────────────────────
 //  SNAPSHOT FOR /security
 //────────────────────────────────────────────────────────────
 
 func (e *Engine) Snapshot() SecuritySnapshot {
+	views := make([]shardView, len(e.shards))
+	e.eachShard(func(s *shard) {
+		pathStats := CounterStats{
+			Tracked:   len(s.paths.heap),
+			Capacity:  s.paths.capacity,
+			Evictions: s.paths.evictions,
+		}
+		views[s.id] = shardView{
+			ips:     s.ips.Top(),
+			paths:   s.pathNames(),
+			counter: [3]CounterStats{s.ips.Stats(), pathStats, s.subnets.Stats()},
+			cache:   s.lookups.stats(),
+			queued:  len(s.in),
+		}
+	})
+	topK := topKOrDefault(e.cfg.SecurityTopK)
+	perIP := map[string]int{}
+	perPath := map[string]int{}
+	for _, v := range views {
+		for ip, n := range v.ips {
+			perIP[ip] = n
+		}
+		for _, path := range v.paths {
+			perPath[path] = e.paths.Count(path)
+		}
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -322,14 +1051,73 @@ func (e *Engine) Snapshot() SecuritySnapshot {
 		active = append(active, ev)
 	}
 
+	verified := 0
+	if e.crawlers != nil {
+		verified = e.crawlers.VerifiedCount()
+	}
+
+	cloud := make([]CloudEnforcerStatus, 0, len(e.cloud))
+	for _, c := range e.cloud {
+		cloud = append(cloud, c.Status())
+	}
+
+	traps := TrapStats{
+		Total:   e.trapStats.Total,
+		PerTrap: make(map[string]uint64, len(e.trapStats.PerTrap)),
+		Recent:  append([]TrapHit{}, e.trapStats.Recent...),
+	}
+	for k, v := range e.trapStats.PerTrap {
+		traps.PerTrap[k] = v
+	}
+
+	auth := AuthStats{
+		Failures:   make(map[string]uint64, len(e.authStats.Failures)),
+		Bans:       make(map[string]uint64, len(e.authStats.Bans)),
+		TrackedIPs: len(e.authFails),
+		Recent:     append([]AuthFailure{}, e.authStats.Recent...),
+	}
+	for k, v := range e.authStats.Failures {
+		auth.Failures[k] = v
+	}
+	for k, v := range e.authStats.Bans {
+		auth.Bans[k] = v
+	}
+
+	waf := WafStats{
+		Alerts:     e.wafStats.Alerts,
+		Bans:       e.wafStats.Bans,
+		Rules:      make(map[string]uint64, len(e.wafStats.Rules)),
+		TrackedIPs: len(e.wafHits),
+		Recent:     append([]WafAlert{}, e.wafStats.Recent...),
+	}
+	for k, v := range e.wafStats.Rules {
+		waf.Rules[k] = v
+	}
+
+	var baseline BaselineStatus
+	if e.baseline != nil {
+		baseline = e.baseline.Status()
+	}
+
 	return SecuritySnapshot{
 		Now:                time.Now(),
 		ActiveBans:         active,
 		RecentBans:         e.history,
 		WindowStart:        e.windowStart,
-		PerIPMinute:        e.perIPMinute,
-		PerPathMinute:      e.perPathMinute,
-		PerASNMinute:       e.perASNMinute,
+		PerIPMinute:        topN(perIP, topK),
+		PerPathMinute:      topN(perPath, topK),
+		PerASNMinute:       e.asns.Snapshot(),
 		BanDurationMinutes: e.cfg.SecurityBanMinutes,
+		VerifiedCrawlers:   verified,
+		CrawlerImpostors:   e.impostors,
+		Notifications:      e.notifier.Stats(),
+		Cloud:              cloud,
+		Traps:              traps,
+		Auth:               auth,
+		Waf:                waf,
+		Baseline:           baseline,
+		Anomalies:          append([]Anomaly{}, e.anomalies...),
+		Attack:             e.attack.AttackStatus,
+		Memory:             e.memoryStats(views),
 	}
 }
@@ -0,0 +1,504 @@
+package security
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Sharded event processing
+//────────────────────────────────────────────────────────────
+
+// Process hands each access log event to one of SecurityShards workers,
+// chosen by the client's /24 (IPv4) or /64 (IPv6). A worker owns the
+// per-IP and per-subnet counters and the ASN/country cache of its subnets,
+// so the hot path takes no engine lock: path, ASN, site and total counts
+// are shared atomics, active bans are mirrored in a concurrent set, and
+// e.mu is only taken to ban or to report a threshold.
+
+const (
+	shardQueue             = 4096 // events buffered per worker before Process blocks
+	defaultLookupCacheSize = 65536
+	minShardLookupCache    = 1024
+)
+
+type shard struct {
+	id int
+	e  *Engine
+	in chan shardMsg
+
+	ips      *minuteCounter
+	subnets  *minuteCounter // attack mode, only counted while active
+	paths    spaceSaving    // path names seen by this worker; counts come from e.paths
+	lookups  *lookupCache
+	reported map[breachKey]bool // thresholds already passed to the engine this window
+}
+
+type shardMsg struct {
+	evt  LogEvent
+	ip   net.IP
+	ctl  func(*shard) // runs on the worker instead of an event
+	done chan struct{}
+}
+
+type breachKey struct {
+	scope, ip, path string
+	asn             int
+}
+
+func newShard(e *Engine, id, cacheSize int) *shard {
+	cfg := e.cfg
+	return &shard{
+		id:       id,
+		e:        e,
+		in:       make(chan shardMsg, shardQueue),
+		ips:      newMinuteCounter("ip", cfg.SecuritySketchWidth, cfg.SecurityTopK),
+		subnets:  newMinuteCounter("subnet", cfg.SecuritySketchWidth, cfg.SecurityTopK),
+		paths:    newSpaceSaving(topKOrDefault(cfg.SecurityTopK)),
+		lookups:  newLookupCache(cacheSize),
+		reported: make(map[breachKey]bool),
+	}
+}
+
+func (s *shard) run() {
+	for m := range s.in {
+		if m.ctl != nil {
+			m.ctl(s)
+			close(m.done)
+			continue
+		}
+		s.process(m.evt, m.ip)
+	}
+}
+
+// Process queues evt for the worker owning its IP. It blocks while that
+// worker is shardQueue events behind.
+func (e *Engine) Process(evt LogEvent) {
+	if !e.cfg.SecurityEnabled {
+		return
+	}
+	evt.IP = strings.TrimSpace(evt.IP)
+	parsed := net.ParseIP(evt.IP)
+	if parsed == nil {
+		return
+	}
+	e.shardOf(parsed).in <- shardMsg{evt: evt, ip: parsed}
+}
+
+// shardOf picks the worker owning ip's /24 or /64, so subnet counters in
+// attack mode stay local to one worker.
+func (e *Engine) shardOf(ip net.IP) *shard {
+	var prefix []byte
+	if v4 := ip.To4(); v4 != nil {
+		prefix = v4[:3]
+	} else {
+		prefix = ip.To16()[:8]
+	}
+	return e.shards[maphash.Bytes(e.shardSeed, prefix)%uint64(len(e.shards))]
+}
+
+// eachShard runs fn on every worker, after the events already queued for
+// it, and waits for all of them. fn runs concurrently on different shards.
+// Never call it with e.mu held: a worker may be waiting for e.mu.
+func (e *Engine) eachShard(fn func(s *shard)) {
+	done := make([]chan struct{}, len(e.shards))
+	for i, s := range e.shards {
+		done[i] = make(chan struct{})
+		s.in <- shardMsg{ctl: fn, done: done[i]}
+	}
+	for _, d := range done {
+		<-d
+	}
+}
+
+// process is the per-event pipeline. It runs on the worker owning the IP.
+func (s *shard) process(evt LogEvent, parsedIP net.IP) {
+	e := s.e
+	ip := evt.IP
+
+	// feed hit counters (the feed manager has its own lock)
+	if e.feeds != nil {
+		e.feeds.Match(parsedIP)
+	}
+
+	// crawler verification is asynchronous; this only reads the cache
+	crawler := CrawlerNone
+	if e.crawlers != nil {
+		crawler = e.crawlers.Check(ip, evt.Agent)
+	}
+
+	// counters and thresholds use the normalized path, traps the raw one
+	path := NormalizePath(evt.Path)
+	ipCount := s.ips.Add(ip)
+	pathCount := e.paths.Add(path)
+	s.paths.add(path)
+	if evt.Source != "" {
+		e.sites.Add(evt.Source)
+	}
+	total := int(e.requests.Add(1))
+
+	var asn, asnCount int
+	if e.asn != nil {
+		asn = s.lookups.asn(ip, e.asn)
+		if asn > 0 {
+			asnCount = e.asns.Add(asn)
+		}
+	}
+
+	// trap paths: a single hit is enough
+	if trap, hit := e.traps.Match(evt.Source, evt.Path); hit {
+		e.mu.Lock()
+		_, banned := e.bans[ip]
+		ban := !banned && crawler != CrawlerVerified
+		e.recordTrapHit(TrapHit{IP: ip, Path: evt.Path, Trap: trap, Site: evt.Source, Time: time.Now(), Banned: ban})
+		if ban {
+			e.applyBanFor(ip, path, asn, "trap", "trap "+trap, time.Duration(e.cfg.SecurityTrapBanMinutes)*time.Minute)
+		}
+		e.mu.Unlock()
+		if ban {
+			return
+		}
+	}
+
+	switch crawler {
+	case CrawlerVerified:
+		// verified search-engine crawlers are exempt from rate bans
+		return
+	case CrawlerImpostor:
+		if e.cfg.SecurityBanFakeCrawlers {
+			s.ban(ip, path, asn, "fake-crawler", "crawler user agent failed reverse DNS")
+			return
+		}
+	}
+
+	// attack mode: global surge detection, subnet/ASN aggregation, geo allow-list
+	if e.attack.Enabled && s.attackCheck(ip, parsedIP, path, asn, asnCount, total) {
+		return
+	}
+
+	// Check thresholds
+	if rule := s.shouldBanIP(ip, path, asn, ipCount, pathCount, asnCount); rule != "" {
+		s.ban(ip, path, asn, "rate-limit", rule)
+	}
+}
+
+// shouldBanIP returns the first threshold exceeded, or "" when the IP
+// stays within all of them.
+func (s *shard) shouldBanIP(ip, path string, asn, ipCount, pathCount, asnCount int) string {
+	e := s.e
+	cfg := e.cfg
+	rule := ""
+
+	if limit := e.attackIPLimit(cfg.SecurityMaxRpmPerIp); limit > 0 && ipCount > limit {
+		s.breached(Notification{Scope: "ip", IP: ip, Count: ipCount, Limit: limit})
+		rule = fmt.Sprintf("ip > %d/min", limit)
+	}
+
+	if limit := e.pathLimit(path, cfg.SecurityMaxRpmPerPath); limit > 0 && pathCount > limit {
+		s.breached(Notification{Scope: "path", Path: path, Count: pathCount, Limit: limit})
+		if rule == "" {
+			rule = fmt.Sprintf("path > %d/min", limit)
+		}
+	}
+
+	if limit := e.asnLimit(asn, cfg.SecurityMaxRpmPerAsn); asn > 0 && limit > 0 && asnCount > limit {
+		s.breached(Notification{Scope: "asn", ASN: asn, Count: asnCount, Limit: limit})
+		if rule == "" {
+			rule = fmt.Sprintf("asn > %d/min", limit)
+		}
+	}
+
+	return rule
+}
+
+// breached passes a threshold to the engine once per window per worker,
+// so a hot path or ASN doesn't take e.mu on every request.
+func (s *shard) breached(ev Notification) {
+	key := breachKey{scope: ev.Scope, ip: ev.IP, path: ev.Path, asn: ev.ASN}
+	if s.reported[key] {
+		return
+	}
+	s.reported[key] = true
+	s.e.mu.Lock()
+	s.e.thresholdBreached(ev)
+	s.e.mu.Unlock()
+}
+
+// ban bans ip at most once per window from this worker: an allow-listed
+// IP over a limit would otherwise take e.mu on every request.
+func (s *shard) ban(ip, path string, asn int, reason, rule string) {
+	key := breachKey{scope: "ban", ip: ip}
+	if s.reported[key] || s.e.isBanned(ip) {
+		return
+	}
+	s.reported[key] = true
+	s.e.banIfNew(ip, path, asn, reason, rule, 0)
+}
+
+// pathNames returns the paths this worker tracks by name.
+func (s *shard) pathNames() []string {
+	out := make([]string, 0, len(s.paths.heap))
+	for _, e := range s.paths.heap {
+		out = append(out, e.key)
+	}
+	return out
+}
+
+// reset starts a new window.
+func (s *shard) reset() {
+	s.ips.Reset()
+	s.subnets.Reset()
+	s.paths.reset()
+	clear(s.reported)
+}
+
+// banIfNew bans ip unless it already is. It takes e.mu.
+func (e *Engine) banIfNew(ip, path string, asn int, reason, rule string, ttl time.Duration) {
+	if e.isBanned(ip) {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, banned := e.bans[ip]; !banned {
+		e.applyBanFor(ip, path, asn, reason, rule, ttl)
+	}
+}
+
+// isBanned reads the lock-free mirror of e.bans.
+func (e *Engine) isBanned(ip string) bool {
+	_, ok := e.banned.Load(ip)
+	return ok
+}
+
+// ipCount estimates ip's requests this window from any goroutine.
+func (e *Engine) ipCount(ip string) int {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0
+	}
+	return e.shardOf(parsed).ips.Estimate(ip)
+}
+
+//────────────────────────────────────────────────────────────
+//  Adaptive limits
+//────────────────────────────────────────────────────────────
+
+// adaptiveLimits are the learned path and ASN limits for the current
+// window, rebuilt every minute so workers read them without a lock.
+type adaptiveLimits struct {
+	paths map[string]int
+	asns  map[int]int
+}
+
+// updateLimits recomputes the learned limits for the window starting at
+// e.windowStart. Caller holds e.mu.
+func (e *Engine) updateLimits() {
+	if !e.cfg.SecurityAdaptiveThresholds || e.baseline == nil {
+		return
+	}
+	l := &adaptiveLimits{paths: map[string]int{}, asns: map[int]int{}}
+	for _, key := range e.baseline.Keys("path:") {
+		if limit, ok := e.baseline.Limit(key, e.windowStart); ok {
+			l.paths[strings.TrimPrefix(key, "path:")] = limit
+		}
+	}
+	for _, key := range e.baseline.Keys("asn:") {
+		var asn int
+		if _, err := fmt.Sscanf(key, "asn:%d", &asn); err != nil {
+			continue
+		}
+		if limit, ok := e.baseline.Limit(key, e.windowStart); ok {
+			l.asns[asn] = limit
+		}
+	}
+	e.limits.Store(l)
+}
+
+// pathLimit returns the learned limit for path when adaptive thresholds
+// are on and the path has enough history, otherwise fixed.
+func (e *Engine) pathLimit(path string, fixed int) int {
+	if l := e.limits.Load(); l != nil {
+		if limit, ok := l.paths[path]; ok {
+			return limit
+		}
+	}
+	return fixed
+}
+
+func (e *Engine) asnLimit(asn, fixed int) int {
+	if l := e.limits.Load(); l != nil && asn > 0 {
+		if limit, ok := l.asns[asn]; ok {
+			return limit
+		}
+	}
+	return fixed
+}
+
+//────────────────────────────────────────────────────────────
+//  Shared counters
+//────────────────────────────────────────────────────────────
+
+// countMap counts per key with atomic increments. It suits small key
+// spaces (ASNs, sites): a key's counter is created once and then updated
+// without locking. Reset swaps in an empty map.
+type countMap[K comparable] struct {
+	m atomic.Pointer[sync.Map]
+}
+
+func newCountMap[K comparable]() *countMap[K] {
+	c := &countMap[K]{}
+	c.m.Store(&sync.Map{})
+	return c
+}
+
+func (c *countMap[K]) Add(k K) int {
+	m := c.m.Load()
+	v, ok := m.Load(k)
+	if !ok {
+		v, _ = m.LoadOrStore(k, new(atomic.Int64))
+	}
+	return int(v.(*atomic.Int64).Add(1))
+}
+
+func (c *countMap[K]) Get(k K) int {
+	if v, ok := c.m.Load().Load(k); ok {
+		return int(v.(*atomic.Int64).Load())
+	}
+	return 0
+}
+
+// Snapshot copies the current counts.
+func (c *countMap[K]) Snapshot() map[K]int {
+	return countsOf[K](c.m.Load())
+}
+
+// Reset starts a new window and returns the counts of the one that ended.
+func (c *countMap[K]) Reset() map[K]int {
+	return countsOf[K](c.m.Swap(&sync.Map{}))
+}
+
+func countsOf[K comparable](m *sync.Map) map[K]int {
+	out := map[K]int{}
+	m.Range(func(k, v any) bool {
+		out[k.(K)] = int(v.(*atomic.Int64).Load())
+		return true
+	})
+	return out
+}
+
+// topN keeps the n largest counts.
+func topN(m map[string]int, n int) map[string]int {
+	if len(m) <= n {
+		return m
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return m[keys[i]] > m[keys[j]] })
+	out := make(map[string]int, n)
+	for _, k := range keys[:n] {
+		out[k] = m[k]
+	}
+	return out
+}
+
+func topKOrDefault(k int) int {
+	if k <= 0 {
+		return defaultTopK
+	}
+	return k
+}
+
+//────────────────────────────────────────────────────────────
+//  ASN / country lookup cache
+//────────────────────────────────────────────────────────────
+
+// LookupCacheStats is reported under memory in the security snapshot.
+type LookupCacheStats struct {
+	Entries  int    `json:"entries"`
+	Capacity int    `json:"capacity"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+type lookupEntry struct {
+	ip         string
+	asn        int
+	country    string
+	hasASN     bool
+	hasCountry bool
+}
+
+// lookupCache is an LRU of mmdb results per IP. Each worker has its own,
+// so it needs no lock.
+type lookupCache struct {
+	capacity int
+	order    *list.List // front = most recently used
+	items    map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+func newLookupCache(capacity int) *lookupCache {
+	if capacity < minShardLookupCache {
+		capacity = minShardLookupCache
+	}
+	return &lookupCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (c *lookupCache) entry(ip string) *lookupEntry {
+	if el, ok := c.items[ip]; ok {
+		c.order.MoveToFront(el)
+		return el.Value.(*lookupEntry)
+	}
+	var el *list.Element
+	if c.order.Len() >= c.capacity {
+		// reuse the least recently used entry
+		el = c.order.Back()
+		delete(c.items, el.Value.(*lookupEntry).ip)
+		*el.Value.(*lookupEntry) = lookupEntry{ip: ip}
+		c.order.MoveToFront(el)
+	} else {
+		el = c.order.PushFront(&lookupEntry{ip: ip})
+	}
+	c.items[ip] = el
+	return el.Value.(*lookupEntry)
+}
+
+func (c *lookupCache) asn(ip string, r *ASNResolver) int {
+	e := c.entry(ip)
+	if e.hasASN {
+		c.hits++
+		return e.asn
+	}
+	c.misses++
+	e.asn, e.hasASN = r.ASN(ip), true
+	return e.asn
+}
+
+func (c *lookupCache) country(ip string, r *CountryResolver) string {
+	e := c.entry(ip)
+	if e.hasCountry {
+		c.hits++
+		return e.country
+	}
+	c.misses++
+	e.country, e.hasCountry = r.Country(ip), true
+	return e.country
+}
+
+func (c *lookupCache) stats() LookupCacheStats {
+	return LookupCacheStats{Entries: c.order.Len(), Capacity: c.capacity, Hits: c.hits, Misses: c.misses}
+}
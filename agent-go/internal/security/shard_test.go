@@ -0,0 +1,104 @@
+package security
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchTrapEvery is how often a benchmark event hits a trap path from a
+// new IP, taking the ban path: e.mu, applyBanFor, enforceBan, notify.
+const benchTrapEvery = 64
+
+// newBenchEngine runs the real engine with the local firewall disabled and
+// rate limits high enough that only trap hits ban.
+func newBenchEngine(b *testing.B) *Engine {
+	return newTestEngine(b, &Config{
+		SecurityMaxRpmPerIp:   1 << 30,
+		SecurityMaxRpmPerPath: 1 << 30,
+		SecurityMaxRpmPerAsn:  1 << 30,
+		SecurityTraps:         []TrapConfig{{Paths: []string{"/wp-login.php", "/.env"}}},
+		InstanceId:            "bench",
+	})
+}
+
+// benchEvents pre-generates traffic so the benchmark measures Process,
+// not fmt.
+func benchEvents() []LogEvent {
+	pool := make([]LogEvent, 1<<16)
+	rng := rand.New(rand.NewSource(1))
+	agents := []string{"Mozilla/5.0 (X11; Linux x86_64)", "curl/8.5.0", "python-requests/2.31"}
+	for i := range pool {
+		n := rng.Intn(200000)
+		pool[i] = LogEvent{
+			IP:     fmt.Sprintf("%d.%d.%d.%d", 11+n>>16&0x7f, n>>8&0xff, n&0xff, 1+rng.Intn(250)),
+			Path:   fmt.Sprintf("/page/%d?ref=%d", rng.Intn(5000), rng.Intn(100)),
+			Agent:  agents[rng.Intn(len(agents))],
+			Time:   time.Now(),
+			Source: fmt.Sprintf("site%d.access.log", rng.Intn(8)),
+		}
+	}
+	return pool
+}
+
+// trapEvent is a trap hit from an IP in 100.64.0.0/10 never used before.
+func trapEvent(n uint64) LogEvent {
+	ip := make([]byte, 0, 15)
+	ip = strconv.AppendUint(ip, 100, 10)
+	ip = append(ip, '.')
+	ip = strconv.AppendUint(ip, 64+n>>16&0x3f, 10)
+	ip = append(ip, '.')
+	ip = strconv.AppendUint(ip, n>>8&0xff, 10)
+	ip = append(ip, '.')
+	ip = strconv.AppendUint(ip, n&0xff, 10)
+	return LogEvent{IP: string(ip), Path: "/wp-login.php", Agent: "curl/8.5.0", Time: time.Now(), Source: "site0.access.log"}
+}
+
+func reportBench(b *testing.B, e *Engine) {
+	snap := e.Snapshot() // returns once every queued event is processed
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+	b.ReportMetric(float64(len(snap.ActiveBans))/float64(b.N), "bans/op")
+}
+
+func BenchmarkProcess(b *testing.B) {
+	e := newBenchEngine(b)
+	pool := benchEvents()
+	var trapIPs uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%benchTrapEvery == benchTrapEvery-1 {
+			e.Process(trapEvent(trapIPs))
+			trapIPs++
+			continue
+		}
+		e.Process(pool[i&(len(pool)-1)])
+	}
+	reportBench(b, e)
+}
+
+// BenchmarkProcessParallel calls Process from GOMAXPROCS goroutines, like
+// one per tailed log.
+func BenchmarkProcessParallel(b *testing.B) {
+	e := newBenchEngine(b)
+	pool := benchEvents()
+	var offsets, trapIPs atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(offsets.Add(1) * 7919)
+		for pb.Next() {
+			i++
+			if i%benchTrapEvery == 0 {
+				e.Process(trapEvent(trapIPs.Add(1)))
+				continue
+			}
+			e.Process(pool[i&(len(pool)-1)])
+		}
+	})
+	reportBench(b, e)
+}
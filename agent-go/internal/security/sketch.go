@@ -0,0 +1,331 @@
+package security
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+//────────────────────────────────────────────────────────────
+//  Bounded per-minute counters (count-min sketch + Space-Saving)
+//────────────────────────────────────────────────────────────
+
+const (
+	sketchDepth        = 4
+	defaultSketchWidth = 1 << 14 // 4 x 16384 x 4 bytes = 256 KiB per counter
+	defaultTopK        = 1000
+)
+
+// CounterStats is reported under memory in the security snapshot.
+type CounterStats struct {
+	Name        string `json:"name"`
+	Total       uint64 `json:"total"`       // events counted this window
+	Tracked     int    `json:"tracked"`     // heavy hitters tracked exactly
+	Capacity    int    `json:"capacity"`    // heavy hitter slots
+	Evictions   uint64 `json:"evictions"`   // heavy hitters displaced this window
+	SketchBytes int    `json:"sketchBytes"` // fixed size of the count-min sketch
+}
+
+// merge adds another shard's counter of the same name.
+func (s *CounterStats) merge(o CounterStats) {
+	s.Total += o.Total
+	s.Tracked += o.Tracked
+	s.Capacity += o.Capacity
+	s.Evictions += o.Evictions
+	s.SketchBytes += o.SketchBytes
+}
+
+// countMin is a count-min sketch with atomic cells, so estimates can be
+// read from any goroutine while a shard worker is counting.
+type countMin struct {
+	seed  maphash.Seed
+	width uint64
+	cells []atomic.Uint32 // sketchDepth rows of width cells
+}
+
+func newCountMin(width int) countMin {
+	if width <= 0 {
+		width = defaultSketchWidth
+	}
+	// round up to a power of two so the row index is a mask
+	w := 1
+	for w < width {
+		w <<= 1
+	}
+	return countMin{
+		seed:  maphash.MakeSeed(),
+		width: uint64(w),
+		cells: make([]atomic.Uint32, sketchDepth*w),
+	}
+}
+
+func (s *countMin) hash(key string) (h1, h2 uint64) {
+	h1 = maphash.String(s.seed, key)
+	return h1, h1>>32 | 1
+}
+
+func (s *countMin) index(row, h1, h2 uint64) uint64 {
+	return row*s.width + (h1+row*h2)&(s.width-1)
+}
+
+func (s *countMin) estimate(h1, h2 uint64) uint32 {
+	est := ^uint32(0)
+	for i := uint64(0); i < sketchDepth; i++ {
+		if v := s.cells[s.index(i, h1, h2)].Load(); v < est {
+			est = v
+		}
+	}
+	return est
+}
+
+// addConservative only raises cells below the new estimate. It needs a
+// single writer: two concurrent adds could both raise a cell to the same
+// value and lose a count.
+func (s *countMin) addConservative(h1, h2 uint64) uint32 {
+	est := s.estimate(h1, h2) + 1
+	for i := uint64(0); i < sketchDepth; i++ {
+		if c := &s.cells[s.index(i, h1, h2)]; c.Load() < est {
+			c.Store(est)
+		}
+	}
+	return est
+}
+
+// addShared increments every row and is safe for concurrent writers.
+func (s *countMin) addShared(h1, h2 uint64) uint32 {
+	est := ^uint32(0)
+	for i := uint64(0); i < sketchDepth; i++ {
+		if v := s.cells[s.index(i, h1, h2)].Add(1); v < est {
+			est = v
+		}
+	}
+	return est
+}
+
+func (s *countMin) reset() {
+	for i := range s.cells {
+		s.cells[i].Store(0)
+	}
+}
+
+func (s *countMin) bytes() int {
+	return len(s.cells) * 4
+}
+
+// minuteCounter counts keys for one window in fixed memory. A count-min
+// sketch (conservative update) estimates any key; a Space-Saving summary
+// keeps the top keys by name for the snapshot and the baseline. Both only
+// ever over-estimate, so a key above a threshold is never missed.
+// Add, Count, Top, Reset and Stats belong to the owning shard worker;
+// Estimate may be called from anywhere.
+type minuteCounter struct {
+	name   string
+	sketch countMin
+	top    spaceSaving
+	total  atomic.Uint64
+}
+
+func newMinuteCounter(name string, width, topK int) *minuteCounter {
+	if topK <= 0 {
+		topK = defaultTopK
+	}
+	return &minuteCounter{
+		name:   name,
+		sketch: newCountMin(width),
+		top:    newSpaceSaving(topK),
+	}
+}
+
+// Add counts one event for key and returns its estimated count.
+func (c *minuteCounter) Add(key string) int {
+	c.total.Add(1)
+	est := c.sketch.addConservative(c.sketch.hash(key))
+	c.top.add(key)
+	return c.min(key, est)
+}
+
+// Count returns the estimated count of key in this window.
+func (c *minuteCounter) Count(key string) int {
+	return c.min(key, c.sketch.estimate(c.sketch.hash(key)))
+}
+
+// Estimate is Count without the Space-Saving refinement, for callers
+// outside the owning worker.
+func (c *minuteCounter) Estimate(key string) int {
+	return int(c.sketch.estimate(c.sketch.hash(key)))
+}
+
+// min takes the tighter of the sketch estimate and the Space-Saving count.
+func (c *minuteCounter) min(key string, est uint32) int {
+	if e, ok := c.top.items[key]; ok && e.count < est {
+		return int(e.count)
+	}
+	return int(est)
+}
+
+// Top returns the tracked heavy hitters with their estimated counts.
+func (c *minuteCounter) Top() map[string]int {
+	out := make(map[string]int, len(c.top.heap))
+	for _, e := range c.top.heap {
+		out[e.key] = c.Count(e.key)
+	}
+	return out
+}
+
+// Reset starts a new window without reallocating.
+func (c *minuteCounter) Reset() {
+	c.sketch.reset()
+	c.top.reset()
+	c.total.Store(0)
+}
+
+func (c *minuteCounter) Stats() CounterStats {
+	return CounterStats{
+		Name:        c.name,
+		Total:       c.total.Load(),
+		Tracked:     len(c.top.heap),
+		Capacity:    c.top.capacity,
+		Evictions:   c.top.evictions,
+		SketchBytes: c.sketch.bytes(),
+	}
+}
+
+// sharedCounter is a count-min sketch every shard worker adds to, for keys
+// that are not partitioned by IP (paths). The shards keep their own
+// Space-Saving summaries of the keys by name.
+type sharedCounter struct {
+	sketch countMin
+	total  atomic.Uint64
+}
+
+func newSharedCounter(width int) *sharedCounter {
+	return &sharedCounter{sketch: newCountMin(width)}
+}
+
+func (c *sharedCounter) Add(key string) int {
+	c.total.Add(1)
+	return int(c.sketch.addShared(c.sketch.hash(key)))
+}
+
+func (c *sharedCounter) Count(key string) int {
+	return int(c.sketch.estimate(c.sketch.hash(key)))
+}
+
+func (c *sharedCounter) Reset() {
+	c.sketch.reset()
+	c.total.Store(0)
+}
+
+//────────────────────────────────────────────────────────────
+//  Space-Saving heavy hitters
+//────────────────────────────────────────────────────────────
+
+type ssEntry struct {
+	key   string
+	count uint32
+	idx   int
+}
+
+// spaceSaving tracks at most capacity keys. When full, a new key replaces
+// the least counted one and inherits its count, so tracked counts are
+// upper bounds and any key above total/capacity is guaranteed tracked.
+type spaceSaving struct {
+	capacity  int
+	items     map[string]*ssEntry
+	heap      ssHeap
+	evictions uint64
+}
+
+func newSpaceSaving(capacity int) spaceSaving {
+	return spaceSaving{
+		capacity: capacity,
+		items:    make(map[string]*ssEntry, capacity),
+		heap:     make(ssHeap, 0, capacity),
+	}
+}
+
+func (s *spaceSaving) add(key string) {
+	if e, ok := s.items[key]; ok {
+		e.count++
+		heap.Fix(&s.heap, e.idx)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		e := &ssEntry{key: key, count: 1}
+		s.items[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+	min := s.heap[0]
+	delete(s.items, min.key)
+	min.key = key
+	min.count++
+	s.items[key] = min
+	heap.Fix(&s.heap, 0)
+	s.evictions++
+}
+
+func (s *spaceSaving) reset() {
+	clear(s.items)
+	s.heap = s.heap[:0]
+	s.evictions = 0
+}
+
+// ssHeap is a min-heap on count.
+type ssHeap []*ssEntry
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+func (h *ssHeap) Push(x any) {
+	e := x.(*ssEntry)
+	e.idx = len(*h)
+	*h = append(*h, e)
+}
+func (h *ssHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+//────────────────────────────────────────────────────────────
+//  Path normalization
+//────────────────────────────────────────────────────────────
+
+var (
+	reNumericSegment = regexp.MustCompile(`^\d+$`)
+	reHashSegment    = regexp.MustCompile(`^(?i:[0-9a-f]{16,}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+)
+
+// NormalizePath drops the query string and fragment and collapses numeric
+// ids, UUIDs and long hex tokens, so "/post/123?x=1" and "/post/456" are
+// counted as one path: "/post/:id".
+func NormalizePath(p string) string {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	if p == "" {
+		return "/"
+	}
+	if !strings.ContainsAny(p, "0123456789") {
+		return p
+	}
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		switch {
+		case s == "":
+		case reNumericSegment.MatchString(s):
+			segs[i] = ":id"
+		case reHashSegment.MatchString(s):
+			segs[i] = ":hash"
+		}
+	}
+	return strings.Join(segs, "/")
+}
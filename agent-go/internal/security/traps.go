@@ -0,0 +1,235 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//────────────────────────────────────────────────────────────
+//  Honeypot / trap paths
+//────────────────────────────────────────────────────────────
+
+// TrapConfig lists trap paths for the sites whose access log file name
+// matches Site. A path ending in "/" or "*" matches everything below it.
+type TrapConfig struct {
+	Site  string   `json:"site"` // log file glob, e.g. "example.com*"; empty = every site
+	Paths []string `json:"paths"`
+}
+
+// TrapHit is one request to a trap path.
+type TrapHit struct {
+	IP     string    `json:"ip"`
+	Path   string    `json:"path"`
+	Trap   string    `json:"trap"` // configured pattern that matched
+	Site   string    `json:"site,omitempty"`
+	Time   time.Time `json:"time"`
+	Banned bool      `json:"banned"`
+}
+
+// TrapStats is reported in the security snapshot, separately from the
+// rate-limit counters.
+type TrapStats struct {
+	Total   uint64            `json:"total"`
+	PerTrap map[string]uint64 `json:"perTrap"`
+	Recent  []TrapHit         `json:"recent"`
+}
+
+// TrapLinks is what the control panel injects into sites: robots.txt
+// Disallow lines and invisible anchors pointing at generated trap paths.
+// Well-behaved crawlers obey robots.txt and never see the anchors, so
+// anything requesting these paths is scraping for hidden URLs.
+type TrapLinks struct {
+	Links     []string `json:"links"`
+	RobotsTxt string   `json:"robotsTxt"`
+	Html      string   `json:"html"`
+}
+
+const maxTrapHits = 100
+
+type trapRule struct {
+	site     string // glob on the log file name, "" = all
+	exact    map[string]string
+	prefixes []string
+}
+
+// TrapSet matches request paths against the configured and generated traps.
+// It is immutable after construction.
+type TrapSet struct {
+	rules []trapRule
+	links []string
+}
+
+// NewTrapSet builds the trap rules. linkCount hidden links are generated
+// under linkPrefix, derived from key so they are stable across restarts
+// and can't be computed by anyone who doesn't hold it.
+func NewTrapSet(traps []TrapConfig, key []byte, linkCount int, linkPrefix string) *TrapSet {
+	t := &TrapSet{}
+	for _, tc := range traps {
+		r := trapRule{site: strings.TrimSpace(tc.Site), exact: make(map[string]string)}
+		for _, p := range tc.Paths {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			if strings.HasSuffix(p, "*") || strings.HasSuffix(p, "/") {
+				r.prefixes = append(r.prefixes, normalizeTrapPath(strings.TrimSuffix(p, "*"), true))
+				continue
+			}
+			r.exact[normalizeTrapPath(p, false)] = p
+		}
+		if len(r.exact) > 0 || len(r.prefixes) > 0 {
+			t.rules = append(t.rules, r)
+		}
+	}
+
+	if linkCount > 0 {
+		if linkPrefix == "" {
+			linkPrefix = "/_/"
+		}
+		if !strings.HasSuffix(linkPrefix, "/") {
+			linkPrefix += "/"
+		}
+		r := trapRule{exact: map[string]string{}}
+		for i := 0; i < linkCount; i++ {
+			h := hmac.New(sha256.New, key)
+			fmt.Fprintf(h, "trap-link-%d", i)
+			link := linkPrefix + hex.EncodeToString(h.Sum(nil))[:16] + "/"
+			t.links = append(t.links, link)
+			r.prefixes = append(r.prefixes, normalizeTrapPath(link, true))
+		}
+		t.rules = append(t.rules, r)
+	}
+	return t
+}
+
+const trapKeySize = 32
+
+// trapKey returns the secret the trap links are derived from, kept in
+// trap.key in SecurityStateDir. Without it the links change on every
+// restart.
+func trapKey(cfg *Config) []byte {
+	if path := stateFile(cfg, "trap.key"); cfg.SecurityTrapLinks > 0 && path != "" {
+		key, err := loadTrapKey(path)
+		if err == nil {
+			return key
+		}
+		log.Printf("security: trap links will change on restart: %v", err)
+	}
+	key := make([]byte, trapKeySize)
+	rand.Read(key)
+	return key
+}
+
+// loadTrapKey reads the trap link key from path, creating it with random
+// bytes on first use. The key must stay private: anyone holding it can
+// derive the links and steer around them.
+func loadTrapKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) >= trapKeySize {
+			return key, nil
+		}
+		return nil, fmt.Errorf("%s: not a %d-byte hex key", path, trapKeySize)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, trapKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return key, os.Rename(tmp, path)
+}
+
+// normalizeTrapPath drops the query string, lower-cases and cleans the
+// path so "/.AWS//credentials?x" still hits "/.aws/credentials".
+func normalizeTrapPath(p string, dir bool) string {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	p = strings.ToLower(p)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if (dir || strings.HasSuffix(p, "/")) && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// Match returns the trap pattern hit by a request for reqPath on the site
+// logged to source, if any.
+func (t *TrapSet) Match(source, reqPath string) (string, bool) {
+	if t == nil || len(t.rules) == 0 {
+		return "", false
+	}
+	p := normalizeTrapPath(reqPath, false)
+	for _, r := range t.rules {
+		if r.site != "" {
+			if ok, _ := filepath.Match(r.site, source); !ok {
+				continue
+			}
+		}
+		if orig, ok := r.exact[p]; ok {
+			return orig, true
+		}
+		for _, prefix := range r.prefixes {
+			if strings.HasPrefix(p, prefix) || p+"/" == prefix {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Links returns the generated trap links with ready-made snippets.
+func (t *TrapSet) Links() TrapLinks {
+	out := TrapLinks{Links: []string{}}
+	if t == nil || len(t.links) == 0 {
+		return out
+	}
+	out.Links = append(out.Links, t.links...)
+
+	var robots, html strings.Builder
+	robots.WriteString("User-agent: *\n")
+	for _, l := range t.links {
+		fmt.Fprintf(&robots, "Disallow: %s\n", l)
+		fmt.Fprintf(&html, `<a href="%s" rel="nofollow" style="display:none" aria-hidden="true" tabindex="-1"></a>`+"\n", l)
+	}
+	out.RobotsTxt = robots.String()
+	out.Html = html.String()
+	return out
+}
+
+// recordTrapHit tallies a trap hit. Caller holds e.mu.
+func (e *Engine) recordTrapHit(hit TrapHit) {
+	e.trapStats.Total++
+	e.trapStats.PerTrap[hit.Trap]++
+	e.trapStats.Recent = append(e.trapStats.Recent, hit)
+	if len(e.trapStats.Recent) > maxTrapHits {
+		e.trapStats.Recent = e.trapStats.Recent[len(e.trapStats.Recent)-maxTrapHits:]
+	}
+}
+
+// TrapLinks returns the hidden trap links for robots.txt / page injection.
+func (e *Engine) TrapLinks() TrapLinks {
+	return e.traps.Links()
+}
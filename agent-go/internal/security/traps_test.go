@@ -0,0 +1,48 @@
+package security
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrapKeyPersists(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{SecurityTrapLinks: 3, SecurityStateDir: dir}
+
+	key := trapKey(cfg)
+	if len(key) != trapKeySize {
+		t.Fatalf("key is %d bytes, want %d", len(key), trapKeySize)
+	}
+	st, err := os.Stat(filepath.Join(dir, "trap.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0o600 {
+		t.Fatalf("trap.key mode = %v, want 0600", st.Mode().Perm())
+	}
+	if again := trapKey(cfg); !bytes.Equal(again, key) {
+		t.Fatal("key changed on reload")
+	}
+
+	a := NewTrapSet(nil, key, 3, "")
+	b := NewTrapSet(nil, trapKey(cfg), 3, "")
+	other := NewTrapSet(nil, trapKey(&Config{SecurityTrapLinks: 3}), 3, "")
+	if a.Links().Links[0] != b.Links().Links[0] {
+		t.Fatal("links not stable for the same key")
+	}
+	if a.Links().Links[0] == other.Links().Links[0] {
+		t.Fatal("links identical for different keys")
+	}
+}
+
+func TestTrapKeyRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trap.key")
+	if err := os.WriteFile(path, []byte("i-0123456789abcdef0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTrapKey(path); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
@@ -0,0 +1,434 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+//────────────────────────────────────────────────────────────
+//  AWS WAFv2 IP set enforcement
+//────────────────────────────────────────────────────────────
+
+// WAFv2 operation shapes, named after the AWS API. Only the fields used
+// by the agent are present.
+type WafGetIPSetInput struct {
+	Name  string `json:"Name"`
+	Scope string `json:"Scope"` // REGIONAL or CLOUDFRONT
+	Id    string `json:"Id"`
+}
+
+type WafIPSet struct {
+	Name             string   `json:"Name"`
+	Id               string   `json:"Id"`
+	ARN              string   `json:"ARN"`
+	IPAddressVersion string   `json:"IPAddressVersion"` // IPV4 or IPV6
+	Addresses        []string `json:"Addresses"`
+}
+
+type WafGetIPSetOutput struct {
+	IPSet     WafIPSet `json:"IPSet"`
+	LockToken string   `json:"LockToken"`
+}
+
+type WafUpdateIPSetInput struct {
+	Name      string   `json:"Name"`
+	Scope     string   `json:"Scope"`
+	Id        string   `json:"Id"`
+	Addresses []string `json:"Addresses"`
+	LockToken string   `json:"LockToken"`
+}
+
+type WafUpdateIPSetOutput struct {
+	NextLockToken string `json:"NextLockToken"`
+}
+
+// WAFv2API is the subset of the WAFv2 API used for IP set bans.
+// NewWafv2Client returns the real implementation; tests can pass a fake.
+type WAFv2API interface {
+	GetIPSet(ctx context.Context, in *WafGetIPSetInput) (*WafGetIPSetOutput, error)
+	UpdateIPSet(ctx context.Context, in *WafUpdateIPSetInput) (*WafUpdateIPSetOutput, error)
+}
+
+// wafv2IPSetMax is the AWS limit of addresses per IP set.
+const wafv2IPSetMax = 10000
+
+// wafBackend owns the addresses of one IP set that the agent wrote. An
+// IP set entry carries no marker, so they are listed in a ledger file;
+// everything else in the set, including addresses an operator added by
+// hand, is kept but never touched. UpdateIPSet replaces the whole list
+// and is guarded by the lock token returned from GetIPSet; on
+// WAFOptimisticLockException the set is re-read and the change replayed.
+type wafBackend struct {
+	api     WAFv2API
+	scope   string
+	name    string
+	id      string
+	maxSize int
+	ledger  string // file listing the owned entries, "" = kept in memory only
+
+	lockToken string
+	ipv6      bool     // address family of the set, learned on sync
+	extra     []string // addresses not owned by the agent
+	owned     map[string]CloudEntry
+}
+
+// NewWafIPSetEnforcer creates an enforcer for one WAFv2 IP set. An IP set
+// holds a single address family; IPs of the other family are ignored.
+// ledger persists which addresses the agent owns across restarts.
+func NewWafIPSetEnforcer(api WAFv2API, scope, name, id string, maxSize int, ledger string) CloudEnforcer {
+	if scope == "" {
+		scope = "REGIONAL"
+	}
+	if maxSize <= 0 || maxSize > wafv2IPSetMax {
+		maxSize = wafv2IPSetMax
+	}
+	return newCloudEnforcer(&wafBackend{
+		api:     api,
+		scope:   strings.ToUpper(scope),
+		name:    name,
+		id:      id,
+		maxSize: maxSize,
+		ledger:  ledger,
+		owned:   loadCloudLedger(ledger),
+	})
+}
+
+func (w *wafBackend) kind() string   { return CloudWAFv2 }
+func (w *wafBackend) target() string { return w.name + "/" + w.id }
+
+func (w *wafBackend) sync(ctx context.Context) error {
+	var out *WafGetIPSetOutput
+	err := withRetry(ctx, func() error {
+		var err error
+		out, err = w.api.GetIPSet(ctx, &WafGetIPSetInput{Name: w.name, Scope: w.scope, Id: w.id})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// owned entries removed by someone else are forgotten
+	owned := make(map[string]CloudEntry, len(w.owned))
+	var extra []string
+	for _, cidr := range out.IPSet.Addresses {
+		ip := banFromCIDR(cidr, "")
+		if prev, ok := w.owned[ip]; ok && ip != "" {
+			owned[ip] = prev
+			continue
+		}
+		extra = append(extra, cidr)
+	}
+	changed := len(owned) != len(w.owned)
+	w.owned = owned
+	w.extra = extra
+	w.ipv6 = out.IPSet.IPAddressVersion == "IPV6"
+	w.lockToken = out.LockToken
+	if changed {
+		w.saveLedger()
+	}
+	return nil
+}
+
+// foreign reports whether cidr is already in the set as someone else's
+// entry. The agent doesn't add it again: removing its own copy later
+// would take the operator's with it.
+func (w *wafBackend) foreign(cidr string) bool {
+	for _, x := range w.extra {
+		if x == cidr {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *wafBackend) saveLedger() {
+	if err := saveCloudLedger(w.ledger, w.owned); err != nil {
+		log.Printf("security: %s: saving owned entries: %v", w.target(), err)
+	}
+}
+
+func (w *wafBackend) entries() []CloudEntry {
+	out := make([]CloudEntry, 0, len(w.owned))
+	for _, e := range w.owned {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (w *wafBackend) capacity() int {
+	return w.maxSize - len(w.extra)
+}
+
+func (w *wafBackend) add(ctx context.Context, ips []string) error {
+	return w.update(ctx, ips, nil)
+}
+
+func (w *wafBackend) remove(ctx context.Context, ips []string) error {
+	return w.update(ctx, nil, ips)
+}
+
+// family drops IPs the set cannot hold.
+func (w *wafBackend) family(ips []string) []string {
+	out := ips[:0:0]
+	for _, ip := range ips {
+		if strings.Contains(ip, ":") == w.ipv6 {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// update writes the IP set with add/remove applied, replaying the change
+// on a fresh lock token when another writer got there first.
+func (w *wafBackend) update(ctx context.Context, add, remove []string) error {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+	if w.lockToken == "" {
+		if err := w.sync(ctx); err != nil {
+			return err
+		}
+	}
+	if add = w.family(add); len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	for attempt := 0; attempt < cloudRetryAttempts; attempt++ {
+		next := make(map[string]CloudEntry, len(w.owned)+len(add))
+		for ip, e := range w.owned {
+			next[ip] = e
+		}
+		changed := false
+		for _, ip := range remove {
+			if _, ok := next[ip]; ok {
+				delete(next, ip)
+				changed = true
+			}
+		}
+		now := time.Now()
+		for _, ip := range add {
+			if _, ok := next[ip]; !ok && !w.foreign(banCIDR(ip)) {
+				next[ip] = CloudEntry{IP: ip, Created: now}
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		if len(next)+len(w.extra) > w.maxSize {
+			return fmt.Errorf("IP set %s would hold %d addresses: %w", w.name, len(next), errCloudFull)
+		}
+
+		addrs := append([]string(nil), w.extra...)
+		for ip := range next {
+			addrs = append(addrs, banCIDR(ip))
+		}
+		sort.Strings(addrs)
+
+		out, err := w.api.UpdateIPSet(ctx, &WafUpdateIPSetInput{
+			Name:      w.name,
+			Scope:     w.scope,
+			Id:        w.id,
+			Addresses: addrs,
+			LockToken: w.lockToken,
+		})
+		if err == nil {
+			w.owned = next
+			w.lockToken = out.NextLockToken
+			w.saveLedger()
+			return nil
+		}
+
+		switch {
+		case strings.Contains(err.Error(), "WAFOptimisticLockException"):
+			// stale lock token: re-read and replay on the current list
+			if err := w.sync(ctx); err != nil {
+				return err
+			}
+		case strings.Contains(err.Error(), "WAFLimitsExceededException"):
+			return fmt.Errorf("IP set %s: %v: %w", w.name, err, errCloudFull)
+		default:
+			if attempt == cloudRetryAttempts-1 {
+				return err
+			}
+			if !sleepCtx(ctx, cloudRetryBase<<attempt) {
+				return ctx.Err()
+			}
+		}
+	}
+	return fmt.Errorf("could not update IP set %s after %d attempts", w.name, cloudRetryAttempts)
+}
+
+// loadCloudLedger reads the owned entries saved by saveCloudLedger. A
+// missing or unreadable ledger owns nothing, so nothing is removed.
+func loadCloudLedger(path string) map[string]CloudEntry {
+	owned := make(map[string]CloudEntry)
+	if path == "" {
+		return owned
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("security: reading %s: %v", path, err)
+		}
+		return owned
+	}
+	var entries []CloudEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("security: reading %s: %v", path, err)
+		return owned
+	}
+	for _, e := range entries {
+		owned[e.IP] = e
+	}
+	return owned
+}
+
+func saveCloudLedger(path string, owned map[string]CloudEntry) error {
+	if path == "" {
+		return nil
+	}
+	entries := make([]CloudEntry, 0, len(owned))
+	for _, e := range owned {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// banCIDR formats a ban key as a CIDR: subnet bans are already in CIDR
+// form, single addresses become /32 or /128.
+func banCIDR(ip string) string {
+	if strings.Contains(ip, "/") {
+		return ip
+	}
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+//────────────────────────────────────────────────────────────
+//  WAFv2 JSON client
+//────────────────────────────────────────────────────────────
+
+// wafv2Client calls the WAFv2 JSON API directly, signed with SigV4, so
+// the agent doesn't carry the full service SDK for two operations.
+type wafv2Client struct {
+	cfg      aws.Config
+	region   string
+	endpoint string
+	signer   *v4.Signer
+	http     aws.HTTPClient
+}
+
+// NewWafv2Client returns a WAFv2API for cfg. CLOUDFRONT-scoped IP sets
+// live in us-east-1 regardless of the agent's region.
+func NewWafv2Client(cfg aws.Config, scope string) WAFv2API {
+	region := cfg.Region
+	if strings.EqualFold(scope, "CLOUDFRONT") {
+		region = "us-east-1"
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &wafv2Client{
+		cfg:      cfg,
+		region:   region,
+		endpoint: fmt.Sprintf("https://wafv2.%s.amazonaws.com/", region),
+		signer:   v4.NewSigner(),
+		http:     httpClient,
+	}
+}
+
+func (c *wafv2Client) GetIPSet(ctx context.Context, in *WafGetIPSetInput) (*WafGetIPSetOutput, error) {
+	var out WafGetIPSetOutput
+	if err := c.call(ctx, "GetIPSet", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *wafv2Client) UpdateIPSet(ctx context.Context, in *WafUpdateIPSetInput) (*WafUpdateIPSetOutput, error) {
+	var out WafUpdateIPSetOutput
+	if err := c.call(ctx, "UpdateIPSet", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *wafv2Client) call(ctx context.Context, op string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AWSWAF_20190729."+op)
+
+	if c.cfg.Credentials == nil {
+		return errors.New("wafv2: no AWS credentials")
+	}
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	if err := c.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "wafv2", c.region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"Message"`
+		}
+		json.Unmarshal(data, &apiErr)
+		if i := strings.LastIndex(apiErr.Type, "#"); i >= 0 {
+			apiErr.Type = apiErr.Type[i+1:]
+		}
+		return fmt.Errorf("wafv2 %s: %s: %s (status %d)", op, apiErr.Type, apiErr.Message, resp.StatusCode)
+	}
+	return json.Unmarshal(data, out)
+}
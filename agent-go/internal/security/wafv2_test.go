@@ -0,0 +1,204 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// fakeWaf is an in-memory WAFv2API holding one IP set.
+type fakeWaf struct {
+	version   string
+	addresses []string
+	token     int
+	limit     int // addresses AWS accepts; 0 = no limit
+
+	updates  int
+	conflict int // updates that failed on a stale lock token
+}
+
+func (f *fakeWaf) lockToken() string {
+	return fmt.Sprintf("token-%d", f.token)
+}
+
+// write replaces the set as another writer would, invalidating tokens.
+func (f *fakeWaf) write(addrs ...string) {
+	f.addresses = addrs
+	f.token++
+}
+
+func (f *fakeWaf) GetIPSet(ctx context.Context, in *WafGetIPSetInput) (*WafGetIPSetOutput, error) {
+	return &WafGetIPSetOutput{
+		IPSet: WafIPSet{
+			Name:             in.Name,
+			Id:               in.Id,
+			IPAddressVersion: f.version,
+			Addresses:        append([]string(nil), f.addresses...),
+		},
+		LockToken: f.lockToken(),
+	}, nil
+}
+
+func (f *fakeWaf) UpdateIPSet(ctx context.Context, in *WafUpdateIPSetInput) (*WafUpdateIPSetOutput, error) {
+	f.updates++
+	if in.LockToken != f.lockToken() {
+		f.conflict++
+		return nil, errors.New("wafv2 UpdateIPSet: WAFOptimisticLockException: stale token (status 400)")
+	}
+	if f.limit > 0 && len(in.Addresses) > f.limit {
+		return nil, errors.New("wafv2 UpdateIPSet: WAFLimitsExceededException: too many addresses (status 400)")
+	}
+	f.write(in.Addresses...)
+	return &WafUpdateIPSetOutput{NextLockToken: f.lockToken()}, nil
+}
+
+func (f *fakeWaf) sorted() []string {
+	out := append([]string(nil), f.addresses...)
+	sort.Strings(out)
+	return out
+}
+
+func newTestWaf(t *testing.T, api *fakeWaf, maxSize int) (*cloudEnforcer, *wafBackend) {
+	return newTestWafLedger(t, api, maxSize, "")
+}
+
+func newTestWafLedger(t *testing.T, api *fakeWaf, maxSize int, ledger string) (*cloudEnforcer, *wafBackend) {
+	t.Helper()
+	b := &wafBackend{api: api, scope: "REGIONAL", name: "bans", id: "id-1", maxSize: maxSize,
+		ledger: ledger, owned: loadCloudLedger(ledger)}
+	return newTestEnforcer(t, b), b
+}
+
+func TestWafAddKeepsForeignRanges(t *testing.T) {
+	api := &fakeWaf{version: "IPV4", addresses: []string{"10.0.0.0/8"}}
+	c, b := newTestWaf(t, api, 100)
+
+	block(c, "203.0.113.1", "198.51.100.0/24", "2001:db8::1")
+	want := []string{"10.0.0.0/8", "198.51.100.0/24", "203.0.113.1/32"}
+	if got := api.sorted(); !equalStrings(got, want) {
+		t.Fatalf("addresses = %v, want %v (IPv6 dropped from an IPv4 set)", got, want)
+	}
+	if api.updates != 1 {
+		t.Fatalf("%d updates, want the batch in one call", api.updates)
+	}
+	if got := b.capacity(); got != 99 {
+		t.Fatalf("capacity = %d, want 99", got)
+	}
+}
+
+func TestWafLockTokenConflictReplays(t *testing.T) {
+	api := &fakeWaf{version: "IPV4"}
+	c, _ := newTestWaf(t, api, 100)
+	block(c, "203.0.113.1")
+
+	// another writer changes the set after our last read
+	api.write("203.0.113.1/32", "10.0.0.0/8")
+	block(c, "203.0.113.2")
+
+	if api.conflict != 1 {
+		t.Fatalf("%d lock conflicts, want 1", api.conflict)
+	}
+	want := []string{"10.0.0.0/8", "203.0.113.1/32", "203.0.113.2/32"}
+	if got := api.sorted(); !equalStrings(got, want) {
+		t.Fatalf("addresses = %v, want %v", got, want)
+	}
+	if st := c.Status(); st.LastError != "" {
+		t.Fatalf("unexpected error: %s", st.LastError)
+	}
+}
+
+func TestWafFullEvictsOldest(t *testing.T) {
+	api := &fakeWaf{version: "IPV4", addresses: []string{"10.0.0.0/8"}}
+	c, b := newTestWaf(t, api, 3)
+
+	block(c, "203.0.113.1")
+	block(c, "203.0.113.2")
+	block(c, "203.0.113.3")
+
+	if got, want := ownedIPs(b), []string{"203.0.113.2", "203.0.113.3"}; !equalStrings(got, want) {
+		t.Fatalf("owned = %v, want %v", got, want)
+	}
+	if st := c.Status(); st.Evictions != 1 || st.LastError != "" {
+		t.Fatalf("status = %+v, want one eviction", st)
+	}
+}
+
+func TestCloudAddTrimsOldestBans(t *testing.T) {
+	api := &fakeWaf{version: "IPV4"}
+	c, b := newTestWaf(t, api, 2)
+
+	// banned newest last; the lexically smallest is also the newest
+	block(c, "203.0.113.9", "203.0.113.5", "198.51.100.1")
+	if got, want := ownedIPs(b), []string{"198.51.100.1", "203.0.113.5"}; !equalStrings(got, want) {
+		t.Fatalf("owned = %v, want the two newest bans %v", got, want)
+	}
+
+	// reconcile passes bans oldest first too
+	c.reconcile(context.Background(), []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"})
+	if got, want := ownedIPs(b), []string{"10.0.0.1", "10.0.0.2"}; !equalStrings(got, want) {
+		t.Fatalf("owned = %v, want the two newest bans %v", got, want)
+	}
+}
+
+func TestWafLimitsExceededIsFull(t *testing.T) {
+	api := &fakeWaf{version: "IPV4", limit: 1}
+	c, b := newTestWaf(t, api, 100)
+	block(c, "203.0.113.1")
+
+	err := b.add(context.Background(), []string{"203.0.113.2"})
+	if !errors.Is(err, errCloudFull) {
+		t.Fatalf("err = %v, want errCloudFull", err)
+	}
+
+	block(c, "203.0.113.2")
+	if got := api.sorted(); !equalStrings(got, []string{"203.0.113.2/32"}) {
+		t.Fatalf("addresses = %v, want the oldest ban evicted", got)
+	}
+}
+
+func TestWafReconcileKeepsUnownedEntries(t *testing.T) {
+	api := &fakeWaf{version: "IPV6", addresses: []string{"2001:db8::1/128", "2001:db8::2/128", "2001:db8:ffff::/48"}}
+	c, b := newTestWaf(t, api, 100)
+	if !b.ipv6 {
+		t.Fatal("address family not learned from the set")
+	}
+	if got := ownedIPs(b); len(got) != 0 {
+		t.Fatalf("owned = %v, want none: the agent wrote none of them", got)
+	}
+
+	c.reconcile(context.Background(), []string{"2001:db8::2", "2001:db8::3"})
+	want := []string{"2001:db8::1/128", "2001:db8::2/128", "2001:db8::3/128", "2001:db8:ffff::/48"}
+	if got := api.sorted(); !equalStrings(got, want) {
+		t.Fatalf("addresses = %v, want %v", got, want)
+	}
+
+	unblock(c, "2001:db8::2", "2001:db8::3", "2001:db8::9")
+	want = []string{"2001:db8::1/128", "2001:db8::2/128", "2001:db8:ffff::/48"}
+	if got := api.sorted(); !equalStrings(got, want) {
+		t.Fatalf("addresses = %v, want the operator's entries only", got)
+	}
+}
+
+func TestWafLedgerSurvivesRestart(t *testing.T) {
+	ledger := filepath.Join(t.TempDir(), "wafv2-id-1.json")
+	api := &fakeWaf{version: "IPV4", addresses: []string{"10.0.0.0/8"}}
+	c, _ := newTestWafLedger(t, api, 100, ledger)
+	block(c, "203.0.113.1", "198.51.100.0/24")
+
+	api.write(append(api.addresses, "203.0.113.5/32")...) // added by hand
+	c, b := newTestWafLedger(t, api, 100, ledger)
+	if got := ownedIPs(b); !equalStrings(got, []string{"198.51.100.0/24", "203.0.113.1"}) {
+		t.Fatalf("owned after restart = %v", got)
+	}
+
+	c.reconcile(context.Background(), nil)
+	if got := api.sorted(); !equalStrings(got, []string{"10.0.0.0/8", "203.0.113.5/32"}) {
+		t.Fatalf("addresses = %v, want only the agent's entries removed", got)
+	}
+	if got := ownedIPs(&wafBackend{owned: loadCloudLedger(ledger)}); len(got) != 0 {
+		t.Fatalf("ledger = %v, want empty", got)
+	}
+}
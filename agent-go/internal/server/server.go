@@ -2,11 +2,13 @@ package server
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/jetcamer/agent-go/internal/config"
 	"github.com/jetcamer/agent-go/internal/s3upload"
@@ -22,14 +24,20 @@ import (
 //  - GET /live
 //  - GET /live/summary
 //  - GET /security
+//  - GET /security/feeds (threat feed status; POST forces a refresh)
+//  - GET /security/traps (hidden trap links for robots.txt / page injection)
+//  - GET /security/audit (audit log, filtered by ip, from, to, limit)
+//  - POST /security/ban, POST /security/unban (manual actions)
 //  - GET /internal/get-machine-id (returns machine ID)
 //  - PUT /internal/set-aws-config (sets AWS credentials)
 //  - GET /internal/s3-validate (validates S3 configuration)
+//  - GET /internal/secret-store (credentials encryption status)
+//  - POST /internal/secret-store/rotate, POST /internal/secret-store/wipe
 //  - GET /internal/ws-status (returns WebSocket client status)
-//  - POST /internal/batch (internal route for batch uploads to S3)
-func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uploader *s3upload.S3Uploader) {
-	// Store s3Uploader in a way that allows lazy initialization
-	var s3UploaderPtr *s3upload.S3Uploader = s3Uploader
+//  - POST /internal/batch (optional ingestion of external batches into S3)
+//  - GET /internal/spool (batch spool depth, drops and retries; ?sink=<name>)
+//  - GET /internal/sinks (every routed sink with its filter and spool)
+func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, uploader *s3upload.Shared, router *sinks.Router) {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -116,6 +124,139 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 		_ = json.NewEncoder(w).Encode(snap)
 	})
 
+	mux.HandleFunc("/security/feeds", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if sec == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"securityEnabled":false}`))
+			return
+		}
+		if r.Method == http.MethodPost {
+			sec.RefreshFeeds()
+		}
+		feeds := sec.FeedStatus()
+		if feeds == nil {
+			feeds = []security.FeedStatus{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"feeds": feeds,
+		})
+	})
+
+	mux.HandleFunc("/security/traps", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if sec == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"securityEnabled":false}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sec.TrapLinks())
+	})
+
+	mux.HandleFunc("/security/audit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if sec == nil {
+			w.Write([]byte(`{"securityEnabled":false}`))
+			return
+		}
+
+		q := security.AuditQuery{IP: r.URL.Query().Get("ip")}
+		var err error
+		if q.From, err = parseTimeParam(r.URL.Query().Get("from")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid from: " + err.Error()})
+			return
+		}
+		if q.To, err = parseTimeParam(r.URL.Query().Get("to")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid to: " + err.Error()})
+			return
+		}
+		if s := r.URL.Query().Get("limit"); s != "" {
+			if q.Limit, err = strconv.Atoi(s); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid limit"})
+				return
+			}
+		}
+
+		records, err := sec.AuditQuery(q)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"records": records,
+		})
+	})
+
+	mux.HandleFunc("/security/ban", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if sec == nil {
+			w.Write([]byte(`{"securityEnabled":false}`))
+			return
+		}
+		var payload struct {
+			IP         string `json:"ip"`
+			Note       string `json:"note"`
+			TTLSeconds int    `json:"ttlSeconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid JSON payload"}`))
+			return
+		}
+		if err := sec.Ban(payload.IP, payload.Note, time.Duration(payload.TTLSeconds)*time.Second); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+
+	mux.HandleFunc("/security/unban", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if sec == nil {
+			w.Write([]byte(`{"securityEnabled":false}`))
+			return
+		}
+		var payload struct {
+			IP string `json:"ip"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid JSON payload"}`))
+			return
+		}
+		if !sec.Unban(payload.IP) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"ip is not banned"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+
 	// Internal route to get machine ID
 	mux.HandleFunc("/internal/get-machine-id", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -163,26 +304,53 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 			return
 		}
 		
-		// Extract credentials
-		accessKeyID := payload["AWS_ACCESS_KEY_ID"]
-		secretAccessKey := payload["AWS_SECRET_ACCESS_KEY"]
-		region := payload["AWS_REGION"]
+		// Extract credentials; a role may be given with or without keys
+		creds := s3upload.StoredCredentials{
+			AccessKeyID:          payload["AWS_ACCESS_KEY_ID"],
+			SecretAccessKey:      payload["AWS_SECRET_ACCESS_KEY"],
+			Region:               payload["AWS_REGION"],
+			RoleARN:              payload["AWS_ROLE_ARN"],
+			ExternalID:           payload["AWS_EXTERNAL_ID"],
+			RoleSessionName:      payload["AWS_ROLE_SESSION_NAME"],
+			WebIdentityTokenFile: payload["AWS_WEB_IDENTITY_TOKEN_FILE"],
+		}
+		region := creds.Region
+		if d := payload["AWS_ROLE_DURATION_SECONDS"]; d != "" {
+			secs, err := strconv.Atoi(d)
+			if err != nil || secs < 900 || secs > 43200 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "AWS_ROLE_DURATION_SECONDS must be 900-43200",
+				})
+				return
+			}
+			creds.RoleDurationSeconds = secs
+		}
 		
 		// Validate required fields
-		if accessKeyID == "" || secretAccessKey == "" {
+		if (creds.AccessKeyID == "" || creds.SecretAccessKey == "") && creds.RoleARN == "" {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(map[string]string{
-				"error": "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required",
+				"error": "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_ROLE_ARN, are required",
 			})
 			return
 		}
+		if creds.WebIdentityTokenFile != "" {
+			if _, err := os.Stat(creds.WebIdentityTokenFile); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "AWS_WEB_IDENTITY_TOKEN_FILE is not readable: " + err.Error(),
+				})
+				return
+			}
+		}
 		
-		// Store credentials
-		s3upload.SetStoredCredentials(accessKeyID, secretAccessKey, region)
+		// Store credentials; the S3 and EC2 clients are rebuilt with them
+		s3upload.SetStoredCredentials(creds)
 		
 		response := map[string]interface{}{
 			"status": "ok",
-			"message": "AWS credentials stored successfully",
+			"message": "AWS credentials stored; AWS clients are reloaded without a restart",
 		}
 		
 		// Try to start WebSocket client if credentials are now available
@@ -202,6 +370,48 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 		json.NewEncoder(w).Encode(response)
 	})
 
+	// Internal routes for the encrypted credentials store
+	mux.HandleFunc("/internal/secret-store", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s3upload.GetSecretStoreStatus())
+	})
+
+	mux.HandleFunc("/internal/secret-store/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		status, err := s3upload.RotateSecretKey()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
+	mux.HandleFunc("/internal/secret-store/wipe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := s3upload.WipeSecretStore(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "ok",
+			"message": "stored credentials and secret key removed; AWS clients fall back to the default credential chain",
+		})
+	})
+
 	// Internal route for WebSocket status
 	mux.HandleFunc("/internal/ws-status", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -232,7 +442,7 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 		}
 		
 		ctx := r.Context()
-		result := s3upload.ValidateS3Config(ctx)
+		result := s3upload.ValidateS3Config(ctx, cfg.S3Options())
 		
 		w.Header().Set("Content-Type", "application/json")
 		if !result.Valid {
@@ -243,37 +453,23 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 		json.NewEncoder(w).Encode(result)
 	})
 
-	// Internal route for batch uploads to S3
+	// Internal route for batches from outside the agent; the agent's own
+	// batch sink writes to S3 directly
 	mux.HandleFunc("/internal/batch", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 		
-		// Try lazy initialization if uploader is nil but credentials are available
-		if s3UploaderPtr == nil {
-			// Check if stored credentials are available
-			if s3upload.HasStoredCredentials() {
-				log.Printf("S3 uploader not initialized, attempting lazy initialization with stored credentials...")
-				ctx := r.Context()
-				newUploader, err := s3upload.NewS3Uploader(ctx)
-				if err != nil {
-					log.Printf("lazy S3 uploader initialization failed: %v", err)
-					w.WriteHeader(http.StatusInternalServerError)
-					json.NewEncoder(w).Encode(map[string]string{
-						"error": fmt.Sprintf("S3 uploader not initialized: %v. Use /internal/set-aws-config to configure credentials.", err),
-					})
-					return
-				}
-				s3UploaderPtr = newUploader
-				log.Printf("S3 uploader initialized successfully with stored credentials")
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{
-					"error": "S3 uploader not initialized. Configure AWS credentials via /internal/set-aws-config or ensure AWS credentials are available.",
-				})
-				return
-			}
+		// Initializes lazily once credentials are available
+		s3Uploader, err := uploader.Get(r.Context())
+		if err != nil {
+			log.Printf("internal/batch: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
 		}
 
 		// Read request body
@@ -314,7 +510,7 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 
 		// Upload to S3
 		ctx := r.Context()
-		if err := s3UploaderPtr.UploadBatch(ctx, events); err != nil {
+		if err := s3Uploader.UploadBatch(ctx, events); err != nil {
 			log.Printf("failed to upload batch to S3: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(`{"error":"failed to upload to S3"}`))
@@ -330,9 +526,64 @@ func Run(cfg *config.Config, agg *sinks.Aggregator, sec *security.Engine, s3Uplo
 		json.NewEncoder(w).Encode(response)
 	})
 
+	// Internal route for the batch spool
+	mux.HandleFunc("/internal/spool", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if router == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "batch sink not running",
+			})
+			return
+		}
+		batch, ok := router.Route(r.URL.Query().Get("sink"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "no such sink",
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batch.Stats())
+	})
+
+	// Internal route for the sink router
+	mux.HandleFunc("/internal/sinks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if router == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "batch sink not running",
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sinks": router.Stats(),
+		})
+	})
+
 	addr := cfg.FluentWebListen
 	log.Printf("agent web server listening on %s", addr)
 	if err := http.ListenAndServe(addr, mux); err != nil {
 		log.Printf("agent web server exited: %v", err)
 	}
 }
+
+// parseTimeParam accepts RFC 3339 or unix seconds; empty means no bound.
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,505 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+	"github.com/jetcamer/agent-go/internal/security"
+	"github.com/jetcamer/agent-go/internal/spool"
+)
+
+// Sink receives batches of events for long-term storage. Each element is
+// one JSON-encoded Event exactly as spooled, so implementations can
+// stream them without decoding. A returned error makes the batch sink
+// retry the same events later.
+type Sink interface {
+	Name() string
+	WriteBatch(ctx context.Context, events [][]byte) error
+}
+
+// BatchSink ships events to a Sink through an on-disk spool, so batches
+// survive upload failures and agent restarts. Delivery is at-least-once:
+// a segment is deleted only after every batch in it was accepted, and a
+// retry after a partial failure resends the batches not yet acknowledged.
+// A segment the destination keeps rejecting as malformed (see permanent)
+// is moved to the spool's dead-letter directory after deadLetterAfter
+// attempts instead of blocking the segments behind it.
+type BatchSink struct {
+	name     string
+	sink     Sink
+	interval time.Duration
+	maxBatch int
+	retryMax time.Duration
+
+	in    chan Event
+	spool *spool.Spool
+
+	closeOnce sync.Once
+	stop      chan struct{} // closed by Close
+	closed    chan struct{} // closed once the queue is spooled and synced
+
+	dropped  atomic.Uint64 // channel full
+	spoolErr atomic.Uint64 // could not be written to the spool
+	retries  atomic.Uint64
+
+	mu        sync.Mutex
+	lastError string
+	lastErrAt time.Time
+	backoff   time.Duration
+}
+
+// BatchStats is served on GET /internal/spool.
+type BatchStats struct {
+	Spool        spool.Stats `json:"spool"`
+	Queued       int         `json:"queued"`       // events waiting in memory for the spool writer
+	QueueDropped uint64      `json:"queueDropped"` // events lost because the in-memory queue was full
+	SpoolErrors  uint64      `json:"spoolErrors"`  // events lost because the spool could not be written
+	Retries      uint64      `json:"retries"`
+	Staged       int         `json:"staged,omitempty"`  // events delivered to the sink but still buffered by it (Parquet)
+	StagedError  string      `json:"stagedError,omitempty"` // last failure writing out staged events
+	StagedErrAt  time.Time   `json:"stagedErrorAt,omitempty"`
+	Backoff      string      `json:"backoff,omitempty"` // current retry delay, empty when healthy
+	LastError    string      `json:"lastError,omitempty"`
+	LastErrorAt  time.Time   `json:"lastErrorAt,omitempty"`
+}
+
+const (
+	batchQueue      = 100000
+	writeTimeout    = 2 * time.Minute
+	deadLetterAfter = 3 // consecutive permanent rejections of one segment
+)
+
+// batchOptions are the spool and delivery settings of one BatchSink.
+// sub is the spool's place below spoolDir, empty for the default sink.
+type batchOptions struct {
+	name       string
+	sub        string
+	interval   time.Duration
+	maxBatch   int
+	retryMax   time.Duration
+	segmentMB  int
+	maxSpoolMB int
+}
+
+func defaultBatchOptions(cfg *config.Config) batchOptions {
+	return batchOptions{
+		name:       "default",
+		interval:   cfg.FlushInterval(),
+		maxBatch:   cfg.CollectorMaxBatchSize,
+		retryMax:   time.Duration(cfg.SpoolRetryMaxSeconds) * time.Second,
+		segmentMB:  cfg.SpoolSegmentMB,
+		maxSpoolMB: cfg.SpoolMaxMB,
+	}
+}
+
+// NewBatchSink opens the spool in cfg.SpoolDir and delivers to sink. If
+// that directory is not usable it falls back to one under the system temp
+// dir, which still covers upload outages but not reboots.
+func NewBatchSink(cfg *config.Config, sink Sink) (*BatchSink, error) {
+	return newBatchSink(cfg, defaultBatchOptions(cfg), sink)
+}
+
+func newBatchSink(cfg *config.Config, o batchOptions, sink Sink) (*BatchSink, error) {
+	segAge := o.interval
+	dir := filepath.Join(cfg.SpoolDir, o.sub)
+	sp, err := spool.Open(dir, int64(o.segmentMB)<<20, segAge, int64(o.maxSpoolMB)<<20)
+	if err != nil {
+		fallback := filepath.Join(os.TempDir(), "jetcamer-spool", o.sub)
+		log.Printf("batch sink %s: spool %s unavailable (%v), using %s", o.name, dir, err, fallback)
+		sp, err = spool.Open(fallback, int64(o.segmentMB)<<20, segAge, int64(o.maxSpoolMB)<<20)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.maxBatch <= 0 {
+		o.maxBatch = 500
+	}
+	if o.retryMax <= 0 {
+		o.retryMax = 5 * time.Minute
+	}
+	return &BatchSink{
+		name:     o.name,
+		sink:     sink,
+		interval: segAge,
+		maxBatch: o.maxBatch,
+		retryMax: o.retryMax,
+		in:       make(chan Event, batchQueue),
+		spool:    sp,
+		stop:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// Offer queues evt without blocking; it is dropped, and counted, when the
+// spool writer has fallen behind.
+func (b *BatchSink) Offer(evt Event) bool {
+	select {
+	case b.in <- evt:
+		return true
+	default:
+		b.dropped.Add(1)
+		return false
+	}
+}
+
+// Run writes queued events to the spool and delivers sealed segments.
+// It returns once Close has spooled the queue.
+func (b *BatchSink) Run() {
+	log.Printf("batch sink %s using %s interval=%s size=%d spool=%s",
+		b.name, b.sink.Name(), b.interval, b.maxBatch, b.spool.Stats().Dir)
+	go b.deliverLoop()
+	b.writeLoop()
+}
+
+func (b *BatchSink) writeLoop() {
+	defer close(b.closed)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case evt := <-b.in:
+			b.write(evt)
+		case <-ticker.C:
+			b.spool.Tick()
+		case <-b.stop:
+			b.drain()
+			return
+		}
+	}
+}
+
+func (b *BatchSink) write(evt Event) {
+	line, err := json.Marshal(evt)
+	if err == nil {
+		err = b.spool.Append(line)
+	}
+	if err != nil {
+		b.spoolErr.Add(1)
+	}
+}
+
+// drain spools whatever is still queued and seals the open segment, so
+// it is on disk and delivered on the next start.
+func (b *BatchSink) drain() {
+	n := 0
+queued:
+	for {
+		select {
+		case evt := <-b.in:
+			b.write(evt)
+			n++
+		default:
+			break queued
+		}
+	}
+	if err := b.spool.Flush(); err != nil {
+		log.Printf("batch sink %s: failed to flush spool on close: %v", b.name, err)
+		return
+	}
+	log.Printf("batch sink %s: spooled %d queued events on close", b.name, n)
+}
+
+// Close stops the spool writer after it has written the queued events
+// and synced the open segment to disk. Events offered afterwards are not
+// spooled. Delivery of sealed segments is left to the next start.
+func (b *BatchSink) Close() {
+	b.closeOnce.Do(func() { close(b.stop) })
+	<-b.closed
+}
+
+func (b *BatchSink) deliverLoop() {
+	var (
+		current  uint64
+		sent     int // records of current already accepted
+		rejected int // consecutive permanent rejections of current
+	)
+	for {
+		seg, ok := b.spool.Next()
+		if !ok {
+			select {
+			case <-b.spool.Ready():
+			case <-time.After(b.interval):
+			}
+			continue
+		}
+		if seg.Seq != current {
+			current, sent, rejected = seg.Seq, 0, 0
+		}
+		n, err := b.deliver(seg, sent)
+		sent += n
+		if n > 0 {
+			rejected = 0
+		}
+		if err != nil && permanent(err) {
+			if rejected++; rejected >= deadLetterAfter {
+				log.Printf("batch sink %s: segment %d rejected %d times (%v), moving it to dead-letter",
+					b.name, seg.Seq, rejected, err)
+				b.spool.DeadLetter(seg)
+				continue
+			}
+		}
+		if err != nil {
+			b.fail(err)
+			continue
+		}
+		b.spool.Done(seg)
+		b.recovered()
+	}
+}
+
+// deliver posts the records of seg after the first skip in batches of
+// maxBatch and returns how many were accepted.
+func (b *BatchSink) deliver(seg spool.Segment, skip int) (int, error) {
+	var (
+		batch [][]byte
+		sent  int
+		i     int
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		err := b.sink.WriteBatch(ctx, batch)
+		cancel()
+		if err != nil {
+			return err
+		}
+		sent += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err := spool.ReadRecords(seg, func(rec []byte) error {
+		i++
+		if i <= skip {
+			return nil
+		}
+		batch = append(batch, append([]byte(nil), rec...))
+		if len(batch) >= b.maxBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return sent, err
+}
+
+// fail records err and sleeps for the next backoff step: 1s doubling up
+// to retryMax.
+func (b *BatchSink) fail(err error) {
+	b.retries.Add(1)
+	b.mu.Lock()
+	if b.backoff == 0 {
+		b.backoff = time.Second
+	} else if b.backoff *= 2; b.backoff > b.retryMax {
+		b.backoff = b.retryMax
+	}
+	wait := b.backoff
+	b.lastError = err.Error()
+	b.lastErrAt = time.Now()
+	b.mu.Unlock()
+	log.Printf("batch sink %s error: %v (retrying in %s)", b.name, err, wait)
+	time.Sleep(wait)
+}
+
+func (b *BatchSink) recovered() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.backoff != 0 {
+		log.Printf("batch sink %s: delivering again after %s backoff", b.name, b.backoff)
+		b.backoff = 0
+	}
+}
+
+// Stats reports spool depth and delivery counters.
+func (b *BatchSink) Stats() BatchStats {
+	st := BatchStats{
+		Spool:        b.spool.Stats(),
+		Queued:       len(b.in),
+		QueueDropped: b.dropped.Load(),
+		SpoolErrors:  b.spoolErr.Load(),
+		Retries:      b.retries.Load(),
+	}
+	if s, ok := b.sink.(interface{ StagedRows() int }); ok {
+		st.Staged = s.StagedRows()
+	}
+	if s, ok := b.sink.(interface{ SinkError() (string, time.Time) }); ok {
+		if msg, at := s.SinkError(); msg != "" {
+			st.StagedError, st.StagedErrAt = msg, at
+		}
+	}
+	b.mu.Lock()
+	if b.backoff > 0 {
+		st.Backoff = b.backoff.String()
+	}
+	st.LastError = b.lastError
+	st.LastErrorAt = b.lastErrAt
+	b.mu.Unlock()
+	return st
+}
+
+// HTTPSink posts batches as {"env","instanceId","siteId","events":[...]}
+// to an external collector, or to another agent's /internal/batch. As a
+// routed webhook it can also sign the body or send plain NDJSON.
+type HTTPSink struct {
+	url    string
+	apiKey string
+	env    string
+	inst   string
+	site   string
+	client *http.Client
+
+	ndjson bool
+	secret string // HMAC-SHA256 signature as on notification webhooks
+	auth   httpAuth
+}
+
+// NewHTTPSink posts to url; apiKey, if set, is sent as a bearer token.
+func NewHTTPSink(cfg *config.Config, url, apiKey string) *HTTPSink {
+	return &HTTPSink{
+		url:    url,
+		apiKey: apiKey,
+		env:    cfg.Env,
+		inst:   cfg.InstanceId,
+		site:   cfg.SiteId,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (h *HTTPSink) Name() string {
+	return redactURL(h.url)
+}
+
+// WriteBatch sends already-encoded events without decoding them again.
+func (h *HTTPSink) WriteBatch(ctx context.Context, events [][]byte) error {
+	var body bytes.Buffer
+	contentType := "application/json"
+	if h.ndjson {
+		contentType = "application/x-ndjson"
+		for _, e := range events {
+			body.Write(e)
+			body.WriteByte('\n')
+		}
+	} else {
+		head, _ := json.Marshal(map[string]string{
+			"env":        h.env,
+			"instanceId": h.inst,
+			"siteId":     h.site,
+		})
+		body.Write(head[:len(head)-1])
+		body.WriteString(`,"events":[`)
+		for i, e := range events {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(e)
+		}
+		body.WriteString("]}")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if h.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+h.apiKey)
+	}
+	if h.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Jetcamer-Timestamp", ts)
+		req.Header.Set("X-Jetcamer-Signature", "sha256="+security.SignWebhook(h.secret, ts, body.Bytes()))
+	}
+	h.auth.apply(req)
+	return doPost(h.client, req)
+}
+
+// httpAuth is the optional basic auth and extra headers of a routed sink.
+type httpAuth struct {
+	username string
+	password string
+	headers  map[string]string
+}
+
+func (a httpAuth) apply(req *http.Request) {
+	if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+	for k, v := range a.headers {
+		req.Header.Set(k, v)
+	}
+}
+
+// statusError is a non-2xx response. HTTPStatusCode matches the AWS SDK's
+// response errors, so permanent handles both.
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d, response: %s", e.code, e.body)
+}
+
+func (e *statusError) HTTPStatusCode() int { return e.code }
+
+// permanent reports whether err is a rejection that resending the same
+// batch cannot fix: a 4xx other than timeouts, throttling, and auth or
+// not-found failures, which hit every batch until the config is fixed.
+func permanent(err error) bool {
+	var se interface{ HTTPStatusCode() int }
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch code := se.HTTPStatusCode(); code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	default:
+		return code >= 400 && code < 500
+	}
+}
+
+// doPost sends req and turns any non-2xx status into an error carrying
+// the start of the response.
+func doPost(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{code: resp.StatusCode, body: bytes.TrimSpace(respBody)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// redactURL drops credentials and the query string, which often carry
+// tokens, so sink names can be logged and served on the local API.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "invalid-url"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
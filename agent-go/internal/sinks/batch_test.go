@@ -0,0 +1,105 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+)
+
+// fakeSink records accepted batches; err, when set, rejects them.
+type fakeSink struct {
+	batches chan [][]byte
+	err     error
+}
+
+func (f *fakeSink) Name() string { return "fake" }
+
+func (f *fakeSink) WriteBatch(ctx context.Context, events [][]byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.batches <- events
+	return nil
+}
+
+func newTestBatchSink(t *testing.T, sink Sink) *BatchSink {
+	t.Helper()
+	cfg := &config.Config{SpoolDir: t.TempDir(), SpoolSegmentMB: 8, SpoolMaxMB: 64}
+	o := defaultBatchOptions(cfg)
+	o.interval = time.Hour // segments are sealed by Close only
+	b, err := newBatchSink(cfg, o, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBatchSinkCloseSpoolsQueue(t *testing.T) {
+	sink := &fakeSink{err: errors.New("collector down")}
+	b := newTestBatchSink(t, sink)
+	for i := 0; i < 50; i++ {
+		b.Offer(Event{RemoteIP: "203.0.113.1", Path: "/", Status: 200})
+	}
+	go b.Run()
+	b.Close()
+
+	st := b.Stats()
+	if st.Queued != 0 || st.Spool.Segments != 1 || st.Spool.Pending != 50 {
+		t.Fatalf("after Close: queued=%d segments=%d pending=%d, want 0, 1, 50",
+			st.Queued, st.Spool.Segments, st.Spool.Pending)
+	}
+	b.Close() // idempotent
+}
+
+func TestPermanent(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{code: 400}, true},
+		{&statusError{code: 413}, true},
+		{&statusError{code: 422}, true},
+		{fmt.Errorf("sink x: %w", &statusError{code: 400}), true},
+		{&statusError{code: 401}, false},
+		{&statusError{code: 403}, false},
+		{&statusError{code: 404}, false},
+		{&statusError{code: 429}, false},
+		{&statusError{code: 500}, false},
+		{&statusError{code: 503}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, c := range cases {
+		if got := permanent(c.err); got != c.want {
+			t.Errorf("permanent(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestBatchSinkDeadLettersRejectedSegment(t *testing.T) {
+	sink := &fakeSink{err: &statusError{code: 400, body: []byte("bad row")}}
+	b := newTestBatchSink(t, sink)
+	b.Offer(Event{RemoteIP: "203.0.113.1", Path: "/", Status: 200})
+	go b.Run()
+	b.Close() // seals the segment; delivery keeps running
+
+	deadline := time.Now().Add(10 * time.Second)
+	for b.Stats().Spool.DeadSegments == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("segment not dead-lettered: %+v", b.Stats())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	st := b.Stats()
+	if st.Spool.Segments != 0 || st.Spool.DeadLettered != 1 || st.Retries != deadLetterAfter-1 {
+		t.Fatalf("stats = %+v", st)
+	}
+	matches, _ := filepath.Glob(filepath.Join(st.Spool.Dir, "dead-letter", "*.seg"))
+	if len(matches) != 1 {
+		t.Fatalf("dead-letter files = %v", matches)
+	}
+}
@@ -0,0 +1,78 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+)
+
+// ClickHouseSink inserts events through ClickHouse's HTTP interface as
+// JSONEachRow, one row per event with the event JSON names as columns.
+// Fields the table does not have are skipped, and ts is parsed as an RFC
+// 3339 time, so a table with a subset of the columns works too.
+type ClickHouseSink struct {
+	url    string
+	table  string
+	auth   httpAuth
+	apiKey string
+	client *http.Client
+}
+
+var clickHouseTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// NewClickHouseSink inserts into sc.Table, default "jetcamer_events", on
+// the server at sc.URL (e.g. "http://clickhouse:8123").
+func NewClickHouseSink(sc config.SinkConfig) (*ClickHouseSink, error) {
+	u, err := parseSinkURL(sc.URL)
+	if err != nil {
+		return nil, err
+	}
+	table := sc.Table
+	if table == "" {
+		table = "jetcamer_events"
+	}
+	if !clickHouseTable.MatchString(table) {
+		return nil, fmt.Errorf("invalid clickhouse table %q", table)
+	}
+	q := u.Query()
+	q.Set("query", "INSERT INTO "+table+" FORMAT JSONEachRow")
+	q.Set("date_time_input_format", "best_effort")
+	q.Set("input_format_skip_unknown_fields", "1")
+	u.RawQuery = q.Encode()
+	return &ClickHouseSink{
+		url:    u.String(),
+		table:  table,
+		auth:   httpAuth{username: sc.Username, password: sc.Password, headers: sc.Headers},
+		apiKey: sc.ApiKey,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (c *ClickHouseSink) Name() string {
+	return "clickhouse " + redactURL(c.url) + " " + c.table
+}
+
+// WriteBatch inserts the batch in one request. ClickHouse applies an
+// insert atomically, so a failed batch is retried whole.
+func (c *ClickHouseSink) WriteBatch(ctx context.Context, events [][]byte) error {
+	var body bytes.Buffer
+	for _, e := range events {
+		body.Write(e)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	c.auth.apply(req)
+	return doPost(c.client, req)
+}
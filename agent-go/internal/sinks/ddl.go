@@ -0,0 +1,132 @@
+package sinks
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jetcamer/agent-go/internal/s3upload"
+)
+
+// TableOptions describe the Athena/Glue table over archived events.
+type TableOptions struct {
+	Database    string
+	Table       string
+	Bucket      string
+	Prefix      string // s3Prefix from the agent config
+	KeyTemplate string // s3KeyTemplate from the agent config
+	Format      string // s3Format from the agent config: "ndjson" or "parquet"
+}
+
+// TableDDL returns a CREATE EXTERNAL TABLE statement whose columns follow
+// the JSON encoding of Event, so it cannot drift from what the agent
+// writes. Partitions come from the k={var} directories of the key
+// template; when the whole prefix is made of them the table uses
+// partition projection and needs no MSCK REPAIR.
+func TableDDL(opts TableOptions) (string, error) {
+	prefix, parts, projectable, err := s3upload.KeyPartitions(opts.KeyTemplate)
+	if err != nil {
+		return "", err
+	}
+	table := opts.Table
+	if opts.Database != "" {
+		table = opts.Database + "." + table
+	}
+	if p := strings.Trim(opts.Prefix, "/"); p != "" {
+		prefix = p + "/" + prefix
+	}
+	location := fmt.Sprintf("s3://%s/%s", opts.Bucket, prefix)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE EXTERNAL TABLE IF NOT EXISTS %s (\n", table)
+	parquetFormat := strings.EqualFold(opts.Format, "parquet")
+	cols := eventColumns()
+	for i, c := range cols {
+		sep := ","
+		if i == len(cols)-1 {
+			sep = ""
+		}
+		typ := c[1]
+		if parquetFormat && c[0] == "ts" {
+			typ = "timestamp"
+		}
+		fmt.Fprintf(&b, "  `%s` %s%s\n", c[0], typ, sep)
+	}
+	b.WriteString(")\n")
+	if len(parts) > 0 {
+		var pcols []string
+		for _, p := range parts {
+			typ := "string"
+			if p.Var == "hour" {
+				typ = "int"
+			}
+			pcols = append(pcols, fmt.Sprintf("`%s` %s", p.Column, typ))
+		}
+		fmt.Fprintf(&b, "PARTITIONED BY (%s)\n", strings.Join(pcols, ", "))
+	}
+	if parquetFormat {
+		b.WriteString("STORED AS PARQUET\n")
+	} else {
+		b.WriteString("ROW FORMAT SERDE 'org.openx.data.jsonserde.JsonSerDe'\n")
+		b.WriteString("WITH SERDEPROPERTIES ('ignore.malformed.json' = 'true')\n")
+	}
+	fmt.Fprintf(&b, "LOCATION '%s'", location)
+
+	if projectable {
+		props := []string{"'projection.enabled' = 'true'"}
+		tmpl := location
+		for _, p := range parts {
+			switch p.Var {
+			case "dt":
+				props = append(props,
+					fmt.Sprintf("'projection.%s.type' = 'date'", p.Column),
+					fmt.Sprintf("'projection.%s.format' = 'yyyy-MM-dd'", p.Column),
+					fmt.Sprintf("'projection.%s.range' = 'NOW-3YEARS,NOW'", p.Column),
+					fmt.Sprintf("'projection.%s.interval' = '1'", p.Column),
+					fmt.Sprintf("'projection.%s.interval.unit' = 'DAYS'", p.Column))
+			case "hour":
+				props = append(props,
+					fmt.Sprintf("'projection.%s.type' = 'integer'", p.Column),
+					fmt.Sprintf("'projection.%s.range' = '0,23'", p.Column),
+					fmt.Sprintf("'projection.%s.digits' = '2'", p.Column))
+			default:
+				// site, env, machine, ...: any value, given in the WHERE clause
+				props = append(props, fmt.Sprintf("'projection.%s.type' = 'injected'", p.Column))
+			}
+			tmpl += fmt.Sprintf("%s=${%s}/", p.Column, p.Column)
+		}
+		props = append(props, fmt.Sprintf("'storage.location.template' = '%s'", tmpl))
+		b.WriteString("\nTBLPROPERTIES (\n  " + strings.Join(props, ",\n  ") + "\n)")
+	}
+	b.WriteString(";\n")
+	if len(parts) > 0 && !projectable {
+		fmt.Fprintf(&b, "\n-- the key template has directories that are not k=v partitions, so neither\n-- projection nor MSCK REPAIR TABLE can find the data; register each\n-- partition with ALTER TABLE %s ADD PARTITION (...) LOCATION '...'\n", table)
+	}
+	return b.String(), nil
+}
+
+// eventColumns maps the JSON fields of Event to Athena types. In NDJSON ts
+// stays a string (RFC 3339); query it with from_iso8601_timestamp(ts).
+// Parquet files store it as a timestamp and use the same column names.
+func eventColumns() [][2]string {
+	var cols [][2]string
+	t := reflect.TypeOf(Event{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		typ := "string"
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int32:
+			typ = "int"
+		case reflect.Int64, reflect.Uint64:
+			typ = "bigint"
+		case reflect.Bool:
+			typ = "boolean"
+		}
+		cols = append(cols, [2]string{strings.ToLower(name), typ})
+	}
+	return cols
+}
@@ -0,0 +1,189 @@
+package sinks
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Filter selects the events a routed sink receives. An expression is a
+// list of clauses joined by "&&", each "<field> <op> <values>":
+//
+//	status>=500
+//	site=shop.example.com*,blog* && path!=/health
+//	status=4xx,5xx && method=POST
+//
+// Fields are site (the access log file name, a glob as in securityTraps),
+// status, path and method. Comma-separated values are alternatives. site,
+// path and method take = and !=; status also takes <, <=, > and >=, and
+// matches whole classes written as 4xx. A path value ending in "*"
+// matches everything below it, and the query string is ignored.
+type Filter struct {
+	expr    string
+	clauses []clause
+}
+
+type clause struct {
+	field  string
+	op     string
+	values []string
+}
+
+var filterOps = []string{"!=", ">=", "<=", "==", "=", ">", "<"}
+
+// ParseFilter compiles expr; an empty expression matches every event.
+func ParseFilter(expr string) (*Filter, error) {
+	f := &Filter{expr: strings.TrimSpace(expr)}
+	if f.expr == "" {
+		return f, nil
+	}
+	for _, part := range strings.Split(f.expr, "&&") {
+		c, err := parseClause(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		f.clauses = append(f.clauses, c)
+	}
+	return f, nil
+}
+
+func parseClause(s string) (clause, error) {
+	i := strings.IndexAny(s, "!=<>")
+	if i < 0 {
+		return clause{}, fmt.Errorf("filter %q: missing operator", s)
+	}
+	var op string
+	for _, o := range filterOps {
+		if strings.HasPrefix(s[i:], o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return clause{}, fmt.Errorf("filter %q: bad operator", s)
+	}
+	c := clause{field: strings.ToLower(strings.TrimSpace(s[:i])), op: op}
+	if op == "==" {
+		c.op = "="
+	}
+	for _, v := range strings.Split(s[i+len(op):], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			c.values = append(c.values, v)
+		}
+	}
+	if len(c.values) == 0 {
+		return c, fmt.Errorf("filter %q: no value", s)
+	}
+	switch c.field {
+	case "site", "path", "method":
+		if c.op != "=" && c.op != "!=" {
+			return c, fmt.Errorf("filter %q: %s only takes = and !=", s, c.field)
+		}
+		for _, v := range c.values {
+			if _, err := path.Match(v, ""); err != nil {
+				return c, fmt.Errorf("filter %q: bad pattern %q", s, v)
+			}
+		}
+	case "status":
+		for _, v := range c.values {
+			if _, _, err := statusRange(v); err != nil {
+				return c, fmt.Errorf("filter %q: %v", s, err)
+			}
+		}
+	default:
+		return c, fmt.Errorf("filter %q: unknown field %q (want site, status, path or method)", s, c.field)
+	}
+	return c, nil
+}
+
+// statusRange parses "503" or "5xx" into an inclusive range.
+func statusRange(v string) (lo, hi int, err error) {
+	if len(v) == 3 && strings.EqualFold(v[1:], "xx") && v[0] >= '1' && v[0] <= '5' {
+		lo = int(v[0]-'0') * 100
+		return lo, lo + 99, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 100 || n > 599 {
+		return 0, 0, fmt.Errorf("bad status %q", v)
+	}
+	return n, n, nil
+}
+
+// String returns the expression as configured.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Match reports whether evt passes every clause.
+func (f *Filter) Match(evt *Event) bool {
+	if f == nil {
+		return true
+	}
+	for _, c := range f.clauses {
+		if !c.match(evt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c clause) match(evt *Event) bool {
+	if c.field == "status" {
+		return c.matchStatus(evt.Status)
+	}
+	hit := false
+	for _, v := range c.values {
+		if c.matchValue(v, evt) {
+			hit = true
+			break
+		}
+	}
+	return hit == (c.op == "=")
+}
+
+func (c clause) matchValue(v string, evt *Event) bool {
+	switch c.field {
+	case "site":
+		ok, _ := filepath.Match(v, evt.Source)
+		return ok
+	case "method":
+		return strings.EqualFold(v, evt.Method)
+	}
+	p := evt.Path
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	if prefix, ok := strings.CutSuffix(v, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+		return strings.HasPrefix(p, prefix)
+	}
+	ok, _ := path.Match(v, p)
+	return ok
+}
+
+func (c clause) matchStatus(status int) bool {
+	for _, v := range c.values {
+		lo, hi, _ := statusRange(v)
+		var ok bool
+		switch c.op {
+		case "=", "!=":
+			ok = status >= lo && status <= hi
+		case "<":
+			ok = status < lo
+		case "<=":
+			ok = status <= hi
+		case ">":
+			ok = status > hi
+		case ">=":
+			ok = status >= lo
+		}
+		if ok {
+			return c.op != "!="
+		}
+	}
+	return c.op == "!="
+}
@@ -0,0 +1,97 @@
+package sinks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		evt  Event
+		want bool
+	}{
+		{"", Event{Status: 200}, true},
+
+		{"status=5xx", Event{Status: 503}, true},
+		{"status=5xx", Event{Status: 404}, false},
+		{"status==404", Event{Status: 404}, true},
+		{"status!=4xx,5xx", Event{Status: 200}, true},
+		{"status!=4xx,5xx", Event{Status: 404}, false},
+		{"status!=4xx,5xx", Event{Status: 502}, false},
+		{"status!=404", Event{Status: 403}, true},
+		{"status<5xx", Event{Status: 499}, true},
+		{"status<5xx", Event{Status: 500}, false},
+		{"status<=5xx", Event{Status: 599}, true},
+		{"status>4xx", Event{Status: 499}, false},
+		{"status>4xx", Event{Status: 500}, true},
+		{"status>5xx", Event{Status: 599}, false},
+		{"status>=5xx", Event{Status: 500}, true},
+		{"status>=5xx", Event{Status: 499}, false},
+		{"status>=500", Event{Status: 500}, true},
+		{"status>404,499", Event{Status: 450}, true},
+
+		{"path=/api/*", Event{Path: "/api/v1/users?id=7"}, true},
+		{"path=/api/*", Event{Path: "/api"}, false},
+		{"path=/api*", Event{Path: "/apiv2"}, true},
+		{"path=*", Event{Path: "/anything/at/all"}, true},
+		{"path=/static/*.css", Event{Path: "/static/site.css"}, true},
+		{"path=/static/*.css", Event{Path: "/static/a/site.css"}, false},
+		{"path=/a*b*", Event{Path: "/axb/c"}, false},
+		{"path=/a*b*", Event{Path: "/axbc"}, true},
+		{"path=/login", Event{Path: "/login#top"}, true},
+		{"path!=/health", Event{Path: "/health?probe=1"}, false},
+		{"path!=/health,/metrics", Event{Path: "/"}, true},
+
+		{"site=shop.example.com*,blog*", Event{Source: "blog-access.log"}, true},
+		{"site=shop.example.com*", Event{Source: "api.example.com.log"}, false},
+		{"method=post", Event{Method: "POST"}, true},
+		{"method!=GET,HEAD", Event{Method: "HEAD"}, false},
+
+		{"status=4xx,5xx && method=POST", Event{Status: 422, Method: "POST"}, true},
+		{"status=4xx,5xx && method=POST", Event{Status: 422, Method: "GET"}, false},
+		{" Status >= 500 && PATH != /health ", Event{Status: 500, Path: "/x"}, true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q): %v", tt.expr, err)
+		}
+		if got := f.Match(&tt.evt); got != tt.want {
+			t.Errorf("%q on %+v = %v, want %v", tt.expr, tt.evt, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr, err string
+	}{
+		{"status", "missing operator"},
+		{"status!500", "bad operator"},
+		{"status=", "no value"},
+		{"status= , ,", "no value"},
+		{"status=600", "bad status"},
+		{"status=6xx", "bad status"},
+		{"status=5x", "bad status"},
+		{"status=>500", "bad status"},
+		{"path>/api", "only takes = and !="},
+		{"method<=GET", "only takes = and !="},
+		{"path=/api/[", "bad pattern"},
+		{"host=example.com", "unknown field"},
+		{"status=500 && ", "missing operator"},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseFilter(%q) = %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	if !f.Match(&Event{}) || f.String() != "" {
+		t.Fatal("nil filter must match everything")
+	}
+}
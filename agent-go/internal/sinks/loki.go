@@ -0,0 +1,126 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+	"github.com/jetcamer/agent-go/internal/s3upload"
+)
+
+// LokiSink pushes events to Grafana Loki's push API. Each event is one log
+// line, its JSON encoding, in a stream per access log file labelled with
+// the agent's env, site and instance plus any static labels, so LogQL
+// queries can use "| json" to reach the fields.
+type LokiSink struct {
+	url    string
+	labels map[string]string
+	auth   httpAuth
+	apiKey string
+	client *http.Client
+}
+
+// NewLokiSink posts to sc.URL, which is the push endpoint or just the
+// Loki base URL.
+func NewLokiSink(cfg *config.Config, sc config.SinkConfig) (*LokiSink, error) {
+	u, err := parseSinkURL(sc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/loki/api/v1/push"
+	}
+	labels := map[string]string{
+		"job":      "jetcamer-agent",
+		"env":      cfg.Env,
+		"site_id":  cfg.SiteId,
+		"instance": cfg.InstanceId,
+	}
+	for k, v := range sc.Labels {
+		labels[k] = v
+	}
+	return &LokiSink{
+		url:    u.String(),
+		labels: labels,
+		auth:   httpAuth{username: sc.Username, password: sc.Password, headers: sc.Headers},
+		apiKey: sc.ApiKey,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (l *LokiSink) Name() string {
+	return "loki " + redactURL(l.url)
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+	ts     []int64
+}
+
+func (s *lokiStream) Len() int           { return len(s.Values) }
+func (s *lokiStream) Less(i, j int) bool { return s.ts[i] < s.ts[j] }
+func (s *lokiStream) Swap(i, j int) {
+	s.Values[i], s.Values[j] = s.Values[j], s.Values[i]
+	s.ts[i], s.ts[j] = s.ts[j], s.ts[i]
+}
+
+// WriteBatch sends one push request; entries are ordered by time within
+// each stream, as older Loki versions require.
+func (l *LokiSink) WriteBatch(ctx context.Context, events [][]byte) error {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	now := time.Now()
+	for _, e := range events {
+		var head struct {
+			Source string `json:"source"`
+		}
+		json.Unmarshal(e, &head)
+		st, ok := streams[head.Source]
+		if !ok {
+			labels := make(map[string]string, len(l.labels)+1)
+			for k, v := range l.labels {
+				labels[k] = v
+			}
+			if head.Source != "" {
+				labels["source"] = head.Source
+			}
+			st = &lokiStream{Stream: labels}
+			streams[head.Source] = st
+			order = append(order, head.Source)
+		}
+		ts := now
+		if t, ok := s3upload.EventTime(e); ok {
+			ts = t
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(ts.UnixNano(), 10), string(e)})
+		st.ts = append(st.ts, ts.UnixNano())
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, src := range order {
+		sort.Stable(streams[src])
+		push.Streams = append(push.Streams, streams[src])
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", l.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+	l.auth.apply(req)
+	return doPost(l.client, req)
+}
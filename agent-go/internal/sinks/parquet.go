@@ -0,0 +1,397 @@
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+	"github.com/jetcamer/agent-go/internal/parquet"
+	"github.com/jetcamer/agent-go/internal/s3upload"
+	"github.com/jetcamer/agent-go/internal/version"
+)
+
+// ObjectStore stores finished files under the archive key layout;
+// *s3upload.Shared implements it.
+type ObjectStore interface {
+	UploadObject(ctx context.Context, obj s3upload.Object) error
+}
+
+// eventColumn is one column of the Parquet schema for Event. The order and
+// names are part of the archive format: add columns at the end, never
+// rename or retype them.
+type eventColumn struct {
+	parquet.Column
+	str func(e *Event) string
+	num func(e *Event) int64
+}
+
+var eventParquet = []eventColumn{
+	{parquet.Column{Name: "ip", Kind: parquet.String, Dictionary: true}, func(e *Event) string { return e.RemoteIP }, nil},
+	{parquet.Column{Name: "proxyip", Kind: parquet.String, Optional: true, Dictionary: true}, func(e *Event) string { return e.ProxyIP }, nil},
+	{parquet.Column{Name: "xff", Kind: parquet.String, Optional: true}, func(e *Event) string { return e.ForwardedFor }, nil},
+	{parquet.Column{Name: "cfconnectingip", Kind: parquet.String, Optional: true, Dictionary: true}, func(e *Event) string { return e.CFConnectingIP }, nil},
+	{parquet.Column{Name: "path", Kind: parquet.String, Dictionary: true}, func(e *Event) string { return e.Path }, nil},
+	{parquet.Column{Name: "method", Kind: parquet.String, Dictionary: true}, func(e *Event) string { return e.Method }, nil},
+	{parquet.Column{Name: "status", Kind: parquet.Int32, Dictionary: true}, nil, func(e *Event) int64 { return int64(e.Status) }},
+	{parquet.Column{Name: "bytes", Kind: parquet.Int64}, nil, func(e *Event) int64 { return e.Bytes }},
+	{parquet.Column{Name: "ua", Kind: parquet.String, Dictionary: true}, func(e *Event) string { return e.UserAgent }, nil},
+	{parquet.Column{Name: "referer", Kind: parquet.String, Dictionary: true}, func(e *Event) string { return e.Referer }, nil},
+	{parquet.Column{Name: "ts", Kind: parquet.TimestampMillis}, nil, func(e *Event) int64 { return e.Timestamp.UnixMilli() }},
+	{parquet.Column{Name: "source", Kind: parquet.String, Dictionary: true}, func(e *Event) string { return e.Source }, nil},
+	{parquet.Column{Name: "raw", Kind: parquet.String, Optional: true}, func(e *Event) string {
+		if e.Raw == nil {
+			return ""
+		}
+		return *e.Raw
+	}, nil},
+}
+
+// ParquetSink turns batches into Parquet files. Parquet wants large row
+// groups, far larger than one batch, so events are first staged on disk
+// per UTC hour and written out once an hour has RowGroupRows events or
+// its oldest staged event is MaxAge old. A batch counts as delivered
+// once it is staged and synced; uploads run on flushLoop alone, so an
+// hour that fails to upload never fails the batches of other hours.
+type ParquetSink struct {
+	store        ObjectStore
+	dir          string
+	codec        parquet.Codec
+	rowGroupRows int
+	maxAge       time.Duration
+
+	mu        sync.Mutex
+	stages    map[int64]*stage // by hour, unix seconds
+	lastError string           // last failed upload, cleared by the next good flush
+	lastErrAt time.Time
+}
+
+// stage is the staging file of one hour.
+type stage struct {
+	hour  time.Time
+	path  string
+	f     *os.File
+	rows  int
+	since time.Time
+}
+
+// NewParquetSink stages under <spoolDir>/parquet, falling back to the
+// system temp dir, and picks up files staged by a previous run.
+func NewParquetSink(cfg *config.Config, store ObjectStore) (*ParquetSink, error) {
+	return newParquetSink(cfg, store, "parquet")
+}
+
+// newParquetSink stages under <spoolDir>/<sub>.
+func newParquetSink(cfg *config.Config, store ObjectStore, sub string) (*ParquetSink, error) {
+	codec, err := parquet.ParseCodec(cfg.ParquetCompression)
+	if err != nil {
+		return nil, err
+	}
+	rowGroupRows := cfg.ParquetRowGroupRows
+	if rowGroupRows <= 0 {
+		rowGroupRows = 100000
+	}
+	maxAge := time.Duration(cfg.ParquetMaxAgeMinutes) * time.Minute
+	if maxAge <= 0 {
+		maxAge = 15 * time.Minute
+	}
+	dir := filepath.Join(cfg.SpoolDir, sub)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		fallback := filepath.Join(os.TempDir(), "jetcamer-"+sub)
+		log.Printf("parquet sink: staging %s unavailable (%v), using %s", dir, err, fallback)
+		dir = fallback
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+	p := &ParquetSink{
+		store:        store,
+		dir:          dir,
+		codec:        codec,
+		rowGroupRows: rowGroupRows,
+		maxAge:       maxAge,
+		stages:       make(map[int64]*stage),
+	}
+	if err := p.recover(); err != nil {
+		return nil, err
+	}
+	go p.flushLoop()
+	return p, nil
+}
+
+func (p *ParquetSink) recover() error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".parquet.tmp") {
+			os.Remove(filepath.Join(p.dir, name))
+			continue
+		}
+		unix, err := strconv.ParseInt(strings.TrimSuffix(name, ".ndjson"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".ndjson") {
+			continue
+		}
+		path := filepath.Join(p.dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// drop a record torn by a crash
+		if i := bytes.LastIndexByte(data, '\n'); i+1 < len(data) {
+			if err := os.Truncate(path, int64(i+1)); err != nil {
+				return err
+			}
+			data = data[:i+1]
+		}
+		st, err := p.open(time.Unix(unix, 0).UTC())
+		if err != nil {
+			return err
+		}
+		st.rows = bytes.Count(data, []byte{'\n'})
+		if info, err := e.Info(); err == nil {
+			st.since = info.ModTime()
+		}
+		log.Printf("parquet sink: resuming %d staged events for %s", st.rows, st.hour.Format("2006-01-02T15"))
+	}
+	return nil
+}
+
+// open returns the stage of hour, creating its file. Caller holds p.mu
+// (or is recover).
+func (p *ParquetSink) open(hour time.Time) (*stage, error) {
+	if st, ok := p.stages[hour.Unix()]; ok {
+		return st, nil
+	}
+	path := filepath.Join(p.dir, fmt.Sprintf("%d.ndjson", hour.Unix()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	st := &stage{hour: hour, path: path, f: f, since: time.Now()}
+	p.stages[hour.Unix()] = st
+	return st, nil
+}
+
+func (p *ParquetSink) Name() string {
+	return "s3 (parquet, " + p.codec.String() + ")"
+}
+
+// WriteBatch stages events. Only a staging error fails the batch.
+func (p *ParquetSink) WriteBatch(ctx context.Context, events [][]byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	touched := make(map[*stage]bool)
+	for _, l := range events {
+		hour := now.UTC().Truncate(time.Hour)
+		if ts, ok := s3upload.EventTime(l); ok {
+			hour = ts.UTC().Truncate(time.Hour)
+		}
+		st, err := p.open(hour)
+		if err != nil {
+			return err
+		}
+		if _, err := st.f.Write(append(l, '\n')); err != nil {
+			return err
+		}
+		st.rows++
+		touched[st] = true
+	}
+	for st := range touched {
+		if err := st.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StagedRows reports events staged and not yet uploaded.
+func (p *ParquetSink) StagedRows() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, st := range p.stages {
+		n += st.rows
+	}
+	return n
+}
+
+// SinkError reports the last failed upload; staged hours are retried on
+// the next tick.
+func (p *ParquetSink) SinkError() (string, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastError, p.lastErrAt
+}
+
+func (p *ParquetSink) flushLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.flushTick(context.Background())
+	}
+}
+
+// flushTick uploads the hours that are due and records the outcome.
+func (p *ParquetSink) flushTick(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.flushDue(ctx, false); err != nil {
+		log.Printf("parquet sink: %v", err)
+		p.lastError = err.Error()
+		p.lastErrAt = time.Now()
+		return
+	}
+	p.lastError = ""
+}
+
+// flushDue writes out the hours that are full or old enough, oldest
+// first. An hour that fails doesn't hold back the others. Caller holds
+// p.mu.
+func (p *ParquetSink) flushDue(ctx context.Context, all bool) error {
+	var due []*stage
+	for _, st := range p.stages {
+		if st.rows > 0 && (all || st.rows >= p.rowGroupRows || time.Since(st.since) >= p.maxAge) {
+			due = append(due, st)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].hour.Before(due[j].hour) })
+	var errs []error
+	for _, st := range due {
+		if err := p.flush(ctx, st); err != nil {
+			errs = append(errs, fmt.Errorf("parquet %s: %w", st.hour.Format("2006-01-02T15"), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flush converts one staging file into a Parquet file, uploads it and
+// removes both. Caller holds p.mu.
+func (p *ParquetSink) flush(ctx context.Context, st *stage) error {
+	events, err := readStaged(st.path)
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".parquet.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	first, last, err := p.writeFile(f, events)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	err = p.store.UploadObject(ctx, s3upload.Object{
+		Hour:        st.hour,
+		Ext:         ".parquet",
+		ContentType: "application/vnd.apache.parquet",
+		Body:        f,
+		Size:        size,
+		Events:      len(events),
+		Metadata:    s3upload.ObjectMetadata(len(events), first, last),
+	})
+	if err != nil {
+		return err
+	}
+	st.f.Close()
+	os.Remove(st.path)
+	delete(p.stages, st.hour.Unix())
+	return nil
+}
+
+// writeFile writes events as row groups of at most rowGroupRows and
+// returns their time range.
+func (p *ParquetSink) writeFile(f *os.File, events []Event) (first, last time.Time, err error) {
+	bw := bufio.NewWriterSize(f, 1<<20)
+	schema := make([]parquet.Column, len(eventParquet))
+	for i, c := range eventParquet {
+		schema[i] = c.Column
+	}
+	w, err := parquet.NewWriter(bw, schema, p.codec)
+	if err != nil {
+		return first, last, err
+	}
+	w.CreatedBy = "jetcamer-agent version " + version.Get()
+
+	for start := 0; start < len(events); start += p.rowGroupRows {
+		rows := events[start:min(start+p.rowGroupRows, len(events))]
+		cols := make([]parquet.ColumnValues, len(eventParquet))
+		for i, c := range eventParquet {
+			for j := range rows {
+				e := &rows[j]
+				if c.str != nil {
+					s := c.str(e)
+					cols[i].Strings = append(cols[i].Strings, s)
+					if c.Optional {
+						cols[i].Null = append(cols[i].Null, s == "")
+					}
+				} else {
+					cols[i].Ints = append(cols[i].Ints, c.num(e))
+				}
+			}
+		}
+		for j := range rows {
+			ts := rows[j].Timestamp
+			if first.IsZero() || ts.Before(first) {
+				first = ts
+			}
+			if ts.After(last) {
+				last = ts
+			}
+		}
+		if err := w.WriteRowGroup(len(rows), cols); err != nil {
+			return first, last, err
+		}
+	}
+	if err := w.Close(map[string]string{"jetcamer.schema": "sinks.Event/1"}); err != nil {
+		return first, last, err
+	}
+	return first, last, bw.Flush()
+}
+
+func readStaged(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []Event
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			log.Printf("parquet sink: skipping bad staged event: %v", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, sc.Err()
+}
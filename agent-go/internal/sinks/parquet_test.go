@@ -0,0 +1,81 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+	"github.com/jetcamer/agent-go/internal/s3upload"
+)
+
+// fakeStore records uploaded hours and rejects those in fail.
+type fakeStore struct {
+	mu       sync.Mutex
+	fail     map[time.Time]error
+	uploaded []time.Time
+}
+
+func (f *fakeStore) UploadObject(ctx context.Context, obj s3upload.Object) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail[obj.Hour]; err != nil {
+		return err
+	}
+	f.uploaded = append(f.uploaded, obj.Hour)
+	return nil
+}
+
+func encodeEvents(t *testing.T, ts time.Time, n int) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for i := 0; i < n; i++ {
+		line, err := json.Marshal(Event{RemoteIP: "203.0.113.1", Path: "/", Method: "GET", Status: 200, Timestamp: ts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func TestParquetUploadFailureDoesNotFailBatches(t *testing.T) {
+	old := time.Date(2026, 10, 18, 7, 0, 0, 0, time.UTC)
+	cur := old.Add(time.Hour)
+	store := &fakeStore{fail: map[time.Time]error{old: errors.New("s3 PutObject: AccessDenied (status 403)")}}
+	p, err := newParquetSink(&config.Config{SpoolDir: t.TempDir(), ParquetRowGroupRows: 2}, store, "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := p.WriteBatch(ctx, encodeEvents(t, old.Add(time.Minute), 2)); err != nil {
+		t.Fatal(err)
+	}
+	p.flushTick(ctx)
+	if msg, _ := p.SinkError(); !strings.Contains(msg, "AccessDenied") {
+		t.Fatalf("SinkError = %q, want the upload failure", msg)
+	}
+
+	// the failing hour is still due, but a new batch is staged regardless
+	if err := p.WriteBatch(ctx, encodeEvents(t, cur.Add(time.Minute), 3)); err != nil {
+		t.Fatalf("WriteBatch failed for another hour's upload: %v", err)
+	}
+	p.flushTick(ctx)
+	if len(store.uploaded) != 1 || !store.uploaded[0].Equal(cur) {
+		t.Fatalf("uploaded = %v, want %s despite the failing hour", store.uploaded, cur)
+	}
+	if got := p.StagedRows(); got != 2 {
+		t.Fatalf("staged = %d, want the 2 events of the failing hour", got)
+	}
+
+	delete(store.fail, old)
+	p.flushTick(ctx)
+	if msg, _ := p.SinkError(); msg != "" || p.StagedRows() != 0 {
+		t.Fatalf("after recovery: error %q, %d staged", msg, p.StagedRows())
+	}
+}
@@ -0,0 +1,233 @@
+package sinks
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jetcamer/agent-go/internal/config"
+	"github.com/jetcamer/agent-go/internal/s3upload"
+)
+
+// Router fans tailed events out to one BatchSink per configured sink.
+// Each route has its own filter, batch size, flush interval, retry
+// backoff and spool, so a slow or failing destination only backs up its
+// own spool. Without cfg.Sinks there is a single route, "default", that
+// keeps the agent's original layout: S3 (NDJSON or Parquet per s3Format),
+// or collectorUrl, spooled directly in spoolDir.
+type Router struct {
+	routes []*route
+}
+
+type route struct {
+	name    string
+	kind    string
+	filter  *Filter
+	batch   *BatchSink
+	matched atomic.Uint64
+}
+
+// SinkStats is served on GET /internal/sinks.
+type SinkStats struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Sink    string `json:"sink"` // destination, credentials and query removed
+	Filter  string `json:"filter,omitempty"`
+	Matched uint64 `json:"matched"` // events that passed the filter since start
+	BatchStats
+}
+
+var sinkName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// NewRouter builds the routes of cfg. S3 sinks write through uploader.
+func NewRouter(cfg *config.Config, uploader *s3upload.Shared) (*Router, error) {
+	r := &Router{}
+	if len(cfg.Sinks) == 0 {
+		sink, kind, err := defaultSink(cfg, uploader)
+		if err != nil {
+			return nil, err
+		}
+		b, err := NewBatchSink(cfg, sink)
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, &route{name: "default", kind: kind, batch: b})
+		return r, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, sc := range cfg.Sinks {
+		if !sinkName.MatchString(sc.Name) {
+			return nil, fmt.Errorf("sink name %q: use letters, digits, - and _", sc.Name)
+		}
+		if seen[sc.Name] {
+			return nil, fmt.Errorf("sink %s is configured twice", sc.Name)
+		}
+		seen[sc.Name] = true
+
+		filter, err := ParseFilter(sc.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+		sink, err := newRoutedSink(cfg, sc, uploader)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+		o := defaultBatchOptions(cfg)
+		o.name = sc.Name
+		o.sub = filepath.Join("sinks", sc.Name)
+		if sc.BatchSize > 0 {
+			o.maxBatch = sc.BatchSize
+		}
+		if sc.FlushIntervalSec > 0 {
+			o.interval = time.Duration(sc.FlushIntervalSec) * time.Second
+		}
+		if sc.RetryMaxSeconds > 0 {
+			o.retryMax = time.Duration(sc.RetryMaxSeconds) * time.Second
+		}
+		if sc.SpoolMaxMB > 0 {
+			o.maxSpoolMB = sc.SpoolMaxMB
+		}
+		b, err := newBatchSink(cfg, o, sink)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+		r.routes = append(r.routes, &route{
+			name:   sc.Name,
+			kind:   strings.ToLower(sc.Type),
+			filter: filter,
+			batch:  b,
+		})
+	}
+	return r, nil
+}
+
+// defaultSink is the destination of the unnamed, unfiltered route.
+func defaultSink(cfg *config.Config, uploader *s3upload.Shared) (Sink, string, error) {
+	if cfg.CollectorUrl != "" {
+		return NewHTTPSink(cfg, cfg.CollectorUrl, cfg.CollectorApiKey), "http", nil
+	}
+	switch strings.ToLower(cfg.S3Format) {
+	case "", "ndjson":
+	case "parquet":
+		pq, err := NewParquetSink(cfg, uploader)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to set up parquet output: %w", err)
+		}
+		return pq, "s3", nil
+	default:
+		log.Printf("WARNING: unknown s3Format %q, uploading NDJSON", cfg.S3Format)
+	}
+	return uploader, "s3", nil
+}
+
+func newRoutedSink(cfg *config.Config, sc config.SinkConfig, uploader *s3upload.Shared) (Sink, error) {
+	format := strings.ToLower(sc.Format)
+	switch strings.ToLower(sc.Type) {
+	case "s3":
+		switch format {
+		case "", "ndjson":
+			return uploader, nil
+		case "parquet":
+			return newParquetSink(cfg, uploader, filepath.Join("sinks", sc.Name, "parquet"))
+		}
+		return nil, fmt.Errorf("unknown s3 format %q (want ndjson or parquet)", sc.Format)
+	case "http", "webhook":
+		if _, err := parseSinkURL(sc.URL); err != nil {
+			return nil, err
+		}
+		h := NewHTTPSink(cfg, sc.URL, sc.ApiKey)
+		switch format {
+		case "", "json":
+		case "ndjson":
+			h.ndjson = true
+		default:
+			return nil, fmt.Errorf("unknown %s format %q (want json or ndjson)", sc.Type, sc.Format)
+		}
+		h.secret = sc.Secret
+		h.auth = httpAuth{username: sc.Username, password: sc.Password, headers: sc.Headers}
+		return h, nil
+	case "loki":
+		return NewLokiSink(cfg, sc)
+	case "clickhouse":
+		return NewClickHouseSink(sc)
+	}
+	return nil, fmt.Errorf("unknown sink type %q (want s3, http, webhook, loki or clickhouse)", sc.Type)
+}
+
+// parseSinkURL accepts absolute http(s) URLs only.
+func parseSinkURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	return u, nil
+}
+
+// Offer hands evt to every route whose filter it passes, without
+// blocking; each route counts its own drops.
+func (r *Router) Offer(evt Event) {
+	for _, rt := range r.routes {
+		if rt.filter.Match(&evt) {
+			rt.matched.Add(1)
+			rt.batch.Offer(evt)
+		}
+	}
+}
+
+// Start runs every route in its own goroutines.
+func (r *Router) Start() {
+	for _, rt := range r.routes {
+		if rt.filter.String() != "" {
+			log.Printf("sink router: %s receives events matching %q", rt.name, rt.filter)
+		}
+		go rt.batch.Run()
+	}
+}
+
+// Close spools the queued events of every route and syncs the spools;
+// call it after the tailers have stopped offering events.
+func (r *Router) Close() {
+	var wg sync.WaitGroup
+	for _, rt := range r.routes {
+		wg.Add(1)
+		go func(b *BatchSink) {
+			defer wg.Done()
+			b.Close()
+		}(rt.batch)
+	}
+	wg.Wait()
+}
+
+// Route returns the batch sink of the named route; an empty name is the
+// first route.
+func (r *Router) Route(name string) (*BatchSink, bool) {
+	for _, rt := range r.routes {
+		if name == "" || rt.name == name {
+			return rt.batch, true
+		}
+	}
+	return nil, false
+}
+
+// Stats reports every route in configuration order.
+func (r *Router) Stats() []SinkStats {
+	out := make([]SinkStats, 0, len(r.routes))
+	for _, rt := range r.routes {
+		out = append(out, SinkStats{
+			Name:       rt.name,
+			Type:       rt.kind,
+			Sink:       rt.batch.sink.Name(),
+			Filter:     rt.filter.String(),
+			Matched:    rt.matched.Load(),
+			BatchStats: rt.batch.Stats(),
+		})
+	}
+	return out
+}
@@ -1,9 +1,6 @@
 package sinks
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
 	"log"
 	"net/http"
 	"sort"
@@ -11,21 +8,23 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jetcamer/agent-go/internal/config"
 	"github.com/jetcamer/agent-go/internal/security"
 )
 
 type Event struct {
-	RemoteIP  string    `json:"ip"`
-	Path      string    `json:"path"`
-	Method    string    `json:"method"`
-	Status    int       `json:"status"`
-	Bytes     int64     `json:"bytes"`
-	UserAgent string    `json:"ua"`
-	Referer   string    `json:"referer"`
-	Timestamp time.Time `json:"ts"`
-	Source    string    `json:"source"`
-	Raw       *string   `json:"raw,omitempty"`
+	RemoteIP       string    `json:"ip"`                // real client address when behind a trusted proxy
+	ProxyIP        string    `json:"proxyIp,omitempty"` // connecting proxy, set when RemoteIP came from a header
+	ForwardedFor   string    `json:"xff,omitempty"`
+	CFConnectingIP string    `json:"cfConnectingIp,omitempty"`
+	Path           string    `json:"path"`
+	Method         string    `json:"method"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	UserAgent      string    `json:"ua"`
+	Referer        string    `json:"referer"`
+	Timestamp      time.Time `json:"ts"`
+	Source         string    `json:"source"`
+	Raw            *string   `json:"raw,omitempty"`
 }
 
 // Aggregator holds last N events and basic stats for /live.
@@ -322,71 +321,3 @@ func topNFromIntMap(m map[int]uint64, n int) []TopItem {
 	}
 	return topNFromMap(tmp, n)
 }
-
-// Batch sink: periodically sends events to internal route which uploads to S3.
-func RunBatchSink(cfg *config.Config, in <-chan Event) {
-	// Use internal route instead of external Next.js collector
-	// Construct URL from FluentWebListen (e.g., "127.0.0.1:9811" -> "http://127.0.0.1:9811/internal/batch")
-	internalURL := "http://" + cfg.FluentWebListen + "/internal/batch"
-	
-	client := &http.Client{Timeout: 10 * time.Second}
-	flushInterval := cfg.FlushInterval()
-	maxBatch := cfg.CollectorMaxBatchSize
-	if maxBatch <= 0 {
-		maxBatch = 500
-	}
-	log.Printf("batch sink using internal route %s interval=%s size=%d", internalURL, flushInterval, maxBatch)
-
-	ticker := time.NewTicker(flushInterval)
-	defer ticker.Stop()
-
-	batch := make([]Event, 0, maxBatch)
-
-	flush := func() {
-		if len(batch) == 0 {
-			return
-		}
-		// Convert Event slice to []interface{} for JSON marshaling
-		events := make([]interface{}, len(batch))
-		for i, evt := range batch {
-			events[i] = evt
-		}
-		
-		payload := map[string]interface{}{
-			"env":        cfg.Env,
-			"instanceId": cfg.InstanceId,
-			"siteId":     cfg.SiteId,
-			"events":     events,
-		}
-		body, _ := json.Marshal(payload)
-		log.Printf("batch sink: flushing %d events to %s", len(batch), internalURL)
-		req, _ := http.NewRequest("POST", internalURL, bytes.NewReader(body))
-		req.Header.Set("Content-Type", "application/json")
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("batch sink error: %v", err)
-		} else {
-			if resp.StatusCode == http.StatusOK {
-				log.Printf("batch sink: successfully sent %d events to internal route", len(batch))
-			} else {
-				// Read error response body for debugging
-				respBody, _ := io.ReadAll(resp.Body)
-				log.Printf("batch sink error: status %d, response: %s", resp.StatusCode, string(respBody))
-			}
-			resp.Body.Close()
-		}
-		batch = batch[:0]
-	}
-
-	for {
-		select {
-		case evt := <-in:
-			batch = append(batch, evt)
-			if len(batch) >= maxBatch {
-				flush()
-			}
-		case <-ticker.C:
-			flush()
-		}
-	}
-}
@@ -0,0 +1,458 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spool is a disk-backed write-ahead queue of newline-delimited records.
+// Records are appended to an open segment, which is sealed once it reaches
+// SegmentBytes or SegmentAge; sealed segments are handed to the consumer
+// oldest first and removed only after it has delivered them, so delivery
+// is at-least-once and survives restarts. When the spool grows past
+// MaxBytes the oldest undelivered segments are dropped. Segments the
+// consumer gives up on are moved to the dead-letter/ subdirectory, which
+// keeps at most a quarter of MaxBytes.
+//
+// File names: <seq>.open for the segment being written, <seq>-<records>.seg
+// once sealed.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	segmentAge   time.Duration
+	maxBytes     int64
+
+	mu       sync.Mutex
+	seq      uint64
+	open     *os.File
+	w        *bufio.Writer
+	openSize int64
+	openRecs int
+	openedAt time.Time
+	sealed   []Segment // oldest first
+	inflight uint64    // seq handed out by Next, never evicted; noSegment when idle
+	stats    Stats
+
+	ready chan struct{} // signalled when a segment is sealed
+}
+
+const noSegment = ^uint64(0)
+
+// Segment is a sealed file of Records records.
+type Segment struct {
+	Seq     uint64
+	Path    string
+	Records int
+	Bytes   int64
+}
+
+// Stats is reported on the local API.
+type Stats struct {
+	Dir             string    `json:"dir"`
+	Segments        int       `json:"segments"` // sealed, waiting for delivery
+	Bytes           int64     `json:"bytes"`    // sealed + open
+	Pending         int64     `json:"pending"`  // records not yet delivered, open segment included
+	Written         uint64    `json:"written"`
+	Delivered       uint64    `json:"delivered"`
+	Dropped         uint64    `json:"dropped"` // records in segments evicted by maxBytes
+	DroppedSegments uint64    `json:"droppedSegments"`
+	Replayed        uint64    `json:"replayed"`     // records found on disk at startup
+	DeadLettered    uint64    `json:"deadLettered"` // records in segments moved to dead-letter/
+	DeadSegments    uint64    `json:"deadSegments"`
+	LastError       string    `json:"lastError,omitempty"`
+	LastErrorAt     time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Open creates dir if needed and picks up segments left by a previous run.
+// A segment that was still open is sealed, minus any torn last record.
+func Open(dir string, segmentBytes int64, segmentAge time.Duration, maxBytes int64) (*Spool, error) {
+	if segmentBytes <= 0 {
+		segmentBytes = 4 << 20
+	}
+	if segmentAge <= 0 {
+		segmentAge = 10 * time.Second
+	}
+	if maxBytes <= 0 {
+		maxBytes = 512 << 20
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		segmentAge:   segmentAge,
+		maxBytes:     maxBytes,
+		inflight:     noSegment,
+		ready:        make(chan struct{}, 1),
+	}
+	s.stats.Dir = dir
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, ".seg"):
+			var seq uint64
+			var recs int
+			if _, err := fmt.Sscanf(name, "%d-%d.seg", &seq, &recs); err != nil {
+				log.Printf("spool: ignoring %s", name)
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			s.sealed = append(s.sealed, Segment{Seq: seq, Path: filepath.Join(s.dir, name), Records: recs, Bytes: info.Size()})
+		case strings.HasSuffix(name, ".open"):
+			seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".open"), 10, 64)
+			if err != nil {
+				log.Printf("spool: ignoring %s", name)
+				continue
+			}
+			seg, err := sealTorn(filepath.Join(s.dir, name), seq)
+			if err != nil {
+				log.Printf("spool: could not recover %s: %v", name, err)
+				continue
+			}
+			if seg.Records > 0 {
+				s.sealed = append(s.sealed, seg)
+			}
+		default:
+			continue
+		}
+	}
+	sort.Slice(s.sealed, func(i, j int) bool { return s.sealed[i].Seq < s.sealed[j].Seq })
+	for _, seg := range s.sealed {
+		if seg.Seq >= s.seq {
+			s.seq = seg.Seq + 1
+		}
+		s.stats.Replayed += uint64(seg.Records)
+	}
+	if len(s.sealed) > 0 {
+		log.Printf("spool: replaying %d records in %d segments from %s", s.stats.Replayed, len(s.sealed), s.dir)
+		s.signal()
+	}
+	return nil
+}
+
+// sealTorn truncates a crashed segment after its last complete record and
+// seals it.
+func sealTorn(path string, seq uint64) (Segment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Segment{}, err
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i+1 < len(data) {
+		data = data[:i+1]
+		if err := os.Truncate(path, int64(len(data))); err != nil {
+			return Segment{}, err
+		}
+	}
+	recs := bytes.Count(data, []byte{'\n'})
+	if recs == 0 {
+		return Segment{}, os.Remove(path)
+	}
+	sealed := filepath.Join(filepath.Dir(path), fmt.Sprintf("%020d-%d.seg", seq, recs))
+	if err := os.Rename(path, sealed); err != nil {
+		return Segment{}, err
+	}
+	return Segment{Seq: seq, Path: sealed, Records: recs, Bytes: int64(len(data))}, nil
+}
+
+// Append writes one record (without the trailing newline).
+func (s *Spool) Append(rec []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.open == nil {
+		if err := s.create(); err != nil {
+			s.fail(err)
+			return err
+		}
+	}
+	n, err := s.w.Write(rec)
+	if err == nil {
+		err = s.w.WriteByte('\n')
+		n++
+	}
+	s.openSize += int64(n)
+	if err != nil {
+		s.fail(err)
+		return err
+	}
+	s.openRecs++
+	s.stats.Written++
+	if s.openSize >= s.segmentBytes {
+		return s.seal()
+	}
+	return nil
+}
+
+// Tick seals the open segment once it is older than SegmentAge. Call it
+// periodically from the writer.
+func (s *Spool) Tick() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open == nil || time.Since(s.openedAt) < s.segmentAge {
+		return nil
+	}
+	return s.seal()
+}
+
+// Flush seals the open segment regardless of its age, e.g. on shutdown.
+func (s *Spool) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open == nil {
+		return nil
+	}
+	return s.seal()
+}
+
+// create starts a new open segment. Caller holds s.mu.
+func (s *Spool) create() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%020d.open", s.seq)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	s.open = f
+	s.w = bufio.NewWriterSize(f, 64<<10)
+	s.openSize = 0
+	s.openRecs = 0
+	s.openedAt = time.Now()
+	return nil
+}
+
+// seal flushes, syncs and renames the open segment, then enforces
+// maxBytes. Caller holds s.mu.
+func (s *Spool) seal() error {
+	f := s.open
+	s.open = nil
+	seq := s.seq
+	s.seq++
+
+	err := s.w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.fail(err)
+		return err
+	}
+	if s.openRecs == 0 {
+		return os.Remove(f.Name())
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d-%d.seg", seq, s.openRecs))
+	if err := os.Rename(f.Name(), path); err != nil {
+		s.fail(err)
+		return err
+	}
+	s.sealed = append(s.sealed, Segment{Seq: seq, Path: path, Records: s.openRecs, Bytes: s.openSize})
+	s.openSize = 0
+	s.openRecs = 0
+	s.evict()
+	s.signal()
+	return nil
+}
+
+// evict drops the oldest segments while the spool is over maxBytes.
+// Caller holds s.mu.
+func (s *Spool) evict() {
+	var total int64
+	for _, seg := range s.sealed {
+		total += seg.Bytes
+	}
+	for i := 0; total > s.maxBytes && i < len(s.sealed); {
+		seg := s.sealed[i]
+		if seg.Seq == s.inflight {
+			i++
+			continue
+		}
+		if err := os.Remove(seg.Path); err != nil && !os.IsNotExist(err) {
+			s.fail(err)
+		}
+		total -= seg.Bytes
+		s.stats.Dropped += uint64(seg.Records)
+		s.stats.DroppedSegments++
+		s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+		log.Printf("spool: over %d MB, dropped segment %d (%d records)", s.maxBytes>>20, seg.Seq, seg.Records)
+	}
+}
+
+func (s *Spool) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// fail records err for Stats. Caller holds s.mu.
+func (s *Spool) fail(err error) {
+	s.stats.LastError = err.Error()
+	s.stats.LastErrorAt = time.Now()
+	log.Printf("spool: %v", err)
+}
+
+// Ready is signalled whenever a segment is sealed.
+func (s *Spool) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Next returns the oldest sealed segment. It stays on disk, and is not
+// evicted, until Done.
+func (s *Spool) Next() (Segment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sealed) == 0 {
+		return Segment{}, false
+	}
+	seg := s.sealed[0]
+	s.inflight = seg.Seq
+	return seg, true
+}
+
+// Done removes a delivered segment.
+func (s *Spool) Done(seg Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, x := range s.sealed {
+		if x.Seq == seg.Seq {
+			s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+			break
+		}
+	}
+	s.inflight = noSegment
+	s.stats.Delivered += uint64(seg.Records)
+	if err := os.Remove(seg.Path); err != nil && !os.IsNotExist(err) {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// deadLetterDir holds segments the consumer gave up on.
+const deadLetterDir = "dead-letter"
+
+// DeadLetter moves a segment that cannot be delivered out of the queue
+// into dead-letter/, where it is kept for inspection or a manual replay.
+func (s *Spool) DeadLetter(seg Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, x := range s.sealed {
+		if x.Seq == seg.Seq {
+			s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+			break
+		}
+	}
+	s.inflight = noSegment
+	s.stats.DeadLettered += uint64(seg.Records)
+	s.stats.DeadSegments++
+
+	dir := filepath.Join(s.dir, deadLetterDir)
+	err := os.MkdirAll(dir, 0o750)
+	if err == nil {
+		err = os.Rename(seg.Path, filepath.Join(dir, filepath.Base(seg.Path)))
+	}
+	if err != nil {
+		s.fail(err)
+		os.Remove(seg.Path)
+		return err
+	}
+	s.pruneDeadLetters(dir)
+	return nil
+}
+
+// pruneDeadLetters removes the oldest dead-letter segments past a quarter
+// of maxBytes. Caller holds s.mu.
+func (s *Spool) pruneDeadLetters(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var total int64
+	sizes := make([]int64, len(entries))
+	for i, e := range entries {
+		if info, err := e.Info(); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	// names start with the zero-padded seq, so ReadDir's order is oldest first
+	for i := 0; total > s.maxBytes/4 && i < len(entries); i++ {
+		if err := os.Remove(filepath.Join(dir, entries[i].Name())); err == nil {
+			total -= sizes[i]
+			log.Printf("spool: dead-letter over %d MB, removed %s", s.maxBytes>>22, entries[i].Name())
+		}
+	}
+}
+
+// Stats returns the current depth and counters.
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	st.Segments = len(s.sealed)
+	st.Bytes = s.openSize
+	st.Pending = int64(s.openRecs)
+	for _, seg := range s.sealed {
+		st.Bytes += seg.Bytes
+		st.Pending += int64(seg.Records)
+	}
+	return st
+}
+
+// ReadRecords calls fn with each record of seg in order. The slice is only
+// valid during the call.
+func ReadRecords(seg Segment, fn func(rec []byte) error) error {
+	f, err := os.Open(seg.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64<<10)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// record longer than the buffer: line is only its first chunk
+			// and aliases the buffer, so copy it before reading the rest
+			head := append([]byte{}, line...)
+			rest, rerr := r.ReadBytes('\n')
+			line = append(head, rest...)
+			err = rerr
+		}
+		if rec := bytes.TrimSuffix(line, []byte{'\n'}); len(rec) > 0 {
+			if ferr := fn(rec); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package spool
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReadRecordsLongRecord(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := bytes.Repeat([]byte("x"), 200<<10) // longer than the read buffer
+	want := [][]byte{[]byte(`{"a":1}`), long, []byte(`{"b":2}`)}
+	for _, rec := range want {
+		if err := s.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	seg, ok := s.Next()
+	if !ok {
+		t.Fatal("no sealed segment after Flush")
+	}
+
+	var got [][]byte
+	err = ReadRecords(seg, func(rec []byte) error {
+		got = append(got, append([]byte(nil), rec...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("record %d: got %d bytes, want %d", i, len(got[i]), len(want[i]))
+		}
+	}
+}
+
+func TestReadRecordsStopsOnError(t *testing.T) {
+	s, err := Open(t.TempDir(), 1<<20, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Append([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	s.Flush()
+	seg, _ := s.Next()
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = ReadRecords(seg, func(rec []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("err = %v after %d calls, want stop after 1", err, calls)
+	}
+}
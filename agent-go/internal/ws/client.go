@@ -20,6 +20,8 @@ type Client struct {
 	agentID  string
 	secret   string
 	apiURL   string
+
+	onFleetBan func(FleetBanPayload)
 }
 
 func NewClient(cfg *config.Config) *Client {
@@ -173,6 +175,27 @@ func (c *Client) readLoop(ctx context.Context, errCh chan<- error) {
 				log.Printf("[ws] ✓ command_result sent successfully")
 			}
 
+		case TypeFleetBan:
+			if c.onFleetBan == nil {
+				log.Printf("[ws] fleet ban sharing disabled, ignoring fleet_ban")
+				continue
+			}
+			if !VerifySigned(data, c.secret) {
+				log.Printf("[ws] rejecting fleet_ban with invalid signature")
+				continue
+			}
+			if err := signedNonces.check(env.TS, env.Nonce, time.Now()); err != nil {
+				log.Printf("[ws] rejecting replayed or stale fleet_ban: %v", err)
+				continue
+			}
+			var fb FleetBanPayload
+			b, _ := json.Marshal(env.Payload)
+			if err := json.Unmarshal(b, &fb); err != nil {
+				log.Printf("[ws] invalid fleet_ban payload: %v", err)
+				continue
+			}
+			c.onFleetBan(fb)
+
 		default:
 			log.Printf("[ws] received message type=%s (payload=%v)", env.Type, env.Payload)
 		}
@@ -2,8 +2,8 @@ package ws
 
 import (
 	"context"
+	"errors"
 	"log"
-	"os"
 	"sync"
 	"time"
 
@@ -24,6 +24,8 @@ type Manager struct {
 	cancel     context.CancelFunc
 	started    bool
 	mu         sync.Mutex
+
+	onFleetBan func(FleetBanPayload)
 }
 
 // GetManager returns the global WebSocket manager instance
@@ -94,6 +96,8 @@ func (m *Manager) TryStart() bool {
 		agentID: m.cfg.InstanceId,
 		secret:  secret,
 		apiURL:  apiURL,
+
+		onFleetBan: m.onFleetBan,
 	}
 
 	m.client = client
@@ -123,6 +127,27 @@ func (m *Manager) Stop() {
 	log.Printf("[ws] WebSocket client stopped")
 }
 
+// SetFleetBanHandler registers the handler for fleet_ban commands from the
+// control panel. It applies to clients started after the call.
+func (m *Manager) SetFleetBanHandler(fn func(FleetBanPayload)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFleetBan = fn
+}
+
+// Publish sends a message of type t over the connected client.
+// It returns an error when the client is not connected.
+func (m *Manager) Publish(t MessageType, payload interface{}) error {
+	m.mu.Lock()
+	client := m.client
+	m.mu.Unlock()
+
+	if client == nil || client.conn == nil {
+		return errors.New("websocket not connected")
+	}
+	return client.send(NewEnvelope(t, client.agentID, payload))
+}
+
 // IsStarted returns whether the WebSocket client is currently running
 func (m *Manager) IsStarted() bool {
 	m.mu.Lock()
@@ -170,17 +195,8 @@ func (m *Manager) getSecret() string {
 		return m.cfg.WsSecret
 	}
 
-	// 2. Try stored AWS credentials
-	if storedCreds := s3upload.GetStoredCredentials(); storedCreds != nil && storedCreds.SecretAccessKey != "" {
-		return storedCreds.SecretAccessKey
-	}
-
-	// 3. Try environment variable
-	if secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY"); secretKey != "" {
-		return secretKey
-	}
-
-	return ""
+	// 2. Derive it from the stored AWS credentials or the environment
+	return s3upload.WsSecret()
 }
 
 // getAPIURL gets the API URL, trying to detect public IP if needed
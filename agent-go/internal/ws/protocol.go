@@ -1,10 +1,13 @@
 package ws
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,6 +22,10 @@ const (
 	TypeCommand       MessageType = "command"
 	TypeCommandResult MessageType = "command_result"
 	TypeHeartbeat     MessageType = "heartbeat"
+	TypeSecurityEvent MessageType = "security_event"
+	TypeBanShare      MessageType = "ban_share" // agent → server: local ban decisions
+	TypeFleetBan      MessageType = "fleet_ban" // server → agent: fleet-wide ban command
+	TypeAttackMode    MessageType = "attack_mode" // agent → server: DDoS attack mode transitions
 )
 
 type Envelope struct {
@@ -52,6 +59,36 @@ type LogPayload struct {
 	Source  string `json:"source,omitempty"`
 }
 
+// SecurityEventPayload carries a batch of security notifications
+// (ban, unban, threshold, feed_refresh, anomaly, attack_mode) from the
+// agent's notifier.
+type SecurityEventPayload struct {
+	Events  interface{} `json:"events"`
+	Dropped uint64      `json:"dropped,omitempty"`
+}
+
+// FleetBan is one ban decision shared across agents of the same customer.
+type FleetBan struct {
+	ID         string `json:"id"`
+	Action     string `json:"action,omitempty"` // "ban" (default) or "unban"
+	IP         string `json:"ip"`
+	Reason     string `json:"reason,omitempty"`
+	Origin     string `json:"origin"`
+	SiteID     string `json:"siteId,omitempty"`
+	TTLSeconds int    `json:"ttlSeconds,omitempty"`
+}
+
+type FleetBanPayload struct {
+	Bans []FleetBan `json:"bans"`
+}
+
+// AttackModePayload reports an attack mode transition ("escalate" or
+// "de-escalate") with the engine's attack state.
+type AttackModePayload struct {
+	Transition string      `json:"transition"`
+	Status     interface{} `json:"status"`
+}
+
 func NewEnvelope(t MessageType, agentID string, payload interface{}) Envelope {
 	return Envelope{
 		Type:    t,
@@ -90,6 +127,43 @@ func signEnvelope(env *Envelope, secret string) error {
 	return nil
 }
 
+// VerifySigned checks the signature of a raw incoming message. The payload
+// is kept as received so the signed bytes match the sender's serialization.
+func VerifySigned(data []byte, secret string) bool {
+	var env struct {
+		Type      MessageType     `json:"type"`
+		AgentID   string          `json:"agentId"`
+		TS        int64           `json:"ts"`
+		Nonce     string          `json:"nonce"`
+		Payload   json.RawMessage `json:"payload"`
+		Signature string          `json:"signature"`
+	}
+	if err := json.Unmarshal(data, &env); err != nil || env.Signature == "" {
+		return false
+	}
+
+	tmp := struct {
+		Type    MessageType     `json:"type"`
+		AgentID string          `json:"agentId"`
+		TS      int64           `json:"ts"`
+		Nonce   string          `json:"nonce"`
+		Payload json.RawMessage `json:"payload"`
+	}{env.Type, env.AgentID, env.TS, env.Nonce, env.Payload}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(tmp); err != nil {
+		return false
+	}
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(bytes.TrimRight(buf.Bytes(), "\n"))
+	expected := hex.EncodeToString(h.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(env.Signature))
+}
+
 func MarshalSigned(env Envelope, secret string) ([]byte, error) {
 	if err := signEnvelope(&env, secret); err != nil {
 		return nil, err
@@ -97,3 +171,52 @@ func MarshalSigned(env Envelope, secret string) ([]byte, error) {
 	return json.Marshal(env)
 }
 
+
+// signedMaxSkew bounds how far the ts of a signed envelope may be from the
+// local clock. Nonces are remembered for as long as their ts is accepted,
+// so a captured envelope can't be replayed.
+const signedMaxSkew = 5 * time.Minute
+
+// nonceCache rejects signed envelopes that are stale or were seen before.
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce -> when its ts leaves the window
+	lastPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// signedNonces is shared by every client, so a replay is caught across
+// reconnects too.
+var signedNonces = newNonceCache()
+
+// check accepts an envelope once: ts (Unix milliseconds) must be within
+// signedMaxSkew of now and nonce new. Call it after the signature was
+// verified, so forged envelopes can't fill the cache.
+func (n *nonceCache) check(ts int64, nonce string, now time.Time) error {
+	if nonce == "" {
+		return fmt.Errorf("missing nonce")
+	}
+	sent := time.UnixMilli(ts)
+	if skew := now.Sub(sent); skew > signedMaxSkew || skew < -signedMaxSkew {
+		return fmt.Errorf("ts %s is %s off the local clock", sent.UTC().Format(time.RFC3339), skew.Round(time.Second))
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.lastPrune) >= time.Minute {
+		for k, until := range n.seen {
+			if now.After(until) {
+				delete(n.seen, k)
+			}
+		}
+		n.lastPrune = now
+	}
+	if _, dup := n.seen[nonce]; dup {
+		return fmt.Errorf("nonce %s was already used", nonce)
+	}
+	n.seen[nonce] = sent.Add(signedMaxSkew)
+	return nil
+}
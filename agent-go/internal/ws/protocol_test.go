@@ -0,0 +1,56 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignedRoundTrip(t *testing.T) {
+	env := NewEnvelope(TypeFleetBan, "i-123", FleetBanPayload{Bans: []FleetBan{{IP: "203.0.113.7", Reason: "trap"}}})
+	data, err := MarshalSigned(env, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifySigned(data, "s3cret") {
+		t.Fatal("valid signature rejected")
+	}
+	if VerifySigned(data, "other") {
+		t.Fatal("signature accepted with the wrong secret")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	n := newNonceCache()
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	ts := now.UnixMilli()
+
+	if err := n.check(ts, "a", now); err != nil {
+		t.Fatalf("fresh envelope rejected: %v", err)
+	}
+	if err := n.check(ts, "a", now.Add(time.Second)); err == nil {
+		t.Fatal("replayed nonce accepted")
+	}
+	if err := n.check(ts, "", now); err == nil {
+		t.Fatal("empty nonce accepted")
+	}
+	if err := n.check(now.Add(-6*time.Minute).UnixMilli(), "b", now); err == nil {
+		t.Fatal("stale ts accepted")
+	}
+	if err := n.check(now.Add(6*time.Minute).UnixMilli(), "c", now); err == nil {
+		t.Fatal("future ts accepted")
+	}
+	if err := n.check(now.Add(4*time.Minute).UnixMilli(), "d", now); err != nil {
+		t.Fatalf("ts within the skew rejected: %v", err)
+	}
+
+	// once its ts is out of the window the nonce is forgotten, and the
+	// envelope is rejected by the skew check instead
+	later := now.Add(10 * time.Minute)
+	n.check(later.UnixMilli(), "e", later)
+	if _, ok := n.seen["a"]; ok {
+		t.Fatal("expired nonce kept")
+	}
+	if err := n.check(ts, "a", later); err == nil {
+		t.Fatal("expired envelope accepted")
+	}
+}
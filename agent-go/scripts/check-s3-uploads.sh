@@ -83,7 +83,7 @@ fi
 echo ""
 echo "[5] S3 Bucket Contents:"
 if command -v aws &> /dev/null; then
-    BUCKET="cyber-agent-logs"
+    BUCKET="${S3_BUCKET:-cyber-agent-logs}"
     echo "  Checking s3://$BUCKET/$MACHINE_ID/"
     
     FILES=$(aws s3 ls "s3://$BUCKET/$MACHINE_ID/" --recursive 2>/dev/null | wc -l)
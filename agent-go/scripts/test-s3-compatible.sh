@@ -0,0 +1,130 @@
+#!/usr/bin/env bash
+# Integration test for S3-compatible destinations (s3Bucket, s3Prefix,
+# s3Endpoint, s3PathStyle). Starts MinIO in Docker as a local S3 stand-in,
+# runs a freshly built agent against it and checks that /internal/s3-validate
+# passes and that a batch lands under the configured bucket and prefix.
+#
+# Point it at an existing service instead of Docker with:
+#   S3_ENDPOINT=https://minio.internal:9000 S3_CA_FILE=/path/ca.pem \
+#   AWS_ACCESS_KEY_ID=... AWS_SECRET_ACCESS_KEY=... ./scripts/test-s3-compatible.sh
+
+set -euo pipefail
+
+ROOT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)"
+WORK_DIR="$(mktemp -d)"
+AGENT_LISTEN="${AGENT_LISTEN:-127.0.0.1:19811}"
+AGENT_URL="http://$AGENT_LISTEN"
+BUCKET="${S3_BUCKET:-jetcamer-it-$(date +%s)}"
+PREFIX="${S3_PREFIX:-it/agents}"
+MINIO_PORT="${MINIO_PORT:-19000}"
+MINIO_CONTAINER=""
+AGENT_PID=""
+
+export AWS_ACCESS_KEY_ID="${AWS_ACCESS_KEY_ID:-minioadmin}"
+export AWS_SECRET_ACCESS_KEY="${AWS_SECRET_ACCESS_KEY:-minioadmin}"
+
+cleanup() {
+    [ -n "$AGENT_PID" ] && kill "$AGENT_PID" 2>/dev/null || true
+    [ -n "$MINIO_CONTAINER" ] && docker rm -f "$MINIO_CONTAINER" >/dev/null 2>&1 || true
+    rm -rf "$WORK_DIR"
+}
+trap cleanup EXIT
+
+fail() {
+    echo "✗ $*"
+    if [ -f "$WORK_DIR/agent.log" ]; then
+        echo "--- agent log ---"
+        tail -30 "$WORK_DIR/agent.log"
+    fi
+    exit 1
+}
+
+echo "=== Testing S3-compatible upload ==="
+
+if [ -f /etc/jetcamer/aws-credentials.json ]; then
+    echo "⚠️  /etc/jetcamer/aws-credentials.json exists; stored credentials take priority over"
+    echo "   AWS_ACCESS_KEY_ID, so the agent may not authenticate against the test endpoint"
+fi
+
+# [1] S3 stand-in
+if [ -z "${S3_ENDPOINT:-}" ]; then
+    command -v docker >/dev/null || fail "docker not found (or set S3_ENDPOINT to an existing service)"
+    echo "[1] Starting MinIO on port $MINIO_PORT..."
+    MINIO_CONTAINER=$(docker run -d --rm -p "127.0.0.1:$MINIO_PORT:9000" \
+        -e MINIO_ROOT_USER="$AWS_ACCESS_KEY_ID" -e MINIO_ROOT_PASSWORD="$AWS_SECRET_ACCESS_KEY" \
+        minio/minio server /data)
+    S3_ENDPOINT="http://127.0.0.1:$MINIO_PORT"
+    for _ in $(seq 1 30); do
+        curl -s -f "$S3_ENDPOINT/minio/health/live" >/dev/null && break
+        sleep 1
+    done
+    curl -s -f "$S3_ENDPOINT/minio/health/live" >/dev/null || fail "MinIO did not become ready"
+    echo "✓ MinIO is running at $S3_ENDPOINT"
+else
+    echo "[1] Using existing endpoint $S3_ENDPOINT"
+fi
+
+# [2] Agent
+echo "[2] Building and starting the agent..."
+(cd "$ROOT_DIR" && go build -o "$WORK_DIR/jetcamer-agent" ./cmd/agent) || fail "build failed"
+cat > "$WORK_DIR/agent.config.json" <<EOF
+{
+  "logPaths": [],
+  "webListen": "$AGENT_LISTEN",
+  "env": "test",
+  "siteId": "it",
+  "securityEnabled": false,
+  "firewallDisabled": true,
+  "spoolDir": "$WORK_DIR/spool",
+  "s3Compression": "none",
+  "s3Bucket": "$BUCKET",
+  "s3Prefix": "$PREFIX",
+  "s3Endpoint": "$S3_ENDPOINT",
+  "s3PathStyle": true,
+  "s3CaFile": "${S3_CA_FILE:-}"
+}
+EOF
+JETCAMER_AGENT_CONFIG="$WORK_DIR/agent.config.json" "$WORK_DIR/jetcamer-agent" >"$WORK_DIR/agent.log" 2>&1 &
+AGENT_PID=$!
+for _ in $(seq 1 20); do
+    curl -s -f "$AGENT_URL/health" >/dev/null && break
+    sleep 0.5
+done
+curl -s -f "$AGENT_URL/health" >/dev/null || fail "agent is not responding at $AGENT_URL"
+echo "✓ Agent is running"
+
+# [3] Validation
+echo "[3] Validating S3 configuration..."
+VALIDATION=$(curl -s "$AGENT_URL/internal/s3-validate")
+echo "$VALIDATION"
+echo "$VALIDATION" | grep -q '"valid":true' || fail "validation failed"
+echo "$VALIDATION" | grep -q "\"bucket\":\"$BUCKET\"" || fail "validation did not use s3Bucket"
+echo "$VALIDATION" | grep -q '"bucketExists":true' || fail "bucket was not created"
+echo "✓ S3 configuration is valid"
+
+# [4] Upload
+echo "[4] Sending test batch to /internal/batch..."
+TIMESTAMP=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+RESPONSE=$(curl -s -X POST "$AGENT_URL/internal/batch" \
+  -H "Content-Type: application/json" \
+  -d "{\"env\":\"test\",\"instanceId\":\"it\",\"siteId\":\"it\",\"events\":[{\"ip\":\"192.0.2.1\",\"path\":\"/it\",\"method\":\"GET\",\"status\":200,\"bytes\":1,\"ua\":\"it\",\"referer\":\"\",\"ts\":\"$TIMESTAMP\",\"source\":\"test-s3-compatible\"}]}")
+echo "$RESPONSE"
+echo "$RESPONSE" | grep -q '"status":"ok"' || fail "upload failed"
+echo "✓ Batch uploaded"
+
+# [5] Object under bucket/prefix
+echo "[5] Checking the uploaded object..."
+grep -q "uploaded batch to S3: s3://$BUCKET/$PREFIX/" "$WORK_DIR/agent.log" || fail "no upload under s3://$BUCKET/$PREFIX/ in the agent log"
+if command -v aws >/dev/null; then
+    CA_ARGS=()
+    [ -n "${S3_CA_FILE:-}" ] && CA_ARGS=(--ca-bundle "$S3_CA_FILE")
+    OBJECTS=$(aws --endpoint-url "$S3_ENDPOINT" "${CA_ARGS[@]}" s3 ls "s3://$BUCKET/$PREFIX/" --recursive)
+    echo "$OBJECTS"
+    echo "$OBJECTS" | grep -q '\.ndjson$' || fail "object not found with the AWS CLI"
+else
+    echo "  (AWS CLI not found, relying on the agent log)"
+fi
+echo "✓ Object stored under s3://$BUCKET/$PREFIX/"
+
+echo ""
+echo "=== Test Complete ==="
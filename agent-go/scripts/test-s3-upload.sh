@@ -95,7 +95,7 @@ fi
 if command -v aws &> /dev/null; then
     echo ""
     echo "[5] Checking S3 bucket..."
-    BUCKET="cyber-agent-logs"
+    BUCKET="${S3_BUCKET:-cyber-agent-logs}"
     
     if aws s3 ls "s3://$BUCKET/" &> /dev/null; then
         echo "✓ Bucket exists"
@@ -54,8 +54,8 @@ sudo rm -rf /opt/jetcamer-agent
 
 # Remove AWS credentials if stored via API (before removing /etc/jetcamer)
 if [[ -f /etc/jetcamer/aws-credentials.json ]]; then
-    echo "    ✓ Removing stored AWS credentials..."
-    sudo rm -f /etc/jetcamer/aws-credentials.json
+    echo "    ✓ Removing stored AWS credentials and secret key..."
+    sudo rm -f /etc/jetcamer/aws-credentials.json /etc/jetcamer/secret.key /etc/jetcamer/secret.key.new
 fi
 
 sudo rm -rf /etc/jetcamer